@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"adwise-service/service/call"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/google/uuid"
+)
+
+// HandleCalls returns one of the caller's calls (GET ?id=) or their call history, newest first.
+// The history is paged with the limit and before (RFC 3339, the started_at of the last call of the
+// previous page) query parameters.
+func (s *Server) HandleCalls(w http.ResponseWriter, r *http.Request) {
+	user, ok := currentUser(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	if idStr := query.Get("id"); idStr != "" {
+		callID, err := uuid.Parse(idStr)
+		if err != nil {
+			http.Error(w, "Invalid call ID", http.StatusBadRequest)
+			return
+		}
+		found, err := s.callService.GetCall(user.ID, callID)
+		if err != nil {
+			writeCallError(w, err, "Failed to retrieve call")
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(found)
+		return
+	}
+
+	before, err := parseOptionalTime(query.Get("before"))
+	if err != nil {
+		http.Error(w, "Invalid before time", http.StatusBadRequest)
+		return
+	}
+	limit := 0
+	if limitStr := query.Get("limit"); limitStr != "" {
+		if limit, err = strconv.Atoi(limitStr); err != nil {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	calls, err := s.callService.GetCallHistory(user.ID, before, limit)
+	if err != nil {
+		writeCallError(w, err, "Failed to retrieve calls")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(calls)
+}
+
+// HandleCallICEServers returns the STUN and TURN servers, with time-limited TURN credentials, the
+// caller uses to set up the peer connection of a call.
+func (s *Server) HandleCallICEServers(w http.ResponseWriter, r *http.Request) {
+	user, ok := currentUser(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(s.callService.ICEServers(user.ID))
+}
+
+// HandleGroupCall returns the ongoing call of one of the caller's groups (GET ?group_id=), so a
+// member opening the conversation can offer to join it.
+func (s *Server) HandleGroupCall(w http.ResponseWriter, r *http.Request) {
+	user, ok := currentUser(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	groupID, err := strconv.ParseUint(r.URL.Query().Get("group_id"), 10, 64)
+	if err != nil || groupID == 0 {
+		http.Error(w, "Invalid group ID", http.StatusBadRequest)
+		return
+	}
+	found, err := s.callService.GetActiveGroupCall(user.ID, uint(groupID))
+	if err != nil {
+		writeCallError(w, err, "Failed to retrieve group call")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(found)
+}
+
+// writeCallError maps CallService errors onto HTTP responses.
+func writeCallError(w http.ResponseWriter, err error, fallback string) {
+	switch {
+	case errors.Is(err, call.ErrCallNotFound):
+		http.Error(w, "Call not found", http.StatusNotFound)
+	case errors.Is(err, call.ErrNotCallParticipant):
+		http.Error(w, "Not a participant of the call", http.StatusForbidden)
+	case errors.Is(err, call.ErrNotGroupMember):
+		http.Error(w, "Not a member of the group", http.StatusForbidden)
+	default:
+		http.Error(w, fallback, http.StatusInternalServerError)
+	}
+}
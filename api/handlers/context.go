@@ -0,0 +1,13 @@
+package handlers
+
+import (
+	"adwise-service/api/middleware"
+	"adwise-service/model"
+	"net/http"
+)
+
+// currentUser returns the authenticated user set on the request by the auth middleware.
+func currentUser(r *http.Request) (*model.User, bool) {
+	user, ok := r.Context().Value(middleware.KeyUser).(*model.User)
+	return user, ok && user != nil
+}
@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"adwise-service/model"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// HandleConversationSettings reads (GET) or updates (PUT) the shared settings of a conversation.
+// GET takes the conversation from the group_id or receiver_id query parameter, PUT from the body.
+func (s *Server) HandleConversationSettings(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.getConversationSettings(w, r)
+	case http.MethodPut:
+		s.updateConversationSettings(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// getConversationSettings returns the settings of a conversation.
+func (s *Server) getConversationSettings(w http.ResponseWriter, r *http.Request) {
+	user, ok := currentUser(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	target, err := parseConversationTarget(r)
+	if err != nil {
+		http.Error(w, "Either group_id or receiver_id is required", http.StatusBadRequest)
+		return
+	}
+
+	setting, err := s.messageService.GetConversationSetting(user.ID, target)
+	if err != nil {
+		writeMessageError(w, err, "Failed to retrieve conversation settings")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(setting)
+}
+
+// updateConversationSettings sets the disappearing-message timer of a conversation.
+func (s *Server) updateConversationSettings(w http.ResponseWriter, r *http.Request) {
+	user, ok := currentUser(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var request struct {
+		model.ConversationTarget
+		DisappearAfterSeconds uint `json:"disappear_after_seconds"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	after := time.Duration(request.DisappearAfterSeconds) * time.Second
+	setting, err := s.messageService.SetDisappearingTimer(user.ID, request.ConversationTarget, after)
+	if err != nil {
+		writeMessageError(w, err, "Failed to update conversation settings")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(setting)
+}
@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"adwise-service/service/websocket"
+	"adwise-service/utils"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// HandleEventStream streams the caller's server events as Server-Sent Events, for clients that can
+// not open a WebSocket. It authenticates like /ws, with a ticket query parameter or an
+// Authorization bearer header, and resumes from the Last-Event-ID header or last_event_id query
+// parameter. See websocket.HandleEventStream.
+func (s *Server) HandleEventStream(w http.ResponseWriter, r *http.Request) {
+	userUUID, version, expiresAt, resume, ok := s.authenticateEvents(w, r)
+	if !ok {
+		return
+	}
+	s.websocketService.HandleEventStream(w, r, userUUID, r.URL.Query().Get("device_id"), version, expiresAt, resume)
+}
+
+// HandlePollEvents returns the caller's server events as a batch, waiting for them up to the
+// timeout query parameter in seconds. The client passes the last_event_id of the batch as
+// Last-Event-ID on its next poll. It authenticates like HandleEventStream; since a ticket is single
+// use, polling clients usually send an Authorization header.
+func (s *Server) HandlePollEvents(w http.ResponseWriter, r *http.Request) {
+	userUUID, version, _, resume, ok := s.authenticateEvents(w, r)
+	if !ok {
+		return
+	}
+	wait := 0
+	if timeoutStr := r.URL.Query().Get("timeout"); timeoutStr != "" {
+		var err error
+		if wait, err = strconv.Atoi(timeoutStr); err != nil || wait < 0 {
+			http.Error(w, "Invalid timeout", http.StatusBadRequest)
+			return
+		}
+	}
+
+	batch := s.websocketService.PollEvents(r.Context(), userUUID, r.URL.Query().Get("device_id"), version, resume, time.Duration(wait)*time.Second)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(batch)
+}
+
+// authenticateEvents runs the checks a WebSocket upgrade goes through for a request of the HTTP
+// event transports and reads its resume state. On failure an HTTP error has already been written.
+func (s *Server) authenticateEvents(w http.ResponseWriter, r *http.Request) (uuid.UUID, int, time.Time, *websocket.ResumeState, bool) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return uuid.Nil, 0, time.Time{}, nil, false
+	}
+	if !s.websocketService.CheckOrigin(r) {
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return uuid.Nil, 0, time.Time{}, nil, false
+	}
+	version, _, err := websocket.NegotiateVersion(r)
+	if err != nil {
+		http.Error(w, "Unsupported protocol version", http.StatusBadRequest)
+		return uuid.Nil, 0, time.Time{}, nil, false
+	}
+
+	var resume *websocket.ResumeState
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+	if lastEventID != "" {
+		if resume, err = websocket.ParseEventID(lastEventID); err != nil {
+			http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+			return uuid.Nil, 0, time.Time{}, nil, false
+		}
+	}
+
+	userUUID, expiresAt, _, err := s.authenticateWebSocket(r)
+	if err != nil {
+		utils.LogWarn("Rejected event stream", zap.Error(err), zap.String("remote_addr", r.RemoteAddr))
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return uuid.Nil, 0, time.Time{}, nil, false
+	}
+	return userUUID, version, expiresAt, resume, true
+}
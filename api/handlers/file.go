@@ -1,8 +1,14 @@
 package handlers
 
 import (
+	"adwise-service/model"
+	"adwise-service/service/file"
 	"encoding/json"
+	"errors"
 	"net/http"
+	"strconv"
+
+	"github.com/google/uuid"
 )
 
 // handleFiles handles file uploads and downloads.
@@ -10,16 +16,39 @@ func (s *Server) HandleFiles(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodPost:
 		s.uploadFile(w, r)
-	case http.MethodGet:
+	case http.MethodGet, http.MethodHead:
 		s.downloadFile(w, r)
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
-// uploadFile handles file uploads.
+// multipartOverhead is the room left in a multipart upload's body for the part headers and
+// boundaries around the file.
+const multipartOverhead = 1 << 20
+
+// uploadFile handles file uploads. The caller becomes the owner of the file. The body is cut off
+// past the largest accepted file, and the file is validated before it is stored.
 func (s *Server) uploadFile(w http.ResponseWriter, r *http.Request) {
+	user, ok := currentUser(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if maxSize := s.fileService.MaxUploadSize(); maxSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, maxSize+multipartOverhead)
+	}
 	file, header, err := r.FormFile("file")
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeUploadError(w, http.StatusRequestEntityTooLarge, model.UploadError{
+			Code:    model.UploadErrTooLarge,
+			Message: "the file is larger than the maximum upload size",
+			MaxSize: s.fileService.MaxUploadSize(),
+		})
+		return
+	}
 	if err != nil {
 		http.Error(w, "Failed to read file", http.StatusBadRequest)
 		return
@@ -27,9 +56,9 @@ func (s *Server) uploadFile(w http.ResponseWriter, r *http.Request) {
 	defer file.Close()
 
 	// Upload the file
-	uploadedFile, err := s.fileService.UploadFile(file, header)
+	uploadedFile, err := s.fileService.UploadFile(user.ID, file, header)
 	if err != nil {
-		http.Error(w, "Failed to upload file", http.StatusInternalServerError)
+		writeFileError(w, err, "Failed to upload file")
 		return
 	}
 
@@ -37,22 +66,288 @@ func (s *Server) uploadFile(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(uploadedFile)
 }
 
-// downloadFile handles file downloads.
+// downloadFile streams the file given by the id query parameter. It serves byte ranges so that
+// media players can seek, and answers conditional requests from the object's ETag and modification
+// time. Images, audio and video are shown inline unless download=1 is given. When downloads are
+// redirected, the client is sent to a short-lived signed URL of the blob store instead.
 func (s *Server) downloadFile(w http.ResponseWriter, r *http.Request) {
-	fileID := r.URL.Query().Get("id")
-	if fileID == "" {
-		http.Error(w, "File ID is required", http.StatusBadRequest)
+	user, ok := currentUser(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	fileID, err := parseFileID(r, "id")
+	if err != nil {
+		http.Error(w, "Invalid file ID", http.StatusBadRequest)
+		return
+	}
+
+	download := r.URL.Query().Get("download") == "1"
+	redirect, err := s.fileService.SignedDownloadURL(r.Context(), user.ID, fileID, download)
+	if err != nil {
+		writeFileError(w, err, "Failed to download file")
+		return
+	}
+	if redirect != "" {
+		http.Redirect(w, r, redirect, http.StatusFound)
+		return
+	}
+
+	record, content, info, err := s.fileService.OpenFile(r.Context(), user.ID, fileID)
+	if err != nil {
+		writeFileError(w, err, "Failed to download file")
+		return
+	}
+	defer content.Close()
+
+	// Headers go out before ServeContent writes the status; a set Content-Type also keeps it from
+	// sniffing the content.
+	w.Header().Set("Content-Type", file.ContentType(record))
+	w.Header().Set("Content-Disposition", file.ContentDisposition(record, download))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if info.ETag != "" {
+		w.Header().Set("ETag", info.ETag)
+	}
+	http.ServeContent(w, r, "", info.LastModified, content)
+}
+
+// HandleThumbnail streams the thumbnail of an image (GET or HEAD) given by the id and size query
+// parameters. Thumbnails can be read by everyone who can read the image, once it is clean.
+func (s *Server) HandleThumbnail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, ok := currentUser(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	fileID, err := parseFileID(r, "id")
+	if err != nil {
+		http.Error(w, "Invalid file ID", http.StatusBadRequest)
+		return
+	}
+	size, err := strconv.Atoi(r.URL.Query().Get("size"))
+	if err != nil || size <= 0 {
+		http.Error(w, "Invalid thumbnail size", http.StatusBadRequest)
 		return
 	}
 
-	// Download the file
-	fileBytes, err := s.fileService.DownloadFile(fileID)
+	thumbnail, content, info, err := s.fileService.OpenThumbnail(r.Context(), user.ID, fileID, size)
 	if err != nil {
-		http.Error(w, "Failed to download file", http.StatusInternalServerError)
+		writeFileError(w, err, "Failed to download thumbnail")
+		return
+	}
+	defer content.Close()
+
+	w.Header().Set("Content-Type", thumbnail.ContentType)
+	w.Header().Set("Content-Disposition", "inline")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if info.ETag != "" {
+		w.Header().Set("ETag", info.ETag)
+	}
+	http.ServeContent(w, r, "", info.LastModified, content)
+}
+
+// HandleUploadIntent starts a direct upload of a file to storage (POST). It returns the pending
+// file and the signed request to upload its content with.
+func (s *Server) HandleUploadIntent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, ok := currentUser(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var request model.UploadIntentRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	intent, err := s.fileService.CreateUploadIntent(user.ID, request)
+	if err != nil {
+		writeFileError(w, err, "Failed to start upload")
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(intent)
+}
+
+// completeUploadRequest is the body of a request completing a direct upload.
+type completeUploadRequest struct {
+	FileID uint `json:"file_id"`
+}
+
+// HandleCompleteUpload completes a direct upload (POST) once the client has uploaded the content.
+func (s *Server) HandleCompleteUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, ok := currentUser(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var request completeUploadRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.FileID == 0 {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	completed, err := s.fileService.CompleteUpload(user.ID, request.FileID)
+	if err != nil {
+		writeFileError(w, err, "Failed to complete upload")
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Write(fileBytes)
+	json.NewEncoder(w).Encode(completed)
+}
+
+// HandleSignedStorage serves the signed URLs of a storage driver that emulates them, such as the
+// local driver. The signature authorizes the request.
+func (s *Server) HandleSignedStorage(w http.ResponseWriter, r *http.Request) {
+	handler := s.fileService.SignedURLHandler()
+	if handler == nil {
+		http.NotFound(w, r)
+		return
+	}
+	handler.ServeHTTP(w, r)
+}
+
+// shareFileRequest is the body of a request sharing a file.
+type shareFileRequest struct {
+	FileID  uint        `json:"file_id"`
+	UserIDs []uuid.UUID `json:"user_ids"`
+}
+
+// HandleFileShares lists (GET ?file_id=), adds (POST) or revokes (DELETE ?file_id=&user_id=) the
+// shares of one of the caller's files.
+func (s *Server) HandleFileShares(w http.ResponseWriter, r *http.Request) {
+	user, ok := currentUser(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		fileID, err := parseFileID(r, "file_id")
+		if err != nil {
+			http.Error(w, "Invalid file ID", http.StatusBadRequest)
+			return
+		}
+		shares, err := s.fileService.GetFileShares(user.ID, fileID)
+		if err != nil {
+			writeFileError(w, err, "Failed to retrieve shares")
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(shares)
+
+	case http.MethodPost:
+		var request shareFileRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		shares, err := s.fileService.ShareFile(user.ID, request.FileID, request.UserIDs)
+		if err != nil {
+			writeFileError(w, err, "Failed to share file")
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(shares)
+
+	case http.MethodDelete:
+		fileID, err := parseFileID(r, "file_id")
+		if err != nil {
+			http.Error(w, "Invalid file ID", http.StatusBadRequest)
+			return
+		}
+		userID, err := uuid.Parse(r.URL.Query().Get("user_id"))
+		if err != nil {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+		if err := s.fileService.UnshareFile(user.ID, fileID, userID); err != nil {
+			writeFileError(w, err, "Failed to revoke share")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// parseFileID reads a file ID from a query parameter.
+func parseFileID(r *http.Request, param string) (uint, error) {
+	id, err := strconv.ParseUint(r.URL.Query().Get(param), 10, 64)
+	if err != nil || id == 0 {
+		return 0, errors.New("invalid file ID")
+	}
+	return uint(id), nil
+}
+
+// writeFileError maps FileService errors onto HTTP responses. Rejected uploads are described by
+// an UploadError.
+func writeFileError(w http.ResponseWriter, err error, fallback string) {
+	var validation *file.ValidationError
+	switch {
+	case errors.Is(err, file.ErrFileNotFound):
+		http.Error(w, "File not found", http.StatusNotFound)
+	case errors.Is(err, file.ErrThumbnailNotFound):
+		http.Error(w, "Thumbnail not found", http.StatusNotFound)
+	case errors.Is(err, file.ErrFileAccessDenied):
+		http.Error(w, "Not allowed to access the file", http.StatusForbidden)
+	case errors.Is(err, file.ErrNotFileOwner):
+		http.Error(w, "Only the owner can manage the shares of a file", http.StatusForbidden)
+	case errors.Is(err, file.ErrInvalidShare):
+		http.Error(w, "A file can only be shared with other users", http.StatusBadRequest)
+	case errors.As(err, &validation):
+		status := http.StatusBadRequest
+		switch {
+		case errors.Is(err, file.ErrFileTooLarge):
+			status = http.StatusRequestEntityTooLarge
+		case errors.Is(err, file.ErrTypeNotAllowed):
+			status = http.StatusUnsupportedMediaType
+		case errors.Is(err, file.ErrTypeMismatch):
+			status = http.StatusUnprocessableEntity
+		}
+		writeUploadError(w, status, validation.Detail)
+	case errors.Is(err, file.ErrDirectUploadUnsupported):
+		http.Error(w, "Direct uploads are not supported", http.StatusNotImplemented)
+	case errors.Is(err, file.ErrUploadNotPending):
+		http.Error(w, "File upload is already complete", http.StatusConflict)
+	case errors.Is(err, file.ErrUploadIncomplete):
+		http.Error(w, "File content has not been uploaded", http.StatusConflict)
+	case errors.Is(err, file.ErrUploadMismatch):
+		http.Error(w, "Uploaded content does not match the size or checksum", http.StatusUnprocessableEntity)
+	case errors.Is(err, file.ErrFileQuarantined):
+		http.Error(w, "File is awaiting a malware scan", http.StatusConflict)
+	case errors.Is(err, file.ErrFileInfected):
+		http.Error(w, "File is infected with malware", http.StatusForbidden)
+	case errors.Is(err, file.ErrFileUnscannable):
+		http.Error(w, "File is too large to be scanned for malware", http.StatusForbidden)
+	default:
+		http.Error(w, fallback, http.StatusInternalServerError)
+	}
+}
+
+// writeUploadError responds with the reason an upload was rejected.
+func writeUploadError(w http.ResponseWriter, status int, uploadError model.UploadError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(uploadError)
 }
@@ -2,7 +2,9 @@ package handlers
 
 import (
 	"adwise-service/model"
+	"adwise-service/service/message"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"strconv"
 
@@ -21,16 +23,22 @@ func (s *Server) HandleMessages(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// sendMessage sends a new message
+// sendMessage sends a new message from the caller and delivers it to the conversation's members.
 func (s *Server) sendMessage(w http.ResponseWriter, r *http.Request) {
+	user, ok := currentUser(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
 	var message model.Message
 	if err := json.NewDecoder(r.Body).Decode(&message); err != nil {
 		http.Error(w, "Invalid request payload", http.StatusBadRequest)
 		return
 	}
 
-	if err := s.messageService.SaveMessage(&message); err != nil {
-		http.Error(w, "Failed to send message", http.StatusInternalServerError)
+	if err := s.messageService.SendMessage(user.ID, &message); err != nil {
+		writeMessageError(w, err, "Failed to send message")
 		return
 	}
 
@@ -76,3 +84,61 @@ func (s *Server) getMessages(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(messages)
 }
+
+// HandleForwardMessage forwards a message into one or more conversations.
+func (s *Server) HandleForwardMessage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := currentUser(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var request struct {
+		MessageID uint                       `json:"message_id"`
+		Targets   []model.ConversationTarget `json:"targets"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if request.MessageID == 0 || len(request.Targets) == 0 {
+		http.Error(w, "Message ID and at least one target are required", http.StatusBadRequest)
+		return
+	}
+
+	forwarded, err := s.messageService.ForwardMessage(user.ID, request.MessageID, request.Targets)
+	if err != nil {
+		writeMessageError(w, err, "Failed to forward message")
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(forwarded)
+}
+
+// writeMessageError maps MessageService errors onto HTTP responses.
+func writeMessageError(w http.ResponseWriter, err error, fallback string) {
+	switch {
+	case errors.Is(err, message.ErrMessageNotFound):
+		http.Error(w, "Message not found", http.StatusNotFound)
+	case errors.Is(err, message.ErrNotConversationMember):
+		http.Error(w, "Not a member of the conversation", http.StatusForbidden)
+	case errors.Is(err, message.ErrAttachmentNotAllowed):
+		http.Error(w, "Not allowed to attach the file", http.StatusForbidden)
+	case errors.Is(err, message.ErrForwardLimitReached):
+		http.Error(w, "Message can not be forwarded any further", http.StatusForbidden)
+	case errors.Is(err, message.ErrPinLimitReached):
+		http.Error(w, "Conversation already has the maximum number of pinned messages", http.StatusConflict)
+	case errors.Is(err, message.ErrInvalidExpiry):
+		http.Error(w, "Message expiry must be in the future", http.StatusBadRequest)
+	case errors.Is(err, message.ErrInvalidTarget):
+		http.Error(w, "Each target needs either a receiver ID or a group ID", http.StatusBadRequest)
+	default:
+		http.Error(w, fallback, http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"adwise-service/model"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/google/uuid"
+)
+
+// HandleMessageStar stars (POST) or unstars (DELETE) the message given by the id query parameter for the caller.
+func (s *Server) HandleMessageStar(w http.ResponseWriter, r *http.Request) {
+	user, ok := currentUser(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	messageID, err := parseMessageID(r)
+	if err != nil {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		err = s.messageService.StarMessage(user.ID, messageID)
+	case http.MethodDelete:
+		err = s.messageService.UnstarMessage(user.ID, messageID)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		writeMessageError(w, err, "Failed to update star")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleStarredMessages lists the caller's starred messages across all conversations.
+func (s *Server) HandleStarredMessages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := currentUser(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	limit := 50 // Default limit
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		var err error
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	messages, err := s.messageService.GetStarredMessages(user.ID, limit)
+	if err != nil {
+		http.Error(w, "Failed to retrieve starred messages", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(messages)
+}
+
+// HandleMessagePin pins (POST) or unpins (DELETE) the message given by the id query parameter in its conversation.
+func (s *Server) HandleMessagePin(w http.ResponseWriter, r *http.Request) {
+	user, ok := currentUser(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	messageID, err := parseMessageID(r)
+	if err != nil {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		pin, err := s.messageService.PinMessage(user.ID, messageID)
+		if err != nil {
+			writeMessageError(w, err, "Failed to pin message")
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(pin)
+	case http.MethodDelete:
+		if err := s.messageService.UnpinMessage(user.ID, messageID); err != nil {
+			writeMessageError(w, err, "Failed to unpin message")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleConversationPins lists the pinned messages of the conversation given by the
+// group_id or receiver_id query parameter.
+func (s *Server) HandleConversationPins(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := currentUser(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	target, err := parseConversationTarget(r)
+	if err != nil {
+		http.Error(w, "Either group_id or receiver_id is required", http.StatusBadRequest)
+		return
+	}
+
+	messages, err := s.messageService.GetPinnedMessages(user.ID, target)
+	if err != nil {
+		writeMessageError(w, err, "Failed to retrieve pinned messages")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(messages)
+}
+
+// parseMessageID parses the id query parameter as a message ID.
+func parseMessageID(r *http.Request) (uint, error) {
+	id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return uint(id), nil
+}
+
+// parseConversationTarget parses the group_id or receiver_id query parameter as a conversation target.
+func parseConversationTarget(r *http.Request) (model.ConversationTarget, error) {
+	var target model.ConversationTarget
+	if groupID := r.URL.Query().Get("group_id"); groupID != "" {
+		id, err := strconv.ParseUint(groupID, 10, 64)
+		if err != nil {
+			return target, err
+		}
+		target.GroupID = uint(id)
+	}
+	if receiverID := r.URL.Query().Get("receiver_id"); receiverID != "" {
+		id, err := uuid.Parse(receiverID)
+		if err != nil {
+			return target, err
+		}
+		target.ReceiverID = id
+	}
+	if !target.Valid() {
+		return target, errors.New("invalid conversation target")
+	}
+	return target, nil
+}
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"adwise-service/model"
+	"adwise-service/service/message"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// HandleMessageSearch searches the caller's message history.
+//
+// Query parameters: q (required), lang, sender_id, group_id or receiver_id, from and to (RFC 3339),
+// media_type, limit and cursor (the next_cursor of the previous page).
+func (s *Server) HandleMessageSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := currentUser(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := model.MessageSearchFilter{
+		Query:     query.Get("q"),
+		Language:  query.Get("lang"),
+		MediaType: query.Get("media_type"),
+	}
+
+	if senderID := query.Get("sender_id"); senderID != "" {
+		id, err := uuid.Parse(senderID)
+		if err != nil {
+			http.Error(w, "Invalid sender ID", http.StatusBadRequest)
+			return
+		}
+		filter.SenderID = id
+	}
+	if query.Get("group_id") != "" || query.Get("receiver_id") != "" {
+		target, err := parseConversationTarget(r)
+		if err != nil {
+			http.Error(w, "Specify either group_id or receiver_id", http.StatusBadRequest)
+			return
+		}
+		filter.Conversation = &target
+	}
+
+	var err error
+	if filter.From, err = parseOptionalTime(query.Get("from")); err != nil {
+		http.Error(w, "Invalid from time", http.StatusBadRequest)
+		return
+	}
+	if filter.To, err = parseOptionalTime(query.Get("to")); err != nil {
+		http.Error(w, "Invalid to time", http.StatusBadRequest)
+		return
+	}
+	if limitStr := query.Get("limit"); limitStr != "" {
+		if filter.Limit, err = strconv.Atoi(limitStr); err != nil {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	page, err := s.messageService.SearchMessages(user.ID, filter, query.Get("cursor"))
+	switch {
+	case errors.Is(err, message.ErrEmptySearchQuery):
+		http.Error(w, "Search query is required", http.StatusBadRequest)
+		return
+	case errors.Is(err, message.ErrInvalidCursor):
+		http.Error(w, "Invalid cursor", http.StatusBadRequest)
+		return
+	case err != nil:
+		writeMessageError(w, err, "Failed to search messages")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(page)
+}
+
+// parseOptionalTime parses an RFC 3339 time, returning the zero time for an empty value.
+func parseOptionalTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
@@ -0,0 +1,166 @@
+package handlers
+
+import (
+	"adwise-service/model"
+	"adwise-service/service/message"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+// scheduledMessageRequest is the body for creating or editing a scheduled message.
+type scheduledMessageRequest struct {
+	model.ConversationTarget
+	Content        string `json:"content"`
+	Type           string `json:"type"`
+	MediaURL       string `json:"media_url"`
+	MediaType      string `json:"media_type"`
+	MediaSize      int64  `json:"media_size"`
+	MediaThumbnail string `json:"media_thumbnail"`
+	IsReminder     bool   `json:"is_reminder"`
+	SendAt         string `json:"send_at"`   // RFC 3339, or a local time such as "2026-01-31T09:00" read in TimeZone
+	TimeZone       string `json:"time_zone"` // IANA time zone; defaults to the user's preferred time zone
+}
+
+// HandleScheduledMessages lists (GET), creates (POST), edits (PUT ?id=) and cancels (DELETE ?id=)
+// the caller's scheduled messages and reminders.
+func (s *Server) HandleScheduledMessages(w http.ResponseWriter, r *http.Request) {
+	user, ok := currentUser(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		s.getScheduledMessages(w, r, user.ID)
+	case http.MethodPost:
+		s.createScheduledMessage(w, r, user.ID)
+	case http.MethodPut:
+		s.updateScheduledMessage(w, r, user.ID)
+	case http.MethodDelete:
+		s.cancelScheduledMessage(w, r, user.ID)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// getScheduledMessages lists the caller's scheduled messages, optionally filtered by the status query parameter.
+func (s *Server) getScheduledMessages(w http.ResponseWriter, r *http.Request, userID uuid.UUID) {
+	var statuses []string
+	if status := r.URL.Query().Get("status"); status != "" {
+		statuses = append(statuses, status)
+	}
+
+	scheduled, err := s.messageService.GetScheduledMessages(userID, statuses...)
+	if err != nil {
+		http.Error(w, "Failed to retrieve scheduled messages", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(scheduled)
+}
+
+// createScheduledMessage schedules a new message.
+func (s *Server) createScheduledMessage(w http.ResponseWriter, r *http.Request, userID uuid.UUID) {
+	scheduled, ok := s.decodeScheduledMessage(w, r, userID)
+	if !ok {
+		return
+	}
+
+	if err := s.messageService.ScheduleMessage(userID, scheduled); err != nil {
+		writeScheduledMessageError(w, err, "Failed to schedule message")
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(scheduled)
+}
+
+// updateScheduledMessage replaces a pending scheduled message.
+func (s *Server) updateScheduledMessage(w http.ResponseWriter, r *http.Request, userID uuid.UUID) {
+	id, err := parseMessageID(r)
+	if err != nil {
+		http.Error(w, "Invalid scheduled message ID", http.StatusBadRequest)
+		return
+	}
+
+	update, ok := s.decodeScheduledMessage(w, r, userID)
+	if !ok {
+		return
+	}
+
+	scheduled, err := s.messageService.UpdateScheduledMessage(userID, id, update)
+	if err != nil {
+		writeScheduledMessageError(w, err, "Failed to update scheduled message")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(scheduled)
+}
+
+// cancelScheduledMessage cancels a pending scheduled message.
+func (s *Server) cancelScheduledMessage(w http.ResponseWriter, r *http.Request, userID uuid.UUID) {
+	id, err := parseMessageID(r)
+	if err != nil {
+		http.Error(w, "Invalid scheduled message ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.messageService.CancelScheduledMessage(userID, id); err != nil {
+		writeScheduledMessageError(w, err, "Failed to cancel scheduled message")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// decodeScheduledMessage reads a scheduledMessageRequest and resolves its send time.
+// It writes the error response and returns false if the request is invalid.
+func (s *Server) decodeScheduledMessage(w http.ResponseWriter, r *http.Request, userID uuid.UUID) (*model.ScheduledMessage, bool) {
+	var request scheduledMessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return nil, false
+	}
+
+	sendAt, timeZone, err := s.messageService.ResolveSendAt(userID, request.SendAt, request.TimeZone)
+	if err != nil {
+		writeScheduledMessageError(w, err, "Failed to resolve send time")
+		return nil, false
+	}
+
+	return &model.ScheduledMessage{
+		ReceiverID:     request.ReceiverID,
+		GroupID:        request.GroupID,
+		Content:        request.Content,
+		Type:           request.Type,
+		MediaURL:       request.MediaURL,
+		MediaType:      request.MediaType,
+		MediaSize:      request.MediaSize,
+		MediaThumbnail: request.MediaThumbnail,
+		IsReminder:     request.IsReminder,
+		SendAt:         sendAt,
+		TimeZone:       timeZone,
+	}, true
+}
+
+// writeScheduledMessageError maps scheduled message errors onto HTTP responses.
+func writeScheduledMessageError(w http.ResponseWriter, err error, fallback string) {
+	switch {
+	case errors.Is(err, message.ErrScheduledMessageNotFound):
+		http.Error(w, "Scheduled message not found", http.StatusNotFound)
+	case errors.Is(err, message.ErrScheduledMessageNotPending):
+		http.Error(w, "Scheduled message was already sent or cancelled", http.StatusConflict)
+	case errors.Is(err, message.ErrInvalidSendTime):
+		http.Error(w, "Send time must be a valid future time", http.StatusBadRequest)
+	case errors.Is(err, message.ErrInvalidTimeZone):
+		http.Error(w, "Invalid time zone", http.StatusBadRequest)
+	default:
+		writeMessageError(w, err, fallback)
+	}
+}
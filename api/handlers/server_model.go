@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"adwise-service/service/auth"
+	"adwise-service/service/call"
 	"adwise-service/service/file"
 	"adwise-service/service/message"
 	"adwise-service/service/websocket"
@@ -11,9 +12,10 @@ import (
 // Server represents the API server.
 type Server struct {
 	authService      auth.AuthService
-	messageService   message.MessageService
+	messageService   *message.MessageService
 	fileService      file.FileService
-	websocketService websocket.WebSocketService
+	websocketService *websocket.WebSocketService
+	callService      *call.CallService
 	httpServer       *http.Server
 	middleware       []func(http.Handler) http.Handler
 }
@@ -21,9 +23,10 @@ type Server struct {
 // NewServer creates a new API server.
 func NewServer(
 	authService auth.AuthService,
-	messageService message.MessageService,
+	messageService *message.MessageService,
 	fileService file.FileService,
-	websocketService websocket.WebSocketService,
+	websocketService *websocket.WebSocketService,
+	callService *call.CallService,
 	httpServer *http.Server,
 	middleware []func(http.Handler) http.Handler,
 ) *Server {
@@ -32,6 +35,7 @@ func NewServer(
 		messageService:   messageService,
 		fileService:      fileService,
 		websocketService: websocketService,
+		callService:      callService,
 		httpServer:       httpServer,
 		middleware:       middleware,
 	}
@@ -0,0 +1,236 @@
+package handlers
+
+import (
+	"adwise-service/model"
+	"adwise-service/service/file"
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// tusVersion is the version of the tus resumable upload protocol served.
+const tusVersion = "1.0.0"
+
+// tusPath is the creation endpoint of resumable uploads; an upload's URL is tusPath, a slash and
+// the upload's ID.
+const tusPath = "/api/files/tus"
+
+// statusChecksumMismatch is the status the tus checksum extension answers a mismatching chunk with.
+const statusChecksumMismatch = 460
+
+// HandleTusUploads creates resumable uploads (POST) following the tus protocol, with the creation,
+// termination, checksum and expiration extensions, and describes the server (OPTIONS). The file
+// name and type are read from the filename (or name) and filetype (or type) metadata.
+func (s *Server) HandleTusUploads(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	switch r.Method {
+	case http.MethodOptions:
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", "creation,termination,checksum,expiration")
+		w.Header().Set("Tus-Checksum-Algorithm", strings.Join(file.ChecksumAlgorithms, ","))
+		if maxSize := s.fileService.MaxUploadSize(); maxSize > 0 {
+			w.Header().Set("Tus-Max-Size", strconv.FormatInt(maxSize, 10))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodPost:
+		user, ok := currentUser(r)
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !checkTusResumable(w, r) {
+			return
+		}
+		length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+		if err != nil || length < 0 {
+			http.Error(w, "Invalid Upload-Length", http.StatusBadRequest)
+			return
+		}
+		metadata, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+		if err != nil {
+			http.Error(w, "Invalid Upload-Metadata", http.StatusBadRequest)
+			return
+		}
+		name := firstNonEmpty(metadata["filename"], metadata["name"])
+		contentType := firstNonEmpty(metadata["filetype"], metadata["type"])
+
+		upload, err := s.fileService.CreateUpload(user.ID, name, contentType, length)
+		if err != nil {
+			writeTusError(w, err, "Failed to create upload")
+			return
+		}
+		w.Header().Set("Location", tusPath+"/"+upload.ID.String())
+		setUploadExpires(w, upload)
+		w.WriteHeader(http.StatusCreated)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleTusUpload reports the offset of a resumable upload (HEAD), appends a chunk to it (PATCH)
+// or terminates it (DELETE). Once an upload is complete, its file is given by the X-File-ID and
+// X-File-URL headers.
+func (s *Server) HandleTusUpload(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	user, ok := currentUser(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !checkTusResumable(w, r) {
+		return
+	}
+	uploadID, err := uuid.Parse(strings.TrimPrefix(r.URL.Path, tusPath+"/"))
+	if err != nil {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		upload, err := s.fileService.GetUpload(user.ID, uploadID)
+		if err != nil {
+			writeTusError(w, err, "Failed to retrieve upload")
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+		setUploadExpires(w, upload)
+		setUploadFile(w, upload)
+		w.WriteHeader(http.StatusOK)
+
+	case http.MethodPatch:
+		if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+			http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+			return
+		}
+		offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+		if err != nil || offset < 0 {
+			http.Error(w, "Invalid Upload-Offset", http.StatusBadRequest)
+			return
+		}
+		checksum, err := parseUploadChecksum(r.Header.Get("Upload-Checksum"))
+		if err != nil {
+			http.Error(w, "Invalid Upload-Checksum", http.StatusBadRequest)
+			return
+		}
+
+		// The chunk received before a client disconnects is still stored
+		upload, _, err := s.fileService.WriteChunk(context.WithoutCancel(r.Context()), user.ID, uploadID, offset, r.Body, checksum)
+		if upload != nil && !errors.Is(err, file.ErrOffsetMismatch) {
+			w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+			setUploadExpires(w, upload)
+			setUploadFile(w, upload)
+		}
+		if err != nil {
+			writeTusError(w, err, "Failed to store chunk")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodDelete:
+		if err := s.fileService.TerminateUpload(user.ID, uploadID); err != nil {
+			writeTusError(w, err, "Failed to terminate upload")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// checkTusResumable rejects requests for a protocol version other than tusVersion.
+func checkTusResumable(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+// parseUploadMetadata decodes the Upload-Metadata header: comma-separated keys, each followed by a
+// space and its base64-encoded value unless the value is empty.
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, encoded, _ := strings.Cut(pair, " ")
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, err
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
+
+// parseUploadChecksum decodes the Upload-Checksum header, the algorithm followed by a space and the
+// base64-encoded checksum. It returns nil without a header.
+func parseUploadChecksum(header string) (*file.ChunkChecksum, error) {
+	if header == "" {
+		return nil, nil
+	}
+	algorithm, encoded, ok := strings.Cut(header, " ")
+	if !ok {
+		return nil, errors.New("invalid checksum")
+	}
+	sum, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	return &file.ChunkChecksum{Algorithm: algorithm, Sum: sum}, nil
+}
+
+// setUploadExpires tells the client until when an incomplete upload can be resumed.
+func setUploadExpires(w http.ResponseWriter, upload *model.Upload) {
+	if upload.FileID == 0 {
+		w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	}
+}
+
+// setUploadFile tells the client the file a complete upload was assembled into.
+func setUploadFile(w http.ResponseWriter, upload *model.Upload) {
+	if upload.FileID != 0 {
+		w.Header().Set("X-File-ID", strconv.FormatUint(uint64(upload.FileID), 10))
+		w.Header().Set("X-File-URL", upload.FileURL)
+	}
+}
+
+// firstNonEmpty returns the first of values that is not empty.
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// writeTusError maps the errors of resumable uploads onto HTTP responses.
+func writeTusError(w http.ResponseWriter, err error, fallback string) {
+	switch {
+	case errors.Is(err, file.ErrUploadNotFound):
+		http.Error(w, "Upload not found", http.StatusNotFound)
+	case errors.Is(err, file.ErrOffsetMismatch):
+		http.Error(w, "Upload-Offset does not match the upload", http.StatusConflict)
+	case errors.Is(err, file.ErrChunkTooLarge):
+		http.Error(w, "Chunk exceeds the upload length", http.StatusRequestEntityTooLarge)
+	case errors.Is(err, file.ErrChecksumMismatch):
+		http.Error(w, "Checksum mismatch", statusChecksumMismatch)
+	case errors.Is(err, file.ErrUnsupportedChecksum):
+		http.Error(w, "Unsupported checksum algorithm", http.StatusBadRequest)
+	default:
+		writeFileError(w, err, fallback)
+	}
+}
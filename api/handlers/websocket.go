@@ -1,86 +1,173 @@
 package handlers
 
 import (
-	"adwise-service/model"
+	"adwise-service/service/websocket"
 	"adwise-service/utils"
 	"encoding/json"
-	"log"
+	"errors"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
-	"github.com/gorilla/websocket"
 	"go.uber.org/zap"
 )
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true // Allow all connections (customize for production)
-	},
-}
+// tokenSubprotocol is the WebSocket subprotocol used to pass an access token from a browser, which
+// can not set an Authorization header on a WebSocket. The client offers the subprotocols
+// "access_token" and the token itself; the server accepts "access_token".
+const tokenSubprotocol = "access_token"
 
-// Test
-func (s *Server) HandleWebSocket_OLD(w http.ResponseWriter, r *http.Request) {
-	token := r.Header.Get("Authorization")
-	userUUID, token, role := s.ValidateToken(token)
-	conn, err := upgrader.Upgrade(w, r, nil)
+// handleWebSocket handles WebSocket connections.
+//
+// The connection is authenticated before upgrading, using the first of: a ticket query parameter
+// issued by /api/ws/ticket, an Authorization bearer header, or the access_token subprotocol. The
+// protocol version is negotiated before upgrading as well; see websocket.NegotiateVersion.
+func (s *Server) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
+	version, versionSubprotocol, err := websocket.NegotiateVersion(r)
 	if err != nil {
-		utils.LogError("Failed to upgrade connection: %v\n", err)
-		http.Error(w, "Failed to upgrade to WebSocket", http.StatusInternalServerError)
+		http.Error(w, "Unsupported protocol version", http.StatusBadRequest)
+		return
+	}
+	resume, err := parseResumeState(r)
+	if err != nil {
+		http.Error(w, "Invalid last_seq", http.StatusBadRequest)
+		return
+	}
+
+	userUUID, expiresAt, subprotocol, err := s.authenticateWebSocket(r)
+	if err != nil {
+		utils.LogWarn("Rejected WebSocket connection", zap.Error(err), zap.String("remote_addr", r.RemoteAddr))
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Only one subprotocol can be accepted; the version subprotocol wins as the client offered it too
+	if versionSubprotocol != "" {
+		subprotocol = versionSubprotocol
+	}
+	var responseHeader http.Header
+	if subprotocol != "" {
+		responseHeader = http.Header{"Sec-Websocket-Protocol": {subprotocol}}
+	}
+	conn, err := s.websocketService.Upgrade(w, r, responseHeader)
+	if err != nil {
+		// The upgrader has already replied with an HTTP error
+		utils.LogWarn("Failed to upgrade to WebSocket", zap.Error(err))
 		return
 	}
 	defer conn.Close()
 
-	AddConnection(userUUID, token, conn)
-	defer RemoveConnection(userUUID, token)
+	// Each device passes a stable device_id so that several devices of a user can be connected at once
+	deviceID := r.URL.Query().Get("device_id")
+	s.websocketService.HandleConnection(conn, userUUID, deviceID, version, expiresAt, resume)
+}
 
-	log.Printf("User: %s connected as %s.\n", userUUID, role)
+// parseResumeState reads the stream_id and last_seq query parameters a reconnecting client passes to
+// receive the events it missed. It returns nil for a fresh connection.
+func parseResumeState(r *http.Request) (*websocket.ResumeState, error) {
+	streamID := r.URL.Query().Get("stream_id")
+	lastSeq := r.URL.Query().Get("last_seq")
+	if streamID == "" && lastSeq == "" {
+		return nil, nil
+	}
+	seq, err := strconv.ParseUint(lastSeq, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &websocket.ResumeState{StreamID: streamID, LastSeq: seq}, nil
+}
 
-	for {
-		_, message, err := conn.ReadMessage()
-		if err != nil {
-			log.Printf("Read error for user %s: %v\n", "userID", err)
-			break
-		}
-		var msg model.Message
-		if err := json.Unmarshal(message, &msg); err != nil {
-			log.Println("WebSocket unmarshal error:", err)
-			continue
-		}
-		s.websocketService.HandleMessage(userUUID, msg)
+// HandleWebSocketSchema serves the JSON Schema of the WebSocket protocol.
+func (s *Server) HandleWebSocketSchema(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
+	w.Header().Set("Content-Type", "application/schema+json")
+	w.Write(websocket.ProtocolSchema())
 }
 
-// handleWebSocket handles WebSocket connections.
-func (s *Server) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
-	// userID := r.Context().Value("user_id")
-	token := r.Header.Get("Authorization")
-	userUUID, _, _ := s.ValidateToken(token)
-	conn, err := upgrader.Upgrade(w, r, nil)
+// HandleWebSocketTicket issues a short-lived, single-use ticket for opening a WebSocket connection.
+func (s *Server) HandleWebSocketTicket(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// The ticket keeps the connection open only as long as the access token it was issued for
+	userUUID, _, sessionExpiresAt, err := s.authService.ValidateSessionToken(bearerToken(r.Header.Get("Authorization")))
 	if err != nil {
-		http.Error(w, "Failed to upgrade to WebSocket", http.StatusInternalServerError)
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
 		return
 	}
-	defer conn.Close()
-	s.websocketService.HandleConnection(conn, userUUID)
+
+	ticket, expiresAt, err := s.authService.IssueWebSocketTicket(userUUID, sessionExpiresAt)
+	if err != nil {
+		http.Error(w, "Failed to issue ticket", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ticket":     ticket,
+		"expires_at": expiresAt,
+	})
+}
+
+// authenticateWebSocket resolves the user of a WebSocket upgrade request. It returns the user, the
+// time at which the connection's authentication expires and the subprotocol to accept, if any.
+func (s *Server) authenticateWebSocket(r *http.Request) (uuid.UUID, time.Time, string, error) {
+	if ticket := r.URL.Query().Get("ticket"); ticket != "" {
+		userUUID, expiresAt, err := s.authService.RedeemWebSocketTicket(ticket)
+		return userUUID, expiresAt, "", err
+	}
+
+	if header := r.Header.Get("Authorization"); header != "" {
+		token := bearerToken(header)
+		if token == "" {
+			return uuid.Nil, time.Time{}, "", errors.New("invalid authorization header format")
+		}
+		userUUID, _, expiresAt, err := s.authService.ValidateSessionToken(token)
+		return userUUID, expiresAt, "", err
+	}
+
+	if token, ok := subprotocolToken(r); ok {
+		userUUID, _, expiresAt, err := s.authService.ValidateSessionToken(token)
+		return userUUID, expiresAt, tokenSubprotocol, err
+	}
+
+	return uuid.Nil, time.Time{}, "", errors.New("no credentials provided")
 }
 
-// Validate Token
-func (s *Server) ValidateToken(bearerToken string) (uuid.UUID, string, string) {
-	// Check if the header is in the format "Bearer <token>"
-	parts := strings.Split(bearerToken, " ")
+// bearerToken extracts the token from an Authorization header in the format "Bearer <token>".
+func bearerToken(header string) string {
+	parts := strings.Split(header, " ")
 	if len(parts) != 2 || parts[0] != "Bearer" {
-		utils.LogWarn("Invalid authorization header format")
-		return uuid.Nil, bearerToken, "unathorized"
+		return ""
 	}
+	return parts[1]
+}
 
-	tokenString := parts[1]
+// subprotocolToken extracts an access token offered as a subprotocol next to "access_token". Version
+// subprotocols offered alongside are skipped.
+func subprotocolToken(r *http.Request) (string, bool) {
+	var offered []string
+	for _, header := range r.Header.Values("Sec-Websocket-Protocol") {
+		for _, protocol := range strings.Split(header, ",") {
+			offered = append(offered, strings.TrimSpace(protocol))
+		}
+	}
 
-	// Parse and validate the token
-	userUUID, role, err := s.authService.ValidateToken(tokenString)
-	if err != nil {
-		utils.LogWarn("Invalid token", zap.Error(err))
-		return uuid.Nil, tokenString, "unathorized"
+	hasTokenProtocol := false
+	token := ""
+	for _, protocol := range offered {
+		if protocol == tokenSubprotocol {
+			hasTokenProtocol = true
+		} else if token == "" && !websocket.IsVersionSubprotocol(protocol) {
+			token = protocol
+		}
 	}
-	return userUUID, tokenString, role
+	return token, hasTokenProtocol && token != ""
 }
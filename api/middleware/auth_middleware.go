@@ -2,6 +2,7 @@ package middleware
 
 import (
 	"adwise-service/service/auth"
+	"adwise-service/storage"
 	"adwise-service/utils"
 	"context"
 	"errors"
@@ -40,9 +41,14 @@ func (m *AuthMiddleware) Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
 		// Skip authentication for the registration endpoint
+		// The WebSocket and event endpoints authenticate themselves, since browsers can not send an
+		// Authorization header on a WebSocket or EventSource. Signed storage URLs carry their own
+		// authorization
 		if r.URL.Path == "/api/register" || r.URL.Path == "/api/login" ||
 			r.URL.Path == "/api/admin" || r.URL.Path == "/api/request-reset" ||
-			r.URL.Path == "/api/reset-password" {
+			r.URL.Path == "/api/reset-password" || r.URL.Path == "/ws" ||
+			r.URL.Path == "/api/ws/schema" || r.URL.Path == "/api/events" ||
+			r.URL.Path == "/api/events/poll" || strings.HasPrefix(r.URL.Path, storage.SignedPath) {
 			next.ServeHTTP(w, r)
 			return
 		}
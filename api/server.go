@@ -3,9 +3,11 @@ package api
 import (
 	"adwise-service/api/handlers"
 	"adwise-service/service/auth"
+	"adwise-service/service/call"
 	"adwise-service/service/file"
 	"adwise-service/service/message"
 	"adwise-service/service/websocket"
+	"adwise-service/storage"
 	"adwise-service/utils"
 	"context"
 	"log"
@@ -17,9 +19,10 @@ import (
 
 type Server struct {
 	authService      auth.AuthService
-	messageService   message.MessageService
+	messageService   *message.MessageService
 	fileService      file.FileService
-	websocketService websocket.WebSocketService
+	websocketService *websocket.WebSocketService
+	callService      *call.CallService
 	httpServer       *http.Server
 	middleware       []func(http.Handler) http.Handler
 }
@@ -27,9 +30,10 @@ type Server struct {
 // NewServer creates a new API server.
 func NewServer(
 	authService auth.AuthService,
-	messageService message.MessageService,
+	messageService *message.MessageService,
 	fileService file.FileService,
-	websocketService websocket.WebSocketService,
+	websocketService *websocket.WebSocketService,
+	callService *call.CallService,
 	httpServer *http.Server,
 	middleware []func(http.Handler) http.Handler,
 ) *Server {
@@ -38,6 +42,7 @@ func NewServer(
 		messageService:   messageService,
 		fileService:      fileService,
 		websocketService: websocketService,
+		callService:      callService,
 		httpServer:       httpServer,
 		middleware:       middleware,
 	}
@@ -98,7 +103,7 @@ func (s *Server) Start(port string) error {
 // initRouter initializes the HTTP router and registers routes.
 func (s *Server) initRouter() *http.ServeMux {
 	router := http.NewServeMux()
-	h := handlers.NewServer(s.authService, s.messageService, s.fileService, s.websocketService, s.httpServer, s.middleware)
+	h := handlers.NewServer(s.authService, s.messageService, s.fileService, s.websocketService, s.callService, s.httpServer, s.middleware)
 	// Register routes
 	router.HandleFunc("/api/register", h.HandleRegister)
 	router.HandleFunc("/api/login", h.HandleLogin)
@@ -107,8 +112,30 @@ func (s *Server) initRouter() *http.ServeMux {
 	router.HandleFunc("/api/reset-password", h.HandleResetPassword) // Reset password
 	router.HandleFunc("/api/refresh", h.HandleRefresh)
 	router.HandleFunc("/api/messages", h.HandleMessages)
+	router.HandleFunc("/api/messages/forward", h.HandleForwardMessage)
+	router.HandleFunc("/api/messages/search", h.HandleMessageSearch)
+	router.HandleFunc("/api/messages/scheduled", h.HandleScheduledMessages)
+	router.HandleFunc("/api/messages/star", h.HandleMessageStar)
+	router.HandleFunc("/api/messages/starred", h.HandleStarredMessages)
+	router.HandleFunc("/api/messages/pin", h.HandleMessagePin)
+	router.HandleFunc("/api/conversations/pins", h.HandleConversationPins)
+	router.HandleFunc("/api/conversations/settings", h.HandleConversationSettings)
 	router.HandleFunc("/api/files", h.HandleFiles)
+	router.HandleFunc("/api/files/shares", h.HandleFileShares)
+	router.HandleFunc("/api/files/thumbnail", h.HandleThumbnail)
+	router.HandleFunc("/api/files/uploads", h.HandleUploadIntent)
+	router.HandleFunc("/api/files/uploads/complete", h.HandleCompleteUpload)
+	router.HandleFunc("/api/files/tus", h.HandleTusUploads)
+	router.HandleFunc("/api/files/tus/", h.HandleTusUpload)
+	router.HandleFunc(storage.SignedPath, h.HandleSignedStorage)
+	router.HandleFunc("/api/calls", h.HandleCalls)
+	router.HandleFunc("/api/calls/ice-servers", h.HandleCallICEServers)
+	router.HandleFunc("/api/calls/group", h.HandleGroupCall)
+	router.HandleFunc("/api/ws/ticket", h.HandleWebSocketTicket)
+	router.HandleFunc("/api/ws/schema", h.HandleWebSocketSchema)
 	router.HandleFunc("/ws", h.HandleWebSocket)
+	router.HandleFunc("/api/events", h.HandleEventStream)
+	router.HandleFunc("/api/events/poll", h.HandlePollEvents)
 
 	return router
 }
@@ -0,0 +1,36 @@
+package broker
+
+import (
+	"context"
+	"errors"
+
+	"github.com/google/uuid"
+)
+
+// ErrClosed is returned when publishing on a broker that was closed.
+var ErrClosed = errors.New("broker is closed")
+
+// Handler receives the messages published on a channel.
+type Handler func(payload []byte)
+
+// Broker publishes messages to named channels and delivers them to every subscriber of the
+// channel, on this or any other instance sharing the broker.
+//
+// Delivery is at most once and only to subscribers present when the message is published.
+// Handlers must not block; they may be called concurrently for different messages.
+type Broker interface {
+	// Publish sends a message to every subscriber of a channel.
+	Publish(ctx context.Context, channel string, payload []byte) error
+	// Subscribe registers a handler for a channel. The returned function removes it again.
+	Subscribe(channel string, handler Handler) (unsubscribe func(), err error)
+	// Close stops delivering messages and releases the broker's resources.
+	Close() error
+}
+
+// RoutesChannel is the channel on which instances announce the users whose sessions they hold.
+const RoutesChannel = "routes"
+
+// UserChannel is the channel of the events for a user.
+func UserChannel(userID uuid.UUID) string {
+	return "user:" + userID.String()
+}
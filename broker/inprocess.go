@@ -0,0 +1,89 @@
+package broker
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// subscription is a handler registered for a channel.
+type subscription struct {
+	handler Handler
+}
+
+// subscriptions keeps the handlers of each channel. It is shared by the broker implementations.
+type subscriptions struct {
+	mu       sync.RWMutex
+	channels map[string]map[*subscription]struct{}
+}
+
+// add registers a handler and returns the function removing it.
+func (s *subscriptions) add(channel string, handler Handler) func() {
+	sub := &subscription{handler: handler}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.channels == nil {
+		s.channels = make(map[string]map[*subscription]struct{})
+	}
+	if s.channels[channel] == nil {
+		s.channels[channel] = make(map[*subscription]struct{})
+	}
+	s.channels[channel][sub] = struct{}{}
+
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.channels[channel], sub)
+		if len(s.channels[channel]) == 0 {
+			delete(s.channels, channel)
+		}
+	}
+}
+
+// dispatch calls every handler of a channel.
+func (s *subscriptions) dispatch(channel string, payload []byte) {
+	s.mu.RLock()
+	handlers := make([]Handler, 0, len(s.channels[channel]))
+	for sub := range s.channels[channel] {
+		handlers = append(handlers, sub.handler)
+	}
+	s.mu.RUnlock()
+
+	for _, handler := range handlers {
+		handler(payload)
+	}
+}
+
+// InProcessBroker delivers messages between subscribers in the same process. Several service
+// instances sharing one InProcessBroker behave like replicas sharing a bus, which makes it suitable
+// for single-instance deployments and tests.
+type InProcessBroker struct {
+	subs   subscriptions
+	closed atomic.Bool
+}
+
+// NewInProcessBroker creates a new InProcessBroker.
+func NewInProcessBroker() *InProcessBroker {
+	return &InProcessBroker{}
+}
+
+// Publish delivers a message to the subscribers of a channel before returning.
+func (b *InProcessBroker) Publish(ctx context.Context, channel string, payload []byte) error {
+	if b.closed.Load() {
+		return ErrClosed
+	}
+	b.subs.dispatch(channel, payload)
+	return nil
+}
+
+// Subscribe registers a handler for a channel.
+func (b *InProcessBroker) Subscribe(channel string, handler Handler) (func(), error) {
+	return b.subs.add(channel, handler), nil
+}
+
+// Close stops delivering messages.
+func (b *InProcessBroker) Close() error {
+	b.closed.Store(true)
+	return nil
+}
@@ -0,0 +1,190 @@
+package broker
+
+import (
+	"adwise-service/utils"
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.uber.org/zap"
+)
+
+const (
+	// postgresChannel is the PostgreSQL notification channel every broker channel is multiplexed on.
+	postgresChannel = "adwise_broker"
+	// maxNotifyPayload is the largest message sent inline with NOTIFY. PostgreSQL rejects payloads of
+	// 8000 bytes or more; larger messages are stored in the broker_payloads table and sent by reference.
+	maxNotifyPayload = 7000
+	// payloadRetention is how long stored payloads are kept for listeners to read them.
+	payloadRetention = 5 * time.Minute
+	// reconnectDelay is the pause before listening again after the listen connection failed.
+	reconnectDelay = 2 * time.Second
+)
+
+// notification is the NOTIFY payload of a published message. Exactly one of Payload and Ref is set.
+type notification struct {
+	Channel string          `json:"c"`
+	Payload json.RawMessage `json:"p,omitempty"`
+	Ref     int64           `json:"r,omitempty"` // ID of the row in broker_payloads holding the payload
+}
+
+// PostgresBroker delivers messages between service instances with PostgreSQL LISTEN/NOTIFY.
+//
+// All broker channels share one notification channel; every instance receives every message and
+// dispatches it to its own subscribers. Messages are delivered only to instances listening when
+// the publishing transaction commits, and a listen connection that drops misses the messages sent
+// until it is back.
+type PostgresBroker struct {
+	pool   *pgxpool.Pool
+	subs   subscriptions
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	cleanupMu   sync.Mutex
+	lastCleanup time.Time
+}
+
+// NewPostgresBroker connects to the database at dsn and starts listening for messages.
+func NewPostgresBroker(ctx context.Context, dsn string) (*PostgresBroker, error) {
+	pool, err := pgxpool.New(ctx, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := pool.Exec(ctx, `CREATE TABLE IF NOT EXISTS broker_payloads (
+		id BIGSERIAL PRIMARY KEY,
+		payload BYTEA NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`); err != nil {
+		pool.Close()
+		return nil, err
+	}
+
+	listenCtx, cancel := context.WithCancel(context.Background())
+	b := &PostgresBroker{pool: pool, cancel: cancel, done: make(chan struct{})}
+	go b.listen(listenCtx)
+	return b, nil
+}
+
+// Publish sends a message to the subscribers of a channel on every instance.
+func (b *PostgresBroker) Publish(ctx context.Context, channel string, payload []byte) error {
+	message := notification{Channel: channel, Payload: payload}
+	if !json.Valid(payload) || len(payload) > maxNotifyPayload {
+		ref, err := b.storePayload(ctx, payload)
+		if err != nil {
+			return err
+		}
+		message = notification{Channel: channel, Ref: ref}
+	}
+
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	_, err = b.pool.Exec(ctx, "SELECT pg_notify($1, $2)", postgresChannel, string(data))
+	return err
+}
+
+// Subscribe registers a handler for a channel.
+func (b *PostgresBroker) Subscribe(channel string, handler Handler) (func(), error) {
+	return b.subs.add(channel, handler), nil
+}
+
+// Close stops listening and closes the database connections.
+func (b *PostgresBroker) Close() error {
+	b.cancel()
+	<-b.done
+	b.pool.Close()
+	return nil
+}
+
+// listen receives notifications until the context is cancelled, reconnecting after failures.
+func (b *PostgresBroker) listen(ctx context.Context) {
+	defer close(b.done)
+	for {
+		err := b.listenOnce(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		utils.LogError("Broker listen connection failed", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(reconnectDelay):
+		}
+	}
+}
+
+// listenOnce holds one connection listening for notifications until it fails.
+func (b *PostgresBroker) listenOnce(ctx context.Context) error {
+	conn, err := b.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	// A connection left in LISTEN mode must not go back to the pool
+	defer conn.Hijack().Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{postgresChannel}.Sanitize()); err != nil {
+		return err
+	}
+	for {
+		pgNotification, err := conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		b.deliver(ctx, pgNotification.Payload)
+	}
+}
+
+// deliver dispatches a received notification to the subscribers of its channel.
+func (b *PostgresBroker) deliver(ctx context.Context, data string) {
+	var message notification
+	if err := json.Unmarshal([]byte(data), &message); err != nil {
+		utils.LogError("Invalid broker notification", err)
+		return
+	}
+
+	payload := []byte(message.Payload)
+	if message.Ref != 0 {
+		// Skip the lookup when nobody here listens on the channel
+		b.subs.mu.RLock()
+		_, subscribed := b.subs.channels[message.Channel]
+		b.subs.mu.RUnlock()
+		if !subscribed {
+			return
+		}
+		if err := b.pool.QueryRow(ctx, "SELECT payload FROM broker_payloads WHERE id = $1", message.Ref).
+			Scan(&payload); err != nil {
+			utils.LogError("Failed to load broker payload", err, zap.Int64("ref", message.Ref))
+			return
+		}
+	}
+	b.subs.dispatch(message.Channel, payload)
+}
+
+// storePayload stores a message too large for NOTIFY and returns its reference. Payloads older
+// than the retention are removed at most once per retention period.
+func (b *PostgresBroker) storePayload(ctx context.Context, payload []byte) (int64, error) {
+	var ref int64
+	if err := b.pool.QueryRow(ctx, "INSERT INTO broker_payloads (payload) VALUES ($1) RETURNING id", payload).
+		Scan(&ref); err != nil {
+		return 0, err
+	}
+
+	b.cleanupMu.Lock()
+	due := time.Since(b.lastCleanup) > payloadRetention
+	if due {
+		b.lastCleanup = time.Now()
+	}
+	b.cleanupMu.Unlock()
+	if due {
+		if _, err := b.pool.Exec(ctx, "DELETE FROM broker_payloads WHERE created_at < now() - make_interval(secs => $1)",
+			payloadRetention.Seconds()); err != nil {
+			utils.LogError("Failed to remove old broker payloads", err)
+		}
+	}
+	return ref, nil
+}
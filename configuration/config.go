@@ -3,6 +3,10 @@ package configuration
 import (
 	"errors"
 	"os"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
 )
 
 // Config holds all configuration settings for the application.
@@ -15,6 +19,78 @@ type Config struct {
 	S3Bucket      string // AWS S3 bucket name for file storage
 	S3Region      string // AWS S3 region
 	JWTSecret     string // Secret key for JWT signing
+
+	// Messaging
+	MaxForwardDepth   uint // Maximum number of times a message can be forwarded onwards; 0 disables the limit
+	MaxPinnedMessages int  // Maximum number of pinned messages per conversation
+	ExpirySweepSecs   int  // Interval in seconds between sweeps for expired disappearing messages
+	SchedulerPollSecs int  // Interval in seconds between polls for due scheduled messages
+
+	// WebSocket
+	WSMaxMessageBytes int      // Maximum size in bytes of an inbound WebSocket message
+	WSSendQueueSize   int      // Outbound messages buffered per connection before a slow consumer is evicted
+	WSPongWaitSecs    int      // Seconds without a pong after which a connection is considered dead
+	WSAllowedOrigins  []string // Origins allowed to open WebSocket connections; "*" allows any
+	WSReplayLogSize   int      // Recent events kept per user for replay when a client reconnects
+	WSReplaySecs      int      // Seconds a disconnected user's replay log is kept
+	PresenceGraceSecs int      // Seconds a user must stay disconnected before being reported offline
+	TypingTimeoutSecs int      // Seconds after which a typing indicator without a stop expires
+	TypingThrottleMs  int      // Minimum milliseconds between forwarded typing starts per sender and conversation
+	SSEKeepAliveSecs  int      // Seconds between keep-alive comments on an event stream
+	LongPollWaitSecs  int      // Longest time in seconds a long-poll request waits for events
+
+	// Calls
+	CallRingTimeoutSecs    int      // Seconds a call rings before it is missed
+	CallReconnectGraceSecs int      // Seconds a participant may be disconnected before their calls end
+	STUNURLs               []string // STUN server URLs handed to call participants
+	TURNURLs               []string // TURN server URLs handed to call participants
+	TURNSecret             string   // Shared secret of the TURN server's REST API authentication
+	TURNCredentialTTLSecs  int      // Seconds TURN credentials stay valid
+	GroupCallMaxSize       int      // Maximum participants of a group call
+
+	// Storage
+	StorageDriver     string // Blob store for uploaded files: s3, local or memory
+	S3Endpoint        string // Custom endpoint of an S3-compatible service such as MinIO
+	S3AccessKeyID     string // Static S3 credentials; the AWS default credential chain is used when empty
+	S3SecretAccessKey string // Secret of the static S3 credentials
+	StorageLocalDir   string // Root directory of the local storage driver
+	StorageSigningKey string // Key of the local storage driver's signed URLs; direct uploads need it with that driver
+	PublicBaseURL     string // Origin clients reach the API at, used in the local storage driver's signed URLs
+
+	// Files
+	FileMaxUploadBytes    int              // Largest file accepted in bytes unless its type has a limit; 0 disables the limit
+	FileTypeSizeLimits    map[string]int64 // Size limits of content types, like image/*=10485760
+	FileAllowedTypes      []string         // Content types accepted for upload, like image/png or image/*; * accepts any
+	SignedURLExpirySecs   int              // Seconds signed upload and download URLs stay valid
+	FileDownloadRedirects bool             // Redirect downloads to signed storage URLs instead of streaming them
+	UploadTTLSecs         int              // Seconds after which unfinished resumable and direct uploads are discarded
+	UploadSweepSecs       int              // Interval in seconds between sweeps for abandoned uploads
+	ThumbnailSizes        []int            // Edges of the squares image thumbnails are fit into, in pixels
+	ImageConcurrency      int              // Images processed at a time; each may take about 100MB of memory
+
+	// Malware scanning
+	ScannerDriver     string // Scanner new files are checked with: clamav, fake or none; files are quarantined until scanned
+	ClamAVAddress     string // TCP address of clamd
+	ClamAVTimeoutSecs int    // Seconds a single scan may take
+	ClamAVMaxBytes    int    // StreamMaxLength of clamd; larger files can not be scanned
+	ScanPollSecs      int    // Interval in seconds between polls for files awaiting a scan
+
+	// Clustering
+	BrokerDriver string // Broker delivering events between instances: "memory" for a single instance or "postgres"
+	NodeID       string // Unique name of this instance in the route registry
+	RouteTTLSecs int    // Seconds an instance's routes stay valid without a heartbeat
+}
+
+// defaultAllowedTypes are the content types accepted for upload unless FILE_ALLOWED_TYPES is set:
+// media, documents and archives, but nothing a browser would run.
+var defaultAllowedTypes = []string{
+	"image/jpeg", "image/png", "image/gif", "image/webp", "image/heic", "image/heif", "image/avif",
+	"video/*", "audio/*",
+	"application/pdf", "text/plain", "text/csv", "application/rtf", "application/zip",
+	"application/msword", "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	"application/vnd.ms-excel", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	"application/vnd.ms-powerpoint", "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	"application/vnd.oasis.opendocument.text", "application/vnd.oasis.opendocument.spreadsheet",
 }
 
 // LoadConfig loads configuration from environment variables.
@@ -29,6 +105,63 @@ func LoadConfig() (*Config, error) {
 		S3Bucket:      getEnv("S3_BUCKET", ""),
 		S3Region:      getEnv("S3_REGION", ""),
 		JWTSecret:     getEnv("JWT_SECRET", "secret_key"),
+
+		MaxForwardDepth:   uint(getEnvInt("MAX_FORWARD_DEPTH", 5)),
+		MaxPinnedMessages: getEnvInt("MAX_PINNED_MESSAGES", 3),
+		ExpirySweepSecs:   getEnvInt("EXPIRY_SWEEP_SECONDS", 30),
+		SchedulerPollSecs: getEnvInt("SCHEDULER_POLL_SECONDS", 5),
+
+		WSMaxMessageBytes: getEnvInt("WS_MAX_MESSAGE_BYTES", 64*1024),
+		WSSendQueueSize:   getEnvInt("WS_SEND_QUEUE_SIZE", 256),
+		WSPongWaitSecs:    getEnvInt("WS_PONG_WAIT_SECONDS", 60),
+		WSAllowedOrigins:  getEnvList("WS_ALLOWED_ORIGINS"),
+		WSReplayLogSize:   getEnvInt("WS_REPLAY_LOG_SIZE", 200),
+		WSReplaySecs:      getEnvInt("WS_REPLAY_RETENTION_SECONDS", 300),
+		PresenceGraceSecs: getEnvInt("PRESENCE_OFFLINE_GRACE_SECONDS", 10),
+		TypingTimeoutSecs: getEnvInt("TYPING_TIMEOUT_SECONDS", 6),
+		TypingThrottleMs:  getEnvInt("TYPING_THROTTLE_MILLISECONDS", 3000),
+		SSEKeepAliveSecs:  getEnvInt("SSE_KEEPALIVE_SECONDS", 15),
+		LongPollWaitSecs:  getEnvInt("LONG_POLL_WAIT_SECONDS", 25),
+
+		CallRingTimeoutSecs:    getEnvInt("CALL_RING_TIMEOUT_SECONDS", 45),
+		CallReconnectGraceSecs: getEnvInt("CALL_RECONNECT_GRACE_SECONDS", 15),
+		STUNURLs:               getEnvList("STUN_URLS"),
+		TURNURLs:               getEnvList("TURN_URLS"),
+		TURNSecret:             getEnv("TURN_SECRET", ""),
+		TURNCredentialTTLSecs:  getEnvInt("TURN_CREDENTIAL_TTL_SECONDS", 86400),
+		GroupCallMaxSize:       getEnvInt("GROUP_CALL_MAX_PARTICIPANTS", 8),
+
+		StorageDriver:     getEnv("STORAGE_DRIVER", "s3"),
+		S3Endpoint:        getEnv("S3_ENDPOINT", ""),
+		S3AccessKeyID:     getEnv("S3_ACCESS_KEY_ID", ""),
+		S3SecretAccessKey: getEnv("S3_SECRET_ACCESS_KEY", ""),
+		StorageLocalDir:   getEnv("STORAGE_LOCAL_DIR", "data/files"),
+		StorageSigningKey: getEnv("STORAGE_SIGNING_KEY", ""),
+
+		FileMaxUploadBytes:    getEnvInt("FILE_MAX_UPLOAD_BYTES", 100*1024*1024),
+		FileTypeSizeLimits:    getEnvSizes("FILE_TYPE_SIZE_LIMITS"),
+		FileAllowedTypes:      getEnvList("FILE_ALLOWED_TYPES"),
+		SignedURLExpirySecs:   getEnvInt("SIGNED_URL_EXPIRY_SECONDS", 900),
+		FileDownloadRedirects: getEnvBool("FILE_DOWNLOAD_REDIRECTS", false),
+		UploadTTLSecs:         getEnvInt("UPLOAD_TTL_SECONDS", 86400),
+		UploadSweepSecs:       getEnvInt("UPLOAD_SWEEP_SECONDS", 600),
+		ThumbnailSizes:        getEnvInts("THUMBNAIL_SIZES", []int{64, 256, 1024}),
+		ImageConcurrency:      getEnvInt("IMAGE_CONCURRENCY", 2),
+
+		ScannerDriver:     getEnv("SCANNER_DRIVER", "clamav"),
+		ClamAVAddress:     getEnv("CLAMAV_ADDRESS", "localhost:3310"),
+		ClamAVTimeoutSecs: getEnvInt("CLAMAV_TIMEOUT_SECONDS", 120),
+		ClamAVMaxBytes:    getEnvInt("CLAMAV_MAX_BYTES", 25*1024*1024),
+		ScanPollSecs:      getEnvInt("SCAN_POLL_SECONDS", 30),
+
+		BrokerDriver: getEnv("BROKER_DRIVER", "memory"),
+		NodeID:       getEnv("NODE_ID", defaultNodeID()),
+		RouteTTLSecs: getEnvInt("ROUTE_TTL_SECONDS", 30),
+	}
+
+	cfg.PublicBaseURL = getEnv("PUBLIC_BASE_URL", "http://localhost:"+cfg.ServerPort)
+	if len(cfg.FileAllowedTypes) == 0 {
+		cfg.FileAllowedTypes = defaultAllowedTypes
 	}
 
 	// Validate required configurations
@@ -41,6 +174,21 @@ func LoadConfig() (*Config, error) {
 	if cfg.JWTSecret == "" {
 		return nil, errors.New("JWT_SECRET is required")
 	}
+	if cfg.BrokerDriver != "memory" && cfg.BrokerDriver != "postgres" {
+		return nil, errors.New("BROKER_DRIVER must be memory or postgres")
+	}
+	switch cfg.StorageDriver {
+	case "s3":
+		if cfg.S3Bucket == "" {
+			return nil, errors.New("S3_BUCKET is required for the s3 storage driver")
+		}
+	case "local", "memory":
+	default:
+		return nil, errors.New("STORAGE_DRIVER must be s3, local or memory")
+	}
+	if cfg.ScannerDriver != "clamav" && cfg.ScannerDriver != "fake" && cfg.ScannerDriver != "none" {
+		return nil, errors.New("SCANNER_DRIVER must be clamav, fake or none")
+	}
 
 	return cfg, nil
 }
@@ -52,3 +200,82 @@ func getEnv(key, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+// getEnvInt retrieves an integer environment variable with a fallback default value.
+func getEnvInt(key string, defaultValue int) int {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return defaultValue
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return defaultValue
+	}
+	return parsed
+}
+
+// getEnvSizes retrieves a comma-separated list of type=bytes pairs, skipping malformed entries.
+func getEnvSizes(key string) map[string]int64 {
+	sizes := map[string]int64{}
+	for _, entry := range getEnvList(key) {
+		name, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			continue
+		}
+		size, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			continue
+		}
+		sizes[strings.TrimSpace(name)] = size
+	}
+	return sizes
+}
+
+// getEnvInts retrieves a comma-separated list of positive integers with a fallback default value.
+// Entries that are not positive integers are skipped.
+func getEnvInts(key string, defaultValue []int) []int {
+	if _, exists := os.LookupEnv(key); !exists {
+		return defaultValue
+	}
+	var values []int
+	for _, entry := range getEnvList(key) {
+		if value, err := strconv.Atoi(entry); err == nil && value > 0 {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// getEnvBool retrieves a boolean environment variable with a fallback default value.
+func getEnvBool(key string, defaultValue bool) bool {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return defaultValue
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return defaultValue
+	}
+	return parsed
+}
+
+// defaultNodeID names an instance after its host, with a random suffix so that instances sharing a
+// host, or restarting, do not take over each other's routes.
+func defaultNodeID() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "node"
+	}
+	return hostname + "-" + uuid.New().String()[:8]
+}
+
+// getEnvList retrieves a comma-separated environment variable as a list, skipping empty entries.
+func getEnvList(key string) []string {
+	var values []string
+	for _, value := range strings.Split(os.Getenv(key), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
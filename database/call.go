@@ -0,0 +1,103 @@
+package database
+
+import (
+	"adwise-service/model"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// PlaceCall saves a new ringing call unless the caller is in an active call already, see
+// FindActiveCalls, and reports whether it was saved. A callee in an active call makes the new call
+// busy. The check and the insert run under transaction-scoped advisory locks on both parties, so
+// concurrent calls to or from the same user on several instances are placed one after another.
+func (r *RelationalDB) PlaceCall(call *model.Call, ringingSince time.Time) (bool, error) {
+	placed := false
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		parties := []string{call.CallerID.String(), call.CalleeID.String()}
+		slices.Sort(parties) // A fixed order keeps crossing calls from deadlocking
+		for _, party := range parties {
+			if err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", "calls:"+party).Error; err != nil {
+				return err
+			}
+		}
+
+		var active []model.Call
+		if err := activeCalls(tx, []uuid.UUID{call.CallerID, call.CalleeID}, ringingSince).Find(&active).Error; err != nil {
+			return err
+		}
+		for _, other := range active {
+			if other.HasParticipant(call.CallerID) {
+				return nil
+			}
+			call.Status = model.CallStatusBusy
+			endedAt := call.StartedAt
+			call.EndedAt = &endedAt
+		}
+
+		if err := tx.Create(call).Error; err != nil {
+			return err
+		}
+		placed = true
+		return nil
+	})
+	return placed, err
+}
+
+// FindCallByID retrieves a call by its ID.
+func (r *RelationalDB) FindCallByID(id uuid.UUID) (*model.Call, error) {
+	var call model.Call
+	if err := r.db.Where("id = ?", id).First(&call).Error; err != nil {
+		return nil, err
+	}
+	return &call, nil
+}
+
+// FindActiveCalls returns the accepted calls, and the calls ringing since ringingSince, of any of the users.
+func (r *RelationalDB) FindActiveCalls(userIDs []uuid.UUID, ringingSince time.Time) ([]model.Call, error) {
+	var calls []model.Call
+	if err := activeCalls(r.db, userIDs, ringingSince).Find(&calls).Error; err != nil {
+		return nil, err
+	}
+	return calls, nil
+}
+
+// activeCalls scopes a query to the active calls of any of the users.
+func activeCalls(db *gorm.DB, userIDs []uuid.UUID, ringingSince time.Time) *gorm.DB {
+	return db.Where("(caller_id IN ? OR callee_id IN ?) AND (status = ? OR (status = ? AND started_at > ?))",
+		userIDs, userIDs, model.CallStatusAccepted, model.CallStatusRinging, ringingSince)
+}
+
+// UpdateCallStatus applies updates to a call as long as its status is one of from and returns the
+// updated call, or nil when the call is in another status. The check and the update are a single
+// statement, so concurrent transitions of the same call on several instances can not both succeed.
+func (r *RelationalDB) UpdateCallStatus(id uuid.UUID, from []string, updates map[string]interface{}) (*model.Call, error) {
+	var calls []model.Call
+	if err := r.db.Model(&calls).Clauses(clause.Returning{}).
+		Where("id = ? AND status IN ?", id, from).
+		Updates(updates).Error; err != nil {
+		return nil, err
+	}
+	if len(calls) == 0 {
+		return nil, nil
+	}
+	return &calls[0], nil
+}
+
+// SetCallMessage links a call to the system message recording it.
+func (r *RelationalDB) SetCallMessage(id uuid.UUID, messageID uint) error {
+	return r.db.Model(&model.Call{}).Where("id = ?", id).Update("message_id", messageID).Error
+}
+
+// FindCallsByUserID retrieves up to limit calls of a user started before the given time, newest first.
+func (r *RelationalDB) FindCallsByUserID(userID uuid.UUID, before time.Time, limit int) ([]model.Call, error) {
+	var calls []model.Call
+	if err := r.db.Where("(caller_id = ? OR callee_id = ?) AND started_at < ?", userID, userID, before).
+		Order("started_at DESC").Limit(limit).Find(&calls).Error; err != nil {
+		return nil, err
+	}
+	return calls, nil
+}
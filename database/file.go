@@ -0,0 +1,183 @@
+package database
+
+import (
+	"adwise-service/model"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// CreateFile saves the record of a stored file with its thumbnails. A quarantined file that is ready
+// is queued for scanning in the same transaction, so that no file stays quarantined without a scan
+// job.
+func (r *RelationalDB) CreateFile(file *model.File) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(file).Error; err != nil {
+			return err
+		}
+		return queueScanJob(tx, file)
+	})
+}
+
+// FindFileByID retrieves a file record by its ID with its thumbnails, smallest first.
+func (r *RelationalDB) FindFileByID(id uint) (*model.File, error) {
+	var file model.File
+	if err := r.db.Preload("Thumbnails", func(db *gorm.DB) *gorm.DB {
+		return db.Order("size")
+	}).First(&file, id).Error; err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+// CompleteFileUpload marks a pending file as ready with what was learnt from its content: the key
+// it was copied to, its checksum, detected type and size, an image's dimensions and blurhash, and its thumbnails. A
+// quarantined file is queued for scanning. It reports whether the file was pending.
+func (r *RelationalDB) CompleteFileUpload(file *model.File) (bool, error) {
+	completed := false
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&model.File{}).
+			Where("id = ? AND status = ?", file.ID, model.FileStatusPending).
+			Updates(map[string]interface{}{
+				"status":       model.FileStatusReady,
+				"key":          file.Key,
+				"checksum":     file.Checksum,
+				"content_type": file.ContentType,
+				"size":         file.Size,
+				"width":        file.Width,
+				"height":       file.Height,
+				"blurhash":     file.Blurhash,
+			})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		completed = true
+
+		for i := range file.Thumbnails {
+			file.Thumbnails[i].FileID = file.ID
+		}
+		if len(file.Thumbnails) > 0 {
+			if err := tx.Create(&file.Thumbnails).Error; err != nil {
+				return err
+			}
+		}
+		var completedFile model.File
+		if err := tx.First(&completedFile, file.ID).Error; err != nil {
+			return err
+		}
+		return queueScanJob(tx, &completedFile)
+	})
+	if err != nil {
+		return false, err
+	}
+	return completed, nil
+}
+
+// FindPendingFiles lists files whose direct upload was started before the given time and never
+// completed.
+func (r *RelationalDB) FindPendingFiles(before time.Time, limit int) ([]model.File, error) {
+	var files []model.File
+	err := r.db.Where("status = ? AND created_at < ?", model.FileStatusPending, before).
+		Order("created_at").Limit(limit).Find(&files).Error
+	return files, err
+}
+
+// DeleteFile removes a file record together with its shares, thumbnails and scan job.
+func (r *RelationalDB) DeleteFile(id uint) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("file_id = ?", id).Delete(&model.FileShare{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("file_id = ?", id).Delete(&model.ScanJob{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("file_id = ?", id).Delete(&model.FileThumbnail{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&model.File{}, id).Error
+	})
+}
+
+// MarkFileAttached records the first attachment of a file to a message; later attachments leave
+// the file as it is. The file becomes ephemeral if asked to and it is not shared.
+func (r *RelationalDB) MarkFileAttached(id uint, ephemeral bool, at time.Time) error {
+	return r.db.Model(&model.File{}).
+		Where("id = ? AND attached_at IS NULL", id).
+		Updates(map[string]interface{}{
+			"attached_at": at,
+			"ephemeral":   gorm.Expr("? AND NOT EXISTS (SELECT 1 FROM file_shares s WHERE s.file_id = files.id)", ephemeral),
+		}).Error
+}
+
+// DeleteEphemeralFile removes the record of a file together with its thumbnails and scan job if the
+// file is ephemeral and not shared. It reports whether the file was removed. Sharing a file clears
+// its ephemeral flag, so a share committed first keeps the file.
+func (r *RelationalDB) DeleteEphemeralFile(id uint) (bool, error) {
+	deleted := false
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("id = ? AND ephemeral AND NOT EXISTS (SELECT 1 FROM file_shares s WHERE s.file_id = files.id)", id).
+			Delete(&model.File{})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		deleted = true
+		if err := tx.Where("file_id = ?", id).Delete(&model.ScanJob{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("file_id = ?", id).Delete(&model.FileThumbnail{}).Error
+	})
+	if err != nil {
+		return false, err
+	}
+	return deleted, nil
+}
+
+// CreateFileShares shares a file with users. Users the file is already shared with are skipped. A
+// shared file is no longer ephemeral.
+func (r *RelationalDB) CreateFileShares(shares []model.FileShare) error {
+	if len(shares) == 0 {
+		return nil
+	}
+	fileIDs := make([]uint, 0, len(shares))
+	for _, share := range shares {
+		fileIDs = append(fileIDs, share.FileID)
+	}
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&model.File{}).Where("id IN ?", fileIDs).Update("ephemeral", false).Error; err != nil {
+			return err
+		}
+		return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&shares).Error
+	})
+}
+
+// DeleteFileShare revokes a user's share of a file.
+func (r *RelationalDB) DeleteFileShare(fileID uint, userID uuid.UUID) error {
+	return r.db.Where("file_id = ? AND user_id = ?", fileID, userID).Delete(&model.FileShare{}).Error
+}
+
+// FindFileShares lists the users a file is shared with.
+func (r *RelationalDB) FindFileShares(fileID uint) ([]model.FileShare, error) {
+	var shares []model.FileShare
+	if err := r.db.Where("file_id = ?", fileID).Order("created_at").Find(&shares).Error; err != nil {
+		return nil, err
+	}
+	return shares, nil
+}
+
+// CanAccessFile reports whether a user may read a file: they own it, it is shared with them, or it
+// is the media of a message in one of their conversations, identified by the file's URL.
+func (r *RelationalDB) CanAccessFile(fileID uint, fileURL string, userID uuid.UUID) (bool, error) {
+	var count int64
+	err := r.db.Raw(`SELECT COUNT(*) FROM files f WHERE f.id = ? AND (
+			f.owner_id = ?
+			OR EXISTS (SELECT 1 FROM file_shares s WHERE s.file_id = f.id AND s.user_id = ?)
+			OR EXISTS (SELECT 1 FROM messages m WHERE m.media_url = ? AND (
+				m.sender_id = ?
+				OR (m.group_id = 0 AND m.receiver_id = ?)
+				OR (m.group_id <> 0 AND EXISTS (
+					SELECT 1 FROM group_members g WHERE g.group_id = m.group_id AND g.user_id = ?)))))`,
+		fileID, userID, userID, fileURL, userID, userID, userID).Scan(&count).Error
+	return count > 0, err
+}
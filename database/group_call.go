@@ -0,0 +1,174 @@
+package database
+
+import (
+	"adwise-service/model"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrGroupCallFull is returned when joining a group call that holds the maximum number of participants.
+var ErrGroupCallFull = errors.New("group call is full")
+
+// JoinGroupCall adds a user to the active call of a group, starting the call with the user as host
+// when there is none. It returns the call with its roster and whether the call was started. The
+// call row is locked while the roster is checked, so concurrent joins can not exceed
+// maxParticipants.
+func (r *RelationalDB) JoinGroupCall(groupID uint, userID uuid.UUID, media string, now time.Time, maxParticipants int) (*model.GroupCall, bool, error) {
+	var call model.GroupCall
+	started := false
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		created := model.GroupCall{
+			ID:        uuid.New(),
+			GroupID:   groupID,
+			HostID:    userID,
+			Media:     media,
+			Status:    model.GroupCallStatusActive,
+			StartedAt: now,
+			UpdatedAt: now,
+		}
+		// The partial unique index on active calls turns a concurrent start into a join
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&created)
+		if result.Error != nil {
+			return result.Error
+		}
+		started = result.RowsAffected > 0
+
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("group_id = ? AND status = ?", groupID, model.GroupCallStatusActive).
+			First(&call).Error; err != nil {
+			return err
+		}
+
+		var others int64
+		if err := tx.Model(&model.GroupCallParticipant{}).
+			Where("call_id = ? AND user_id <> ? AND left_at IS NULL", call.ID, userID).
+			Count(&others).Error; err != nil {
+			return err
+		}
+		if maxParticipants > 0 && int(others) >= maxParticipants {
+			return ErrGroupCallFull
+		}
+
+		participant := model.GroupCallParticipant{CallID: call.ID, UserID: userID, JoinedAt: now}
+		if err := tx.Clauses(clause.OnConflict{
+			Columns: []clause.Column{{Name: "call_id"}, {Name: "user_id"}},
+			DoUpdates: clause.Assignments(map[string]interface{}{
+				"joined_at": now, "left_at": nil, "muted": false, "camera_off": false,
+			}),
+		}).Create(&participant).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&call).Update("updated_at", now).Error; err != nil {
+			return err
+		}
+		return preloadRoster(tx).First(&call, "id = ?", call.ID).Error
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return &call, started, nil
+}
+
+// LeaveGroupCall removes a user from the roster of an active group call. The call ends when its
+// last participant leaves; a host that leaves hands the call over to the longest-standing
+// participant. It returns the call with its roster and whether the user was in the roster.
+func (r *RelationalDB) LeaveGroupCall(callID, userID uuid.UUID, now time.Time) (*model.GroupCall, bool, error) {
+	var call model.GroupCall
+	left := false
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ? AND status = ?", callID, model.GroupCallStatusActive).
+			First(&call).Error; err != nil {
+			return err
+		}
+
+		result := tx.Model(&model.GroupCallParticipant{}).
+			Where("call_id = ? AND user_id = ? AND left_at IS NULL", callID, userID).
+			Update("left_at", now)
+		if result.Error != nil {
+			return result.Error
+		}
+		left = result.RowsAffected > 0
+
+		if err := preloadRoster(tx).First(&call, "id = ?", callID).Error; err != nil {
+			return err
+		}
+		updates := map[string]interface{}{"updated_at": now}
+		switch {
+		case len(call.Participants) == 0:
+			call.Status = model.GroupCallStatusEnded
+			call.EndedAt = &now
+			call.Duration = uint(now.Sub(call.StartedAt) / time.Second)
+			updates["status"] = call.Status
+			updates["ended_at"] = now
+			updates["duration"] = call.Duration
+		case call.HostID == userID:
+			call.HostID = call.Participants[0].UserID
+			updates["host_id"] = call.HostID
+		}
+		call.UpdatedAt = now
+		return tx.Model(&model.GroupCall{}).Where("id = ?", callID).Updates(updates).Error
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return &call, left, nil
+}
+
+// UpdateGroupCallParticipant applies updates to a participant in the roster of a group call. It
+// reports whether the user was in the roster.
+func (r *RelationalDB) UpdateGroupCallParticipant(callID, userID uuid.UUID, updates map[string]interface{}) (bool, error) {
+	result := r.db.Model(&model.GroupCallParticipant{}).
+		Where("call_id = ? AND user_id = ? AND left_at IS NULL", callID, userID).
+		Updates(updates)
+	return result.RowsAffected > 0, result.Error
+}
+
+// FindGroupCallByID retrieves a group call with its roster.
+func (r *RelationalDB) FindGroupCallByID(id uuid.UUID) (*model.GroupCall, error) {
+	var call model.GroupCall
+	if err := preloadRoster(r.db).First(&call, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+	return &call, nil
+}
+
+// FindActiveGroupCall retrieves the active call of a group with its roster.
+func (r *RelationalDB) FindActiveGroupCall(groupID uint) (*model.GroupCall, error) {
+	var call model.GroupCall
+	if err := preloadRoster(r.db).
+		Where("group_id = ? AND status = ?", groupID, model.GroupCallStatusActive).
+		First(&call).Error; err != nil {
+		return nil, err
+	}
+	return &call, nil
+}
+
+// FindActiveGroupCallIDsByUser returns the IDs of the active group calls a user is in.
+func (r *RelationalDB) FindActiveGroupCallIDsByUser(userID uuid.UUID) ([]uuid.UUID, error) {
+	var ids []uuid.UUID
+	if err := r.db.Model(&model.GroupCallParticipant{}).
+		Joins("JOIN group_calls ON group_calls.id = group_call_participants.call_id").
+		Where("group_call_participants.user_id = ? AND group_call_participants.left_at IS NULL AND group_calls.status = ?",
+			userID, model.GroupCallStatusActive).
+		Pluck("group_call_participants.call_id", &ids).Error; err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// SetGroupCallMessage links a group call to the system message recording it.
+func (r *RelationalDB) SetGroupCallMessage(id uuid.UUID, messageID uint) error {
+	return r.db.Model(&model.GroupCall{}).Where("id = ?", id).Update("message_id", messageID).Error
+}
+
+// preloadRoster loads the participants currently in a group call, longest-standing first.
+func preloadRoster(db *gorm.DB) *gorm.DB {
+	return db.Preload("Participants", func(db *gorm.DB) *gorm.DB {
+		return db.Where("left_at IS NULL").Order("joined_at")
+	})
+}
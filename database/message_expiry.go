@@ -0,0 +1,70 @@
+package database
+
+import (
+	"adwise-service/model"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// DeleteExpiredMessages hard-deletes up to limit auto-delete messages that expired before the given time.
+//
+// The messages are claimed with FOR UPDATE SKIP LOCKED, so concurrent callers on other instances
+// never process the same message. It returns the deleted messages and the media URLs no longer
+// referenced by any remaining message, which the caller removes once the deletion is committed.
+func (r *RelationalDB) DeleteExpiredMessages(before time.Time, limit int) ([]model.Message, []string, error) {
+	var messages []model.Message
+	var orphanedMedia []string
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Raw(`SELECT * FROM messages WHERE auto_delete AND expires_at <= ?
+			ORDER BY expires_at LIMIT ? FOR UPDATE SKIP LOCKED`, before, limit).
+			Scan(&messages).Error; err != nil {
+			return err
+		}
+		if len(messages) == 0 {
+			return nil
+		}
+
+		ids := make([]uint, len(messages))
+		mediaURLs := make([]string, 0, len(messages))
+		for i, message := range messages {
+			ids[i] = message.ID
+			if message.MediaURL != "" {
+				mediaURLs = append(mediaURLs, message.MediaURL)
+			}
+		}
+
+		// Forwarded copies share media with the original, so only media without other references is removed.
+		var stillReferenced []string
+		if len(mediaURLs) > 0 {
+			if err := tx.Model(&model.Message{}).Distinct("media_url").
+				Where("media_url IN ? AND id NOT IN ?", mediaURLs, ids).
+				Pluck("media_url", &stillReferenced).Error; err != nil {
+				return err
+			}
+		}
+		referenced := make(map[string]bool, len(stillReferenced))
+		for _, url := range stillReferenced {
+			referenced[url] = true
+		}
+		orphanedMedia = make([]string, 0, len(mediaURLs))
+		for _, url := range mediaURLs {
+			if !referenced[url] {
+				orphanedMedia = append(orphanedMedia, url)
+				referenced[url] = true
+			}
+		}
+
+		if err := tx.Where("message_id IN ?", ids).Delete(&model.MessageStar{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("message_id IN ?", ids).Delete(&model.MessagePin{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&model.Message{}, ids).Error
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return messages, orphanedMedia, nil
+}
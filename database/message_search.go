@@ -0,0 +1,136 @@
+package database
+
+import (
+	"adwise-service/model"
+	"html"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// messageSearchMigration adds the full-text search column and index to the messages table.
+//
+// The search vector is generated from the message content and transcription using the text search
+// configuration matching the message's language, so each message is stemmed in its own language.
+const messageSearchMigration = `
+CREATE OR REPLACE FUNCTION message_search_config(lang text) RETURNS regconfig
+LANGUAGE sql IMMUTABLE PARALLEL SAFE AS $$
+	SELECT CASE lower(split_part(coalesce(lang, ''), '-', 1))
+		WHEN 'ar' THEN 'arabic'::regconfig
+		WHEN 'da' THEN 'danish'::regconfig
+		WHEN 'de' THEN 'german'::regconfig
+		WHEN 'en' THEN 'english'::regconfig
+		WHEN 'es' THEN 'spanish'::regconfig
+		WHEN 'fi' THEN 'finnish'::regconfig
+		WHEN 'fr' THEN 'french'::regconfig
+		WHEN 'hu' THEN 'hungarian'::regconfig
+		WHEN 'id' THEN 'indonesian'::regconfig
+		WHEN 'it' THEN 'italian'::regconfig
+		WHEN 'nl' THEN 'dutch'::regconfig
+		WHEN 'no' THEN 'norwegian'::regconfig
+		WHEN 'pt' THEN 'portuguese'::regconfig
+		WHEN 'ro' THEN 'romanian'::regconfig
+		WHEN 'ru' THEN 'russian'::regconfig
+		WHEN 'sv' THEN 'swedish'::regconfig
+		WHEN 'tr' THEN 'turkish'::regconfig
+		ELSE 'simple'::regconfig
+	END
+$$;
+
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS search_vector tsvector
+	GENERATED ALWAYS AS (
+		to_tsvector(message_search_config(language), coalesce(content, '') || ' ' || coalesce(transcription, ''))
+	) STORED;
+
+CREATE INDEX IF NOT EXISTS idx_messages_search_vector ON messages USING GIN (search_vector);
+`
+
+// messageSearchQuery matches the query parsed in the requested language as well as with the
+// language-neutral configuration, so messages written in other languages still match on exact words.
+const messageSearchQuery = `(websearch_to_tsquery(message_search_config(@lang), @query) || websearch_to_tsquery('simple', @query))`
+
+// Snippets are highlighted by ts_headline with these control characters, which are removed from
+// the message text beforehand, and are turned into <mark> tags only once the text around them has
+// been HTML-escaped. Highlighting with the tags directly would leave the message text unescaped.
+const (
+	snippetStartSel = "\x02"
+	snippetStopSel  = "\x03"
+)
+
+// snippetOptions are the ts_headline options snippets are built with.
+const snippetOptions = "StartSel=" + snippetStartSel + ", StopSel=" + snippetStopSel + ", MaxFragments=2, MaxWords=20, MinWords=5"
+
+// snippetMarks turns the highlights of an escaped snippet into <mark> tags.
+var snippetMarks = strings.NewReplacer(snippetStartSel, "<mark>", snippetStopSel, "</mark>")
+
+// migrateMessageSearch applies the full-text search migration.
+func migrateMessageSearch(db *gorm.DB) error {
+	return db.Exec(messageSearchMigration).Error
+}
+
+// messageSearchRow is a message scanned together with its highlighted snippet.
+type messageSearchRow struct {
+	model.Message
+	Snippet string
+}
+
+// SearchMessages runs a full-text search over the messages in conversations the user belongs to,
+// newest first. It returns at most filter.Limit results.
+func (r *RelationalDB) SearchMessages(userID uuid.UUID, filter model.MessageSearchFilter) ([]model.MessageSearchResult, error) {
+	args := map[string]interface{}{
+		"lang":    filter.Language,
+		"query":   filter.Query,
+		"user":    userID,
+		"options": snippetOptions,
+		"marks":   snippetStartSel + snippetStopSel,
+	}
+
+	query := r.db.Model(&model.Message{}).
+		Select(`messages.*, ts_headline(message_search_config(messages.language),
+			translate(coalesce(messages.content, '') || ' ' || coalesce(messages.transcription, ''), @marks, ''),
+			`+messageSearchQuery+`, @options) AS snippet`, args).
+		Where("messages.search_vector @@ "+messageSearchQuery, args).
+		Where("NOT (messages.auto_delete AND messages.expires_at <= ?)", time.Now()).
+		Where(`(messages.group_id = 0 AND (messages.sender_id = @user OR messages.receiver_id = @user))
+			OR messages.group_id IN (SELECT group_id FROM group_members WHERE user_id = @user)`, args)
+
+	if filter.SenderID != uuid.Nil {
+		query = query.Where("messages.sender_id = ?", filter.SenderID)
+	}
+	if target := filter.Conversation; target != nil {
+		if target.IsGroup() {
+			query = query.Where("messages.group_id = ?", target.GroupID)
+		} else {
+			query = query.Where(`messages.group_id = 0 AND ((messages.sender_id = @user AND messages.receiver_id = @peer)
+				OR (messages.sender_id = @peer AND messages.receiver_id = @user))`,
+				map[string]interface{}{"user": userID, "peer": target.ReceiverID})
+		}
+	}
+	if !filter.From.IsZero() {
+		query = query.Where("messages.created_at >= ?", filter.From)
+	}
+	if !filter.To.IsZero() {
+		query = query.Where("messages.created_at < ?", filter.To)
+	}
+	if filter.MediaType != "" {
+		query = query.Where("messages.media_type = ?", filter.MediaType)
+	}
+	if cursor := filter.Before; cursor != nil {
+		query = query.Where("(messages.created_at, messages.id) < (?, ?)", cursor.CreatedAt, cursor.ID)
+	}
+
+	var rows []messageSearchRow
+	if err := query.Order("messages.created_at DESC, messages.id DESC").
+		Limit(filter.Limit).Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	results := make([]model.MessageSearchResult, len(rows))
+	for i, row := range rows {
+		snippet := snippetMarks.Replace(html.EscapeString(row.Snippet))
+		results[i] = model.MessageSearchResult{Message: row.Message, Snippet: snippet}
+	}
+	return results, nil
+}
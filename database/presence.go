@@ -0,0 +1,63 @@
+package database
+
+import (
+	"adwise-service/model"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// UpdateLastSeen records the time a user was last seen online.
+func (r *RelationalDB) UpdateLastSeen(userID uuid.UUID, at time.Time) error {
+	return r.db.Model(&model.User{}).Where("id = ?", userID).UpdateColumn("last_seen_at", at).Error
+}
+
+// FindLastSeen retrieves the last seen times of users. Users that were never seen are omitted.
+func (r *RelationalDB) FindLastSeen(userIDs []uuid.UUID) (map[uuid.UUID]time.Time, error) {
+	var rows []struct {
+		ID         uuid.UUID
+		LastSeenAt *time.Time
+	}
+	if err := r.db.Model(&model.User{}).Select("id, last_seen_at").
+		Where("id IN ? AND last_seen_at IS NOT NULL", userIDs).Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	lastSeen := make(map[uuid.UUID]time.Time, len(rows))
+	for _, row := range rows {
+		if row.LastSeenAt != nil {
+			lastSeen[row.ID] = *row.LastSeenAt
+		}
+	}
+	return lastSeen, nil
+}
+
+// FindHiddenLastSeen returns the users among userIDs whose preferences hide their last seen time.
+func (r *RelationalDB) FindHiddenLastSeen(userIDs []uuid.UUID) ([]uuid.UUID, error) {
+	var hidden []uuid.UUID
+	if err := r.db.Model(&model.UserPreference{}).Where("user_id IN ? AND hide_last_seen", userIDs).
+		Pluck("user_id", &hidden).Error; err != nil {
+		return nil, err
+	}
+	return hidden, nil
+}
+
+// FilterContacts returns the users among candidates that are contacts of userID: users sharing a
+// group with them or with whom they exchanged a direct message.
+func (r *RelationalDB) FilterContacts(userID uuid.UUID, candidates []uuid.UUID) ([]uuid.UUID, error) {
+	var contacts []uuid.UUID
+	err := r.db.Raw(`SELECT DISTINCT contact_id FROM (
+			SELECT other.user_id AS contact_id FROM group_members own
+				JOIN group_members other ON other.group_id = own.group_id
+				WHERE own.user_id = @user
+			UNION
+			SELECT receiver_id FROM messages WHERE group_id = 0 AND sender_id = @user
+			UNION
+			SELECT sender_id FROM messages WHERE group_id = 0 AND receiver_id = @user
+		) contacts WHERE contact_id IN @candidates AND contact_id <> @user`,
+		map[string]interface{}{"user": userID, "candidates": candidates}).Scan(&contacts).Error
+	if err != nil {
+		return nil, err
+	}
+	return contacts, nil
+}
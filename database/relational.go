@@ -2,12 +2,19 @@ package database
 
 import (
 	"adwise-service/model"
+	"errors"
+	"time"
 
 	"github.com/google/uuid"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
+// ErrPinLimitReached is returned when pinning a message in a conversation that holds the maximum
+// number of pins.
+var ErrPinLimitReached = errors.New("conversation has reached the pin limit")
+
 type RelationalDB struct {
 	db *gorm.DB
 }
@@ -21,7 +28,13 @@ func NewRelationalDB(dsn string) (*RelationalDB, error) {
 	}
 
 	// Auto-migrate models
-	if err := db.AutoMigrate(&model.User{}, &model.Message{}, &model.File{}, &model.LoginUser{}, &model.UserPreference{}); err != nil {
+	if err := db.AutoMigrate(&model.User{}, &model.Message{}, &model.File{}, &model.LoginUser{}, &model.UserPreference{},
+		&model.Group{}, &model.GroupMember{}, &model.MessageStar{}, &model.MessagePin{},
+		&model.ConversationSetting{}, &model.ScheduledMessage{}, &model.WebSocketTicket{}, &model.WebSocketRoute{}, &model.Call{},
+		&model.GroupCall{}, &model.GroupCallParticipant{}, &model.FileShare{}, &model.Upload{}, &model.ScanJob{}, &model.FileThumbnail{}); err != nil {
+		return nil, err
+	}
+	if err := migrateMessageSearch(db); err != nil {
 		return nil, err
 	}
 
@@ -84,6 +97,48 @@ func (r *RelationalDB) FindUserByID(userID uuid.UUID) (*model.User, error) {
 	return &user, nil
 }
 
+// FindUserPreference finds a user's preferences, falling back to the defaults when none are stored.
+func (r *RelationalDB) FindUserPreference(userID uuid.UUID) (*model.UserPreference, error) {
+	var preference model.UserPreference
+	err := r.db.Where("user_id = ?", userID).First(&preference).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return &model.UserPreference{
+			UserID:             userID,
+			LanguagePreference: "en",
+			ThemePreference:    "light",
+			NotificationPref:   true,
+			TimeZone:           "UTC",
+		}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &preference, nil
+}
+
+// CreateWebSocketTicket saves a WebSocket ticket and removes tickets that expired before it was issued.
+func (r *RelationalDB) CreateWebSocketTicket(ticket *model.WebSocketTicket) error {
+	if err := r.db.Where("expires_at < ?", ticket.CreatedAt).Delete(&model.WebSocketTicket{}).Error; err != nil {
+		return err
+	}
+	return r.db.Create(ticket).Error
+}
+
+// ConsumeWebSocketTicket deletes an unexpired WebSocket ticket and returns it. The delete makes
+// redemption atomic, so a ticket can be redeemed only once even across several service instances.
+func (r *RelationalDB) ConsumeWebSocketTicket(ticketHash string, now time.Time) (*model.WebSocketTicket, error) {
+	var tickets []model.WebSocketTicket
+	if err := r.db.Clauses(clause.Returning{}).
+		Where("ticket_hash = ? AND expires_at > ?", ticketHash, now).
+		Delete(&tickets).Error; err != nil {
+		return nil, err
+	}
+	if len(tickets) == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &tickets[0], nil
+}
+
 // CreateMessage saves a new message to the database.
 func (r *RelationalDB) CreateMessage(message *model.Message) error {
 	return r.db.Create(message).Error
@@ -92,7 +147,9 @@ func (r *RelationalDB) CreateMessage(message *model.Message) error {
 // FindMessagesByUserID retrieves messages for a user.
 func (r *RelationalDB) FindMessagesByUserID(userID uuid.UUID, limit int) ([]model.Message, error) {
 	var messages []model.Message
-	if err := r.db.Where("sender_id = ? OR receiver_id = ?", userID, userID).Limit(limit).Find(&messages).Error; err != nil {
+	if err := r.db.Where("sender_id = ? OR receiver_id = ?", userID, userID).
+		Where("NOT (auto_delete AND expires_at <= ?)", time.Now()).
+		Limit(limit).Find(&messages).Error; err != nil {
 		return nil, err
 	}
 	return messages, nil
@@ -111,3 +168,128 @@ func (r *RelationalDB) FindMessageByID(messageID uint) (*model.Message, error) {
 func (r *RelationalDB) DeleteMessage(messageID uint) error {
 	return r.db.Delete(&model.Message{}, messageID).Error
 }
+
+// CreateForwardedMessages saves the forwarded copies of a message and adds their number to the
+// forward count of the original in a single transaction.
+func (r *RelationalDB) CreateForwardedMessages(originalID uint, copies []model.Message) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&copies).Error; err != nil {
+			return err
+		}
+		return tx.Model(&model.Message{}).Where("id = ?", originalID).
+			UpdateColumn("forward_count", gorm.Expr("forward_count + ?", len(copies))).Error
+	})
+}
+
+// FindGroupMemberIDs retrieves the user IDs of a group's members.
+func (r *RelationalDB) FindGroupMemberIDs(groupID uint) ([]uuid.UUID, error) {
+	var userIDs []uuid.UUID
+	if err := r.db.Model(&model.GroupMember{}).Where("group_id = ?", groupID).
+		Pluck("user_id", &userIDs).Error; err != nil {
+		return nil, err
+	}
+	return userIDs, nil
+}
+
+// IsGroupMember reports whether a user is a member of a group.
+func (r *RelationalDB) IsGroupMember(groupID uint, userID uuid.UUID) (bool, error) {
+	var count int64
+	if err := r.db.Model(&model.GroupMember{}).Where("group_id = ? AND user_id = ?", groupID, userID).
+		Count(&count).Error; err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// CreateMessageStar stars a message for a user. Starring an already starred message is a no-op.
+func (r *RelationalDB) CreateMessageStar(star *model.MessageStar) error {
+	return r.db.Clauses(clause.OnConflict{DoNothing: true}).Create(star).Error
+}
+
+// DeleteMessageStar removes a user's star from a message.
+func (r *RelationalDB) DeleteMessageStar(userID uuid.UUID, messageID uint) error {
+	return r.db.Where("user_id = ? AND message_id = ?", userID, messageID).Delete(&model.MessageStar{}).Error
+}
+
+// FindStarredMessages retrieves the messages a user has starred, most recently starred first.
+func (r *RelationalDB) FindStarredMessages(userID uuid.UUID, limit int) ([]model.Message, error) {
+	var messages []model.Message
+	if err := r.db.Joins("JOIN message_stars ON message_stars.message_id = messages.id").
+		Where("message_stars.user_id = ?", userID).
+		Order("message_stars.created_at DESC").Limit(limit).Find(&messages).Error; err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// CreateMessagePin pins a message in a conversation holding fewer than maxPins pins. It returns
+// whether the message was pinned; pinning an already pinned message is a no-op. The pins of the
+// conversation are counted under a transaction-scoped advisory lock on the conversation, so
+// concurrent pins can not exceed maxPins.
+func (r *RelationalDB) CreateMessagePin(pin *model.MessagePin, maxPins int) (bool, error) {
+	pinned := false
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", "message_pins:"+pin.ConversationID).Error; err != nil {
+			return err
+		}
+
+		var count, existing int64
+		if err := tx.Model(&model.MessagePin{}).Where("conversation_id = ?", pin.ConversationID).
+			Count(&count).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&model.MessagePin{}).Where("conversation_id = ? AND message_id = ?", pin.ConversationID, pin.MessageID).
+			Count(&existing).Error; err != nil {
+			return err
+		}
+		if existing > 0 {
+			return nil
+		}
+		if count >= int64(maxPins) {
+			return ErrPinLimitReached
+		}
+
+		if err := tx.Create(pin).Error; err != nil {
+			return err
+		}
+		pinned = true
+		return nil
+	})
+	return pinned, err
+}
+
+// DeleteMessagePin unpins a message from a conversation. It returns whether the message was pinned.
+func (r *RelationalDB) DeleteMessagePin(conversationID string, messageID uint) (bool, error) {
+	result := r.db.Where("conversation_id = ? AND message_id = ?", conversationID, messageID).
+		Delete(&model.MessagePin{})
+	return result.RowsAffected > 0, result.Error
+}
+
+// FindPinnedMessages retrieves the messages pinned in a conversation, most recently pinned first.
+func (r *RelationalDB) FindPinnedMessages(conversationID string) ([]model.Message, error) {
+	var messages []model.Message
+	if err := r.db.Joins("JOIN message_pins ON message_pins.message_id = messages.id").
+		Where("message_pins.conversation_id = ?", conversationID).
+		Order("message_pins.pinned_at DESC").Find(&messages).Error; err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// FindConversationSetting finds the settings of a conversation, falling back to the defaults when none are stored.
+func (r *RelationalDB) FindConversationSetting(conversationID string) (*model.ConversationSetting, error) {
+	var setting model.ConversationSetting
+	err := r.db.Where("conversation_id = ?", conversationID).First(&setting).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return &model.ConversationSetting{ConversationID: conversationID}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &setting, nil
+}
+
+// SaveConversationSetting creates or replaces the settings of a conversation.
+func (r *RelationalDB) SaveConversationSetting(setting *model.ConversationSetting) error {
+	return r.db.Save(setting).Error
+}
@@ -0,0 +1,92 @@
+package database
+
+import (
+	"adwise-service/model"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// queueScanJob queues the scan of a file that is ready and quarantined. New jobs have no run time
+// and are claimed on the next poll. A file already queued is left alone.
+func queueScanJob(tx *gorm.DB, file *model.File) error {
+	if file.Status != model.FileStatusReady || file.ScanStatus != model.ScanStatusQuarantined {
+		return nil
+	}
+	job := &model.ScanJob{FileID: file.ID, Status: model.ScanJobPending}
+	return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(job).Error
+}
+
+// ClaimScanJobs marks up to limit pending scan jobs due at now as running and returns them.
+//
+// Jobs left running by an instance that stopped before finishing, i.e. claimed before staleBefore,
+// are claimed again. Rows locked by another instance are skipped, so several workers can share the
+// queue.
+func (r *RelationalDB) ClaimScanJobs(now, staleBefore time.Time, limit int) ([]model.ScanJob, error) {
+	var claimed []model.ScanJob
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Raw(`SELECT * FROM scan_jobs
+			WHERE (status = ? AND run_at <= ?) OR (status = ? AND claimed_at < ?)
+			ORDER BY run_at, id LIMIT ? FOR UPDATE SKIP LOCKED`,
+			model.ScanJobPending, now, model.ScanJobRunning, staleBefore, limit).
+			Scan(&claimed).Error; err != nil {
+			return err
+		}
+		if len(claimed) == 0 {
+			return nil
+		}
+
+		ids := make([]uint, len(claimed))
+		for i := range claimed {
+			ids[i] = claimed[i].ID
+			claimed[i].Status = model.ScanJobRunning
+			claimed[i].ClaimedAt = now
+			claimed[i].Attempts++
+		}
+		return tx.Model(&model.ScanJob{}).Where("id IN ?", ids).Updates(map[string]interface{}{
+			"status":     model.ScanJobRunning,
+			"claimed_at": now,
+			"attempts":   gorm.Expr("attempts + 1"),
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return claimed, nil
+}
+
+// UpdateScanJob records a scan attempt that failed, rescheduling the job or giving it up.
+func (r *RelationalDB) UpdateScanJob(job *model.ScanJob) error {
+	return r.db.Model(&model.ScanJob{}).Where("id = ?", job.ID).Updates(map[string]interface{}{
+		"status":     job.Status,
+		"run_at":     job.RunAt,
+		"last_error": job.LastError,
+		"updated_at": job.UpdatedAt,
+	}).Error
+}
+
+// FinishFileScan records the verdict of a quarantined file's scan and removes its scan job. It
+// reports whether the file was still quarantined.
+func (r *RelationalDB) FinishFileScan(fileID uint, scanStatus, signature string, scannedAt time.Time) (bool, error) {
+	finished := false
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&model.File{}).
+			Where("id = ? AND scan_status = ?", fileID, model.ScanStatusQuarantined).
+			Updates(map[string]interface{}{"scan_status": scanStatus, "signature": signature, "scanned_at": scannedAt})
+		if result.Error != nil {
+			return result.Error
+		}
+		finished = result.RowsAffected > 0
+		return tx.Where("file_id = ?", fileID).Delete(&model.ScanJob{}).Error
+	})
+	if err != nil {
+		return false, err
+	}
+	return finished, nil
+}
+
+// DeleteScanJob removes a scan job, for instance one whose file no longer exists.
+func (r *RelationalDB) DeleteScanJob(id uint) error {
+	return r.db.Delete(&model.ScanJob{}, id).Error
+}
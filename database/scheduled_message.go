@@ -0,0 +1,137 @@
+package database
+
+import (
+	"adwise-service/model"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// errScheduledClaimLost rolls back sending a scheduled message that another instance claimed again.
+var errScheduledClaimLost = errors.New("scheduled message claimed again")
+
+// CreateScheduledMessage saves a new scheduled message.
+func (r *RelationalDB) CreateScheduledMessage(scheduled *model.ScheduledMessage) error {
+	return r.db.Create(scheduled).Error
+}
+
+// FindScheduledMessageByID retrieves a scheduled message by its ID.
+func (r *RelationalDB) FindScheduledMessageByID(id uint) (*model.ScheduledMessage, error) {
+	var scheduled model.ScheduledMessage
+	if err := r.db.First(&scheduled, id).Error; err != nil {
+		return nil, err
+	}
+	return &scheduled, nil
+}
+
+// FindScheduledMessagesBySender retrieves the scheduled messages of a sender, soonest first.
+func (r *RelationalDB) FindScheduledMessagesBySender(senderID uuid.UUID, statuses []string) ([]model.ScheduledMessage, error) {
+	var scheduled []model.ScheduledMessage
+	query := r.db.Where("sender_id = ?", senderID)
+	if len(statuses) > 0 {
+		query = query.Where("status IN ?", statuses)
+	}
+	if err := query.Order("send_at").Find(&scheduled).Error; err != nil {
+		return nil, err
+	}
+	return scheduled, nil
+}
+
+// UpdatePendingScheduledMessage replaces a scheduled message as long as it is still pending.
+// It reports whether the message was updated.
+func (r *RelationalDB) UpdatePendingScheduledMessage(scheduled *model.ScheduledMessage) (bool, error) {
+	result := r.db.Model(&model.ScheduledMessage{}).
+		Where("id = ? AND status = ?", scheduled.ID, model.ScheduledStatusPending).
+		Select("*").Omit("id", "sender_id", "created_at").Updates(scheduled)
+	return result.RowsAffected > 0, result.Error
+}
+
+// UpdateScheduledMessageStatus records a failed attempt to send a scheduled message.
+func (r *RelationalDB) UpdateScheduledMessageStatus(scheduled *model.ScheduledMessage) error {
+	return r.db.Model(&model.ScheduledMessage{}).Where("id = ?", scheduled.ID).Updates(map[string]interface{}{
+		"status":     scheduled.Status,
+		"message_id": scheduled.MessageID,
+		"attempts":   scheduled.Attempts,
+		"last_error": scheduled.LastError,
+		"retry_at":   scheduled.RetryAt,
+		"updated_at": scheduled.UpdatedAt,
+	}).Error
+}
+
+// SendScheduledMessage saves the message sent for a claimed scheduled message and marks the
+// scheduled message as sent in a single transaction. It reports whether the message was saved;
+// it is not when the scheduled message is no longer held by this claim, because another instance
+// claimed it again in the meantime, so a message is never sent twice.
+func (r *RelationalDB) SendScheduledMessage(scheduled *model.ScheduledMessage, message *model.Message) (bool, error) {
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(message).Error; err != nil {
+			return err
+		}
+		result := tx.Model(&model.ScheduledMessage{}).
+			Where("id = ? AND status = ? AND claimed_at = ?", scheduled.ID, model.ScheduledStatusSending, scheduled.ClaimedAt).
+			Updates(map[string]interface{}{
+				"status":     model.ScheduledStatusSent,
+				"message_id": message.ID,
+				"last_error": "",
+				"updated_at": scheduled.UpdatedAt,
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errScheduledClaimLost
+		}
+		return nil
+	})
+	if errors.Is(err, errScheduledClaimLost) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	scheduled.Status = model.ScheduledStatusSent
+	scheduled.MessageID = message.ID
+	scheduled.LastError = ""
+	return true, nil
+}
+
+// ClaimDueScheduledMessages marks up to limit pending messages due at now as sending and returns them.
+// Messages waiting to be retried are due once their retry time has passed as well.
+//
+// Messages left in the sending state by an instance that stopped before finishing, i.e. claimed
+// before staleBefore, are claimed again. Rows locked by another instance are skipped, so several
+// schedulers can share the table.
+func (r *RelationalDB) ClaimDueScheduledMessages(now, staleBefore time.Time, limit int) ([]model.ScheduledMessage, error) {
+	var claimed []model.ScheduledMessage
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Raw(`SELECT * FROM scheduled_messages
+			WHERE send_at <= ? AND ((status = ? AND (retry_at IS NULL OR retry_at <= ?)) OR (status = ? AND claimed_at < ?))
+			ORDER BY send_at LIMIT ? FOR UPDATE SKIP LOCKED`,
+			now, model.ScheduledStatusPending, now, model.ScheduledStatusSending, staleBefore, limit).
+			Scan(&claimed).Error; err != nil {
+			return err
+		}
+		if len(claimed) == 0 {
+			return nil
+		}
+
+		ids := make([]uint, len(claimed))
+		for i := range claimed {
+			ids[i] = claimed[i].ID
+			claimed[i].Status = model.ScheduledStatusSending
+			claimed[i].ClaimedAt = now
+			claimed[i].Attempts++
+		}
+		return tx.Model(&model.ScheduledMessage{}).Where("id IN ?", ids).Updates(map[string]interface{}{
+			"status":     model.ScheduledStatusSending,
+			"claimed_at": now,
+			"attempts":   gorm.Expr("attempts + 1"),
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return claimed, nil
+}
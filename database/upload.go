@@ -0,0 +1,53 @@
+package database
+
+import (
+	"adwise-service/model"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// CreateUpload saves a new resumable upload.
+func (r *RelationalDB) CreateUpload(upload *model.Upload) error {
+	return r.db.Create(upload).Error
+}
+
+// FindUploadByID retrieves a resumable upload by its ID.
+func (r *RelationalDB) FindUploadByID(id uuid.UUID) (*model.Upload, error) {
+	var upload model.Upload
+	if err := r.db.First(&upload, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+	return &upload, nil
+}
+
+// AdvanceUpload moves the offset of an upload from one position to another and extends its expiry.
+// It reports whether the upload was at the expected offset, so of two requests appending at the
+// same offset only one succeeds.
+func (r *RelationalDB) AdvanceUpload(id uuid.UUID, from, to int64, expiresAt time.Time) (bool, error) {
+	result := r.db.Model(&model.Upload{}).
+		Where("id = ? AND \"offset\" = ?", id, from).
+		Updates(map[string]interface{}{"offset": to, "expires_at": expiresAt})
+	return result.RowsAffected > 0, result.Error
+}
+
+// SetUploadFile links a complete upload to the file assembled from it. It reports whether the
+// upload had no file yet.
+func (r *RelationalDB) SetUploadFile(id uuid.UUID, fileID uint) (bool, error) {
+	result := r.db.Model(&model.Upload{}).
+		Where("id = ? AND file_id = 0", id).
+		Update("file_id", fileID)
+	return result.RowsAffected > 0, result.Error
+}
+
+// DeleteUpload removes a resumable upload.
+func (r *RelationalDB) DeleteUpload(id uuid.UUID) error {
+	return r.db.Delete(&model.Upload{}, "id = ?", id).Error
+}
+
+// FindExpiredUploads lists uploads that expired before the given time.
+func (r *RelationalDB) FindExpiredUploads(before time.Time, limit int) ([]model.Upload, error) {
+	var uploads []model.Upload
+	err := r.db.Where("expires_at < ?", before).Order("expires_at").Limit(limit).Find(&uploads).Error
+	return uploads, err
+}
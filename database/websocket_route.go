@@ -0,0 +1,46 @@
+package database
+
+import (
+	"adwise-service/model"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm/clause"
+)
+
+// RegisterUserNode records that a node holds a session of a user until expiresAt.
+func (r *RelationalDB) RegisterUserNode(nodeID string, userID uuid.UUID, expiresAt time.Time) error {
+	route := &model.WebSocketRoute{NodeID: nodeID, UserID: userID, ExpiresAt: expiresAt}
+	return r.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "node_id"}, {Name: "user_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"expires_at"}),
+	}).Create(route).Error
+}
+
+// UnregisterUserNode removes the route of a user's session on a node.
+func (r *RelationalDB) UnregisterUserNode(nodeID string, userID uuid.UUID) error {
+	return r.db.Where("node_id = ? AND user_id = ?", nodeID, userID).Delete(&model.WebSocketRoute{}).Error
+}
+
+// RefreshNode extends every route of a node until expiresAt and removes routes of any node that lapsed before now.
+func (r *RelationalDB) RefreshNode(nodeID string, now, expiresAt time.Time) error {
+	if err := r.db.Model(&model.WebSocketRoute{}).Where("node_id = ?", nodeID).
+		Update("expires_at", expiresAt).Error; err != nil {
+		return err
+	}
+	return r.db.Where("expires_at < ?", now).Delete(&model.WebSocketRoute{}).Error
+}
+
+// UnregisterNode removes every route of a node.
+func (r *RelationalDB) UnregisterNode(nodeID string) error {
+	return r.db.Where("node_id = ?", nodeID).Delete(&model.WebSocketRoute{}).Error
+}
+
+// FindRoutesOfOtherNodes returns the live routes of every node other than nodeID.
+func (r *RelationalDB) FindRoutesOfOtherNodes(nodeID string, now time.Time) ([]model.WebSocketRoute, error) {
+	var routes []model.WebSocketRoute
+	if err := r.db.Where("node_id <> ? AND expires_at > ?", nodeID, now).Find(&routes).Error; err != nil {
+		return nil, err
+	}
+	return routes, nil
+}
@@ -3,16 +3,24 @@ package main
 import (
 	"adwise-service/api"
 	"adwise-service/api/middleware"
+	"adwise-service/broker"
 	config "adwise-service/configuration"
 	"adwise-service/database"
 	"adwise-service/repository/relational"
+	"adwise-service/scanner"
 	"adwise-service/service/auth"
+	"adwise-service/service/call"
 	"adwise-service/service/file"
 	"adwise-service/service/message"
+	"adwise-service/service/presence"
 	"adwise-service/service/websocket"
+	"adwise-service/storage"
 	"adwise-service/utils"
+	"context"
 	"log"
 	"net/http"
+	"time"
+	_ "time/tzdata" // Embed the time zone database for scheduled messages
 
 	"github.com/rs/cors"
 
@@ -53,9 +61,108 @@ func main() {
 	// print(graphRepo)
 	// Initialize services
 	authService := *auth.NewAuthService(relationalRepo, cfg.JWTSecret)
-	messageService := *message.NewMessageService(relationalRepo)
-	fileService := *file.NewFileService(cfg.S3Bucket, cfg.S3Region)
-	websocketService := *websocket.NewWebSocketService()
+	messageService := message.NewMessageService(relationalRepo, relationalRepo, relationalRepo, message.Config{
+		MaxForwardDepth:   cfg.MaxForwardDepth,
+		MaxPinnedMessages: cfg.MaxPinnedMessages,
+	})
+	blobStore, err := storage.Open(storage.Config{
+		Driver:             cfg.StorageDriver,
+		S3Bucket:           cfg.S3Bucket,
+		S3Region:           cfg.S3Region,
+		S3Endpoint:         cfg.S3Endpoint,
+		S3AccessKeyID:      cfg.S3AccessKeyID,
+		S3SecretAccessKey:  cfg.S3SecretAccessKey,
+		LocalDir:           cfg.StorageLocalDir,
+		LocalSigningSecret: cfg.StorageSigningKey,
+		LocalBaseURL:       cfg.PublicBaseURL,
+	})
+	if err != nil {
+		utils.LogError("Failed to open file storage", err)
+		log.Fatalf("Failed to open file storage: %v", err)
+	}
+	fileService := *file.NewFileService(blobStore, relationalRepo, file.Config{
+		MaxUploadSize:     int64(cfg.FileMaxUploadBytes),
+		TypeSizeLimits:    cfg.FileTypeSizeLimits,
+		AllowedTypes:      cfg.FileAllowedTypes,
+		SignedURLExpiry:   time.Duration(cfg.SignedURLExpirySecs) * time.Second,
+		RedirectDownloads: cfg.FileDownloadRedirects,
+		UploadTTL:         time.Duration(cfg.UploadTTLSecs) * time.Second,
+		ThumbnailSizes:    cfg.ThumbnailSizes,
+		ImageConcurrency:  cfg.ImageConcurrency,
+	})
+	fileScanner, err := scanner.Open(scanner.Config{
+		Driver:        cfg.ScannerDriver,
+		ClamAVAddress: cfg.ClamAVAddress,
+		ClamAVTimeout: time.Duration(cfg.ClamAVTimeoutSecs) * time.Second,
+		ClamAVMaxSize: int64(cfg.ClamAVMaxBytes),
+	})
+	if err != nil {
+		utils.LogError("Failed to open malware scanner", err)
+		log.Fatalf("Failed to open malware scanner: %v", err)
+	}
+	if maxSize := fileService.MaxUploadSize(); cfg.ScannerDriver == "clamav" && (maxSize == 0 || maxSize > int64(cfg.ClamAVMaxBytes)) {
+		utils.LogWarn("Uploads may be larger than clamd scans; such files stay unscannable and can not be downloaded",
+			zap.Int64("max_upload_bytes", maxSize), zap.Int("clamav_max_bytes", cfg.ClamAVMaxBytes))
+	}
+	fileService.SetScanner(fileScanner)
+	messageService.SetAttachmentChecker(&fileService)
+	websocketConfig := websocket.DefaultConfig()
+	websocketConfig.MaxMessageSize = int64(cfg.WSMaxMessageBytes)
+	websocketConfig.SendQueueSize = cfg.WSSendQueueSize
+	websocketConfig.PongWait = time.Duration(cfg.WSPongWaitSecs) * time.Second
+	websocketConfig.PingPeriod = websocketConfig.PongWait * 9 / 10
+	websocketConfig.AllowedOrigins = cfg.WSAllowedOrigins
+	websocketConfig.ReplayLogSize = cfg.WSReplayLogSize
+	websocketConfig.ReplayRetention = time.Duration(cfg.WSReplaySecs) * time.Second
+	websocketConfig.TypingTimeout = time.Duration(cfg.TypingTimeoutSecs) * time.Second
+	websocketConfig.TypingThrottle = time.Duration(cfg.TypingThrottleMs) * time.Millisecond
+	websocketConfig.RouteTTL = time.Duration(cfg.RouteTTLSecs) * time.Second
+	websocketConfig.StreamKeepAlive = time.Duration(cfg.SSEKeepAliveSecs) * time.Second
+	websocketConfig.LongPollWait = time.Duration(cfg.LongPollWaitSecs) * time.Second
+	websocketService := websocket.NewWebSocketService(websocketConfig)
+	if cfg.BrokerDriver == "postgres" {
+		// Instances sharing the database deliver events to users connected to any of them
+		postgresBroker, err := broker.NewPostgresBroker(context.Background(), cfg.DatabaseURL)
+		if err != nil {
+			utils.LogError("Failed to start broker", err)
+			log.Fatalf("Failed to start broker: %v", err)
+		}
+		defer postgresBroker.Close()
+		websocketService.JoinCluster(cfg.NodeID, postgresBroker, relationalRepo)
+		go websocketService.RunRegistry(context.Background())
+		utils.LogInfo("Joined WebSocket cluster", zap.String("node_id", cfg.NodeID))
+	}
+	messageService.SetNotifier(websocketService)
+	fileService.SetNotifier(websocketService)
+	websocketService.SetMessageSender(messageService)
+	presenceService := presence.NewPresenceService(relationalRepo, relationalRepo, relationalRepo, presence.Config{
+		OfflineGrace: time.Duration(cfg.PresenceGraceSecs) * time.Second,
+	})
+	presenceService.SetNotifier(websocketService)
+	websocketService.SetPresenceTracker(presenceService)
+	callService := call.NewCallService(relationalRepo, relationalRepo, messageService, call.Config{
+		RingTimeout:      time.Duration(cfg.CallRingTimeoutSecs) * time.Second,
+		ReconnectGrace:   time.Duration(cfg.CallReconnectGraceSecs) * time.Second,
+		MaxGroupCallSize: cfg.GroupCallMaxSize,
+		ICE: call.ICEConfig{
+			STUNURLs:      cfg.STUNURLs,
+			TURNURLs:      cfg.TURNURLs,
+			TURNSecret:    cfg.TURNSecret,
+			CredentialTTL: time.Duration(cfg.TURNCredentialTTLSecs) * time.Second,
+		},
+	})
+	callService.SetNotifier(websocketService)
+	websocketService.SetCallSignaller(callService)
+
+	// Start background workers
+	expiryWorker := message.NewExpiryWorker(messageService, &fileService, time.Duration(cfg.ExpirySweepSecs)*time.Second, 100)
+	go expiryWorker.Run(context.Background())
+	scheduler := message.NewScheduler(messageService, time.Duration(cfg.SchedulerPollSecs)*time.Second, 100)
+	go scheduler.Run(context.Background())
+	uploadSweeper := file.NewUploadSweeper(&fileService, time.Duration(cfg.UploadSweepSecs)*time.Second, 100)
+	go uploadSweeper.Run(context.Background())
+	scanWorker := file.NewScanWorker(&fileService, time.Duration(cfg.ScanPollSecs)*time.Second, 20)
+	go scanWorker.Run(context.Background())
 
 	// Initialize authentication middleware
 	authMiddleware := middleware.NewAuthMiddleware(authService, cfg.JWTSecret)
@@ -66,14 +173,18 @@ func main() {
 	}
 
 	corsHandler := cors.New(cors.Options{
-		AllowedOrigins:   []string{"*"}, // Allow only your frontend
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Content-Type", "Authorization"},
+		AllowedOrigins: []string{"*"}, // Allow only your frontend
+		AllowedMethods: []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowedHeaders: []string{"Content-Type", "Authorization", "Last-Event-ID", "Range", "If-None-Match", "If-Range",
+			"Tus-Resumable", "Upload-Length", "Upload-Offset", "Upload-Metadata", "Upload-Checksum"},
+		ExposedHeaders: []string{"Content-Range", "Content-Disposition", "ETag", "Accept-Ranges", "Location",
+			"Tus-Resumable", "Tus-Version", "Tus-Extension", "Tus-Max-Size", "Tus-Checksum-Algorithm",
+			"Upload-Offset", "Upload-Length", "Upload-Expires", "X-File-ID", "X-File-URL"},
 		AllowCredentials: true, // if cookies or credentials are being used
 	})
 
 	// Start API server
-	server := api.NewServer(authService, messageService, fileService, websocketService, httpServer, nil)
+	server := api.NewServer(authService, messageService, fileService, websocketService, callService, httpServer, nil)
 	server.UseMiddleware(authMiddleware.Middleware)
 	// Use the CORS middleware
 	server.UseMiddleware(corsHandler.Handler)
@@ -0,0 +1,73 @@
+package model
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Call is a one-to-one voice or video call between two users.
+type Call struct {
+	ID         uuid.UUID  `gorm:"type:uuid;primaryKey" json:"id"`
+	CallerID   uuid.UUID  `gorm:"index;not null" json:"caller_id"`
+	CalleeID   uuid.UUID  `gorm:"index;not null" json:"callee_id"`
+	Media      string     `gorm:"default:'audio'" json:"media"`        // audio or video
+	Status     string     `gorm:"index;not null" json:"status"`        // See the CallStatus constants
+	EndReason  string     `json:"end_reason,omitempty"`                // Reason given by the party that rejected or ended the call
+	EndedBy    *uuid.UUID `gorm:"type:uuid" json:"ended_by,omitempty"` // Party that rejected or ended the call; nil when the server did
+	StartedAt  time.Time  `gorm:"index;not null" json:"started_at"`    // Time the caller placed the call
+	AnsweredAt *time.Time `json:"answered_at,omitempty"`               // Time the callee accepted the call
+	EndedAt    *time.Time `json:"ended_at,omitempty"`                  // Time the call reached its outcome
+	Duration   uint       `gorm:"default:0" json:"duration"`           // Seconds between answer and end
+	MessageID  uint       `json:"message_id,omitempty"`                // System message recording the call in the conversation
+	UpdatedAt  time.Time  `json:"updated_at"`
+}
+
+// Call statuses. Ringing and accepted calls are active; the others are outcomes.
+const (
+	CallStatusRinging  = "ringing"
+	CallStatusAccepted = "accepted"
+	CallStatusRejected = "rejected" // The callee declined the call
+	CallStatusMissed   = "missed"   // The callee did not answer before the caller hung up or the ring timeout
+	CallStatusBusy     = "busy"     // The callee was in another call
+	CallStatusEnded    = "ended"    // An accepted call was hung up
+)
+
+// Call media.
+const (
+	CallMediaAudio = "audio"
+	CallMediaVideo = "video"
+)
+
+// IsActive reports whether the call is still ringing or in progress.
+func (c *Call) IsActive() bool {
+	return c.Status == CallStatusRinging || c.Status == CallStatusAccepted
+}
+
+// Peer returns the other party of the call.
+func (c *Call) Peer(userID uuid.UUID) uuid.UUID {
+	if userID == c.CallerID {
+		return c.CalleeID
+	}
+	return c.CallerID
+}
+
+// HasParticipant reports whether a user is the caller or the callee.
+func (c *Call) HasParticipant(userID uuid.UUID) bool {
+	return userID == c.CallerID || userID == c.CalleeID
+}
+
+// ICEServer is an entry of the iceServers list of a WebRTC RTCConfiguration.
+type ICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// ICEServerConfig is the ICE server configuration handed to a call participant. TURN credentials
+// in it stop working at ExpiresAt.
+type ICEServerConfig struct {
+	ICEServers []ICEServer `json:"ice_servers"`
+	TTL        int         `json:"ttl"` // Seconds the credentials are valid for
+	ExpiresAt  time.Time   `json:"expires_at"`
+}
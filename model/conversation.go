@@ -0,0 +1,53 @@
+package model
+
+import (
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// ConversationTarget addresses a conversation: a direct chat with ReceiverID or a group chat with GroupID.
+type ConversationTarget struct {
+	ReceiverID uuid.UUID `json:"receiver_id,omitempty"`
+	GroupID    uint      `json:"group_id,omitempty"`
+}
+
+// IsGroup reports whether the target is a group conversation.
+func (t ConversationTarget) IsGroup() bool {
+	return t.GroupID != 0
+}
+
+// Valid reports whether exactly one of ReceiverID and GroupID is set.
+func (t ConversationTarget) Valid() bool {
+	return (t.ReceiverID != uuid.Nil) != (t.GroupID != 0)
+}
+
+// ConversationID returns the stable identifier of the conversation as seen by userID.
+func (t ConversationTarget) ConversationID(userID uuid.UUID) string {
+	if t.IsGroup() {
+		return GroupConversationID(t.GroupID)
+	}
+	return DirectConversationID(userID, t.ReceiverID)
+}
+
+// GroupConversationID returns the conversation identifier of a group chat.
+func GroupConversationID(groupID uint) string {
+	return fmt.Sprintf("group:%d", groupID)
+}
+
+// DirectConversationID returns the conversation identifier of a direct chat between two users.
+// The identifier is the same regardless of argument order.
+func DirectConversationID(a, b uuid.UUID) string {
+	if a.String() > b.String() {
+		a, b = b, a
+	}
+	return "direct:" + a.String() + ":" + b.String()
+}
+
+// ConversationID returns the identifier of the conversation the message belongs to.
+func (m *Message) ConversationID() string {
+	if m.GroupID != 0 {
+		return GroupConversationID(m.GroupID)
+	}
+	return DirectConversationID(m.SenderID, m.ReceiverID)
+}
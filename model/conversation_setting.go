@@ -0,0 +1,15 @@
+package model
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ConversationSetting holds the settings shared by all members of a conversation.
+type ConversationSetting struct {
+	ConversationID        string    `gorm:"primaryKey" json:"conversation_id"` // See Message.ConversationID
+	DisappearAfterSeconds uint      `json:"disappear_after_seconds"`           // Lifetime of new messages; 0 keeps messages forever
+	UpdatedBy             uuid.UUID `json:"updated_by"`
+	UpdatedAt             time.Time `json:"updated_at"`
+}
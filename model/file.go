@@ -1,9 +1,149 @@
 package model
 
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// File statuses. A file uploaded directly to storage is pending until the upload is completed.
+const (
+	FileStatusPending = "pending"
+	FileStatusReady   = "ready"
+)
+
+// Scan statuses. A new file is quarantined until a malware scan finds it clean; only clean files
+// can be downloaded. Files stored while no scanner was configured are clean. Files too large for the
+// scanner are unscannable.
+const (
+	ScanStatusQuarantined = "quarantined"
+	ScanStatusClean       = "clean"
+	ScanStatusInfected    = "infected"
+	ScanStatusUnscannable = "unscannable"
+)
+
 // File represents a file stored in the system.
 type File struct {
-	ID   uint   `json:"id" gorm:"primaryKey;autoIncrement"`
-	Name string `json:"name"`
-	URL  string `json:"url"`
-	Size int64  `json:"size"`
+	ID          uint            `json:"id" gorm:"primaryKey;autoIncrement"`
+	OwnerID     uuid.UUID       `gorm:"type:uuid;index;not null" json:"owner_id"` // User who uploaded the file
+	Name        string          `json:"name"`                                     // File name given by the uploader
+	Key         string          `gorm:"uniqueIndex;not null" json:"-"`            // Key of the object in the blob store
+	ContentType string          `json:"content_type"`
+	Size        int64           `json:"size"`
+	Checksum    string          `json:"checksum"` // Hex-encoded SHA-256 of the content
+	Status      string          `gorm:"not null;default:ready" json:"status"`
+	ScanStatus  string          `gorm:"not null;default:clean;index" json:"scan_status"`
+	Signature   string          `json:"signature,omitempty"`  // Malware found in an infected file
+	ScannedAt   *time.Time      `json:"scanned_at,omitempty"` // Time of the scan that cleared or condemned the file
+	Width       int             `json:"width,omitempty"`      // Dimensions of an image, upright
+	Height      int             `json:"height,omitempty"`
+	Blurhash    string          `json:"blurhash,omitempty"` // Placeholder shown while an image loads, see blurha.sh
+	Thumbnails  []FileThumbnail `gorm:"foreignKey:FileID" json:"thumbnails,omitempty"`
+	URL         string          `gorm:"-" json:"url"` // Download URL, to be used as the media URL of messages
+	CreatedAt   time.Time       `json:"created_at"`
+	AttachedAt  *time.Time      `json:"-"`                                       // Time the file was first attached to a message
+	Ephemeral   bool            `gorm:"not null;default:false" json:"ephemeral"` // Sent in a disappearing message before any other use, and deleted when it expires
+}
+
+// Scan job statuses.
+const (
+	ScanJobPending = "pending"
+	ScanJobRunning = "running"
+	ScanJobFailed  = "failed" // Given up after repeated errors; the file stays quarantined
+)
+
+// ScanJob queues the malware scan of a quarantined file. Jobs are claimed by scan workers and
+// removed once the file's verdict is recorded.
+type ScanJob struct {
+	ID        uint      `gorm:"primaryKey;autoIncrement" json:"id"`
+	FileID    uint      `gorm:"uniqueIndex;not null" json:"file_id"`
+	Status    string    `gorm:"not null;default:pending;index" json:"status"`
+	Attempts  uint      `json:"attempts"`
+	RunAt     time.Time `gorm:"index" json:"run_at"` // The job is not claimed before this, to back off after errors
+	ClaimedAt time.Time `json:"claimed_at"`
+	LastError string    `json:"last_error"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// FileScanEvent tells the uploader of a file the verdict of its malware scan.
+type FileScanEvent struct {
+	FileID     uint   `json:"file_id"`
+	Name       string `json:"name"`
+	URL        string `json:"url"`
+	ScanStatus string `json:"scan_status"` // clean, infected or unscannable
+	Signature  string `json:"signature,omitempty"`
+}
+
+// FileThumbnail is a downscaled copy of an image file, stored as an object of its own.
+type FileThumbnail struct {
+	ID          uint   `gorm:"primaryKey;autoIncrement" json:"-"`
+	FileID      uint   `gorm:"uniqueIndex:idx_file_thumbnail_size;not null" json:"-"`
+	Size        int    `gorm:"uniqueIndex:idx_file_thumbnail_size" json:"size"` // Edge of the square the thumbnail fits in, in pixels
+	Key         string `gorm:"not null" json:"-"`
+	ContentType string `json:"content_type"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	URL         string `gorm:"-" json:"url"`
+}
+
+// FileShare grants a user access to a file they do not own.
+type FileShare struct {
+	FileID    uint      `gorm:"primaryKey" json:"file_id"`
+	UserID    uuid.UUID `gorm:"type:uuid;primaryKey;index" json:"user_id"`
+	SharedBy  uuid.UUID `gorm:"type:uuid" json:"shared_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// UploadError describes why an upload was rejected, so that clients can show the reason.
+type UploadError struct {
+	Code         string `json:"code"` // Machine-readable reason, one of the UploadErr constants
+	Message      string `json:"message"`
+	MaxSize      int64  `json:"max_size,omitempty"`      // Size limit of the file's type, for file_too_large
+	DetectedType string `json:"detected_type,omitempty"` // Type detected from the content, once it was seen
+}
+
+// Upload rejection reasons.
+const (
+	UploadErrInvalid        = "invalid_upload"   // Name, size, type or checksum is missing or malformed
+	UploadErrTooLarge       = "file_too_large"   // The file exceeds the size limit of its type
+	UploadErrTypeNotAllowed = "type_not_allowed" // The file's type is not on the allowlist
+	UploadErrTypeMismatch   = "type_mismatch"    // The content does not match the file's extension
+)
+
+// UploadIntentRequest announces a file the client uploads directly to storage.
+type UploadIntentRequest struct {
+	Name        string `json:"name"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	Checksum    string `json:"checksum,omitempty"` // Hex-encoded SHA-256, checked when the upload completes
+}
+
+// UploadTarget is the signed request a client uploads a file's content with.
+type UploadTarget struct {
+	Method    string            `json:"method"`
+	URL       string            `json:"url"`
+	Headers   map[string]string `json:"headers"` // Headers the request must carry
+	ExpiresAt time.Time         `json:"expires_at"`
+}
+
+// UploadIntent is the pending file created for a direct upload and where to upload it.
+type UploadIntent struct {
+	File   *File        `json:"file"`
+	Upload UploadTarget `json:"upload"`
+}
+
+// Upload is a resumable upload following the tus protocol. Its content is stored as chunks until
+// the last one arrives; the chunks are then assembled into a File.
+type Upload struct {
+	ID          uuid.UUID `gorm:"type:uuid;primaryKey" json:"id"`
+	OwnerID     uuid.UUID `gorm:"type:uuid;index;not null" json:"owner_id"`
+	Name        string    `json:"name"`
+	ContentType string    `json:"content_type"`
+	Length      int64     `json:"length"`  // Size of the complete file
+	Offset      int64     `json:"offset"`  // Bytes received so far
+	FileID      uint      `json:"file_id"` // File assembled from the upload; 0 until it is complete
+	FileURL     string    `gorm:"-" json:"file_url,omitempty"`
+	ExpiresAt   time.Time `gorm:"index" json:"expires_at"` // Incomplete uploads are discarded after this
+	CreatedAt   time.Time `json:"created_at"`
 }
@@ -0,0 +1,23 @@
+package model
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Group represents a group conversation.
+type Group struct {
+	ID        uint      `json:"id" gorm:"primaryKey;autoIncrement"`
+	Name      string    `gorm:"not null" json:"name"`
+	CreatedBy uuid.UUID `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// GroupMember links a user to a group conversation.
+type GroupMember struct {
+	GroupID  uint      `gorm:"primaryKey" json:"group_id"`
+	UserID   uuid.UUID `gorm:"primaryKey" json:"user_id"`
+	Role     string    `gorm:"default:'member'" json:"role"` // member, admin
+	JoinedAt time.Time `json:"joined_at"`
+}
@@ -0,0 +1,60 @@
+package model
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// GroupCall is a voice or video call in a group conversation. Participants connect to each other in
+// a mesh, so a call holds a limited number of participants.
+type GroupCall struct {
+	ID           uuid.UUID              `gorm:"type:uuid;primaryKey" json:"id"`
+	GroupID      uint                   `gorm:"not null;uniqueIndex:idx_group_calls_active,where:status = 'active'" json:"group_id"`
+	HostID       uuid.UUID              `gorm:"not null" json:"host_id"` // Participant allowed to mute and remove others; passed on when they leave
+	Media        string                 `gorm:"default:'audio'" json:"media"`
+	Status       string                 `gorm:"index;not null" json:"status"` // active, ended
+	StartedAt    time.Time              `gorm:"not null" json:"started_at"`
+	EndedAt      *time.Time             `json:"ended_at,omitempty"`
+	Duration     uint                   `gorm:"default:0" json:"duration"`             // Seconds between start and end
+	MessageID    uint                   `json:"message_id,omitempty"`                  // System message recording the call in the group
+	Participants []GroupCallParticipant `gorm:"foreignKey:CallID" json:"participants"` // Roster of the participants currently in the call
+	UpdatedAt    time.Time              `json:"updated_at"`
+}
+
+// GroupCallParticipant is a user taking part in a group call.
+type GroupCallParticipant struct {
+	CallID    uuid.UUID  `gorm:"type:uuid;primaryKey" json:"-"`
+	UserID    uuid.UUID  `gorm:"type:uuid;primaryKey;index" json:"user_id"`
+	JoinedAt  time.Time  `gorm:"not null" json:"joined_at"`
+	LeftAt    *time.Time `json:"-"` // Set when the participant leaves; cleared when they join again
+	Muted     bool       `gorm:"default:false" json:"muted"`
+	CameraOff bool       `gorm:"default:false" json:"camera_off"`
+}
+
+// Group call statuses.
+const (
+	GroupCallStatusActive = "active"
+	GroupCallStatusEnded  = "ended"
+)
+
+// Group call events, sent as the Event of a GroupCallEvent.
+const (
+	GroupCallStarted = "started" // The first participant started the call
+	GroupCallJoined  = "joined"
+	GroupCallLeft    = "left"
+	GroupCallMedia   = "media"   // A participant changed their mute or camera state
+	GroupCallMuted   = "muted"   // The host muted a participant
+	GroupCallRemoved = "removed" // The host removed a participant
+	GroupCallEnded   = "ended"   // The last participant left
+)
+
+// HasParticipant reports whether a user is in the roster of the call.
+func (c *GroupCall) HasParticipant(userID uuid.UUID) bool {
+	for _, participant := range c.Participants {
+		if participant.UserID == userID {
+			return true
+		}
+	}
+	return false
+}
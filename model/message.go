@@ -17,18 +17,22 @@ type Message struct {
 	Status     string    `json:"status"`                               // sent, delivered, read, failed
 	CreatedAt  time.Time `json:"created_at"`
 	// Payload           interface{}            `json:"payload,omitempty"`      // Used for WebRTC offers, answers, and ICE candidates
-	IsEncrypted      bool      `json:"is_encrypted,omitempty"` // Whether the message content is encrypted (for security)
-	EncryptionStatus string    `json:"encryption_status,omitempty"`
-	MediaThumbnail   string    `json:"media_thumbnail,omitempty"` // URL to the thumbnail of media (if available)
-	MediaURL         string    `json:"media_url,omitempty"`
-	MediaType        string    `json:"media_type,omitempty"`
-	MediaSize        int64     `json:"media_size,omitempty"`
-	MediaDuration    uint      `json:"media_duration,omitempty"`
-	ReplyToID        uuid.UUID `json:"reply_to_id,omitempty"`
+	IsEncrypted      bool            `json:"is_encrypted,omitempty"` // Whether the message content is encrypted (for security)
+	EncryptionStatus string          `json:"encryption_status,omitempty"`
+	MediaThumbnail   string          `json:"media_thumbnail,omitempty"`        // URL to the thumbnail of media (if available)
+	MediaURL         string          `gorm:"index" json:"media_url,omitempty"` // File URL returned by the upload endpoint, or an external URL
+	MediaType        string          `json:"media_type,omitempty"`
+	MediaSize        int64           `json:"media_size,omitempty"`
+	MediaDuration    uint            `json:"media_duration,omitempty"`
+	MediaWidth       int             `json:"media_width,omitempty"`
+	MediaHeight      int             `json:"media_height,omitempty"`
+	MediaBlurhash    string          `json:"media_blurhash,omitempty"`
+	MediaThumbnails  []FileThumbnail `gorm:"serializer:json;type:jsonb" json:"media_thumbnails,omitempty"` // Thumbnails of an attached image, smallest first
+	ReplyToID        uuid.UUID       `json:"reply_to_id,omitempty"`
 	// ReadBy            []uint                 `json:"read_by,omitempty"`
-	IsStarred       bool    `json:"is_starred,omitempty"`
-	IsReadReceipt   bool    `json:"is_read_receipt,omitempty"`   // Whether the receiver has seen the message (for tracking read status)
-	IsSystemMessage bool    `json:"is_system_message,omitempty"` // True if the message is a system message (e.g., notifications, alerts)
+	IsStarred       bool    `gorm:"-" json:"is_starred,omitempty"` // Starred by the requesting user, see MessageStar
+	IsReadReceipt   bool    `json:"is_read_receipt,omitempty"`     // Whether the receiver has seen the message (for tracking read status)
+	IsSystemMessage bool    `json:"is_system_message,omitempty"`   // True if the message is a system message (e.g., notifications, alerts)
 	LocationLat     float64 `json:"location_lat,omitempty"`
 	LocationLng     float64 `json:"location_lng,omitempty"`
 	// Tags              []string               `json:"tags,omitempty"`
@@ -37,15 +41,16 @@ type Message struct {
 	EditedAt        time.Time `json:"edited_at,omitempty"`
 	ForwardedFromID uint      `json:"forwarded_from_id,omitempty"`
 	IsForwarded     bool      `json:"is_forwarded,omitempty"`
+	ForwardDepth    uint      `json:"forward_depth,omitempty"` // Number of forward hops from the original message
 	DeliveredAt     time.Time `json:"delivered_at,omitempty"`
-	ExpiresAt       time.Time `json:"expires_at,omitempty"`
-	AutoDelete      bool      `json:"auto_delete,omitempty"`
+	ExpiresAt       time.Time `gorm:"index" json:"expires_at,omitempty"` // Time after which an auto-delete message is removed
+	AutoDelete      bool      `json:"auto_delete,omitempty"`             // Whether the message disappears at ExpiresAt
 	Priority        string    `json:"priority,omitempty"`
 	GroupID         uint      `json:"group_id,omitempty"`
 	// TranslatedContent map[string]string      `json:"translated_content,omitempty"`
 	// CustomAttributes  map[string]interface{} `json:"custom_attributes,omitempty"`
 	GlobalMessageID string `json:"global_message_id,omitempty"`
-	IsPinned        bool   `json:"is_pinned,omitempty"`
+	IsPinned        bool   `gorm:"-" json:"is_pinned,omitempty"` // Pinned in the conversation, see MessagePin
 	ForwardCount    uint   `json:"forward_count,omitempty"`
 	DisplayStatus   string `json:"display_status,omitempty"`
 	// CustomTags        []string               `json:"custom_tags,omitempty"`
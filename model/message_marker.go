@@ -0,0 +1,22 @@
+package model
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// MessageStar records that a user starred a message for themselves.
+type MessageStar struct {
+	UserID    uuid.UUID `gorm:"primaryKey" json:"user_id"`
+	MessageID uint      `gorm:"primaryKey;index" json:"message_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// MessagePin records that a message is pinned in a conversation for all of its members.
+type MessagePin struct {
+	ConversationID string    `gorm:"primaryKey" json:"conversation_id"` // See Message.ConversationID
+	MessageID      uint      `gorm:"primaryKey;index" json:"message_id"`
+	PinnedBy       uuid.UUID `json:"pinned_by"`
+	PinnedAt       time.Time `json:"pinned_at"`
+}
@@ -0,0 +1,38 @@
+package model
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// MessageSearchFilter narrows a full-text message search.
+type MessageSearchFilter struct {
+	Query        string    // Free-text query in web search syntax
+	Language     string    // Language used to parse the query (e.g., "en", "fr")
+	SenderID     uuid.UUID // Only messages sent by this user
+	Conversation *ConversationTarget
+	From         time.Time // Only messages created at or after this time
+	To           time.Time // Only messages created before this time
+	MediaType    string    // Only messages with this media type
+	Before       *MessageSearchCursor
+	Limit        int
+}
+
+// MessageSearchCursor is the position after which the next page of search results starts.
+type MessageSearchCursor struct {
+	CreatedAt time.Time
+	ID        uint
+}
+
+// MessageSearchResult is a message matching a search together with a highlighted snippet.
+type MessageSearchResult struct {
+	Message Message `json:"message"`
+	Snippet string  `json:"snippet"` // HTML-escaped matching text with hits wrapped in <mark></mark>
+}
+
+// MessageSearchPage is one page of search results.
+type MessageSearchPage struct {
+	Results    []MessageSearchResult `json:"results"`
+	NextCursor string                `json:"next_cursor,omitempty"`
+}
@@ -0,0 +1,41 @@
+package model
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ScheduledMessage is a message written ahead of time and sent at SendAt.
+type ScheduledMessage struct {
+	ID             uint      `json:"id" gorm:"primaryKey;autoIncrement"`
+	SenderID       uuid.UUID `gorm:"index;not null" json:"sender_id"`
+	ReceiverID     uuid.UUID `json:"receiver_id,omitempty"`
+	GroupID        uint      `json:"group_id,omitempty"`
+	Content        string    `json:"content"`
+	Type           string    `gorm:"default:'text'" json:"type,omitempty"`
+	MediaURL       string    `json:"media_url,omitempty"`
+	MediaType      string    `json:"media_type,omitempty"`
+	MediaSize      int64     `json:"media_size,omitempty"`
+	MediaThumbnail string    `json:"media_thumbnail,omitempty"`
+	IsReminder     bool      `gorm:"default:false" json:"is_reminder"`    // Reminders are delivered to the sender only
+	SendAt         time.Time `gorm:"index;not null" json:"send_at"`       // Time the message is due, stored in UTC
+	TimeZone       string    `gorm:"default:'UTC'" json:"time_zone"`      // IANA time zone the send time was written in
+	Status         string    `gorm:"default:'pending'" json:"status"`     // pending, sending, sent, cancelled, failed
+	MessageID      uint      `json:"message_id,omitempty"`                // Message created when the scheduled message was sent
+	Attempts       uint      `gorm:"default:0" json:"attempts,omitempty"` // Number of delivery attempts
+	LastError      string    `json:"last_error,omitempty"`
+	RetryAt        time.Time `json:"-"` // The message is not sent again before this, to back off after errors
+	ClaimedAt      time.Time `json:"-"` // Time a scheduler instance started sending the message
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// Scheduled message statuses.
+const (
+	ScheduledStatusPending   = "pending"
+	ScheduledStatusSending   = "sending"
+	ScheduledStatusSent      = "sent"
+	ScheduledStatusCancelled = "cancelled"
+	ScheduledStatusFailed    = "failed"
+)
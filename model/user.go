@@ -40,7 +40,8 @@ type User struct {
 	TwitterID  string `json:"twitter_id,omitempty"`  // Twitter social login ID (if applicable)
 
 	// Timestamps
-	LastLoginAt time.Time `json:"last_login_at,omitempty"` // Timestamp for the last login
-	LastLoginIP string    `json:"last_login_ip,omitempty"` // IP address from the last login
+	LastLoginAt time.Time  `json:"last_login_at,omitempty"` // Timestamp for the last login
+	LastLoginIP string     `json:"last_login_ip,omitempty"` // IP address from the last login
+	LastSeenAt  *time.Time `json:"-"`                       // Last time the user was online; exposed through presence, subject to UserPreference.HideLastSeen
 
 }
@@ -15,6 +15,8 @@ type UserPreference struct {
 	Is2FAEnabled       bool      `gorm:"default:false" json:"is_2fa_enabled"`     // Whether 2FA is enabled for the user
 	TwoFAMethod        string    `gorm:"" json:"two_fa_method,omitempty"`         // The method of 2FA (e.g., "TOTP", "SMS")
 	IsDarkMode         bool      `gorm:"default:false" json:"is_dark_mode"`       // Dark mode preference
+	TimeZone           string    `gorm:"default:'UTC'" json:"time_zone"`          // IANA time zone (e.g., 'Europe/Berlin') used for local times
+	HideLastSeen       bool      `gorm:"default:false" json:"hide_last_seen"`     // Whether other users may see when the user was last online
 
 	// Miscellaneous Preferences
 	// CustomPreferences map[string]interface{} `gorm:"" json:"custom_preferences,omitempty"` // A JSON field to store any other custom preferences (e.g., app-specific)
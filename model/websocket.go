@@ -1,13 +1,168 @@
 package model
 
-import "github.com/google/uuid"
-
-type WebSocketMessage struct {
-	Type       string      `json:"type"` // message, call, ice-candidate, ack
-	ID         uint        `json:"id" gorm:"primaryKey;autoIncrement"`
-	SenderID   uuid.UUID   `json:"sender_id"`
-	ReceiverID uuid.UUID   `json:"receiver_id"`
-	Content    string      `json:"content"`
-	Status     string      `json:"status"`  // sent, delivered, read
-	Payload    interface{} `json:"payload"` // Used for WebRTC offers, answers, and ICE candidates
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Envelope is a frame of the versioned WebSocket protocol. Every frame in either direction is an
+// envelope; the payload type depends on Op. See service/websocket/protocol.schema.json.
+type Envelope struct {
+	V       int             `json:"v"`                 // Protocol version negotiated at connect
+	Op      string          `json:"op"`                // Operation, one of the Op constants
+	ID      string          `json:"id,omitempty"`      // Request ID chosen by the client; the reply carries the same ID
+	Seq     uint64          `json:"seq,omitempty"`     // Per-user sequence number of a server event, see HelloPayload.StreamID
+	Payload json.RawMessage `json:"payload,omitempty"` // Operation-specific payload
+	Error   *EnvelopeError  `json:"error,omitempty"`   // Set on replies to requests that failed
+}
+
+// EnvelopeError describes why a request failed.
+type EnvelopeError struct {
+	Code    string `json:"code"` // Machine-readable error code, one of the ErrCode constants
+	Message string `json:"message"`
+}
+
+// WebSocket protocol operations.
+const (
+	OpHello               = "hello"                // Server greeting sent after connecting
+	OpResync              = "resync"               // Missed events can not be replayed; reload state over REST
+	OpError               = "error"                // Reply to a request that failed
+	OpAck                 = "ack"                  // Reply to a request that succeeded
+	OpMessage             = "message"              // A chat message delivered to the client
+	OpMessageSend         = "message.send"         // Send a chat message
+	OpTyping              = "typing"               // Typing indicator
+	OpPresence            = "presence"             // Presence of a user, or the idle/away state of the sending device
+	OpPresenceSubscribe   = "presence.subscribe"   // Subscribe to the presence of contacts or group members
+	OpPresenceUnsubscribe = "presence.unsubscribe" // Stop receiving presence of users
+	OpCallOffer           = "call.offer"           // WebRTC offer starting a call
+	OpCallAnswer          = "call.answer"          // WebRTC answer accepting a call
+	OpCallICE             = "call.ice"             // WebRTC ICE candidate
+	OpCallReject          = "call.reject"          // Callee declines a call
+	OpCallEnd             = "call.end"             // Either side ends a call
+	OpCallState           = "call.state"           // A call changed state; the payload is the Call
+	OpGroupCallJoin       = "group_call.join"      // Join the call of a group, starting it if there is none
+	OpGroupCallLeave      = "group_call.leave"     // Leave a group call
+	OpGroupCallSignal     = "group_call.signal"    // WebRTC offer, answer or ICE candidate for another participant
+	OpGroupCallMedia      = "group_call.media"     // Change the sender's mute or camera state
+	OpGroupCallMute       = "group_call.mute"      // Host mutes a participant
+	OpGroupCallRemove     = "group_call.remove"    // Host removes a participant
+	OpGroupCallState      = "group_call.state"     // A group call changed; sent to every group member
+)
+
+// WebSocket protocol error codes.
+const (
+	ErrCodeBadRequest  = "bad_request" // The envelope or its payload is malformed
+	ErrCodeUnknownOp   = "unknown_op"  // The operation is not supported by the negotiated version
+	ErrCodeForbidden   = "forbidden"   // The user may not perform the operation
+	ErrCodeNotFound    = "not_found"   // A referenced resource does not exist
+	ErrCodeUnavailable = "unavailable" // The peer of the operation is not connected
+	ErrCodeInternal    = "internal"    // The server failed to process the request
+)
+
+// HelloPayload is the payload of OpHello.
+type HelloPayload struct {
+	Version      int       `json:"version"`
+	ConnectionID string    `json:"connection_id"`
+	DeviceID     string    `json:"device_id"`
+	UserID       uuid.UUID `json:"user_id"`
+	PingInterval int       `json:"ping_interval"` // Seconds between server pings
+	StreamID     string    `json:"stream_id"`     // Stream the event sequence numbers belong to; changes when the server restarts
+	Seq          uint64    `json:"seq"`           // Sequence number of the user's last event at connect
+}
+
+// ResyncPayload is the payload of OpResync.
+type ResyncPayload struct {
+	Reason string `json:"reason"` // unknown_stream, gap_too_old
+	Seq    uint64 `json:"seq"`    // Sequence number to resume from after reloading
+}
+
+// EventBatch is the reply to a long-poll request for events.
+type EventBatch struct {
+	LastEventID string            `json:"last_event_id"` // Pass back as Last-Event-ID on the next poll
+	Events      []json.RawMessage `json:"events"`        // Server event envelopes in delivery order
+}
+
+// AckPayload is the payload of OpAck replying to OpMessageSend.
+type AckPayload struct {
+	MessageID uint   `json:"message_id,omitempty"`
+	Status    string `json:"status"` // sent, delivered, read
+}
+
+// TypingPayload is the payload of OpTyping.
+type TypingPayload struct {
+	ConversationTarget
+	ConversationID string    `json:"conversation_id,omitempty"` // Set by the server on delivery, see Message.ConversationID
+	UserID         uuid.UUID `json:"user_id,omitempty"`         // Set by the server on delivery
+	State          string    `json:"state"`                     // start, stop
+}
+
+// Presence statuses.
+const (
+	PresenceOnline  = "online"
+	PresenceAway    = "away"
+	PresenceOffline = "offline"
+)
+
+// PresencePayload is the payload of OpPresence. A client sends only the status of its own device.
+type PresencePayload struct {
+	UserID   uuid.UUID  `json:"user_id,omitempty"`
+	Status   string     `json:"status"`              // online, away, offline
+	LastSeen *time.Time `json:"last_seen,omitempty"` // Omitted while online and when hidden by the user
+}
+
+// PresenceSubscribePayload is the payload of OpPresenceSubscribe and OpPresenceUnsubscribe.
+type PresenceSubscribePayload struct {
+	UserIDs []uuid.UUID `json:"user_ids,omitempty"` // Contacts of the subscriber
+	GroupID uint        `json:"group_id,omitempty"` // Every member of a group the subscriber belongs to
+}
+
+// PresenceListPayload is the ack payload of OpPresenceSubscribe with the current presence of the
+// users subscribed to.
+type PresenceListPayload struct {
+	Presences []PresencePayload `json:"presences"`
+}
+
+// SessionDescription is a WebRTC session description (SDP offer or answer).
+type SessionDescription struct {
+	Type string `json:"type"` // offer, answer
+	SDP  string `json:"sdp"`
+}
+
+// ICECandidate is a WebRTC ICE candidate.
+type ICECandidate struct {
+	Candidate        string  `json:"candidate"`
+	SDPMid           *string `json:"sdpMid,omitempty"`
+	SDPMLineIndex    *uint16 `json:"sdpMLineIndex,omitempty"`
+	UsernameFragment *string `json:"usernameFragment,omitempty"`
+}
+
+// CallSignalPayload is the payload of the call signalling operations.
+type CallSignalPayload struct {
+	CallID      string              `json:"call_id,omitempty"`     // Assigned by the server on call.offer; required by every other operation
+	ReceiverID  uuid.UUID           `json:"receiver_id,omitempty"` // Callee of call.offer; set by the server on delivery of the others
+	SenderID    uuid.UUID           `json:"sender_id,omitempty"`   // Set by the server on delivery
+	Description *SessionDescription `json:"description,omitempty"` // Set for call.offer and call.answer
+	Candidate   *ICECandidate       `json:"candidate,omitempty"`   // Set for call.ice
+	Media       string              `json:"media,omitempty"`       // audio, video
+	Reason      string              `json:"reason,omitempty"`      // Set for call.reject and call.end
+	ICEServers  []ICEServer         `json:"ice_servers,omitempty"` // Set by the server on delivery of call.offer, for the callee
+}
+
+// GroupCallPayload is the payload of the group call operations sent by a client.
+type GroupCallPayload struct {
+	CallID    string    `json:"call_id,omitempty"`    // Required by every operation but group_call.join
+	GroupID   uint      `json:"group_id,omitempty"`   // Group of group_call.join
+	Media     string    `json:"media,omitempty"`      // audio or video; used when group_call.join starts the call
+	UserID    uuid.UUID `json:"user_id,omitempty"`    // Participant of group_call.mute and group_call.remove
+	Muted     *bool     `json:"muted,omitempty"`      // New mute state of group_call.media
+	CameraOff *bool     `json:"camera_off,omitempty"` // New camera state of group_call.media
+}
+
+// GroupCallEvent is the payload of OpGroupCallState.
+type GroupCallEvent struct {
+	Event  string     `json:"event"`             // One of the GroupCall event constants
+	UserID uuid.UUID  `json:"user_id,omitempty"` // Participant the event is about
+	Call   *GroupCall `json:"call"`              // Call with its current roster
 }
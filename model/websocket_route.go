@@ -0,0 +1,15 @@
+package model
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// WebSocketRoute records that a service instance holds a WebSocket session of a user, so that
+// other instances know where to route the user's events.
+type WebSocketRoute struct {
+	NodeID    string    `gorm:"primaryKey" json:"node_id"`
+	UserID    uuid.UUID `gorm:"primaryKey;index" json:"user_id"`
+	ExpiresAt time.Time `gorm:"index" json:"expires_at"` // Extended by the node's heartbeat; a crashed node's routes lapse
+}
@@ -0,0 +1,18 @@
+package model
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// WebSocketTicket is a short-lived, single-use ticket that authenticates one WebSocket upgrade.
+// Browsers can not set an Authorization header on a WebSocket, so they fetch a ticket over REST
+// and pass it in the connection URL instead.
+type WebSocketTicket struct {
+	TicketHash       string    `gorm:"primaryKey" json:"-"` // SHA-256 of the ticket; the ticket itself is never stored
+	UserID           uuid.UUID `gorm:"not null" json:"user_id"`
+	ExpiresAt        time.Time `gorm:"index;not null" json:"expires_at"`   // Time after which the ticket can no longer be redeemed
+	SessionExpiresAt time.Time `gorm:"not null" json:"session_expires_at"` // Expiry of the access token the ticket was issued for
+	CreatedAt        time.Time `json:"created_at"`
+}
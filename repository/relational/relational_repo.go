@@ -3,8 +3,12 @@ package relational
 import (
 	"adwise-service/database"
 	"adwise-service/model"
+	"adwise-service/repository"
+	"errors"
+	"time"
 
 	"github.com/google/uuid"
+	"gorm.io/gorm"
 )
 
 // RelationalRepo implements the UserRepository interface for relational databases.
@@ -42,6 +46,20 @@ func (r *RelationalRepo) FindUserByID(userID uuid.UUID) (*model.User, error) {
 	return r.db.FindUserByID(userID)
 }
 
+// CreateWebSocketTicket saves a WebSocket ticket.
+func (r *RelationalRepo) CreateWebSocketTicket(ticket *model.WebSocketTicket) error {
+	return r.db.CreateWebSocketTicket(ticket)
+}
+
+// ConsumeWebSocketTicket redeems a WebSocket ticket.
+func (r *RelationalRepo) ConsumeWebSocketTicket(ticketHash string, now time.Time) (*model.WebSocketTicket, error) {
+	ticket, err := r.db.ConsumeWebSocketTicket(ticketHash, now)
+	if err != nil {
+		return nil, translateError(err)
+	}
+	return ticket, nil
+}
+
 // CreateMessage saves a new message to the database.
 func (r *RelationalRepo) CreateMessage(message *model.Message) error {
 	return r.db.CreateMessage(message)
@@ -62,7 +80,7 @@ func (r *RelationalRepo) FindMessageByID(messageID uint) (*model.Message, error)
 	// var message model.Message
 	message, err := r.db.FindMessageByID(messageID)
 	if err != nil {
-		return nil, err
+		return nil, translateError(err)
 	}
 	return message, nil
 }
@@ -71,3 +89,371 @@ func (r *RelationalRepo) FindMessageByID(messageID uint) (*model.Message, error)
 func (r *RelationalRepo) DeleteMessage(messageID uint) error {
 	return r.db.DeleteMessage(messageID)
 }
+
+// CreateForwardedMessages saves the forwarded copies of a message and updates its forward count.
+func (r *RelationalRepo) CreateForwardedMessages(originalID uint, copies []model.Message) error {
+	return r.db.CreateForwardedMessages(originalID, copies)
+}
+
+// CreateMessageStar stars a message for a user.
+func (r *RelationalRepo) CreateMessageStar(star *model.MessageStar) error {
+	return r.db.CreateMessageStar(star)
+}
+
+// DeleteMessageStar removes a user's star from a message.
+func (r *RelationalRepo) DeleteMessageStar(userID uuid.UUID, messageID uint) error {
+	return r.db.DeleteMessageStar(userID, messageID)
+}
+
+// FindStarredMessages retrieves the messages a user has starred.
+func (r *RelationalRepo) FindStarredMessages(userID uuid.UUID, limit int) ([]model.Message, error) {
+	return r.db.FindStarredMessages(userID, limit)
+}
+
+// CreateMessagePin pins a message in a conversation holding fewer than maxPins pins.
+func (r *RelationalRepo) CreateMessagePin(pin *model.MessagePin, maxPins int) (bool, error) {
+	pinned, err := r.db.CreateMessagePin(pin, maxPins)
+	if err != nil {
+		return false, translateError(err)
+	}
+	return pinned, nil
+}
+
+// DeleteMessagePin unpins a message from a conversation.
+func (r *RelationalRepo) DeleteMessagePin(conversationID string, messageID uint) (bool, error) {
+	return r.db.DeleteMessagePin(conversationID, messageID)
+}
+
+// FindPinnedMessages retrieves the messages pinned in a conversation.
+func (r *RelationalRepo) FindPinnedMessages(conversationID string) ([]model.Message, error) {
+	return r.db.FindPinnedMessages(conversationID)
+}
+
+// SearchMessages runs a full-text search over the messages visible to a user.
+func (r *RelationalRepo) SearchMessages(userID uuid.UUID, filter model.MessageSearchFilter) ([]model.MessageSearchResult, error) {
+	return r.db.SearchMessages(userID, filter)
+}
+
+// DeleteExpiredMessages hard-deletes a batch of expired auto-delete messages.
+func (r *RelationalRepo) DeleteExpiredMessages(before time.Time, limit int) ([]model.Message, []string, error) {
+	return r.db.DeleteExpiredMessages(before, limit)
+}
+
+// FindConversationSetting finds the settings of a conversation.
+func (r *RelationalRepo) FindConversationSetting(conversationID string) (*model.ConversationSetting, error) {
+	return r.db.FindConversationSetting(conversationID)
+}
+
+// SaveConversationSetting creates or replaces the settings of a conversation.
+func (r *RelationalRepo) SaveConversationSetting(setting *model.ConversationSetting) error {
+	return r.db.SaveConversationSetting(setting)
+}
+
+// CreateScheduledMessage saves a new scheduled message.
+func (r *RelationalRepo) CreateScheduledMessage(scheduled *model.ScheduledMessage) error {
+	return r.db.CreateScheduledMessage(scheduled)
+}
+
+// FindScheduledMessageByID retrieves a scheduled message by its ID.
+func (r *RelationalRepo) FindScheduledMessageByID(id uint) (*model.ScheduledMessage, error) {
+	scheduled, err := r.db.FindScheduledMessageByID(id)
+	if err != nil {
+		return nil, translateError(err)
+	}
+	return scheduled, nil
+}
+
+// FindScheduledMessagesBySender retrieves the scheduled messages of a sender.
+func (r *RelationalRepo) FindScheduledMessagesBySender(senderID uuid.UUID, statuses []string) ([]model.ScheduledMessage, error) {
+	return r.db.FindScheduledMessagesBySender(senderID, statuses)
+}
+
+// UpdatePendingScheduledMessage replaces a scheduled message as long as it is still pending.
+func (r *RelationalRepo) UpdatePendingScheduledMessage(scheduled *model.ScheduledMessage) (bool, error) {
+	return r.db.UpdatePendingScheduledMessage(scheduled)
+}
+
+// UpdateScheduledMessageStatus records a failed attempt to send a scheduled message.
+func (r *RelationalRepo) UpdateScheduledMessageStatus(scheduled *model.ScheduledMessage) error {
+	return r.db.UpdateScheduledMessageStatus(scheduled)
+}
+
+// SendScheduledMessage saves the message sent for a scheduled message and marks it as sent.
+func (r *RelationalRepo) SendScheduledMessage(scheduled *model.ScheduledMessage, message *model.Message) (bool, error) {
+	return r.db.SendScheduledMessage(scheduled, message)
+}
+
+// ClaimDueScheduledMessages claims scheduled messages that are due for sending.
+func (r *RelationalRepo) ClaimDueScheduledMessages(now, staleBefore time.Time, limit int) ([]model.ScheduledMessage, error) {
+	return r.db.ClaimDueScheduledMessages(now, staleBefore, limit)
+}
+
+// FindUserPreference finds a user's preferences.
+func (r *RelationalRepo) FindUserPreference(userID uuid.UUID) (*model.UserPreference, error) {
+	return r.db.FindUserPreference(userID)
+}
+
+// FindGroupMemberIDs retrieves the user IDs of a group's members.
+func (r *RelationalRepo) FindGroupMemberIDs(groupID uint) ([]uuid.UUID, error) {
+	return r.db.FindGroupMemberIDs(groupID)
+}
+
+// IsGroupMember reports whether a user is a member of a group.
+func (r *RelationalRepo) IsGroupMember(groupID uint, userID uuid.UUID) (bool, error) {
+	return r.db.IsGroupMember(groupID, userID)
+}
+
+// UpdateLastSeen records the time a user was last seen online.
+func (r *RelationalRepo) UpdateLastSeen(userID uuid.UUID, at time.Time) error {
+	return r.db.UpdateLastSeen(userID, at)
+}
+
+// FindLastSeen retrieves the last seen times of users.
+func (r *RelationalRepo) FindLastSeen(userIDs []uuid.UUID) (map[uuid.UUID]time.Time, error) {
+	return r.db.FindLastSeen(userIDs)
+}
+
+// FindHiddenLastSeen returns the users whose preferences hide their last seen time.
+func (r *RelationalRepo) FindHiddenLastSeen(userIDs []uuid.UUID) ([]uuid.UUID, error) {
+	return r.db.FindHiddenLastSeen(userIDs)
+}
+
+// FilterContacts returns the users among candidates that are contacts of a user.
+func (r *RelationalRepo) FilterContacts(userID uuid.UUID, candidates []uuid.UUID) ([]uuid.UUID, error) {
+	return r.db.FilterContacts(userID, candidates)
+}
+
+// RegisterUserNode records that a node holds a session of a user.
+func (r *RelationalRepo) RegisterUserNode(nodeID string, userID uuid.UUID, expiresAt time.Time) error {
+	return r.db.RegisterUserNode(nodeID, userID, expiresAt)
+}
+
+// UnregisterUserNode removes the route of a user's session on a node.
+func (r *RelationalRepo) UnregisterUserNode(nodeID string, userID uuid.UUID) error {
+	return r.db.UnregisterUserNode(nodeID, userID)
+}
+
+// RefreshNode extends every route of a node.
+func (r *RelationalRepo) RefreshNode(nodeID string, now, expiresAt time.Time) error {
+	return r.db.RefreshNode(nodeID, now, expiresAt)
+}
+
+// UnregisterNode removes every route of a node.
+func (r *RelationalRepo) UnregisterNode(nodeID string) error {
+	return r.db.UnregisterNode(nodeID)
+}
+
+// FindRoutesOfOtherNodes returns the live routes of every node other than nodeID.
+func (r *RelationalRepo) FindRoutesOfOtherNodes(nodeID string, now time.Time) ([]model.WebSocketRoute, error) {
+	return r.db.FindRoutesOfOtherNodes(nodeID, now)
+}
+
+// PlaceCall saves a new call unless the caller is in an active call already.
+func (r *RelationalRepo) PlaceCall(call *model.Call, ringingSince time.Time) (bool, error) {
+	return r.db.PlaceCall(call, ringingSince)
+}
+
+// FindCallByID retrieves a call by its ID.
+func (r *RelationalRepo) FindCallByID(id uuid.UUID) (*model.Call, error) {
+	call, err := r.db.FindCallByID(id)
+	if err != nil {
+		return nil, translateError(err)
+	}
+	return call, nil
+}
+
+// FindActiveCalls returns the active calls of any of the users.
+func (r *RelationalRepo) FindActiveCalls(userIDs []uuid.UUID, ringingSince time.Time) ([]model.Call, error) {
+	return r.db.FindActiveCalls(userIDs, ringingSince)
+}
+
+// UpdateCallStatus applies updates to a call in one of the given statuses.
+func (r *RelationalRepo) UpdateCallStatus(id uuid.UUID, from []string, updates map[string]interface{}) (*model.Call, error) {
+	return r.db.UpdateCallStatus(id, from, updates)
+}
+
+// SetCallMessage links a call to the system message recording it.
+func (r *RelationalRepo) SetCallMessage(id uuid.UUID, messageID uint) error {
+	return r.db.SetCallMessage(id, messageID)
+}
+
+// FindCallsByUserID retrieves the call history of a user.
+func (r *RelationalRepo) FindCallsByUserID(userID uuid.UUID, before time.Time, limit int) ([]model.Call, error) {
+	return r.db.FindCallsByUserID(userID, before, limit)
+}
+
+// JoinGroupCall adds a user to the active call of a group, starting it if there is none.
+func (r *RelationalRepo) JoinGroupCall(groupID uint, userID uuid.UUID, media string, now time.Time, maxParticipants int) (*model.GroupCall, bool, error) {
+	call, started, err := r.db.JoinGroupCall(groupID, userID, media, now, maxParticipants)
+	if err != nil {
+		return nil, false, translateError(err)
+	}
+	return call, started, nil
+}
+
+// LeaveGroupCall removes a user from the roster of an active group call.
+func (r *RelationalRepo) LeaveGroupCall(callID, userID uuid.UUID, now time.Time) (*model.GroupCall, bool, error) {
+	call, left, err := r.db.LeaveGroupCall(callID, userID, now)
+	if err != nil {
+		return nil, false, translateError(err)
+	}
+	return call, left, nil
+}
+
+// UpdateGroupCallParticipant applies updates to a participant in the roster of a group call.
+func (r *RelationalRepo) UpdateGroupCallParticipant(callID, userID uuid.UUID, updates map[string]interface{}) (bool, error) {
+	return r.db.UpdateGroupCallParticipant(callID, userID, updates)
+}
+
+// FindGroupCallByID retrieves a group call with its roster.
+func (r *RelationalRepo) FindGroupCallByID(id uuid.UUID) (*model.GroupCall, error) {
+	call, err := r.db.FindGroupCallByID(id)
+	if err != nil {
+		return nil, translateError(err)
+	}
+	return call, nil
+}
+
+// FindActiveGroupCall retrieves the active call of a group with its roster.
+func (r *RelationalRepo) FindActiveGroupCall(groupID uint) (*model.GroupCall, error) {
+	call, err := r.db.FindActiveGroupCall(groupID)
+	if err != nil {
+		return nil, translateError(err)
+	}
+	return call, nil
+}
+
+// FindActiveGroupCallIDsByUser returns the IDs of the active group calls a user is in.
+func (r *RelationalRepo) FindActiveGroupCallIDsByUser(userID uuid.UUID) ([]uuid.UUID, error) {
+	return r.db.FindActiveGroupCallIDsByUser(userID)
+}
+
+// SetGroupCallMessage links a group call to the system message recording it.
+func (r *RelationalRepo) SetGroupCallMessage(id uuid.UUID, messageID uint) error {
+	return r.db.SetGroupCallMessage(id, messageID)
+}
+
+// translateError maps database errors onto repository errors.
+func translateError(err error) error {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return repository.ErrNotFound
+	case errors.Is(err, database.ErrGroupCallFull), errors.Is(err, database.ErrPinLimitReached):
+		return repository.ErrLimitReached
+	default:
+		return err
+	}
+}
+
+// CreateFile saves the record of a stored file.
+func (r *RelationalRepo) CreateFile(file *model.File) error {
+	return r.db.CreateFile(file)
+}
+
+// FindFileByID retrieves a file record by its ID.
+func (r *RelationalRepo) FindFileByID(id uint) (*model.File, error) {
+	file, err := r.db.FindFileByID(id)
+	if err != nil {
+		return nil, translateError(err)
+	}
+	return file, nil
+}
+
+// CompleteFileUpload marks a pending file as ready.
+func (r *RelationalRepo) CompleteFileUpload(file *model.File) (bool, error) {
+	return r.db.CompleteFileUpload(file)
+}
+
+// DeleteFile removes a file record together with its shares, thumbnails and scan job.
+func (r *RelationalRepo) DeleteFile(id uint) error {
+	return r.db.DeleteFile(id)
+}
+
+// MarkFileAttached records the first attachment of a file to a message.
+func (r *RelationalRepo) MarkFileAttached(id uint, ephemeral bool, at time.Time) error {
+	return r.db.MarkFileAttached(id, ephemeral, at)
+}
+
+// DeleteEphemeralFile removes the record of an ephemeral file that is not shared.
+func (r *RelationalRepo) DeleteEphemeralFile(id uint) (bool, error) {
+	return r.db.DeleteEphemeralFile(id)
+}
+
+// CreateFileShares shares a file with users.
+func (r *RelationalRepo) CreateFileShares(shares []model.FileShare) error {
+	return r.db.CreateFileShares(shares)
+}
+
+// DeleteFileShare revokes a user's share of a file.
+func (r *RelationalRepo) DeleteFileShare(fileID uint, userID uuid.UUID) error {
+	return r.db.DeleteFileShare(fileID, userID)
+}
+
+// FindFileShares lists the users a file is shared with.
+func (r *RelationalRepo) FindFileShares(fileID uint) ([]model.FileShare, error) {
+	return r.db.FindFileShares(fileID)
+}
+
+// CanAccessFile reports whether a user may read a file.
+func (r *RelationalRepo) CanAccessFile(fileID uint, fileURL string, userID uuid.UUID) (bool, error) {
+	return r.db.CanAccessFile(fileID, fileURL, userID)
+}
+
+// FindPendingFiles lists files whose direct upload was started before the given time.
+func (r *RelationalRepo) FindPendingFiles(before time.Time, limit int) ([]model.File, error) {
+	return r.db.FindPendingFiles(before, limit)
+}
+
+// CreateUpload saves a new resumable upload.
+func (r *RelationalRepo) CreateUpload(upload *model.Upload) error {
+	return r.db.CreateUpload(upload)
+}
+
+// FindUploadByID retrieves a resumable upload by its ID.
+func (r *RelationalRepo) FindUploadByID(id uuid.UUID) (*model.Upload, error) {
+	upload, err := r.db.FindUploadByID(id)
+	if err != nil {
+		return nil, translateError(err)
+	}
+	return upload, nil
+}
+
+// AdvanceUpload moves the offset of an upload if it is at the expected position.
+func (r *RelationalRepo) AdvanceUpload(id uuid.UUID, from, to int64, expiresAt time.Time) (bool, error) {
+	return r.db.AdvanceUpload(id, from, to, expiresAt)
+}
+
+// SetUploadFile links a complete upload to the file assembled from it.
+func (r *RelationalRepo) SetUploadFile(id uuid.UUID, fileID uint) (bool, error) {
+	return r.db.SetUploadFile(id, fileID)
+}
+
+// DeleteUpload removes a resumable upload.
+func (r *RelationalRepo) DeleteUpload(id uuid.UUID) error {
+	return r.db.DeleteUpload(id)
+}
+
+// FindExpiredUploads lists uploads that expired before the given time.
+func (r *RelationalRepo) FindExpiredUploads(before time.Time, limit int) ([]model.Upload, error) {
+	return r.db.FindExpiredUploads(before, limit)
+}
+
+// ClaimScanJobs marks up to limit due scan jobs as running and returns them.
+func (r *RelationalRepo) ClaimScanJobs(now, staleBefore time.Time, limit int) ([]model.ScanJob, error) {
+	return r.db.ClaimScanJobs(now, staleBefore, limit)
+}
+
+// UpdateScanJob records a failed scan attempt.
+func (r *RelationalRepo) UpdateScanJob(job *model.ScanJob) error {
+	return r.db.UpdateScanJob(job)
+}
+
+// FinishFileScan records the verdict of a file's scan and removes its scan job.
+func (r *RelationalRepo) FinishFileScan(fileID uint, scanStatus, signature string, scannedAt time.Time) (bool, error) {
+	return r.db.FinishFileScan(fileID, scanStatus, signature, scannedAt)
+}
+
+// DeleteScanJob removes a scan job.
+func (r *RelationalRepo) DeleteScanJob(id uint) error {
+	return r.db.DeleteScanJob(id)
+}
@@ -2,10 +2,19 @@ package repository
 
 import (
 	"adwise-service/model"
+	"errors"
+	"time"
 
 	"github.com/google/uuid"
 )
 
+var (
+	// ErrNotFound is returned when a requested record does not exist.
+	ErrNotFound = errors.New("record not found")
+	// ErrLimitReached is returned when a record can not be added because its container is full.
+	ErrLimitReached = errors.New("limit reached")
+)
+
 // UserRepository defines the interface for user-related database operations.
 type UserRepository interface {
 	CreateUser(user *model.User) error
@@ -13,6 +22,8 @@ type UserRepository interface {
 	FindUserByEmail(email string) (*model.User, error)
 	FindUserByPhone(country_code, phone_number string) (*model.User, error)
 	FindUserByID(userID uuid.UUID) (*model.User, error)
+	CreateWebSocketTicket(ticket *model.WebSocketTicket) error
+	ConsumeWebSocketTicket(ticketHash string, now time.Time) (*model.WebSocketTicket, error)
 }
 
 // MessageRepository defines the interface for message-related database operations.
@@ -21,4 +32,101 @@ type MessageRepository interface {
 	FindMessagesByUserID(userID uuid.UUID, limit int) ([]model.Message, error)
 	FindMessageByID(messageID uint) (*model.Message, error)
 	DeleteMessage(messageID uint) error
+	CreateForwardedMessages(originalID uint, copies []model.Message) error
+	CreateMessageStar(star *model.MessageStar) error
+	DeleteMessageStar(userID uuid.UUID, messageID uint) error
+	FindStarredMessages(userID uuid.UUID, limit int) ([]model.Message, error)
+	CreateMessagePin(pin *model.MessagePin, maxPins int) (bool, error)
+	DeleteMessagePin(conversationID string, messageID uint) (bool, error)
+	FindPinnedMessages(conversationID string) ([]model.Message, error)
+	SearchMessages(userID uuid.UUID, filter model.MessageSearchFilter) ([]model.MessageSearchResult, error)
+	DeleteExpiredMessages(before time.Time, limit int) ([]model.Message, []string, error)
+	FindConversationSetting(conversationID string) (*model.ConversationSetting, error)
+	SaveConversationSetting(setting *model.ConversationSetting) error
+	ScheduledMessageRepository
+}
+
+// PreferenceRepository defines the interface for user preference database operations.
+type PreferenceRepository interface {
+	FindUserPreference(userID uuid.UUID) (*model.UserPreference, error)
+}
+
+// PresenceRepository defines the interface for presence database operations.
+type PresenceRepository interface {
+	UpdateLastSeen(userID uuid.UUID, at time.Time) error
+	FindLastSeen(userIDs []uuid.UUID) (map[uuid.UUID]time.Time, error)
+	FindHiddenLastSeen(userIDs []uuid.UUID) ([]uuid.UUID, error)
+	FilterContacts(userID uuid.UUID, candidates []uuid.UUID) ([]uuid.UUID, error)
+}
+
+// WebSocketRouteRepository defines the interface for the registry of which node holds which user's
+// WebSocket sessions.
+type WebSocketRouteRepository interface {
+	RegisterUserNode(nodeID string, userID uuid.UUID, expiresAt time.Time) error
+	UnregisterUserNode(nodeID string, userID uuid.UUID) error
+	RefreshNode(nodeID string, now, expiresAt time.Time) error
+	UnregisterNode(nodeID string) error
+	FindRoutesOfOtherNodes(nodeID string, now time.Time) ([]model.WebSocketRoute, error)
+}
+
+// ScheduledMessageRepository defines the interface for scheduled message database operations.
+type ScheduledMessageRepository interface {
+	CreateScheduledMessage(scheduled *model.ScheduledMessage) error
+	FindScheduledMessageByID(id uint) (*model.ScheduledMessage, error)
+	FindScheduledMessagesBySender(senderID uuid.UUID, statuses []string) ([]model.ScheduledMessage, error)
+	UpdatePendingScheduledMessage(scheduled *model.ScheduledMessage) (bool, error)
+	UpdateScheduledMessageStatus(scheduled *model.ScheduledMessage) error
+	SendScheduledMessage(scheduled *model.ScheduledMessage, message *model.Message) (bool, error)
+	ClaimDueScheduledMessages(now, staleBefore time.Time, limit int) ([]model.ScheduledMessage, error)
+}
+
+// GroupRepository defines the interface for group conversation database operations.
+type GroupRepository interface {
+	FindGroupMemberIDs(groupID uint) ([]uuid.UUID, error)
+	IsGroupMember(groupID uint, userID uuid.UUID) (bool, error)
+}
+
+// CallRepository defines the interface for call database operations.
+type CallRepository interface {
+	PlaceCall(call *model.Call, ringingSince time.Time) (bool, error)
+	FindCallByID(id uuid.UUID) (*model.Call, error)
+	FindActiveCalls(userIDs []uuid.UUID, ringingSince time.Time) ([]model.Call, error)
+	UpdateCallStatus(id uuid.UUID, from []string, updates map[string]interface{}) (*model.Call, error)
+	SetCallMessage(id uuid.UUID, messageID uint) error
+	FindCallsByUserID(userID uuid.UUID, before time.Time, limit int) ([]model.Call, error)
+
+	JoinGroupCall(groupID uint, userID uuid.UUID, media string, now time.Time, maxParticipants int) (*model.GroupCall, bool, error)
+	LeaveGroupCall(callID, userID uuid.UUID, now time.Time) (*model.GroupCall, bool, error)
+	UpdateGroupCallParticipant(callID, userID uuid.UUID, updates map[string]interface{}) (bool, error)
+	FindGroupCallByID(id uuid.UUID) (*model.GroupCall, error)
+	FindActiveGroupCall(groupID uint) (*model.GroupCall, error)
+	FindActiveGroupCallIDsByUser(userID uuid.UUID) ([]uuid.UUID, error)
+	SetGroupCallMessage(id uuid.UUID, messageID uint) error
+}
+
+// FileRepository defines the interface for file record database operations.
+type FileRepository interface {
+	CreateFile(file *model.File) error
+	FindFileByID(id uint) (*model.File, error)
+	CompleteFileUpload(file *model.File) (bool, error)
+	DeleteFile(id uint) error
+	MarkFileAttached(id uint, ephemeral bool, at time.Time) error
+	DeleteEphemeralFile(id uint) (bool, error)
+	CreateFileShares(shares []model.FileShare) error
+	DeleteFileShare(fileID uint, userID uuid.UUID) error
+	FindFileShares(fileID uint) ([]model.FileShare, error)
+	CanAccessFile(fileID uint, fileURL string, userID uuid.UUID) (bool, error)
+	FindPendingFiles(before time.Time, limit int) ([]model.File, error)
+
+	CreateUpload(upload *model.Upload) error
+	FindUploadByID(id uuid.UUID) (*model.Upload, error)
+	AdvanceUpload(id uuid.UUID, from, to int64, expiresAt time.Time) (bool, error)
+	SetUploadFile(id uuid.UUID, fileID uint) (bool, error)
+	DeleteUpload(id uuid.UUID) error
+	FindExpiredUploads(before time.Time, limit int) ([]model.Upload, error)
+
+	ClaimScanJobs(now, staleBefore time.Time, limit int) ([]model.ScanJob, error)
+	UpdateScanJob(job *model.ScanJob) error
+	FinishFileScan(fileID uint, scanStatus, signature string, scannedAt time.Time) (bool, error)
+	DeleteScanJob(id uint) error
 }
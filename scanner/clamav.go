@@ -0,0 +1,119 @@
+package scanner
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// clamavChunkSize is the size of the chunks content is streamed to clamd in. It must stay below
+// clamd's StreamMaxLength.
+const clamavChunkSize = 64 * 1024
+
+// ClamAVScanner scans content with a clamd daemon over TCP, streaming it with the INSTREAM command.
+// Every scan uses a connection of its own.
+//
+// clamd rejects streams longer than its StreamMaxLength, 25MB by default. Content larger than maxSize
+// fails with ErrTooLarge without being sent in full, and so does content clamd rejects as too long.
+type ClamAVScanner struct {
+	address string
+	timeout time.Duration
+	maxSize int64
+	dialer  net.Dialer
+}
+
+// NewClamAVScanner creates a ClamAVScanner for the clamd listening at address, which accepts streams
+// of up to maxSize bytes; 0 leaves the limit to clamd.
+func NewClamAVScanner(address string, timeout time.Duration, maxSize int64) (*ClamAVScanner, error) {
+	if address == "" {
+		return nil, errors.New("clamd address is required")
+	}
+	return &ClamAVScanner{address: address, timeout: timeout, maxSize: maxSize}, nil
+}
+
+// Scan streams content to clamd and parses its reply, "stream: OK" or "stream: <name> FOUND".
+func (s *ClamAVScanner) Scan(ctx context.Context, content io.Reader) (Result, error) {
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+	conn, err := s.dialer.DialContext(ctx, "tcp", s.address)
+	if err != nil {
+		return Result{}, fmt.Errorf("%w: %v", ErrScanFailed, err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if err := s.stream(conn, content); err != nil {
+		if errors.Is(err, ErrTooLarge) {
+			return Result{}, err
+		}
+		// clamd replies and closes the connection as soon as a stream exceeds its limit, so writing
+		// the rest fails; its reply tells why
+		reply, _ := bufio.NewReader(conn).ReadString(0)
+		if _, replyErr := parseClamAVReply(strings.TrimRight(reply, "\x00")); errors.Is(replyErr, ErrTooLarge) {
+			return Result{}, replyErr
+		}
+		return Result{}, fmt.Errorf("%w: %v", ErrScanFailed, err)
+	}
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil {
+		return Result{}, fmt.Errorf("%w: reading clamd reply: %v", ErrScanFailed, err)
+	}
+	return parseClamAVReply(strings.TrimRight(reply, "\x00"))
+}
+
+// stream sends the INSTREAM command followed by the content in length-prefixed chunks and the
+// zero-length chunk that ends it.
+func (s *ClamAVScanner) stream(conn net.Conn, content io.Reader) error {
+	if _, err := io.WriteString(conn, "zINSTREAM\x00"); err != nil {
+		return err
+	}
+	buf := make([]byte, 4+clamavChunkSize)
+	var sent int64
+	for {
+		n, err := io.ReadFull(content, buf[4:])
+		sent += int64(n)
+		if s.maxSize > 0 && sent > s.maxSize {
+			return fmt.Errorf("%w: more than %d bytes", ErrTooLarge, s.maxSize)
+		}
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf[:4], uint32(n))
+			if _, err := conn.Write(buf[:4+n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err := conn.Write([]byte{0, 0, 0, 0})
+	return err
+}
+
+// parseClamAVReply reads the verdict from a clamd reply.
+func parseClamAVReply(reply string) (Result, error) {
+	verdict := strings.TrimSpace(strings.TrimPrefix(reply, "stream:"))
+	switch {
+	case verdict == "OK":
+		return Result{}, nil
+	case strings.HasSuffix(verdict, " FOUND"):
+		return Result{Infected: true, Signature: strings.TrimSuffix(verdict, " FOUND")}, nil
+	case strings.HasPrefix(verdict, "INSTREAM size limit exceeded"):
+		return Result{}, fmt.Errorf("%w: clamd replied %q", ErrTooLarge, reply)
+	default:
+		return Result{}, fmt.Errorf("%w: clamd replied %q", ErrScanFailed, reply)
+	}
+}
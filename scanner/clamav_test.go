@@ -0,0 +1,115 @@
+package scanner
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClamd serves INSTREAM scans like clamd with the given StreamMaxLength, finding content that
+// contains "EICAR". It returns its address.
+func fakeClamd(t *testing.T, streamMaxLength int) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveClamd(conn, streamMaxLength)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func serveClamd(conn net.Conn, streamMaxLength int) {
+	defer conn.Close()
+	command := make([]byte, len("zINSTREAM\x00"))
+	if _, err := io.ReadFull(conn, command); err != nil {
+		return
+	}
+	var content bytes.Buffer
+	replied := false
+	for {
+		var size uint32
+		if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+			return
+		}
+		if size == 0 {
+			break
+		}
+		if _, err := io.CopyN(&content, conn, int64(size)); err != nil {
+			return
+		}
+		if content.Len() > streamMaxLength && !replied {
+			io.WriteString(conn, "INSTREAM size limit exceeded. ERROR\x00")
+			replied = true
+		}
+	}
+	switch {
+	case replied:
+	case bytes.Contains(content.Bytes(), []byte("EICAR")):
+		io.WriteString(conn, "stream: Eicar-Test-Signature FOUND\x00")
+	default:
+		io.WriteString(conn, "stream: OK\x00")
+	}
+}
+
+func TestClamAVScanner(t *testing.T) {
+	address := fakeClamd(t, 200<<10)
+	tests := []struct {
+		name    string
+		maxSize int64
+		content string
+		want    Result
+		err     error
+	}{
+		{"clean", 0, "meeting notes", Result{}, nil},
+		{"infected", 0, "notes with EICAR inside", Result{Infected: true, Signature: "Eicar-Test-Signature"}, nil},
+		{"over the limit of clamd", 0, strings.Repeat("x", 300<<10), Result{}, ErrTooLarge},
+		{"over the configured limit", 100 << 10, strings.Repeat("x", 150<<10), Result{}, ErrTooLarge},
+		{"at the configured limit", 100 << 10, strings.Repeat("x", 100<<10), Result{}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewClamAVScanner(address, 5*time.Second, tt.maxSize)
+			if err != nil {
+				t.Fatalf("new scanner: %v", err)
+			}
+			result, err := s.Scan(context.Background(), strings.NewReader(tt.content))
+			if !errors.Is(err, tt.err) || result != tt.want {
+				t.Fatalf("got %+v, %v; want %+v, %v", result, err, tt.want, tt.err)
+			}
+		})
+	}
+}
+
+func TestParseClamAVReply(t *testing.T) {
+	tests := []struct {
+		reply string
+		want  Result
+		err   error
+	}{
+		{"stream: OK", Result{}, nil},
+		{"stream: Win.Test.EICAR_HDB-1 FOUND", Result{Infected: true, Signature: "Win.Test.EICAR_HDB-1"}, nil},
+		{"INSTREAM size limit exceeded. ERROR", Result{}, ErrTooLarge},
+		{"stream: Can't allocate memory ERROR", Result{}, ErrScanFailed},
+	}
+	for _, tt := range tests {
+		result, err := parseClamAVReply(tt.reply)
+		if !errors.Is(err, tt.err) || result != tt.want {
+			t.Errorf("%q: got %+v, %v; want %+v, %v", tt.reply, result, err, tt.want, tt.err)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package scanner
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+)
+
+// eicar is the EICAR anti-malware test file, which every scanner reports as infected.
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// FakeScanner is a Scanner for tests and local development. It reports content containing one of
+// its signatures as infected, by default the EICAR test file, and can be made to fail.
+type FakeScanner struct {
+	mu         sync.Mutex
+	signatures map[string][]byte
+	err        error
+}
+
+// NewFakeScanner creates a FakeScanner that detects the EICAR test file.
+func NewFakeScanner() *FakeScanner {
+	return &FakeScanner{signatures: map[string][]byte{"Eicar-Test-Signature": []byte(eicar)}}
+}
+
+// AddSignature makes the scanner report content containing pattern as infected with name.
+func (s *FakeScanner) AddSignature(name string, pattern []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.signatures[name] = pattern
+}
+
+// SetError makes every following scan fail with err, or succeed again when err is nil.
+func (s *FakeScanner) SetError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+// Scan reads content and looks for the signatures.
+func (s *FakeScanner) Scan(ctx context.Context, content io.Reader) (Result, error) {
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return Result{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return Result{}, s.err
+	}
+	for name, pattern := range s.signatures {
+		if bytes.Contains(data, pattern) {
+			return Result{Infected: true, Signature: name}, nil
+		}
+	}
+	return Result{}, nil
+}
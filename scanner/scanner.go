@@ -0,0 +1,57 @@
+package scanner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+var (
+	// ErrScanFailed is returned when a scanner could not come to a verdict.
+	ErrScanFailed = errors.New("scan failed")
+	// ErrTooLarge is returned when content is larger than a scanner accepts. Scanning it again
+	// fails the same way.
+	ErrTooLarge = errors.New("content exceeds the size limit of the scanner")
+)
+
+// Result is the verdict of a scan.
+type Result struct {
+	Infected  bool
+	Signature string // Name of the malware found; empty when the content is clean
+}
+
+// Scanner checks content for malware.
+type Scanner interface {
+	// Scan reads content to its end and returns the verdict.
+	Scan(ctx context.Context, content io.Reader) (Result, error)
+}
+
+// Config selects and configures a Scanner.
+type Config struct {
+	Driver string // clamav, fake or none
+
+	ClamAVAddress string        // TCP address of clamd
+	ClamAVTimeout time.Duration // Deadline of a single scan, including the upload of the content
+	ClamAVMaxSize int64         // StreamMaxLength of clamd; larger content is not sent. 0 leaves the check to clamd
+}
+
+// Open creates the Scanner selected by the configuration. It returns nil for the none driver, in
+// which case files are not scanned.
+func Open(cfg Config) (Scanner, error) {
+	switch cfg.Driver {
+	case "clamav":
+		scanner, err := NewClamAVScanner(cfg.ClamAVAddress, cfg.ClamAVTimeout, cfg.ClamAVMaxSize)
+		if err != nil {
+			return nil, err
+		}
+		return scanner, nil
+	case "fake":
+		return NewFakeScanner(), nil
+	case "none":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown scanner driver %q", cfg.Driver)
+	}
+}
@@ -4,6 +4,10 @@ import (
 	"adwise-service/model"
 	"adwise-service/repository"
 	"adwise-service/utils"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"time"
 
@@ -107,6 +111,35 @@ func (s *AuthService) generateToken(userID uuid.UUID, role string, expiry time.D
 
 // ValidateToken validates a JWT token.
 func (s *AuthService) ValidateToken(tokenString string) (uuid.UUID, string, error) {
+	claims, err := s.parseClaims(tokenString)
+	if err != nil {
+		return uuid.Nil, "", err
+	}
+	return s.userFromClaims(claims)
+}
+
+// ValidateSessionToken validates a JWT token and also returns the time at which it expires.
+func (s *AuthService) ValidateSessionToken(tokenString string) (uuid.UUID, string, time.Time, error) {
+	claims, err := s.parseClaims(tokenString)
+	if err != nil {
+		return uuid.Nil, "", time.Time{}, err
+	}
+
+	userUUID, role, err := s.userFromClaims(claims)
+	if err != nil {
+		return uuid.Nil, "", time.Time{}, err
+	}
+
+	expiresAt, err := claims.GetExpirationTime()
+	if err != nil || expiresAt == nil {
+		return uuid.Nil, "", time.Time{}, errors.New("invalid expiry in token")
+	}
+
+	return userUUID, role, expiresAt.Time, nil
+}
+
+// parseClaims verifies a JWT token's signature and expiry and returns its claims.
+func (s *AuthService) parseClaims(tokenString string) (jwt.MapClaims, error) {
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, errors.New("invalid signing method")
@@ -114,14 +147,18 @@ func (s *AuthService) ValidateToken(tokenString string) (uuid.UUID, string, erro
 		return []byte(s.jwtSecret), nil
 	})
 	if err != nil {
-		return uuid.Nil, "", err
+		return nil, err
 	}
 
 	claims, ok := token.Claims.(jwt.MapClaims)
 	if !ok || !token.Valid {
-		return uuid.Nil, "", errors.New("invalid token claims")
+		return nil, errors.New("invalid token claims")
 	}
+	return claims, nil
+}
 
+// userFromClaims extracts the user ID and role from token claims.
+func (s *AuthService) userFromClaims(claims jwt.MapClaims) (uuid.UUID, string, error) {
 	userID, ok := claims["user_id"].(string)
 	if !ok {
 		return uuid.Nil, "", errors.New("invalid user ID in token")
@@ -175,3 +212,48 @@ func (s *AuthService) ValidateResetToken(tokenString string) (uuid.UUID, error)
 
 	return userID, nil
 }
+
+// webSocketTicketTTL is how long a WebSocket ticket can be redeemed after it was issued.
+const webSocketTicketTTL = 30 * time.Second
+
+// IssueWebSocketTicket issues a single-use ticket that authenticates one WebSocket upgrade for the user.
+// The connection opened with the ticket lasts until sessionExpiresAt, the expiry of the caller's access token.
+func (s *AuthService) IssueWebSocketTicket(userID uuid.UUID, sessionExpiresAt time.Time) (string, time.Time, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", time.Time{}, err
+	}
+	ticket := base64.RawURLEncoding.EncodeToString(raw)
+
+	now := time.Now()
+	record := &model.WebSocketTicket{
+		TicketHash:       hashTicket(ticket),
+		UserID:           userID,
+		ExpiresAt:        now.Add(webSocketTicketTTL),
+		SessionExpiresAt: sessionExpiresAt,
+		CreatedAt:        now,
+	}
+	if err := s.repo.CreateWebSocketTicket(record); err != nil {
+		return "", time.Time{}, err
+	}
+	return ticket, record.ExpiresAt, nil
+}
+
+// RedeemWebSocketTicket consumes a WebSocket ticket and returns the user it was issued to together
+// with the expiry of the session it belongs to. A ticket can be redeemed only once.
+func (s *AuthService) RedeemWebSocketTicket(ticket string) (uuid.UUID, time.Time, error) {
+	record, err := s.repo.ConsumeWebSocketTicket(hashTicket(ticket), time.Now())
+	if errors.Is(err, repository.ErrNotFound) {
+		return uuid.Nil, time.Time{}, errors.New("invalid or expired ticket")
+	}
+	if err != nil {
+		return uuid.Nil, time.Time{}, err
+	}
+	return record.UserID, record.SessionExpiresAt, nil
+}
+
+// hashTicket returns the stored form of a WebSocket ticket.
+func hashTicket(ticket string) string {
+	sum := sha256.Sum256([]byte(ticket))
+	return hex.EncodeToString(sum[:])
+}
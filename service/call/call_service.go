@@ -0,0 +1,477 @@
+package call
+
+import (
+	"adwise-service/model"
+	"adwise-service/repository"
+	"adwise-service/utils"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrCallNotFound is returned when a call does not exist.
+	ErrCallNotFound = errors.New("call not found")
+	// ErrNotCallParticipant is returned when a user acts on a call they are not part of.
+	ErrNotCallParticipant = errors.New("user is not a participant of the call")
+	// ErrNotCallee is returned when someone other than the callee answers or rejects a call.
+	ErrNotCallee = errors.New("only the callee can answer or reject the call")
+	// ErrInvalidCallState is returned when an operation does not apply to the current state of a call.
+	ErrInvalidCallState = errors.New("operation is not allowed in the current call state")
+	// ErrInvalidCallee is returned when a call is placed without a callee or to the caller themselves.
+	ErrInvalidCallee = errors.New("callee must be another user")
+	// ErrAlreadyInCall is returned when a user places a call while in another one.
+	ErrAlreadyInCall = errors.New("user is already in a call")
+	// ErrInvalidSignal is returned when a signal lacks the session description or candidate its
+	// operation requires.
+	ErrInvalidSignal = errors.New("invalid call signal")
+)
+
+// Reasons recorded when the server ends a call.
+const (
+	ReasonTimeout      = "timeout"      // Nobody answered before the ring timeout
+	ReasonUnavailable  = "unavailable"  // The callee had no connection to ring
+	ReasonDisconnected = "disconnected" // A participant lost their connections for longer than the reconnect grace
+)
+
+// Notifier pushes call signalling and state changes to connected users.
+type Notifier interface {
+	NotifyUsers(userIDs []uuid.UUID, event string, payload interface{})
+	// SendToUser pushes an event to every connection of a user and reports whether there was one.
+	SendToUser(userID uuid.UUID, event string, payload interface{}) bool
+	// IsReachable reports whether a user has a connection to this or any other instance.
+	IsReachable(userID uuid.UUID) bool
+}
+
+// MessageSender posts the system message recording a call in the conversation.
+type MessageSender interface {
+	SendMessage(senderID uuid.UUID, message *model.Message) error
+}
+
+// Config holds the tunables of the CallService.
+type Config struct {
+	RingTimeout    time.Duration // Time a call rings before it is missed
+	ReconnectGrace time.Duration // Time a participant may be disconnected before their calls end
+	ICE            ICEConfig     // STUN and TURN servers handed to the participants
+	// MaxGroupCallSize caps the participants of a group call; every pair of them holds a peer
+	// connection. Zero means no limit.
+	MaxGroupCallSize int
+}
+
+// CallService runs the signalling of one-to-one WebRTC calls and keeps their history.
+//
+// A call starts ringing when the caller sends an offer and moves to accepted when the callee
+// answers. It ends up rejected when the callee declines, missed when nobody answers before the
+// ring timeout or the caller hangs up first, busy when the callee is in another call, and ended
+// when an accepted call is hung up. The state lives in the database and every transition is a
+// conditional update, so the parties may be connected to different service instances.
+//
+// Group calls are rooms in a group conversation that members join and leave while the call lasts;
+// see group_call.go.
+type CallService struct {
+	repo      repository.CallRepository
+	groupRepo repository.GroupRepository
+	notifier  Notifier
+	messages  MessageSender
+	clock     utils.Clock
+	cfg       Config
+
+	mu           sync.Mutex
+	ringTimers   map[uuid.UUID]*time.Timer // Ring timeouts of the calls placed through this instance
+	disconnected map[uuid.UUID]*time.Timer // Pending ends of the calls of users without connections
+}
+
+// NewCallService creates a new CallService.
+func NewCallService(repo repository.CallRepository, groupRepo repository.GroupRepository, messages MessageSender, cfg Config) *CallService {
+	return &CallService{
+		repo:         repo,
+		groupRepo:    groupRepo,
+		messages:     messages,
+		clock:        utils.SystemClock{},
+		cfg:          cfg,
+		ringTimers:   make(map[uuid.UUID]*time.Timer),
+		disconnected: make(map[uuid.UUID]*time.Timer),
+	}
+}
+
+// SetNotifier sets the notifier used to push signalling and state changes to the participants.
+func (s *CallService) SetNotifier(notifier Notifier) {
+	s.notifier = notifier
+}
+
+// SetClock replaces the clock the service reads the current time from.
+func (s *CallService) SetClock(clock utils.Clock) {
+	s.clock = clock
+}
+
+// Offer places a call from the caller to signal.ReceiverID and relays the SDP offer to the callee.
+// The returned call is ringing, or already busy or missed when the callee can not take it.
+func (s *CallService) Offer(callerID uuid.UUID, signal model.CallSignalPayload) (*model.Call, error) {
+	calleeID := signal.ReceiverID
+	if calleeID == uuid.Nil || calleeID == callerID {
+		return nil, ErrInvalidCallee
+	}
+	if signal.Description == nil || signal.Description.Type != "offer" || signal.Description.SDP == "" {
+		return nil, fmt.Errorf("%w: call.offer needs an offer description", ErrInvalidSignal)
+	}
+	if signal.Media == "" {
+		signal.Media = model.CallMediaAudio
+	}
+	if signal.Media != model.CallMediaAudio && signal.Media != model.CallMediaVideo {
+		return nil, fmt.Errorf("%w: media must be audio or video", ErrInvalidSignal)
+	}
+
+	now := s.clock.Now()
+	call := &model.Call{
+		ID:        uuid.New(),
+		CallerID:  callerID,
+		CalleeID:  calleeID,
+		Media:     signal.Media,
+		Status:    model.CallStatusRinging,
+		StartedAt: now,
+	}
+	placed, err := s.repo.PlaceCall(call, now.Add(-s.cfg.RingTimeout))
+	if err != nil {
+		return nil, err
+	}
+	if !placed {
+		return nil, ErrAlreadyInCall
+	}
+	if call.Status == model.CallStatusBusy {
+		s.finish(call)
+		return call, nil
+	}
+
+	signal.CallID = call.ID.String()
+	signal.SenderID = callerID
+	signal.ICEServers = s.ICEServers(calleeID).ICEServers
+	if !s.send(calleeID, model.OpCallOffer, signal) {
+		return s.end(call, []string{model.CallStatusRinging}, model.CallStatusMissed, nil, ReasonUnavailable)
+	}
+
+	s.mu.Lock()
+	s.ringTimers[call.ID] = time.AfterFunc(s.cfg.RingTimeout, func() {
+		s.stopRinging(call.ID)
+		s.expire(call.ID)
+	})
+	s.mu.Unlock()
+	s.notify([]uuid.UUID{callerID}, call)
+	return call, nil
+}
+
+// Answer accepts a ringing call and relays the callee's SDP answer to the caller.
+func (s *CallService) Answer(userID uuid.UUID, signal model.CallSignalPayload) (*model.Call, error) {
+	if signal.Description == nil || signal.Description.Type != "answer" || signal.Description.SDP == "" {
+		return nil, fmt.Errorf("%w: call.answer needs an answer description", ErrInvalidSignal)
+	}
+	call, err := s.findRinging(userID, signal.CallID)
+	if err != nil {
+		return nil, err
+	}
+	if userID != call.CalleeID {
+		return nil, ErrNotCallee
+	}
+
+	accepted, err := s.transition(call, []string{model.CallStatusRinging}, model.CallStatusAccepted, &userID, "")
+	if err != nil {
+		return nil, err
+	}
+	if accepted == nil {
+		return nil, ErrInvalidCallState
+	}
+	s.stopRinging(call.ID)
+
+	s.send(call.CallerID, model.OpCallAnswer, model.CallSignalPayload{
+		CallID:      call.ID.String(),
+		ReceiverID:  call.CallerID,
+		SenderID:    userID,
+		Description: signal.Description,
+	})
+	// The callee's other devices stop ringing
+	s.notify([]uuid.UUID{call.CallerID, call.CalleeID}, accepted)
+	return accepted, nil
+}
+
+// Candidate relays an ICE candidate to the other party of an active call.
+func (s *CallService) Candidate(userID uuid.UUID, signal model.CallSignalPayload) error {
+	if signal.Candidate == nil || signal.Candidate.Candidate == "" {
+		return fmt.Errorf("%w: call.ice needs a candidate", ErrInvalidSignal)
+	}
+	call, err := s.findCall(userID, signal.CallID)
+	if err != nil {
+		return err
+	}
+	if !call.IsActive() {
+		return ErrInvalidCallState
+	}
+
+	peer := call.Peer(userID)
+	s.send(peer, model.OpCallICE, model.CallSignalPayload{
+		CallID:     call.ID.String(),
+		ReceiverID: peer,
+		SenderID:   userID,
+		Candidate:  signal.Candidate,
+	})
+	return nil
+}
+
+// Reject declines a ringing call on behalf of the callee.
+func (s *CallService) Reject(userID uuid.UUID, signal model.CallSignalPayload) (*model.Call, error) {
+	call, err := s.findRinging(userID, signal.CallID)
+	if err != nil {
+		return nil, err
+	}
+	if userID != call.CalleeID {
+		return nil, ErrNotCallee
+	}
+	return s.end(call, []string{model.CallStatusRinging}, model.CallStatusRejected, &userID, signal.Reason)
+}
+
+// End hangs up a call. A call the caller hangs up before it is answered is missed, one the callee
+// hangs up while it rings is rejected.
+func (s *CallService) End(userID uuid.UUID, signal model.CallSignalPayload) (*model.Call, error) {
+	call, err := s.findCall(userID, signal.CallID)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case call.Status == model.CallStatusAccepted:
+		return s.end(call, []string{model.CallStatusAccepted}, model.CallStatusEnded, &userID, signal.Reason)
+	case call.Status == model.CallStatusRinging && userID == call.CallerID:
+		return s.end(call, []string{model.CallStatusRinging}, model.CallStatusMissed, &userID, signal.Reason)
+	case call.Status == model.CallStatusRinging:
+		return s.end(call, []string{model.CallStatusRinging}, model.CallStatusRejected, &userID, signal.Reason)
+	default:
+		return nil, ErrInvalidCallState
+	}
+}
+
+// Connected cancels ending the calls of a user who reconnected within the reconnect grace.
+func (s *CallService) Connected(userID uuid.UUID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if timer, ok := s.disconnected[userID]; ok {
+		timer.Stop()
+		delete(s.disconnected, userID)
+	}
+}
+
+// Disconnected ends the active calls of a user whose last connection closed, unless they reconnect
+// within the reconnect grace. A user who reconnected to another instance in the meantime is found
+// through the route registry and keeps their calls.
+func (s *CallService) Disconnected(userID uuid.UUID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.disconnected[userID]; ok {
+		return
+	}
+	s.disconnected[userID] = time.AfterFunc(s.cfg.ReconnectGrace, func() {
+		s.mu.Lock()
+		delete(s.disconnected, userID)
+		s.mu.Unlock()
+		if s.notifier != nil && s.notifier.IsReachable(userID) {
+			return
+		}
+		s.endAll(userID)
+	})
+}
+
+// GetCall returns a call of the user.
+func (s *CallService) GetCall(userID uuid.UUID, callID uuid.UUID) (*model.Call, error) {
+	call, err := s.repo.FindCallByID(callID)
+	if errors.Is(err, repository.ErrNotFound) {
+		return nil, ErrCallNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !call.HasParticipant(userID) {
+		return nil, ErrNotCallParticipant
+	}
+	return call, nil
+}
+
+// GetCallHistory returns up to limit calls of a user placed before the given time, newest first.
+// A zero time starts at the most recent call.
+func (s *CallService) GetCallHistory(userID uuid.UUID, before time.Time, limit int) ([]model.Call, error) {
+	if limit <= 0 || limit > 100 {
+		limit = 20
+	}
+	if before.IsZero() {
+		before = s.clock.Now().Add(time.Second)
+	}
+	return s.repo.FindCallsByUserID(userID, before, limit)
+}
+
+// findCall loads a call the user takes part in.
+func (s *CallService) findCall(userID uuid.UUID, callID string) (*model.Call, error) {
+	id, err := uuid.Parse(callID)
+	if err != nil {
+		return nil, fmt.Errorf("%w: call_id is required", ErrInvalidSignal)
+	}
+	return s.GetCall(userID, id)
+}
+
+// findRinging loads a ringing call the user takes part in. A call that outlived the ring timeout is
+// missed, even when the instance that placed it did not get to expire it.
+func (s *CallService) findRinging(userID uuid.UUID, callID string) (*model.Call, error) {
+	call, err := s.findCall(userID, callID)
+	if err != nil {
+		return nil, err
+	}
+	if call.Status != model.CallStatusRinging {
+		return nil, ErrInvalidCallState
+	}
+	if s.clock.Now().Sub(call.StartedAt) >= s.cfg.RingTimeout {
+		s.expire(call.ID)
+		return nil, ErrInvalidCallState
+	}
+	return call, nil
+}
+
+// expire marks a call that is still ringing as missed.
+func (s *CallService) expire(callID uuid.UUID) {
+	call, err := s.repo.FindCallByID(callID)
+	if err != nil {
+		utils.LogError("Failed to load call", err, zap.String("call_id", callID.String()))
+		return
+	}
+	if _, err := s.end(call, []string{model.CallStatusRinging}, model.CallStatusMissed, nil, ReasonTimeout); err != nil &&
+		!errors.Is(err, ErrInvalidCallState) {
+		utils.LogError("Failed to expire call", err, zap.String("call_id", callID.String()))
+	}
+}
+
+// endAll hangs up every active call of a user that lost their connections and takes them out of
+// their group calls.
+func (s *CallService) endAll(userID uuid.UUID) {
+	s.leaveAllGroupCalls(userID)
+	calls, err := s.repo.FindActiveCalls([]uuid.UUID{userID}, s.clock.Now().Add(-s.cfg.RingTimeout))
+	if err != nil {
+		utils.LogError("Failed to load active calls", err, zap.String("user_id", userID.String()))
+		return
+	}
+	for i := range calls {
+		call := &calls[i]
+		status := model.CallStatusEnded
+		if call.Status == model.CallStatusRinging {
+			status = model.CallStatusMissed
+		}
+		if _, err := s.end(call, []string{call.Status}, status, nil, ReasonDisconnected); err != nil &&
+			!errors.Is(err, ErrInvalidCallState) {
+			utils.LogError("Failed to end call", err, zap.String("call_id", call.ID.String()))
+		}
+	}
+}
+
+// end moves a call from one of the from statuses to an outcome and records it.
+func (s *CallService) end(call *model.Call, from []string, status string, by *uuid.UUID, reason string) (*model.Call, error) {
+	ended, err := s.transition(call, from, status, by, reason)
+	if err != nil {
+		return nil, err
+	}
+	if ended == nil {
+		return nil, ErrInvalidCallState
+	}
+	return ended, nil
+}
+
+// transition applies a state change to a call if it is still in one of the from statuses. It
+// returns nil when the call was in another status. A call reaching an outcome is recorded in the
+// conversation and the participants are told.
+func (s *CallService) transition(call *model.Call, from []string, status string, by *uuid.UUID, reason string) (*model.Call, error) {
+	now := s.clock.Now()
+	updates := map[string]interface{}{"status": status, "updated_at": now}
+	switch status {
+	case model.CallStatusAccepted:
+		updates["answered_at"] = now
+	default:
+		updates["ended_at"] = now
+		updates["end_reason"] = reason
+		if by != nil {
+			updates["ended_by"] = *by
+		}
+		if call.AnsweredAt != nil {
+			updates["duration"] = uint(now.Sub(*call.AnsweredAt) / time.Second)
+		}
+	}
+
+	updated, err := s.repo.UpdateCallStatus(call.ID, from, updates)
+	if err != nil || updated == nil {
+		return nil, err
+	}
+	if !updated.IsActive() {
+		s.stopRinging(updated.ID)
+		s.finish(updated)
+	}
+	return updated, nil
+}
+
+// finish records the outcome of a call as a system message in the conversation and pushes it to
+// the participants.
+func (s *CallService) finish(call *model.Call) {
+	if s.messages != nil {
+		message := &model.Message{
+			ReceiverID:      call.CalleeID,
+			Content:         summary(call),
+			Type:            "call",
+			MediaType:       call.Media,
+			MediaDuration:   call.Duration,
+			IsSystemMessage: true,
+			Timestamp:       s.clock.Now(),
+		}
+		if err := s.messages.SendMessage(call.CallerID, message); err != nil {
+			utils.LogError("Failed to record call message", err, zap.String("call_id", call.ID.String()))
+		} else if err := s.repo.SetCallMessage(call.ID, message.ID); err != nil {
+			utils.LogError("Failed to link call message", err, zap.String("call_id", call.ID.String()))
+		} else {
+			call.MessageID = message.ID
+		}
+	}
+	s.notify([]uuid.UUID{call.CallerID, call.CalleeID}, call)
+}
+
+// stopRinging cancels the ring timeout of a call placed through this instance.
+func (s *CallService) stopRinging(callID uuid.UUID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if timer, ok := s.ringTimers[callID]; ok {
+		timer.Stop()
+		delete(s.ringTimers, callID)
+	}
+}
+
+// send pushes a signal to a user and reports whether they had a connection.
+func (s *CallService) send(userID uuid.UUID, op string, signal model.CallSignalPayload) bool {
+	if s.notifier == nil {
+		return false
+	}
+	return s.notifier.SendToUser(userID, op, signal)
+}
+
+// notify pushes the state of a call to users.
+func (s *CallService) notify(userIDs []uuid.UUID, call *model.Call) {
+	if s.notifier != nil {
+		s.notifier.NotifyUsers(userIDs, model.OpCallState, call)
+	}
+}
+
+// summary is the text of the system message recording a call.
+func summary(call *model.Call) string {
+	switch call.Status {
+	case model.CallStatusEnded:
+		return fmt.Sprintf("%s call, %s", strings.ToUpper(call.Media[:1])+call.Media[1:], time.Duration(call.Duration)*time.Second)
+	case model.CallStatusRejected:
+		return fmt.Sprintf("Declined %s call", call.Media)
+	case model.CallStatusBusy:
+		return fmt.Sprintf("Missed %s call (busy)", call.Media)
+	default:
+		return fmt.Sprintf("Missed %s call", call.Media)
+	}
+}
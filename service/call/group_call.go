@@ -0,0 +1,280 @@
+package call
+
+import (
+	"adwise-service/model"
+	"adwise-service/repository"
+	"adwise-service/utils"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrCallFull is returned when joining a group call that holds the maximum number of participants.
+	ErrCallFull = errors.New("group call is full")
+	// ErrNotGroupMember is returned when a user joins the call of a group they are not in.
+	ErrNotGroupMember = errors.New("user is not a member of the group")
+	// ErrNotHost is returned when someone other than the host mutes or removes a participant.
+	ErrNotHost = errors.New("only the host can mute or remove participants")
+)
+
+// JoinGroupCall adds a user to the call of one of their groups, starting the call with the user as
+// host when the group has none. Every member of the group is told.
+func (s *CallService) JoinGroupCall(userID uuid.UUID, request model.GroupCallPayload) (*model.GroupCall, error) {
+	if request.GroupID == 0 {
+		return nil, fmt.Errorf("%w: group_id is required", ErrInvalidSignal)
+	}
+	if request.Media == "" {
+		request.Media = model.CallMediaAudio
+	}
+	if request.Media != model.CallMediaAudio && request.Media != model.CallMediaVideo {
+		return nil, fmt.Errorf("%w: media must be audio or video", ErrInvalidSignal)
+	}
+	isMember, err := s.groupRepo.IsGroupMember(request.GroupID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !isMember {
+		return nil, ErrNotGroupMember
+	}
+
+	call, started, err := s.repo.JoinGroupCall(request.GroupID, userID, request.Media, s.clock.Now(), s.cfg.MaxGroupCallSize)
+	if errors.Is(err, repository.ErrLimitReached) {
+		return nil, ErrCallFull
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	event := model.GroupCallJoined
+	if started {
+		event = model.GroupCallStarted
+	}
+	s.broadcast(event, userID, call)
+	return call, nil
+}
+
+// LeaveGroupCall removes a user from a group call. The call ends when its last participant leaves.
+func (s *CallService) LeaveGroupCall(userID uuid.UUID, request model.GroupCallPayload) (*model.GroupCall, error) {
+	call, err := s.findGroupCall(userID, request.CallID)
+	if err != nil {
+		return nil, err
+	}
+	return s.leaveGroupCall(call.ID, userID, model.GroupCallLeft)
+}
+
+// RelayGroupSignal relays a WebRTC offer, answer or ICE candidate between two participants of a
+// group call. Every pair of participants negotiates its own peer connection.
+func (s *CallService) RelayGroupSignal(userID uuid.UUID, signal model.CallSignalPayload) error {
+	hasDescription := signal.Description != nil && signal.Description.SDP != "" &&
+		(signal.Description.Type == "offer" || signal.Description.Type == "answer")
+	hasCandidate := signal.Candidate != nil && signal.Candidate.Candidate != ""
+	if hasDescription == hasCandidate {
+		return fmt.Errorf("%w: group_call.signal needs either a description or a candidate", ErrInvalidSignal)
+	}
+	call, err := s.findGroupCall(userID, signal.CallID)
+	if err != nil {
+		return err
+	}
+	if signal.ReceiverID == userID || !call.HasParticipant(signal.ReceiverID) {
+		return fmt.Errorf("%w: receiver_id must be another participant", ErrInvalidSignal)
+	}
+
+	s.send(signal.ReceiverID, model.OpGroupCallSignal, model.CallSignalPayload{
+		CallID:      call.ID.String(),
+		ReceiverID:  signal.ReceiverID,
+		SenderID:    userID,
+		Description: signal.Description,
+		Candidate:   signal.Candidate,
+	})
+	return nil
+}
+
+// SetGroupCallMedia changes the mute or camera state of a participant and tells the group.
+func (s *CallService) SetGroupCallMedia(userID uuid.UUID, request model.GroupCallPayload) (*model.GroupCall, error) {
+	updates := map[string]interface{}{}
+	if request.Muted != nil {
+		updates["muted"] = *request.Muted
+	}
+	if request.CameraOff != nil {
+		updates["camera_off"] = *request.CameraOff
+	}
+	if len(updates) == 0 {
+		return nil, fmt.Errorf("%w: muted or camera_off is required", ErrInvalidSignal)
+	}
+	call, err := s.findGroupCall(userID, request.CallID)
+	if err != nil {
+		return nil, err
+	}
+	return s.updateParticipant(call.ID, userID, updates, model.GroupCallMedia)
+}
+
+// MuteParticipant mutes a participant on behalf of the host. Only the participant can unmute
+// themselves again.
+func (s *CallService) MuteParticipant(hostID uuid.UUID, request model.GroupCallPayload) (*model.GroupCall, error) {
+	call, err := s.findHostedCall(hostID, request)
+	if err != nil {
+		return nil, err
+	}
+	return s.updateParticipant(call.ID, request.UserID, map[string]interface{}{"muted": true}, model.GroupCallMuted)
+}
+
+// RemoveParticipant removes a participant from a group call on behalf of the host.
+func (s *CallService) RemoveParticipant(hostID uuid.UUID, request model.GroupCallPayload) (*model.GroupCall, error) {
+	call, err := s.findHostedCall(hostID, request)
+	if err != nil {
+		return nil, err
+	}
+	if request.UserID == hostID {
+		return nil, fmt.Errorf("%w: the host leaves with group_call.leave", ErrInvalidSignal)
+	}
+	return s.leaveGroupCall(call.ID, request.UserID, model.GroupCallRemoved)
+}
+
+// GetActiveGroupCall returns the ongoing call of one of the user's groups.
+func (s *CallService) GetActiveGroupCall(userID uuid.UUID, groupID uint) (*model.GroupCall, error) {
+	isMember, err := s.groupRepo.IsGroupMember(groupID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !isMember {
+		return nil, ErrNotGroupMember
+	}
+	call, err := s.repo.FindActiveGroupCall(groupID)
+	if errors.Is(err, repository.ErrNotFound) {
+		return nil, ErrCallNotFound
+	}
+	return call, err
+}
+
+// findGroupCall loads an active group call the user is in.
+func (s *CallService) findGroupCall(userID uuid.UUID, callID string) (*model.GroupCall, error) {
+	id, err := uuid.Parse(callID)
+	if err != nil {
+		return nil, fmt.Errorf("%w: call_id is required", ErrInvalidSignal)
+	}
+	call, err := s.repo.FindGroupCallByID(id)
+	if errors.Is(err, repository.ErrNotFound) {
+		return nil, ErrCallNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if call.Status != model.GroupCallStatusActive {
+		return nil, ErrInvalidCallState
+	}
+	if !call.HasParticipant(userID) {
+		return nil, ErrNotCallParticipant
+	}
+	return call, nil
+}
+
+// findHostedCall loads the group call of a host control request and checks its target.
+func (s *CallService) findHostedCall(hostID uuid.UUID, request model.GroupCallPayload) (*model.GroupCall, error) {
+	call, err := s.findGroupCall(hostID, request.CallID)
+	if err != nil {
+		return nil, err
+	}
+	if call.HostID != hostID {
+		return nil, ErrNotHost
+	}
+	if !call.HasParticipant(request.UserID) {
+		return nil, fmt.Errorf("%w: user_id must be a participant", ErrInvalidSignal)
+	}
+	return call, nil
+}
+
+// leaveGroupCall takes a user out of a group call and tells the group, or records the call when
+// it ended with them.
+func (s *CallService) leaveGroupCall(callID, userID uuid.UUID, event string) (*model.GroupCall, error) {
+	call, left, err := s.repo.LeaveGroupCall(callID, userID, s.clock.Now())
+	if errors.Is(err, repository.ErrNotFound) {
+		return nil, ErrInvalidCallState
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !left {
+		return nil, ErrNotCallParticipant
+	}
+
+	if call.Status == model.GroupCallStatusEnded {
+		s.finishGroupCall(call)
+		event = model.GroupCallEnded
+	}
+	s.broadcast(event, userID, call)
+	return call, nil
+}
+
+// updateParticipant applies updates to a participant and tells the group.
+func (s *CallService) updateParticipant(callID, userID uuid.UUID, updates map[string]interface{}, event string) (*model.GroupCall, error) {
+	updated, err := s.repo.UpdateGroupCallParticipant(callID, userID, updates)
+	if err != nil {
+		return nil, err
+	}
+	if !updated {
+		return nil, ErrNotCallParticipant
+	}
+	call, err := s.repo.FindGroupCallByID(callID)
+	if err != nil {
+		return nil, err
+	}
+	s.broadcast(event, userID, call)
+	return call, nil
+}
+
+// leaveAllGroupCalls takes a user that lost their connections out of their group calls.
+func (s *CallService) leaveAllGroupCalls(userID uuid.UUID) {
+	callIDs, err := s.repo.FindActiveGroupCallIDsByUser(userID)
+	if err != nil {
+		utils.LogError("Failed to load active group calls", err, zap.String("user_id", userID.String()))
+		return
+	}
+	for _, callID := range callIDs {
+		if _, err := s.leaveGroupCall(callID, userID, model.GroupCallLeft); err != nil &&
+			!errors.Is(err, ErrInvalidCallState) && !errors.Is(err, ErrNotCallParticipant) {
+			utils.LogError("Failed to leave group call", err, zap.String("call_id", callID.String()))
+		}
+	}
+}
+
+// finishGroupCall records an ended group call as a system message in the group.
+func (s *CallService) finishGroupCall(call *model.GroupCall) {
+	if s.messages == nil {
+		return
+	}
+	message := &model.Message{
+		GroupID:         call.GroupID,
+		Content:         fmt.Sprintf("Group %s call, %s", call.Media, time.Duration(call.Duration)*time.Second),
+		Type:            "call",
+		MediaType:       call.Media,
+		MediaDuration:   call.Duration,
+		IsSystemMessage: true,
+		Timestamp:       s.clock.Now(),
+	}
+	if err := s.messages.SendMessage(call.HostID, message); err != nil {
+		utils.LogError("Failed to record group call message", err, zap.String("call_id", call.ID.String()))
+		return
+	}
+	if err := s.repo.SetGroupCallMessage(call.ID, message.ID); err != nil {
+		utils.LogError("Failed to link group call message", err, zap.String("call_id", call.ID.String()))
+		return
+	}
+	call.MessageID = message.ID
+}
+
+// broadcast pushes a group call event to every member of the group.
+func (s *CallService) broadcast(event string, userID uuid.UUID, call *model.GroupCall) {
+	if s.notifier == nil {
+		return
+	}
+	members, err := s.groupRepo.FindGroupMemberIDs(call.GroupID)
+	if err != nil {
+		utils.LogError("Failed to resolve group members", err, zap.Uint("group_id", call.GroupID))
+		return
+	}
+	s.notifier.NotifyUsers(members, model.OpGroupCallState, model.GroupCallEvent{Event: event, UserID: userID, Call: call})
+}
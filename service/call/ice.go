@@ -0,0 +1,57 @@
+package call
+
+import (
+	"adwise-service/model"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ICEConfig describes the STUN and TURN servers handed to call participants.
+//
+// TURN credentials follow the REST API of coturn (use-auth-secret): the username is the expiry
+// time as a Unix timestamp and the user ID, separated by a colon, and the password is the base64
+// encoded HMAC-SHA1 of the username keyed with the shared secret. The TURN server checks them
+// without calling back into the service.
+type ICEConfig struct {
+	STUNURLs      []string      // For example "stun:turn.example.com:3478"
+	TURNURLs      []string      // For example "turn:turn.example.com:3478?transport=udp" or "turns:turn.example.com:5349"
+	TURNSecret    string        // Shared secret configured as static-auth-secret in coturn
+	CredentialTTL time.Duration // Time TURN credentials stay valid
+}
+
+// ICEServers returns the ICE servers for a user, with TURN credentials valid for the credential TTL.
+// Without a TURN secret only the STUN servers are returned.
+func (s *CallService) ICEServers(userID uuid.UUID) model.ICEServerConfig {
+	cfg := s.cfg.ICE
+	expiresAt := s.clock.Now().Add(cfg.CredentialTTL).Truncate(time.Second)
+	servers := model.ICEServerConfig{
+		ICEServers: []model.ICEServer{},
+		TTL:        int(cfg.CredentialTTL / time.Second),
+		ExpiresAt:  expiresAt,
+	}
+	if len(cfg.STUNURLs) > 0 {
+		servers.ICEServers = append(servers.ICEServers, model.ICEServer{URLs: cfg.STUNURLs})
+	}
+	if len(cfg.TURNURLs) > 0 && cfg.TURNSecret != "" {
+		username, credential := turnCredentials(cfg.TURNSecret, userID, expiresAt)
+		servers.ICEServers = append(servers.ICEServers, model.ICEServer{
+			URLs:       cfg.TURNURLs,
+			Username:   username,
+			Credential: credential,
+		})
+	}
+	return servers
+}
+
+// turnCredentials mints coturn REST API credentials for a user that expire at expiresAt.
+func turnCredentials(secret string, userID uuid.UUID, expiresAt time.Time) (username, credential string) {
+	username = strconv.FormatInt(expiresAt.Unix(), 10) + ":" + userID.String()
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return username, base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
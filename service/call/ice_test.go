@@ -0,0 +1,76 @@
+package call
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// fixedClock is a utils.Clock stopped at one instant.
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time { return time.Time(c) }
+
+func TestTURNCredentials(t *testing.T) {
+	userID := uuid.MustParse("6f1c2a3e-8b4d-4c5e-9f60-7a8b9c0d1e2f")
+	expiresAt := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	username, credential := turnCredentials("north-secret", userID, expiresAt)
+	if want := "1767225600:6f1c2a3e-8b4d-4c5e-9f60-7a8b9c0d1e2f"; username != want {
+		t.Fatalf("username is %q, want %q", username, want)
+	}
+	// What coturn computes for the username with static-auth-secret=north-secret, the same as
+	// printf '%s' "$username" | openssl dgst -sha1 -hmac north-secret -binary | base64
+	if want := "xJ/QoLCyVXYlD1BAGa7N5zBqD9M="; credential != want {
+		t.Fatalf("credential is %q, want %q", credential, want)
+	}
+}
+
+func TestICEServers(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	userID := uuid.MustParse("6f1c2a3e-8b4d-4c5e-9f60-7a8b9c0d1e2f")
+	ice := ICEConfig{
+		STUNURLs:      []string{"stun:turn.example.com:3478"},
+		TURNURLs:      []string{"turn:turn.example.com:3478?transport=udp"},
+		TURNSecret:    "north-secret",
+		CredentialTTL: 24 * time.Hour,
+	}
+
+	tests := []struct {
+		name    string
+		secret  string
+		servers int
+	}{
+		{"with TURN secret", ice.TURNSecret, 2},
+		{"without TURN secret", "", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := ice
+			cfg.TURNSecret = tt.secret
+			s := NewCallService(nil, nil, nil, Config{ICE: cfg})
+			// Credentials expire on a whole second, as coturn compares Unix timestamps
+			s.SetClock(fixedClock(now.Add(-24*time.Hour + 500*time.Millisecond)))
+
+			servers := s.ICEServers(userID)
+			if len(servers.ICEServers) != tt.servers {
+				t.Fatalf("got %d ICE servers, want %d", len(servers.ICEServers), tt.servers)
+			}
+			if servers.TTL != 86400 || !servers.ExpiresAt.Equal(now) {
+				t.Fatalf("TTL %d expiring at %s, want 86400 expiring at %s", servers.TTL, servers.ExpiresAt, now)
+			}
+			if stun := servers.ICEServers[0]; stun.URLs[0] != ice.STUNURLs[0] || stun.Username != "" {
+				t.Fatalf("first server is %+v, want the STUN server without credentials", stun)
+			}
+			if tt.servers == 1 {
+				return
+			}
+			turn := servers.ICEServers[1]
+			username, credential := turnCredentials(ice.TURNSecret, userID, now)
+			if turn.URLs[0] != ice.TURNURLs[0] || turn.Username != username || turn.Credential != credential {
+				t.Fatalf("TURN server is %+v, want credentials expiring at %s", turn, now)
+			}
+		})
+	}
+}
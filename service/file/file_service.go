@@ -2,93 +2,572 @@ package file
 
 import (
 	"adwise-service/model"
-	"log"
+	"adwise-service/repository"
+	"adwise-service/scanner"
+	"adwise-service/storage"
+	"adwise-service/utils"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"mime"
 	"mime/multipart"
-	"path/filepath"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/google/uuid"
 )
 
+var (
+	// ErrFileNotFound is returned when a file does not exist.
+	ErrFileNotFound = errors.New("file not found")
+	// ErrFileAccessDenied is returned when a user may not read a file.
+	ErrFileAccessDenied = errors.New("user may not access the file")
+	// ErrNotFileOwner is returned when someone other than the owner manages the shares of a file.
+	ErrNotFileOwner = errors.New("only the owner can manage the shares of a file")
+	// ErrInvalidShare is returned when a file is shared with nobody or with its owner.
+	ErrInvalidShare = errors.New("a file can only be shared with other users")
+	// ErrDirectUploadUnsupported is returned when the blob store can not sign upload URLs.
+	ErrDirectUploadUnsupported = errors.New("direct uploads are not supported by the file storage")
+	// ErrUploadNotPending is returned when completing the upload of a file that is not pending.
+	ErrUploadNotPending = errors.New("file upload is already complete")
+	// ErrUploadIncomplete is returned when completing an upload whose content has not been stored.
+	ErrUploadIncomplete = errors.New("file content has not been uploaded")
+	// ErrUploadMismatch is returned when uploaded content differs from the announced size or checksum.
+	ErrUploadMismatch = errors.New("uploaded content does not match the upload intent")
+	// ErrFileQuarantined is returned when downloading a file that has not been scanned for malware yet.
+	ErrFileQuarantined = errors.New("file is awaiting a malware scan")
+	// ErrFileInfected is returned when downloading or attaching a file in which malware was found.
+	ErrFileInfected = errors.New("file is infected with malware")
+	// ErrFileUnscannable is returned when downloading a file too large for the malware scanner.
+	ErrFileUnscannable = errors.New("file is too large to be scanned for malware")
+)
+
+// EventFileScanned is pushed to the uploader of a file once its malware scan has a verdict.
+const EventFileScanned = "file.scanned"
+
+// Notifier pushes realtime events to connected users.
+type Notifier interface {
+	NotifyUsers(userIDs []uuid.UUID, event string, payload interface{})
+}
+
+// Config holds the settings of the FileService.
+type Config struct {
+	MaxUploadSize     int64            // Largest file accepted in bytes unless its type has a limit; 0 disables the limit
+	TypeSizeLimits    map[string]int64 // Size limits of content types, like image/png or image/*
+	AllowedTypes      []string         // Accepted content types, like image/png, image/* or *; empty accepts any
+	SignedURLExpiry   time.Duration    // Validity of signed upload and download URLs
+	RedirectDownloads bool             // Redirect downloads to signed URLs of the blob store instead of streaming them
+	UploadTTL         time.Duration    // Time after which unfinished resumable and direct uploads are discarded
+	ThumbnailSizes    []int            // Edges of the squares thumbnails of images are fit into, in pixels
+	ImageConcurrency  int              // Images decoded at a time, each taking up to 4 bytes a pixel; at least 1
+}
+
+// filePath is the download endpoint of stored files; a file's URL is filePath followed by its ID.
+const filePath = "/api/files?id="
+
 // FileService handles file uploads and downloads.
+//
+// Every stored file has a record naming its owner. A user may read a file they own, one shared with
+// them, or one attached to a message in one of their conversations; a message is attached to a file
+// by using the file's URL as its media URL.
+//
+// Clients can also upload directly to the blob store: an upload intent creates a pending file and
+// returns a signed PUT request for its content, and completing the upload checks the content
+// against the intent and copies it to where the file is served from. Pending files can not be read
+// or attached.
+//
+// With a scanner set, every new file is quarantined and queued for a malware scan once its content
+// is complete. The ScanWorker scans it and marks it clean or infected, or unscannable when it is too
+// large for the scanner; only clean files can be downloaded, and the uploader is told the verdict.
+//
+// Images are stripped of their metadata before they become ready and get thumbnails, which are
+// read with the permissions of the image.
 type FileService struct {
-	s3Bucket string
-	s3Region string
-	uploader *s3manager.Uploader
+	store      storage.BlobStore
+	repo       repository.FileRepository
+	cfg        Config
+	clock      utils.Clock
+	scanner    scanner.Scanner
+	notifier   Notifier
+	scanQueued chan struct{}
+	imageSlots chan struct{}
+}
+
+// NewFileService creates a new FileService storing files in store.
+func NewFileService(store storage.BlobStore, repo repository.FileRepository, cfg Config) *FileService {
+	return &FileService{
+		store:      store,
+		repo:       repo,
+		cfg:        cfg,
+		clock:      utils.SystemClock{},
+		scanQueued: make(chan struct{}, 1),
+		imageSlots: make(chan struct{}, max(cfg.ImageConcurrency, 1)),
+	}
+}
+
+// SetScanner sets the scanner new files are checked for malware with. Without one, files are clean
+// as soon as they are stored.
+func (s *FileService) SetScanner(scanner scanner.Scanner) {
+	s.scanner = scanner
+}
+
+// SetNotifier sets the notifier used to tell uploaders the verdicts of malware scans.
+func (s *FileService) SetNotifier(notifier Notifier) {
+	s.notifier = notifier
+}
+
+// SetClock replaces the clock the service reads the current time from.
+func (s *FileService) SetClock(clock utils.Clock) {
+	s.clock = clock
+}
+
+// UploadFile checks a file uploaded by its owner, stores it and records it. The file is stored
+// with the type detected from its content; images are processed by processImage.
+func (s *FileService) UploadFile(ownerID uuid.UUID, file multipart.File, header *multipart.FileHeader) (*model.File, error) {
+	ctx := context.Background()
+	name := sanitizeFileName(header.Filename)
+	if header.Size <= 0 {
+		return nil, newValidationError(ErrInvalidUpload, model.UploadErrInvalid, "the file is empty")
+	}
+	head := make([]byte, sniffLength)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	contentType, err := s.checkContent(name, head[:n], header.Size)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	key := objectKey(contentType)
+	hash := sha256.New()
+	info, err := s.store.Put(ctx, key, io.TeeReader(file, hash), contentType)
+	if err != nil {
+		return nil, err
+	}
+
+	record := &model.File{
+		OwnerID:     ownerID,
+		Name:        name,
+		Key:         key,
+		ContentType: contentType,
+		Size:        info.Size,
+		Checksum:    hex.EncodeToString(hash.Sum(nil)),
+		Status:      model.FileStatusReady,
+		ScanStatus:  s.newScanStatus(),
+	}
+	if err := s.processImage(ctx, record); err != nil {
+		s.deleteFileObjects(ctx, record)
+		return nil, err
+	}
+	if err := s.repo.CreateFile(record); err != nil {
+		// An object without a record can not be reached, so it is not kept
+		s.deleteFileObjects(ctx, record)
+		return nil, err
+	}
+	s.queueScan(record)
+	setURLs(record)
+	return record, nil
 }
 
-// NewFileService creates a new FileService.
-func NewFileService(s3Bucket, s3Region string) *FileService {
-	// Initialize AWS session
-	sess, err := session.NewSession(&aws.Config{
-		Region: aws.String(s3Region),
+// CreateUploadIntent validates a file the owner is about to upload directly to the blob store,
+// records it as pending and signs the PUT request that uploads its content.
+func (s *FileService) CreateUploadIntent(ownerID uuid.UUID, request model.UploadIntentRequest) (*model.UploadIntent, error) {
+	request.Name = sanitizeFileName(request.Name)
+	if err := s.validateUpload(request); err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	key := stagingKey(request.ContentType)
+	expiresAt := s.clock.Now().Add(s.cfg.SignedURLExpiry)
+	url, err := s.store.SignedURL(ctx, key, http.MethodPut, s.cfg.SignedURLExpiry, storage.SignOptions{
+		ContentType:   request.ContentType,
+		ContentLength: request.Size,
 	})
+	if errors.Is(err, storage.ErrNotSupported) {
+		return nil, ErrDirectUploadUnsupported
+	}
 	if err != nil {
-		log.Fatalf("Failed to create AWS session: %v", err)
+		return nil, err
 	}
 
-	return &FileService{
-		s3Bucket: s3Bucket,
-		s3Region: s3Region,
-		uploader: s3manager.NewUploader(sess),
+	record := &model.File{
+		OwnerID:     ownerID,
+		Name:        request.Name,
+		Key:         key,
+		ContentType: request.ContentType,
+		Size:        request.Size,
+		Checksum:    strings.ToLower(request.Checksum),
+		Status:      model.FileStatusPending,
+		ScanStatus:  s.newScanStatus(),
+	}
+	if err := s.repo.CreateFile(record); err != nil {
+		return nil, err
 	}
+	setURLs(record)
+	return &model.UploadIntent{
+		File: record,
+		Upload: model.UploadTarget{
+			Method:    http.MethodPut,
+			URL:       url,
+			Headers:   map[string]string{"Content-Type": request.ContentType},
+			ExpiresAt: expiresAt,
+		},
+	}, nil
 }
 
-// UploadFile uploads a file to S3 and returns the file URL.
-func (s *FileService) UploadFile(file multipart.File, header *multipart.FileHeader) (*model.File, error) {
-	// Generate a unique file name
-	fileName := generateUniqueFileName(header.Filename)
+// CompleteUpload makes a pending file of the owner ready once its content is in the blob store with
+// the announced size and checksum and passes validation, processing images. Content that does not
+// match or is rejected is deleted, so the client can upload it again with the same intent while its
+// URL is valid.
+//
+// The signed URL writes to a staging key, and the content is copied to a new key of the file while
+// it is checked. Whatever is uploaded with the URL after that is never served, so it can not replace
+// a file that passed validation, scanning and processing.
+func (s *FileService) CompleteUpload(ownerID uuid.UUID, fileID uint) (*model.File, error) {
+	file, err := s.findOwnFile(ownerID, fileID)
+	if err != nil {
+		return nil, err
+	}
+	if file.Status != model.FileStatusPending {
+		return nil, ErrUploadNotPending
+	}
 
-	// Upload the file to S3
-	_, err := s.uploader.Upload(&s3manager.UploadInput{
-		Bucket: aws.String(s.s3Bucket),
-		Key:    aws.String(fileName),
-		Body:   file,
-	})
+	ctx := context.Background()
+	staged := file.Key
+	body, info, err := s.store.Get(ctx, staged)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, ErrUploadIncomplete
+	}
 	if err != nil {
 		return nil, err
 	}
+	defer body.Close()
+	if info.Size != file.Size {
+		if err := s.store.Delete(ctx, staged); err != nil {
+			return nil, err
+		}
+		return nil, ErrUploadMismatch
+	}
+	head := make([]byte, sniffLength)
+	n, err := io.ReadFull(body, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	contentType, err := s.checkContent(file.Name, head[:n], info.Size)
+	if err != nil {
+		s.deleteObject(ctx, staged)
+		return nil, err
+	}
 
-	// Generate the file URL
-	fileURL := "https://" + s.s3Bucket + ".s3." + s.s3Region + ".amazonaws.com/" + fileName
+	// Each completion copies to a key of its own, so concurrent completions do not write over
+	// each other's objects and the one that loses deletes only its own
+	file.Key = objectKey(contentType)
+	hash := sha256.New()
+	info, err = s.store.Put(ctx, file.Key, io.TeeReader(io.MultiReader(bytes.NewReader(head[:n]), body), hash), contentType)
+	if err != nil {
+		s.deleteObject(ctx, file.Key)
+		return nil, err
+	}
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	if info.Size != file.Size || (file.Checksum != "" && checksum != file.Checksum) {
+		s.deleteObject(ctx, file.Key)
+		if err := s.store.Delete(ctx, staged); err != nil {
+			return nil, err
+		}
+		return nil, ErrUploadMismatch
+	}
+	file.Checksum = checksum
+	file.ContentType = contentType
+	if err := s.processImage(ctx, file); err != nil {
+		s.deleteFileObjects(ctx, file)
+		s.deleteObject(ctx, staged)
+		return nil, err
+	}
 
-	return &model.File{
-		Name: header.Filename,
-		URL:  fileURL,
-		Size: header.Size,
-	}, nil
+	completed, err := s.repo.CompleteFileUpload(file)
+	if err != nil {
+		s.deleteFileObjects(ctx, file)
+		return nil, err
+	}
+	if !completed {
+		s.deleteFileObjects(ctx, file)
+		return nil, ErrUploadNotPending
+	}
+	s.deleteObject(ctx, staged)
+	file.Status = model.FileStatusReady
+	setURLs(file)
+	s.queueScan(file)
+	return file, nil
 }
 
-// DownloadFile downloads a file from S3.
-func (s *FileService) DownloadFile(fileName string) ([]byte, error) {
-	// Initialize AWS session
-	sess, err := session.NewSession(&aws.Config{
-		Region: aws.String(s.s3Region),
-	})
+// GetFile returns the record of a file the user may read.
+func (s *FileService) GetFile(userID uuid.UUID, fileID uint) (*model.File, error) {
+	file, err := s.repo.FindFileByID(fileID)
+	if errors.Is(err, repository.ErrNotFound) {
+		return nil, ErrFileNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
+	setURLs(file)
+	if file.Status == model.FileStatusPending {
+		return nil, ErrFileNotFound
+	}
 
-	// Download the file from S3
-	downloader := s3manager.NewDownloader(sess)
-	buf := aws.NewWriteAtBuffer([]byte{})
+	if file.OwnerID != userID {
+		allowed, err := s.repo.CanAccessFile(file.ID, file.URL, userID)
+		if err != nil {
+			return nil, err
+		}
+		if !allowed {
+			return nil, ErrFileAccessDenied
+		}
+	}
+	return file, nil
+}
 
-	_, err = downloader.Download(buf, &s3.GetObjectInput{
-		Bucket: aws.String(s.s3Bucket),
-		Key:    aws.String(fileName),
+// OpenFile opens a clean file the user may read for streaming. The returned reader seeks by
+// reopening the object at the new offset, so ranges of large files are served without reading the
+// rest. The caller closes it.
+func (s *FileService) OpenFile(ctx context.Context, userID uuid.UUID, fileID uint) (*model.File, *storage.Reader, storage.ObjectInfo, error) {
+	file, err := s.GetFile(userID, fileID)
+	if err != nil {
+		return nil, nil, storage.ObjectInfo{}, err
+	}
+	if err := checkScanned(file); err != nil {
+		return nil, nil, storage.ObjectInfo{}, err
+	}
+	info, err := s.store.Stat(ctx, file.Key)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil, storage.ObjectInfo{}, ErrFileNotFound
+	}
+	if err != nil {
+		return nil, nil, storage.ObjectInfo{}, err
+	}
+	return file, storage.NewReader(ctx, s.store, info), info, nil
+}
+
+// SignedDownloadURL returns a short-lived URL reading a clean file the user may read straight from
+// the blob store. It returns "" when downloads are not redirected or the store can not sign URLs, in
+// which case the file is streamed by OpenFile.
+func (s *FileService) SignedDownloadURL(ctx context.Context, userID uuid.UUID, fileID uint, download bool) (string, error) {
+	if !s.cfg.RedirectDownloads {
+		return "", nil
+	}
+	file, err := s.GetFile(userID, fileID)
+	if err != nil {
+		return "", err
+	}
+	if err := checkScanned(file); err != nil {
+		return "", err
+	}
+	url, err := s.store.SignedURL(ctx, file.Key, http.MethodGet, s.cfg.SignedURLExpiry, storage.SignOptions{
+		ContentType:        ContentType(file),
+		ContentDisposition: ContentDisposition(file, download),
 	})
+	if errors.Is(err, storage.ErrNotSupported) {
+		return "", nil
+	}
+	return url, err
+}
+
+// SignedURLHandler returns the handler serving the signed URLs of a blob store that emulates them,
+// or nil when the store's URLs point elsewhere.
+func (s *FileService) SignedURLHandler() http.Handler {
+	handler, _ := s.store.(http.Handler)
+	return handler
+}
+
+// ShareFile gives users access to a file of the owner.
+func (s *FileService) ShareFile(ownerID uuid.UUID, fileID uint, userIDs []uuid.UUID) ([]model.FileShare, error) {
+	if _, err := s.findOwnFile(ownerID, fileID); err != nil {
+		return nil, err
+	}
+	if len(userIDs) == 0 {
+		return nil, ErrInvalidShare
+	}
+	shares := make([]model.FileShare, 0, len(userIDs))
+	for _, userID := range userIDs {
+		if userID == uuid.Nil || userID == ownerID {
+			return nil, ErrInvalidShare
+		}
+		shares = append(shares, model.FileShare{FileID: fileID, UserID: userID, SharedBy: ownerID})
+	}
+	if err := s.repo.CreateFileShares(shares); err != nil {
+		return nil, err
+	}
+	return s.repo.FindFileShares(fileID)
+}
+
+// UnshareFile revokes a user's access to a file of the owner. Users who can see the file in a
+// conversation keep access through it.
+func (s *FileService) UnshareFile(ownerID uuid.UUID, fileID uint, userID uuid.UUID) error {
+	if _, err := s.findOwnFile(ownerID, fileID); err != nil {
+		return err
+	}
+	return s.repo.DeleteFileShare(fileID, userID)
+}
+
+// GetFileShares lists the users a file of the owner is shared with.
+func (s *FileService) GetFileShares(ownerID uuid.UUID, fileID uint) ([]model.FileShare, error) {
+	if _, err := s.findOwnFile(ownerID, fileID); err != nil {
+		return nil, err
+	}
+	return s.repo.FindFileShares(fileID)
+}
+
+// CanAttach reports whether a user may send a message with the given media URL. Attaching a stored
+// file requires access to it, since attaching grants access to the conversation, and infected or
+// unscannable files can not be attached; quarantined files can, as recipients can download them once
+// they are clean.
+// Other URLs are not checked.
+func (s *FileService) CanAttach(userID uuid.UUID, mediaURL string) (bool, error) {
+	fileID, ok := parseFileURL(mediaURL)
+	if !ok {
+		return !strings.HasPrefix(mediaURL, filePath), nil
+	}
+	file, err := s.GetFile(userID, fileID)
+	if errors.Is(err, ErrFileNotFound) || errors.Is(err, ErrFileAccessDenied) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return file.ScanStatus == model.ScanStatusClean || file.ScanStatus == model.ScanStatusQuarantined, nil
+}
+
+// AttachedFile returns the ready file behind a media URL, or nil when the URL does not point to
+// one.
+func (s *FileService) AttachedFile(mediaURL string) (*model.File, error) {
+	fileID, ok := parseFileURL(mediaURL)
+	if !ok {
+		return nil, nil
+	}
+	file, err := s.repo.FindFileByID(fileID)
+	if errors.Is(err, repository.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if file.Status != model.FileStatusReady {
+		return nil, nil
+	}
+	setURLs(file)
+	return file, nil
+}
+
+// MarkAttached records that a message of the sender attaches the file behind a media URL. A file
+// the sender owns becomes ephemeral when its first use is in a disappearing message, and is then
+// deleted once no message refers to it; files used before, shared or attached by other users are
+// kept. Other URLs are left alone.
+func (s *FileService) MarkAttached(senderID uuid.UUID, mediaURL string, disappearing bool) error {
+	fileID, ok := parseFileURL(mediaURL)
+	if !ok {
+		return nil
+	}
+	file, err := s.repo.FindFileByID(fileID)
+	if errors.Is(err, repository.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if file.AttachedAt != nil {
+		return nil
+	}
+	return s.repo.MarkFileAttached(file.ID, disappearing && file.OwnerID == senderID, s.clock.Now())
+}
+
+// DeleteExpiredMedia deletes the file behind the media URL of expired messages that no remaining
+// message refers to, if the file is ephemeral. Files the owner uploaded before or has shared are
+// kept, and so are URLs that do not point to a stored file.
+func (s *FileService) DeleteExpiredMedia(mediaURL string) error {
+	fileID, ok := parseFileURL(mediaURL)
+	if !ok {
+		return nil
+	}
+	file, err := s.repo.FindFileByID(fileID)
+	if errors.Is(err, repository.ErrNotFound) {
+		return nil
+	}
+	if err != nil || !file.Ephemeral {
+		return err
+	}
+	deleted, err := s.repo.DeleteEphemeralFile(file.ID)
+	if err != nil || !deleted {
+		return err
+	}
+	return s.deleteFileObjects(context.Background(), file)
+}
+
+// findOwnFile loads a file of the owner.
+func (s *FileService) findOwnFile(ownerID uuid.UUID, fileID uint) (*model.File, error) {
+	file, err := s.repo.FindFileByID(fileID)
+	if errors.Is(err, repository.ErrNotFound) {
+		return nil, ErrFileNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
+	if file.OwnerID != ownerID {
+		return nil, ErrNotFileOwner
+	}
+	return file, nil
+}
+
+// ContentType returns the Content-Type a file is served with.
+func ContentType(file *model.File) string {
+	if file.ContentType == "" {
+		return "application/octet-stream"
+	}
+	return file.ContentType
+}
 
-	return buf.Bytes(), nil
+// ContentDisposition returns the Content-Disposition a file is served with. Media a browser can show
+// is served inline unless download is set, except SVG, which can carry script; the file name is
+// encoded for non-ASCII names.
+func ContentDisposition(file *model.File, download bool) string {
+	contentType := ContentType(file)
+	disposition := "attachment"
+	if !download && (strings.HasPrefix(contentType, "image/") || strings.HasPrefix(contentType, "audio/") ||
+		strings.HasPrefix(contentType, "video/")) && contentType != "image/svg+xml" {
+		disposition = "inline"
+	}
+	if value := mime.FormatMediaType(disposition, map[string]string{"filename": file.Name}); value != "" {
+		return value
+	}
+	return disposition
 }
 
-// generateUniqueFileName generates a unique file name.
-func generateUniqueFileName(originalName string) string {
-	ext := filepath.Ext(originalName)
-	return uuid.New().String() + ext
+// setURLs sets the download URLs of a file and its thumbnails.
+func setURLs(file *model.File) {
+	file.URL = fileURL(file.ID)
+	for i := range file.Thumbnails {
+		file.Thumbnails[i].URL = thumbnailURL(file.ID, file.Thumbnails[i].Size)
+	}
+}
+
+// fileURL returns the download URL of a file.
+func fileURL(fileID uint) string {
+	return filePath + strconv.FormatUint(uint64(fileID), 10)
+}
+
+// parseFileURL returns the ID of the file a URL returned by fileURL points to.
+func parseFileURL(url string) (uint, bool) {
+	idStr, ok := strings.CutPrefix(url, filePath)
+	if !ok {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	return uint(id), err == nil && id > 0
 }
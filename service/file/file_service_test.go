@@ -0,0 +1,299 @@
+package file
+
+import (
+	"adwise-service/model"
+	"adwise-service/repository"
+	"adwise-service/storage"
+	"adwise-service/utils"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"mime/multipart"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+func init() {
+	utils.Logger = zap.NewNop()
+}
+
+// signingStore is a MemoryStore that signs URLs, recording the keys they were signed for.
+type signingStore struct {
+	*storage.MemoryStore
+	signed []string
+}
+
+func (s *signingStore) SignedURL(ctx context.Context, key, method string, expiry time.Duration, opts storage.SignOptions) (string, error) {
+	s.signed = append(s.signed, key)
+	return "https://blobs.example.com/" + key, nil
+}
+
+// fakeFileRepo keeps files in memory. Methods the tests do not use are left to the embedded nil
+// interface and panic when called.
+type fakeFileRepo struct {
+	repository.FileRepository
+
+	mu     sync.Mutex
+	files  map[uint]*model.File
+	jobs   map[uint]*model.ScanJob
+	shares map[uint][]model.FileShare
+}
+
+func newFakeFileRepo() *fakeFileRepo {
+	return &fakeFileRepo{
+		files:  make(map[uint]*model.File),
+		jobs:   make(map[uint]*model.ScanJob),
+		shares: make(map[uint][]model.FileShare),
+	}
+}
+
+func (r *fakeFileRepo) CreateFile(file *model.File) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	file.ID = uint(len(r.files) + 1)
+	file.CreatedAt = time.Now()
+	stored := *file
+	r.files[file.ID] = &stored
+	return nil
+}
+
+func (r *fakeFileRepo) FindFileByID(id uint) (*model.File, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	file, ok := r.files[id]
+	if !ok {
+		return nil, repository.ErrNotFound
+	}
+	found := *file
+	return &found, nil
+}
+
+func (r *fakeFileRepo) CompleteFileUpload(file *model.File) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stored := r.files[file.ID]
+	if stored.Status != model.FileStatusPending {
+		return false, nil
+	}
+	completed := *file
+	completed.Status = model.FileStatusReady
+	r.files[file.ID] = &completed
+	return true, nil
+}
+
+func (r *fakeFileRepo) MarkFileAttached(id uint, ephemeral bool, at time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	file := r.files[id]
+	if file.AttachedAt == nil {
+		file.AttachedAt = &at
+		file.Ephemeral = ephemeral && len(r.shares[id]) == 0
+	}
+	return nil
+}
+
+func (r *fakeFileRepo) DeleteEphemeralFile(id uint) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	file, ok := r.files[id]
+	if !ok || !file.Ephemeral || len(r.shares[id]) > 0 {
+		return false, nil
+	}
+	delete(r.files, id)
+	return true, nil
+}
+
+func (r *fakeFileRepo) CreateFileShares(shares []model.FileShare) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, share := range shares {
+		r.files[share.FileID].Ephemeral = false
+		r.shares[share.FileID] = append(r.shares[share.FileID], share)
+	}
+	return nil
+}
+
+func (r *fakeFileRepo) FindFileShares(fileID uint) ([]model.FileShare, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.shares[fileID], nil
+}
+
+func (r *fakeFileRepo) FindExpiredUploads(before time.Time, limit int) ([]model.Upload, error) {
+	return nil, nil
+}
+
+func (r *fakeFileRepo) FindPendingFiles(before time.Time, limit int) ([]model.File, error) {
+	return nil, nil
+}
+
+// readObject returns the content of an object.
+func readObject(t *testing.T, store storage.BlobStore, key string) string {
+	t.Helper()
+	body, _, err := store.Get(context.Background(), key)
+	if err != nil {
+		t.Fatalf("get %s: %v", key, err)
+	}
+	defer body.Close()
+	content, _ := io.ReadAll(body)
+	return string(content)
+}
+
+func TestDirectUploadIsCopiedOutOfTheSignedKey(t *testing.T) {
+	ctx := context.Background()
+	store := &signingStore{MemoryStore: storage.NewMemoryStore()}
+	repo := newFakeFileRepo()
+	s := NewFileService(store, repo, Config{SignedURLExpiry: time.Hour, UploadTTL: time.Hour})
+	ownerID := uuid.New()
+	content := "meeting notes\n"
+
+	intent, err := s.CreateUploadIntent(ownerID, model.UploadIntentRequest{
+		Name: "notes.txt", ContentType: "text/plain", Size: int64(len(content)),
+	})
+	if err != nil {
+		t.Fatalf("create upload intent: %v", err)
+	}
+	signedKey := store.signed[0]
+	if !strings.HasPrefix(signedKey, stagingPrefix) {
+		t.Fatalf("upload URL is signed for %q, want a key under %q", signedKey, stagingPrefix)
+	}
+
+	if _, err := s.CompleteUpload(ownerID, intent.File.ID); !errors.Is(err, ErrUploadIncomplete) {
+		t.Fatalf("completing before the upload: %v, want ErrUploadIncomplete", err)
+	}
+	store.Put(ctx, signedKey, strings.NewReader(content), "text/plain")
+	file, err := s.CompleteUpload(ownerID, intent.File.ID)
+	if err != nil {
+		t.Fatalf("complete upload: %v", err)
+	}
+	if file.Key == signedKey || strings.HasPrefix(file.Key, stagingPrefix) {
+		t.Fatalf("completed file is served from %q, the key the upload URL is signed for", file.Key)
+	}
+	if _, err := store.Stat(ctx, signedKey); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("staged content was kept after the upload completed: %v", err)
+	}
+
+	// Uploading again with the signed URL does not change the file
+	store.Put(ctx, signedKey, strings.NewReader("<script>evil()</script>"), "text/plain")
+	if _, err := s.CompleteUpload(ownerID, intent.File.ID); !errors.Is(err, ErrUploadNotPending) {
+		t.Fatalf("completing twice: %v, want ErrUploadNotPending", err)
+	}
+	stored, _ := repo.FindFileByID(intent.File.ID)
+	if stored.Key != file.Key || readObject(t, store, stored.Key) != content {
+		t.Fatalf("file content changed after an upload to the signed URL")
+	}
+
+	// Content uploaded again once no pending file can own it is swept
+	if _, err := s.SweepUploads(time.Now().Add(time.Hour), 10); err != nil {
+		t.Fatalf("sweep: %v", err)
+	}
+	if _, err := store.Stat(ctx, signedKey); errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("staged content was swept while its upload URL may be in use")
+	}
+	if _, err := s.SweepUploads(time.Now().Add(2*time.Hour+time.Minute), 10); err != nil {
+		t.Fatalf("sweep: %v", err)
+	}
+	if _, err := store.Stat(ctx, signedKey); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("staged content left after the upload completed was not swept: %v", err)
+	}
+}
+
+func TestDirectUploadMismatchIsDeleted(t *testing.T) {
+	ctx := context.Background()
+	store := &signingStore{MemoryStore: storage.NewMemoryStore()}
+	s := NewFileService(store, newFakeFileRepo(), Config{SignedURLExpiry: time.Hour})
+	ownerID := uuid.New()
+
+	intent, err := s.CreateUploadIntent(ownerID, model.UploadIntentRequest{
+		Name:        "notes.txt",
+		ContentType: "text/plain",
+		Size:        5,
+		Checksum:    "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", // SHA-256 of "hello"
+	})
+	if err != nil {
+		t.Fatalf("create upload intent: %v", err)
+	}
+	signedKey := store.signed[0]
+
+	for _, content := range []string{"hello, world", "howdy"} {
+		store.Put(ctx, signedKey, strings.NewReader(content), "text/plain")
+		if _, err := s.CompleteUpload(ownerID, intent.File.ID); !errors.Is(err, ErrUploadMismatch) {
+			t.Fatalf("completing with %q: %v, want ErrUploadMismatch", content, err)
+		}
+		if objects, _ := store.List(ctx, ""); len(objects) != 0 {
+			t.Fatalf("content %q left %d objects behind", content, len(objects))
+		}
+	}
+
+	store.Put(ctx, signedKey, bytes.NewReader([]byte("hello")), "text/plain")
+	if _, err := s.CompleteUpload(ownerID, intent.File.ID); err != nil {
+		t.Fatalf("completing with the announced content: %v", err)
+	}
+}
+
+func TestExpiredMediaIsDeletedOnlyIfSentJustForTheMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		byOwner bool // Whether the first message attaching the file is sent by its owner
+		first   bool // Whether the first message attaching the file disappears
+		share   bool // Whether the owner shares the file after sending it
+		deleted bool
+	}{
+		{"sent in a disappearing message", true, true, false, true},
+		{"shared after it was sent", true, true, true, false},
+		{"sent in a lasting message first", true, false, false, false},
+		{"forwarded by another user", false, true, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := storage.NewMemoryStore()
+			repo := newFakeFileRepo()
+			s := NewFileService(store, repo, Config{})
+			ownerID := uuid.New()
+			header := &multipart.FileHeader{Filename: "notes.txt", Size: int64(len("meeting notes\n"))}
+			file, err := s.UploadFile(ownerID, nopCloser{strings.NewReader("meeting notes\n")}, header)
+			if err != nil {
+				t.Fatalf("upload: %v", err)
+			}
+
+			senderID := ownerID
+			if !tt.byOwner {
+				senderID = uuid.New()
+			}
+			if err := s.MarkAttached(senderID, file.URL, tt.first); err != nil {
+				t.Fatalf("mark attached: %v", err)
+			}
+			// Later messages do not change what the first one decided
+			if err := s.MarkAttached(ownerID, file.URL, !tt.first); err != nil {
+				t.Fatalf("mark attached again: %v", err)
+			}
+			if tt.share {
+				if _, err := s.ShareFile(ownerID, file.ID, []uuid.UUID{uuid.New()}); err != nil {
+					t.Fatalf("share: %v", err)
+				}
+			}
+
+			if err := s.DeleteExpiredMedia(file.URL); err != nil {
+				t.Fatalf("delete expired media: %v", err)
+			}
+			_, findErr := repo.FindFileByID(file.ID)
+			_, statErr := store.Stat(ctx, file.Key)
+			if deleted := errors.Is(findErr, repository.ErrNotFound); deleted != tt.deleted {
+				t.Fatalf("file record deleted %t, want %t", deleted, tt.deleted)
+			}
+			if deleted := errors.Is(statErr, storage.ErrNotFound); deleted != tt.deleted {
+				t.Fatalf("file content deleted %t, want %t", deleted, tt.deleted)
+			}
+			if shares, _ := repo.FindFileShares(file.ID); tt.share && len(shares) != 1 {
+				t.Fatalf("file has %d shares after the message expired, want 1", len(shares))
+			}
+		})
+	}
+}
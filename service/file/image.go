@@ -0,0 +1,308 @@
+package file
+
+import (
+	"adwise-service/model"
+	"adwise-service/storage"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"image"
+	_ "image/gif" // Registers the GIF decoder
+	"image/jpeg"
+	"image/png"
+	"io"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/buckket/go-blurhash"
+	"github.com/google/uuid"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp" // Registers the WebP decoder
+)
+
+// ErrThumbnailNotFound is returned when a file has no thumbnail of the requested size.
+var ErrThumbnailNotFound = errors.New("thumbnail not found")
+
+// thumbnailPath is the download endpoint of thumbnails; a thumbnail's URL is thumbnailPath followed
+// by the file's ID and the thumbnail's size.
+const thumbnailPath = "/api/files/thumbnail?id="
+
+const (
+	// maxImagePixels is the largest image processed, in pixels. Larger images are rejected, since
+	// decoding them could exhaust memory: a decoded image takes up to 4 bytes a pixel, 96MB at
+	// the limit, on top of the original and its stripped copy.
+	maxImagePixels = 24 << 20
+	// thumbnailPrefix starts the keys of thumbnail objects.
+	thumbnailPrefix = "thumbnails/"
+	// thumbnailQuality is the JPEG quality thumbnails are encoded with.
+	thumbnailQuality = 80
+	// blurhashSize is the edge of the image a blurhash is computed from, in pixels.
+	blurhashSize = 32
+)
+
+// processedImageTypes are the image types processed on upload. Other images are stored as they
+// are, without thumbnails.
+var processedImageTypes = []string{"image/jpeg", "image/png", "image/gif", "image/webp"}
+
+// processImage prepares the stored content of an image file before the file becomes ready. The
+// image is stripped of its metadata in place, and its upright dimensions, a blurhash and its
+// thumbnails, one per configured size, are recorded on the file. The thumbnails are stored as
+// objects of their own; if the file is not recorded after all, they are removed with
+// deleteFileObjects.
+//
+// An image that can not be decoded, or exceeds maxImagePixels, is rejected with a ValidationError
+// before it is read in full. At most the configured number of images are processed at a time.
+func (s *FileService) processImage(ctx context.Context, file *model.File) error {
+	contentType := mediaType(file.ContentType)
+	if !slices.Contains(processedImageTypes, contentType) {
+		return nil
+	}
+	body, _, err := s.store.Get(ctx, file.Key)
+	if err != nil {
+		return err
+	}
+	config, _, err := image.DecodeConfig(body)
+	body.Close()
+	if err != nil {
+		return newValidationError(ErrInvalidUpload, model.UploadErrInvalid, "%s is not a readable image", file.Name)
+	}
+	if config.Width*config.Height > maxImagePixels {
+		return newValidationError(ErrFileTooLarge, model.UploadErrTooLarge, "%s has more than the %d pixels allowed for images",
+			file.Name, maxImagePixels)
+	}
+
+	select {
+	case s.imageSlots <- struct{}{}:
+		defer func() { <-s.imageSlots }()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	body, _, err = s.store.Get(ctx, file.Key)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return err
+	}
+	stripped, orientation, changed, err := stripMetadata(contentType, data)
+	if err != nil {
+		return newValidationError(ErrInvalidUpload, model.UploadErrInvalid, "%s is not a readable image", file.Name)
+	}
+	img, _, err := image.Decode(bytes.NewReader(stripped))
+	if err != nil {
+		return newValidationError(ErrInvalidUpload, model.UploadErrInvalid, "%s is not a readable image", file.Name)
+	}
+
+	thumbnails, placeholder, err := s.createThumbnails(ctx, file.Key, img, orientation)
+	if err != nil {
+		return err
+	}
+	if changed {
+		info, err := s.store.Put(ctx, file.Key, bytes.NewReader(stripped), contentType)
+		if err != nil {
+			for _, thumbnail := range thumbnails {
+				s.deleteObject(ctx, thumbnail.Key)
+			}
+			return err
+		}
+		sum := sha256.Sum256(stripped)
+		file.Checksum = hex.EncodeToString(sum[:])
+		file.Size = info.Size
+	}
+
+	file.Width, file.Height = config.Width, config.Height
+	if orientation >= 5 {
+		file.Width, file.Height = file.Height, file.Width
+	}
+	file.Blurhash = placeholder
+	file.Thumbnails = thumbnails
+	return nil
+}
+
+// createThumbnails stores the thumbnails of an image, each fit into a square of a configured size
+// and turned upright, and computes its blurhash. Images are never enlarged, so the thumbnails of a
+// small image keep its size. The thumbnails are returned smallest first.
+func (s *FileService) createThumbnails(ctx context.Context, key string, img image.Image, orientation int) ([]model.FileThumbnail, string, error) {
+	sizes := slices.Clone(s.cfg.ThumbnailSizes)
+	slices.Sort(sizes)
+	opaque := isOpaque(img)
+
+	// Each thumbnail is scaled from the next larger one, which is much faster than scaling every
+	// one from the full image
+	thumbnails := make([]model.FileThumbnail, 0, len(sizes))
+	scaled := img
+	for _, size := range slices.Backward(sizes) {
+		scaled = fit(scaled, size)
+		upright := orient(scaled, orientation)
+		var content bytes.Buffer
+		contentType := "image/jpeg"
+		if opaque {
+			if err := jpeg.Encode(&content, upright, &jpeg.Options{Quality: thumbnailQuality}); err != nil {
+				return nil, "", err
+			}
+		} else {
+			contentType = "image/png"
+			if err := png.Encode(&content, upright); err != nil {
+				return nil, "", err
+			}
+		}
+
+		thumbnail := model.FileThumbnail{
+			Size:        size,
+			Key:         thumbnailKey(key, size, contentType),
+			ContentType: contentType,
+			Width:       upright.Bounds().Dx(),
+			Height:      upright.Bounds().Dy(),
+		}
+		if _, err := s.store.Put(ctx, thumbnail.Key, &content, contentType); err != nil {
+			for _, stored := range thumbnails {
+				s.deleteObject(ctx, stored.Key)
+			}
+			return nil, "", err
+		}
+		thumbnails = append(thumbnails, thumbnail)
+	}
+	slices.Reverse(thumbnails)
+
+	small := orient(fit(scaled, blurhashSize), orientation)
+	xComponents, yComponents := 4, 3
+	if small.Bounds().Dy() > small.Bounds().Dx() {
+		xComponents, yComponents = 3, 4
+	}
+	placeholder, err := blurhash.Encode(xComponents, yComponents, small)
+	if err != nil {
+		for _, stored := range thumbnails {
+			s.deleteObject(ctx, stored.Key)
+		}
+		return nil, "", err
+	}
+	return thumbnails, placeholder, nil
+}
+
+// fit scales an image down to fit into a square of the given size, keeping its aspect ratio. An
+// image that already fits is returned as it is.
+func fit(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= size && height <= size {
+		return img
+	}
+	if width >= height {
+		width, height = size, max(1, height*size/width)
+	} else {
+		width, height = max(1, width*size/height), size
+	}
+	scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(scaled, scaled.Bounds(), img, bounds, draw.Src, nil)
+	return scaled
+}
+
+// orient turns an image upright according to its EXIF orientation: 2 to 4 mirror or rotate it by
+// 180 degrees, 5 to 8 also swap its width and height.
+func orient(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	upright := image.NewRGBA(image.Rect(0, 0, width, height))
+	if orientation >= 5 {
+		upright = image.NewRGBA(image.Rect(0, 0, height, width))
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var ux, uy int
+			switch orientation {
+			case 2: // Mirrored horizontally
+				ux, uy = width-1-x, y
+			case 3: // Rotated by 180 degrees
+				ux, uy = width-1-x, height-1-y
+			case 4: // Mirrored vertically
+				ux, uy = x, height-1-y
+			case 5: // Mirrored along the top-left diagonal
+				ux, uy = y, x
+			case 6: // Needs a clockwise quarter turn
+				ux, uy = height-1-y, x
+			case 7: // Mirrored along the top-right diagonal
+				ux, uy = height-1-y, width-1-x
+			case 8: // Needs a counterclockwise quarter turn
+				ux, uy = y, width-1-x
+			}
+			upright.Set(ux, uy, img.At(bounds.Min.X+x, bounds.Min.Y+y))
+		}
+	}
+	return upright
+}
+
+// isOpaque reports whether an image has no transparent pixels, so that its thumbnails can be
+// JPEGs.
+func isOpaque(img image.Image) bool {
+	opaque, ok := img.(interface{ Opaque() bool })
+	return ok && opaque.Opaque()
+}
+
+// thumbnailKey returns the key of a thumbnail of the object with the given key.
+func thumbnailKey(key string, size int, contentType string) string {
+	ext := ".jpg"
+	if contentType == "image/png" {
+		ext = ".png"
+	}
+	return thumbnailDir(key) + strconv.Itoa(size) + ext
+}
+
+// thumbnailDir returns the key prefix of the thumbnails of the object with the given key.
+func thumbnailDir(key string) string {
+	return thumbnailPrefix + strings.TrimSuffix(key, path.Ext(key)) + "/"
+}
+
+// deleteFileObjects deletes the object of a file and its thumbnails. The thumbnails are found by
+// their keys, so that thumbnails of files that were never recorded are deleted too.
+func (s *FileService) deleteFileObjects(ctx context.Context, file *model.File) error {
+	thumbnails, err := s.store.List(ctx, thumbnailDir(file.Key))
+	if err != nil {
+		return err
+	}
+	for _, thumbnail := range thumbnails {
+		if err := s.store.Delete(ctx, thumbnail.Key); err != nil {
+			return err
+		}
+	}
+	return s.store.Delete(ctx, file.Key)
+}
+
+// OpenThumbnail opens the thumbnail of the given size of a clean image the user may read.
+func (s *FileService) OpenThumbnail(ctx context.Context, userID uuid.UUID, fileID uint, size int) (*model.FileThumbnail, *storage.Reader, storage.ObjectInfo, error) {
+	file, err := s.GetFile(userID, fileID)
+	if err != nil {
+		return nil, nil, storage.ObjectInfo{}, err
+	}
+	if err := checkScanned(file); err != nil {
+		return nil, nil, storage.ObjectInfo{}, err
+	}
+	index := slices.IndexFunc(file.Thumbnails, func(thumbnail model.FileThumbnail) bool {
+		return thumbnail.Size == size
+	})
+	if index < 0 {
+		return nil, nil, storage.ObjectInfo{}, ErrThumbnailNotFound
+	}
+	thumbnail := &file.Thumbnails[index]
+	info, err := s.store.Stat(ctx, thumbnail.Key)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil, storage.ObjectInfo{}, ErrThumbnailNotFound
+	}
+	if err != nil {
+		return nil, nil, storage.ObjectInfo{}, err
+	}
+	return thumbnail, storage.NewReader(ctx, s.store, info), info, nil
+}
+
+// thumbnailURL returns the download URL of a file's thumbnail.
+func thumbnailURL(fileID uint, size int) string {
+	return thumbnailPath + strconv.FormatUint(uint64(fileID), 10) + "&size=" + strconv.Itoa(size)
+}
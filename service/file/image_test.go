@@ -0,0 +1,138 @@
+package file
+
+import (
+	"adwise-service/model"
+	"adwise-service/storage"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"mime/multipart"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// uploadImage uploads an image with UploadFile.
+func uploadImage(t *testing.T, s *FileService, name string, data []byte) (*model.File, error) {
+	t.Helper()
+	header := &multipart.FileHeader{Filename: name, Size: int64(len(data))}
+	return s.UploadFile(uuid.New(), nopCloser{strings.NewReader(string(data))}, header)
+}
+
+// isRed reports whether a color is mostly red.
+func isRed(c color.Color) bool {
+	r, g, b, _ := c.RGBA()
+	return r > 0xC000 && g < 0x4000 && b < 0x4000
+}
+
+func TestUploadedImagesAreStrippedAndUpright(t *testing.T) {
+	tests := []struct {
+		name          string
+		orientation   int
+		width, height int
+		thumbnail     image.Rectangle
+		red, blue     image.Point // Pixels of the thumbnail in the red and the blue half of the image
+	}{
+		{"upright", 1, 40, 20, image.Rect(0, 0, 16, 8), image.Pt(2, 4), image.Pt(13, 4)},
+		{"turned clockwise", 6, 20, 40, image.Rect(0, 0, 8, 16), image.Pt(4, 2), image.Pt(4, 13)},
+		{"turned counterclockwise", 8, 20, 40, image.Rect(0, 0, 8, 16), image.Pt(4, 13), image.Pt(4, 2)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := storage.NewMemoryStore()
+			s := NewFileService(store, newFakeFileRepo(), Config{ThumbnailSizes: []int{16}})
+
+			file, err := uploadImage(t, s, "photo.jpg", cameraJPEG(t, twoColorImage(40, 20), tt.orientation))
+			if err != nil {
+				t.Fatalf("upload: %v", err)
+			}
+			if file.Width != tt.width || file.Height != tt.height {
+				t.Fatalf("image is %dx%d, want %dx%d upright", file.Width, file.Height, tt.width, tt.height)
+			}
+			stored := readObject(t, store, file.Key)
+			if strings.Contains(stored, cameraMake) || int64(len(stored)) != file.Size {
+				t.Fatalf("stored image keeps its metadata or differs from the recorded size")
+			}
+			if got := exifOrientation([]byte(stored[2:])); got != 0 && got != tt.orientation {
+				t.Fatalf("stored image has orientation %d, want %d", got, tt.orientation)
+			}
+
+			if len(file.Thumbnails) != 1 {
+				t.Fatalf("got %d thumbnails, want 1", len(file.Thumbnails))
+			}
+			body, _, err := store.Get(ctx, file.Thumbnails[0].Key)
+			if err != nil {
+				t.Fatalf("get thumbnail: %v", err)
+			}
+			thumbnail, _, err := image.Decode(body)
+			body.Close()
+			if err != nil {
+				t.Fatalf("decode thumbnail: %v", err)
+			}
+			if thumbnail.Bounds() != tt.thumbnail {
+				t.Fatalf("thumbnail is %v, want %v", thumbnail.Bounds(), tt.thumbnail)
+			}
+			// The thumbnail is shown as is, so it is turned upright
+			if !isRed(thumbnail.At(tt.red.X, tt.red.Y)) || isRed(thumbnail.At(tt.blue.X, tt.blue.Y)) {
+				t.Fatalf("thumbnail is not upright")
+			}
+		})
+	}
+}
+
+// pngOfSize returns a PNG whose header announces an image of the given size; its pixel data is
+// that of a 1x1 image, which is enough to read the header.
+func pngOfSize(t *testing.T, width, height uint32) []byte {
+	t.Helper()
+	data := cameraPNG(t, twoColorImage(1, 1))
+	ihdr := data[len(pngSignature):]
+	binary.BigEndian.PutUint32(ihdr[8:], width)
+	binary.BigEndian.PutUint32(ihdr[12:], height)
+	binary.BigEndian.PutUint32(ihdr[21:], crc32.ChecksumIEEE(ihdr[4:21]))
+	return data
+}
+
+func TestImagesOverThePixelLimitAreRejected(t *testing.T) {
+	store := storage.NewMemoryStore()
+	s := NewFileService(store, newFakeFileRepo(), Config{ThumbnailSizes: []int{16}})
+
+	_, err := uploadImage(t, s, "huge.png", pngOfSize(t, 8192, 8192))
+	var validation *ValidationError
+	if !errors.As(err, &validation) || !errors.Is(err, ErrFileTooLarge) {
+		t.Fatalf("uploading an image of 8192x8192 pixels: %v, want ErrFileTooLarge", err)
+	}
+	if objects, _ := store.List(context.Background(), ""); len(objects) != 0 {
+		t.Fatalf("rejected image left %d objects behind", len(objects))
+	}
+}
+
+func TestImageProcessingWaitsForAFreeSlot(t *testing.T) {
+	store := storage.NewMemoryStore()
+	s := NewFileService(store, newFakeFileRepo(), Config{ThumbnailSizes: []int{16}, ImageConcurrency: 1})
+	data := cameraJPEG(t, twoColorImage(40, 20), 1)
+	store.Put(context.Background(), "photo.jpg", bytes.NewReader(data), "image/jpeg")
+	file := &model.File{Name: "photo.jpg", Key: "photo.jpg", ContentType: "image/jpeg"}
+
+	s.imageSlots <- struct{}{} // Another image is being processed
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- s.processImage(ctx, file) }()
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("processing without a free slot: %v, want it to wait until cancelled", err)
+	}
+
+	<-s.imageSlots
+	if err := s.processImage(context.Background(), file); err != nil {
+		t.Fatalf("processing with a free slot: %v", err)
+	}
+	if len(s.imageSlots) != 0 {
+		t.Fatalf("processing kept its slot")
+	}
+}
@@ -0,0 +1,267 @@
+package file
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// errMalformedImage is returned when the structure of an image can not be parsed.
+var errMalformedImage = errors.New("malformed image")
+
+// Images are stripped of metadata without re-encoding them: the segments or chunks carrying EXIF,
+// XMP, IPTC and text, which can reveal where, when and with what an image was taken, are dropped
+// and the rest is copied as it is, as is the pixel data. Data appended after the end of an image,
+// like the preview images and videos some cameras add, is dropped too. A JPEG keeps its orientation
+// in a minimal EXIF segment of its own, so that it is still shown upright.
+
+// stripMetadata removes the metadata of an image. It returns the stripped image, the EXIF
+// orientation it had (1 when it had none) and whether anything was removed. Formats without
+// stripping are returned as they are.
+func stripMetadata(contentType string, data []byte) ([]byte, int, bool, error) {
+	switch contentType {
+	case "image/jpeg":
+		return stripJPEG(data)
+	case "image/png":
+		stripped, changed, err := stripPNG(data)
+		return stripped, 1, changed, err
+	case "image/webp":
+		stripped, changed, err := stripWebP(data)
+		return stripped, 1, changed, err
+	}
+	return data, 1, false, nil
+}
+
+// JPEG markers.
+const (
+	jpegSOI   = 0xD8
+	jpegEOI   = 0xD9
+	jpegSOS   = 0xDA
+	jpegRST0  = 0xD0
+	jpegRST7  = 0xD7
+	jpegAPP0  = 0xE0
+	jpegAPP1  = 0xE1
+	jpegAPP2  = 0xE2
+	jpegAPP14 = 0xEE
+	jpegAPP15 = 0xEF
+	jpegCOM   = 0xFE
+)
+
+// stripJPEG drops the application segments of a JPEG except JFIF (APP0), ICC profiles (APP2) and
+// Adobe color transforms (APP14), which are needed to show it, and drops comments.
+func stripJPEG(data []byte) ([]byte, int, bool, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != jpegSOI {
+		return nil, 0, false, errMalformedImage
+	}
+	out := make([]byte, 0, len(data))
+	out = append(out, 0xFF, jpegSOI)
+	orientation := 1
+	wroteOrientation := false
+	pos := 2
+	for {
+		// Markers may be preceded by any number of fill bytes
+		for pos < len(data) && data[pos] == 0xFF && pos+1 < len(data) && data[pos+1] == 0xFF {
+			pos++
+		}
+		if pos+1 >= len(data) || data[pos] != 0xFF {
+			return nil, 0, false, errMalformedImage
+		}
+		marker := data[pos+1]
+		if marker == jpegEOI {
+			out = append(out, 0xFF, jpegEOI)
+			break
+		}
+		if pos+4 > len(data) {
+			return nil, 0, false, errMalformedImage
+		}
+		end := pos + 2 + int(binary.BigEndian.Uint16(data[pos+2:]))
+		if end > len(data) || end < pos+4 {
+			return nil, 0, false, errMalformedImage
+		}
+		segment := data[pos:end]
+		payload := data[pos+4 : end]
+
+		// The orientation goes after JFIF, which has to be the first segment
+		if !wroteOrientation && marker != jpegAPP0 {
+			wroteOrientation = true
+			if o := exifOrientation(data[2:]); o > 1 {
+				orientation = o
+				out = append(out, orientationSegment(o)...)
+			}
+		}
+
+		keep := true
+		switch {
+		case marker == jpegAPP2:
+			keep = bytes.HasPrefix(payload, []byte("ICC_PROFILE\x00"))
+		case marker >= jpegAPP1 && marker <= jpegAPP15 && marker != jpegAPP14, marker == jpegCOM:
+			keep = false
+		}
+		if keep {
+			out = append(out, segment...)
+		}
+		pos = end
+
+		if marker == jpegSOS {
+			// The entropy-coded data of a scan runs to the next marker other than a restart;
+			// a 0xFF within it is followed by a stuffed zero
+			start := pos
+			for pos+1 < len(data) {
+				if data[pos] == 0xFF && data[pos+1] != 0 && (data[pos+1] < jpegRST0 || data[pos+1] > jpegRST7) {
+					break
+				}
+				pos++
+			}
+			if pos+1 >= len(data) {
+				return nil, 0, false, errMalformedImage
+			}
+			out = append(out, data[start:pos]...)
+		}
+	}
+	return out, orientation, !bytes.Equal(out, data), nil
+}
+
+// exifOrientation finds the orientation in the EXIF segment of a JPEG, given its segments after
+// the start of image marker. It returns 0 without one.
+func exifOrientation(segments []byte) int {
+	for pos := 0; pos+4 <= len(segments) && segments[pos] == 0xFF; {
+		marker := segments[pos+1]
+		if marker == jpegSOS || marker == jpegEOI {
+			return 0
+		}
+		end := pos + 2 + int(binary.BigEndian.Uint16(segments[pos+2:]))
+		if end > len(segments) || end < pos+4 {
+			return 0
+		}
+		if payload := segments[pos+4 : end]; marker == jpegAPP1 && bytes.HasPrefix(payload, []byte("Exif\x00\x00")) {
+			return tiffOrientation(payload[6:])
+		}
+		pos = end
+	}
+	return 0
+}
+
+// tiffOrientation reads the orientation tag from the first directory of a TIFF structure.
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0
+	}
+	count := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < count; i++ {
+		entry := ifd + 2 + 12*i
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		// Orientation is a single SHORT, stored in the entry itself
+		if order.Uint16(tiff[entry:]) == 0x0112 && order.Uint16(tiff[entry+2:]) == 3 {
+			if orientation := int(order.Uint16(tiff[entry+8:])); orientation >= 1 && orientation <= 8 {
+				return orientation
+			}
+			return 0
+		}
+	}
+	return 0
+}
+
+// orientationSegment builds an EXIF segment holding nothing but an orientation.
+func orientationSegment(orientation int) []byte {
+	return []byte{
+		0xFF, jpegAPP1, 0, 34,
+		'E', 'x', 'i', 'f', 0, 0,
+		'M', 'M', 0, 42, 0, 0, 0, 8, // Big-endian TIFF header, first directory at offset 8
+		0, 1, // One entry
+		0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, byte(orientation), 0, 0, // Orientation, one SHORT
+		0, 0, 0, 0, // No further directory
+	}
+}
+
+// pngSignature starts every PNG.
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// pngMetadataChunks are the chunks dropped from PNGs.
+var pngMetadataChunks = map[string]bool{"eXIf": true, "tEXt": true, "zTXt": true, "iTXt": true, "tIME": true}
+
+// stripPNG drops the EXIF, text and modification time chunks of a PNG.
+func stripPNG(data []byte) ([]byte, bool, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, false, errMalformedImage
+	}
+	out := make([]byte, 0, len(data))
+	out = append(out, pngSignature...)
+	for pos := len(pngSignature); ; {
+		if pos+8 > len(data) {
+			return nil, false, errMalformedImage
+		}
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		chunkType := string(data[pos+4 : pos+8])
+		end := pos + 12 + length // Length, type, data and CRC
+		if end > len(data) || end < pos {
+			return nil, false, errMalformedImage
+		}
+		if !pngMetadataChunks[chunkType] {
+			out = append(out, data[pos:end]...)
+		}
+		if chunkType == "IEND" {
+			break
+		}
+		pos = end
+	}
+	return out, !bytes.Equal(out, data), nil
+}
+
+// VP8X flags announcing metadata chunks.
+const (
+	webpFlagEXIF = 0x08
+	webpFlagXMP  = 0x04
+)
+
+// stripWebP drops the EXIF and XMP chunks of a WebP and clears the flags announcing them.
+func stripWebP(data []byte) ([]byte, bool, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, false, errMalformedImage
+	}
+	riffEnd := 8 + int(binary.LittleEndian.Uint32(data[4:]))
+	if riffEnd > len(data) || riffEnd < 12 {
+		return nil, false, errMalformedImage
+	}
+	out := make([]byte, 12, len(data))
+	copy(out, data[:12])
+	for pos := 12; pos < riffEnd; {
+		if pos+8 > riffEnd {
+			return nil, false, errMalformedImage
+		}
+		fourCC := string(data[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		end := pos + 8 + size + size%2 // Chunks are padded to an even size
+		if end > riffEnd || end < pos {
+			return nil, false, errMalformedImage
+		}
+		switch fourCC {
+		case "EXIF", "XMP ":
+		case "VP8X":
+			chunk := append([]byte(nil), data[pos:end]...)
+			if size > 0 {
+				chunk[8] &^= webpFlagEXIF | webpFlagXMP
+			}
+			out = append(out, chunk...)
+		default:
+			out = append(out, data[pos:end]...)
+		}
+		pos = end
+	}
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	return out, !bytes.Equal(out, data), nil
+}
@@ -0,0 +1,257 @@
+package file
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// cameraMake and gpsLatitudeRef are metadata values that must not survive stripping.
+const (
+	cameraMake     = "SecretCam"
+	gpsLatitudeRef = "N"
+)
+
+// twoColorImage returns an image whose left half is red and right half blue.
+func twoColorImage(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := color.RGBA{R: 255, A: 255}
+			if x >= width/2 {
+				c = color.RGBA{B: 255, A: 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+// exifTIFF builds a big-endian TIFF structure like cameras write: the first directory holds the
+// orientation, the camera make and a pointer to a GPS directory with the latitude reference.
+func exifTIFF(orientation int) []byte {
+	var tiff bytes.Buffer
+	write := func(values ...interface{}) {
+		for _, value := range values {
+			binary.Write(&tiff, binary.BigEndian, value)
+		}
+	}
+	const ifd0, gpsIFD, makeValue = 8, 8 + 2 + 3*12 + 4, 8 + 2 + 3*12 + 4 + 2 + 12 + 4
+	write([]byte("MM"), uint16(42), uint32(ifd0))
+	write(uint16(3))
+	write(uint16(0x010F), uint16(2), uint32(len(cameraMake)+1), uint32(makeValue))     // Make, ASCII elsewhere
+	write(uint16(0x0112), uint16(3), uint32(1), uint16(orientation), uint16(0))        // Orientation, SHORT
+	write(uint16(0x8825), uint16(4), uint32(1), uint32(gpsIFD))                        // GPS directory, LONG
+	write(uint32(0))                                                                   // No further directory
+	write(uint16(1))                                                                   // GPS directory entries
+	write(uint16(0x0001), uint16(2), uint32(2), []byte(gpsLatitudeRef+"\x00\x00\x00")) // GPSLatitudeRef, ASCII
+	write(uint32(0))
+	write([]byte(cameraMake + "\x00"))
+	return tiff.Bytes()
+}
+
+// jpegSegment builds a JPEG segment with the given marker and payload.
+func jpegSegment(marker byte, payload []byte) []byte {
+	segment := []byte{0xFF, marker, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+// cameraJPEG encodes an image as a JPEG carrying EXIF with GPS data, XMP, a comment and a trailer
+// after the end of the image, like the preview some cameras append.
+func cameraJPEG(t testing.TB, img image.Image, orientation int) []byte {
+	t.Helper()
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, img, nil); err != nil {
+		t.Fatalf("encode JPEG: %v", err)
+	}
+	data := encoded.Bytes()
+	var out []byte
+	out = append(out, data[:2]...) // SOI
+	out = append(out, jpegSegment(jpegAPP1, append([]byte("Exif\x00\x00"), exifTIFF(orientation)...))...)
+	out = append(out, jpegSegment(jpegAPP1, []byte("http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta>"+cameraMake+"</x:xmpmeta>"))...)
+	out = append(out, jpegSegment(jpegCOM, []byte("shot by "+cameraMake))...)
+	out = append(out, data[2:]...)
+	return append(out, []byte("preview of "+cameraMake)...)
+}
+
+// pngChunk builds a PNG chunk; the CRC is not checked by stripping and left zero.
+func pngChunk(chunkType string, payload []byte) []byte {
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(payload)))
+	chunk = append(chunk, chunkType...)
+	chunk = append(chunk, payload...)
+	return append(chunk, 0, 0, 0, 0)
+}
+
+// cameraPNG encodes an image as a PNG carrying EXIF, text and a modification time.
+func cameraPNG(t testing.TB, img image.Image) []byte {
+	t.Helper()
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, img); err != nil {
+		t.Fatalf("encode PNG: %v", err)
+	}
+	data := encoded.Bytes()
+	ihdrEnd := len(pngSignature) + 12 + 13
+	var out []byte
+	out = append(out, data[:ihdrEnd]...)
+	out = append(out, pngChunk("eXIf", exifTIFF(6))...)
+	out = append(out, pngChunk("tEXt", []byte("Author\x00"+cameraMake))...)
+	out = append(out, pngChunk("tIME", []byte{0x07, 0xEA, 3, 1, 9, 0, 0})...)
+	return append(out, data[ihdrEnd:]...)
+}
+
+// webpChunk builds a RIFF chunk, padded to an even size.
+func webpChunk(fourCC string, payload []byte) []byte {
+	chunk := append([]byte(fourCC), binary.LittleEndian.AppendUint32(nil, uint32(len(payload)))...)
+	chunk = append(chunk, payload...)
+	if len(payload)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+// cameraWebP builds an extended WebP whose VP8X header announces EXIF and XMP chunks. The image
+// data is a stand-in; stripping does not decode it.
+func cameraWebP() []byte {
+	vp8x := []byte{webpFlagEXIF | webpFlagXMP, 0, 0, 0, 15, 0, 0, 7, 0, 0}
+	var body []byte
+	body = append(body, "WEBP"...)
+	body = append(body, webpChunk("VP8X", vp8x)...)
+	body = append(body, webpChunk("VP8L", []byte{0x2F, 1, 2, 3, 4})...)
+	body = append(body, webpChunk("EXIF", exifTIFF(1))...)
+	body = append(body, webpChunk("XMP ", []byte("<x:xmpmeta>"+cameraMake+"</x:xmpmeta>"))...)
+	return append(append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(len(body)))...), body...)
+}
+
+func TestStripMetadata(t *testing.T) {
+	img := twoColorImage(40, 20)
+	tests := []struct {
+		name        string
+		contentType string
+		data        []byte
+		orientation int
+		decodes     bool
+	}{
+		{"JPEG upright", "image/jpeg", cameraJPEG(t, img, 1), 1, true},
+		{"JPEG turned", "image/jpeg", cameraJPEG(t, img, 6), 6, true},
+		{"JPEG mirrored", "image/jpeg", cameraJPEG(t, img, 2), 2, true},
+		{"PNG", "image/png", cameraPNG(t, img), 1, true},
+		{"WebP", "image/webp", cameraWebP(), 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stripped, orientation, changed, err := stripMetadata(tt.contentType, tt.data)
+			if err != nil {
+				t.Fatalf("strip: %v", err)
+			}
+			if !changed || orientation != tt.orientation {
+				t.Fatalf("changed %t with orientation %d, want changed with orientation %d", changed, orientation, tt.orientation)
+			}
+			for _, leak := range []string{cameraMake, gpsLatitudeRef + "\x00\x00\x00", "xmpmeta", "Author"} {
+				if bytes.Contains(stripped, []byte(leak)) {
+					t.Fatalf("stripped image still contains %q", leak)
+				}
+			}
+
+			// Only an orientation other than upright is kept, in an EXIF segment of its own
+			wantOrientation := 0
+			if tt.contentType == "image/jpeg" && tt.orientation > 1 {
+				wantOrientation = tt.orientation
+				if !bytes.Contains(stripped, orientationSegment(tt.orientation)) {
+					t.Fatalf("stripped JPEG lacks the orientation segment")
+				}
+			}
+			if tt.contentType == "image/jpeg" {
+				if got := exifOrientation(stripped[2:]); got != wantOrientation {
+					t.Fatalf("stripped JPEG has orientation %d, want %d", got, wantOrientation)
+				}
+			}
+
+			if !tt.decodes {
+				return
+			}
+			decoded, _, err := image.Decode(bytes.NewReader(stripped))
+			if err != nil {
+				t.Fatalf("decode stripped image: %v", err)
+			}
+			if decoded.Bounds() != img.Bounds() {
+				t.Fatalf("stripped image is %v, want %v", decoded.Bounds(), img.Bounds())
+			}
+
+			// Stripping again changes nothing
+			again, _, changed, err := stripMetadata(tt.contentType, stripped)
+			if err != nil || changed || !bytes.Equal(again, stripped) {
+				t.Fatalf("stripping a stripped image changed it: %t, %v", changed, err)
+			}
+		})
+	}
+}
+
+func TestStripWebPClearsMetadataFlags(t *testing.T) {
+	stripped, _, _, err := stripMetadata("image/webp", cameraWebP())
+	if err != nil {
+		t.Fatalf("strip: %v", err)
+	}
+	if flags := stripped[20]; flags&(webpFlagEXIF|webpFlagXMP) != 0 {
+		t.Fatalf("VP8X flags %#x still announce metadata", flags)
+	}
+	if size := binary.LittleEndian.Uint32(stripped[4:]); int(size) != len(stripped)-8 {
+		t.Fatalf("RIFF size %d, want %d", size, len(stripped)-8)
+	}
+}
+
+func TestStripMetadataRejectsMalformedImages(t *testing.T) {
+	jpegData := cameraJPEG(t, twoColorImage(8, 8), 6)
+	pngData := cameraPNG(t, twoColorImage(8, 8))
+	tests := []struct {
+		name        string
+		contentType string
+		data        []byte
+	}{
+		{"JPEG without start", "image/jpeg", jpegData[2:]},
+		{"JPEG cut short", "image/jpeg", jpegData[:len(jpegData)/2]},
+		{"JPEG segment past the end", "image/jpeg", []byte{0xFF, jpegSOI, 0xFF, jpegAPP1, 0xFF, 0xFF, 'E'}},
+		{"PNG without signature", "image/png", pngData[8:]},
+		{"PNG cut short", "image/png", pngData[:len(pngData)-20]},
+		{"WebP chunk past the end", "image/webp", cameraWebP()[:30]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, _, err := stripMetadata(tt.contentType, tt.data); err != errMalformedImage {
+				t.Fatalf("got %v, want errMalformedImage", err)
+			}
+		})
+	}
+}
+
+func FuzzStripMetadata(f *testing.F) {
+	img := twoColorImage(8, 8)
+	f.Add("image/jpeg", cameraJPEG(f, img, 6))
+	f.Add("image/png", cameraPNG(f, img))
+	f.Add("image/webp", cameraWebP())
+	f.Fuzz(func(t *testing.T, contentType string, data []byte) {
+		stripped, orientation, changed, err := stripMetadata(contentType, data)
+		if err != nil {
+			return
+		}
+		if orientation < 1 || orientation > 8 {
+			t.Fatalf("orientation %d", orientation)
+		}
+		if changed == bytes.Equal(stripped, data) {
+			t.Fatalf("reported changed %t for an image that is equal %t", changed, !changed)
+		}
+		// What is left parses again and has nothing more to strip, apart from the orientation
+		// segment a JPEG is given
+		again, againOrientation, _, err := stripMetadata(contentType, stripped)
+		if err != nil {
+			t.Fatalf("stripped image does not parse: %v", err)
+		}
+		if !bytes.Equal(again, stripped) || (againOrientation != orientation && contentType == "image/jpeg") {
+			t.Fatalf("stripping twice differs from stripping once")
+		}
+	})
+}
@@ -0,0 +1,466 @@
+package file
+
+import (
+	"adwise-service/model"
+	"adwise-service/repository"
+	"adwise-service/storage"
+	"adwise-service/utils"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrUploadNotFound is returned when a resumable upload does not exist, has expired or belongs to
+	// someone else.
+	ErrUploadNotFound = errors.New("upload not found")
+	// ErrOffsetMismatch is returned when a chunk does not start at the current offset of its upload.
+	ErrOffsetMismatch = errors.New("chunk does not start at the upload offset")
+	// ErrChunkTooLarge is returned when a chunk extends past the length of its upload.
+	ErrChunkTooLarge = errors.New("chunk exceeds the upload length")
+	// ErrChecksumMismatch is returned when a chunk does not match its checksum. The chunk is discarded.
+	ErrChecksumMismatch = errors.New("chunk checksum does not match")
+	// ErrUnsupportedChecksum is returned for a checksum algorithm other than ChecksumAlgorithms.
+	ErrUnsupportedChecksum = errors.New("checksum algorithm is not supported")
+)
+
+// ChecksumAlgorithms lists the algorithms chunks can be verified with, as named by the tus checksum
+// extension.
+var ChecksumAlgorithms = []string{"sha1", "sha256", "md5"}
+
+// ChunkChecksum is the checksum a chunk is expected to have.
+type ChunkChecksum struct {
+	Algorithm string
+	Sum       []byte
+}
+
+// Resumable uploads follow the tus protocol. Each chunk a client appends is stored as an object of
+// its own under uploadPrefix, named after its offset, and the offset is advanced only when the chunk
+// is stored. When a connection drops in the middle of a chunk, the bytes received so far are kept,
+// so the client resumes from there. The last chunk assembles the chunks into a file like one
+// uploaded in a single request.
+
+// uploadPrefix is the key prefix of the chunks of resumable uploads.
+const uploadPrefix = "uploads/"
+
+// CreateUpload starts a resumable upload of a file of the given length.
+func (s *FileService) CreateUpload(ownerID uuid.UUID, name, contentType string, length int64) (*model.Upload, error) {
+	name = sanitizeFileName(name)
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	if err := s.validateUpload(model.UploadIntentRequest{Name: name, ContentType: contentType, Size: length}); err != nil {
+		return nil, err
+	}
+	now := s.clock.Now()
+	upload := &model.Upload{
+		ID:          uuid.New(),
+		OwnerID:     ownerID,
+		Name:        name,
+		ContentType: contentType,
+		Length:      length,
+		ExpiresAt:   now.Add(s.cfg.UploadTTL),
+		CreatedAt:   now,
+	}
+	if err := s.repo.CreateUpload(upload); err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
+
+// GetUpload returns a resumable upload of the owner.
+func (s *FileService) GetUpload(ownerID, uploadID uuid.UUID) (*model.Upload, error) {
+	upload, err := s.repo.FindUploadByID(uploadID)
+	if errors.Is(err, repository.ErrNotFound) {
+		return nil, ErrUploadNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if upload.OwnerID != ownerID || (upload.FileID == 0 && !s.clock.Now().Before(upload.ExpiresAt)) {
+		return nil, ErrUploadNotFound
+	}
+	if upload.FileID != 0 {
+		upload.FileURL = fileURL(upload.FileID)
+	}
+	return upload, nil
+}
+
+// WriteChunk appends a chunk to an upload at offset, which must be the upload's current offset. A
+// chunk cut short by a failing body is kept up to where it failed, unless it has a checksum. The
+// returned file is set once the upload is complete.
+func (s *FileService) WriteChunk(ctx context.Context, ownerID, uploadID uuid.UUID, offset int64, body io.Reader, checksum *ChunkChecksum) (*model.Upload, *model.File, error) {
+	upload, err := s.GetUpload(ownerID, uploadID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if offset != upload.Offset {
+		return upload, nil, ErrOffsetMismatch
+	}
+	if upload.Offset == upload.Length {
+		// A client retries the last chunk when the assembly failed or its response was lost
+		file, err := s.finishUpload(ctx, upload)
+		return upload, file, err
+	}
+
+	var sum hash.Hash
+	var sink io.Writer = io.Discard
+	if checksum != nil {
+		if sum = newChecksumHash(checksum.Algorithm); sum == nil {
+			return upload, nil, ErrUnsupportedChecksum
+		}
+		sink = sum
+	}
+	partial := &partialReader{r: body}
+	key := chunkKey(upload.ID, offset)
+	info, err := s.store.Put(ctx, key, io.TeeReader(io.LimitReader(partial, upload.Length-offset), sink), "application/octet-stream")
+	if err != nil {
+		return upload, nil, err
+	}
+	if partial.err == nil {
+		var extra [1]byte
+		if n, _ := partial.Read(extra[:]); n > 0 {
+			s.deleteObject(ctx, key)
+			return upload, nil, ErrChunkTooLarge
+		}
+	}
+	if checksum != nil && (partial.err != nil || !bytes.Equal(sum.Sum(nil), checksum.Sum)) {
+		s.deleteObject(ctx, key)
+		if partial.err != nil {
+			return upload, nil, partial.err
+		}
+		return upload, nil, ErrChecksumMismatch
+	}
+	if info.Size == 0 {
+		s.deleteObject(ctx, key)
+		return upload, nil, partial.err
+	}
+
+	expiresAt := s.clock.Now().Add(s.cfg.UploadTTL)
+	advanced, err := s.repo.AdvanceUpload(upload.ID, offset, offset+info.Size, expiresAt)
+	if err != nil || !advanced {
+		s.deleteObject(ctx, key)
+		if err == nil {
+			err = ErrOffsetMismatch
+		}
+		return upload, nil, err
+	}
+	upload.Offset = offset + info.Size
+	upload.ExpiresAt = expiresAt
+	if partial.err != nil || upload.Offset < upload.Length {
+		return upload, nil, partial.err
+	}
+	file, err := s.finishUpload(ctx, upload)
+	return upload, file, err
+}
+
+// TerminateUpload discards an upload of the owner with its chunks. The file of a complete upload
+// is kept.
+func (s *FileService) TerminateUpload(ownerID, uploadID uuid.UUID) error {
+	upload, err := s.GetUpload(ownerID, uploadID)
+	if err != nil {
+		return err
+	}
+	return s.discardUpload(context.Background(), upload)
+}
+
+// SweepUploads discards up to limit resumable uploads that expired before now, direct uploads
+// that were started an upload TTL before now and never completed, and staged content written with
+// the signed URL of a direct upload after it completed. It returns how many it discarded.
+func (s *FileService) SweepUploads(now time.Time, limit int) (int, error) {
+	ctx := context.Background()
+	uploads, err := s.repo.FindExpiredUploads(now, limit)
+	if err != nil {
+		return 0, err
+	}
+	for i := range uploads {
+		if err := s.discardUpload(ctx, &uploads[i]); err != nil {
+			return i, err
+		}
+	}
+
+	files, err := s.repo.FindPendingFiles(now.Add(-s.cfg.UploadTTL), limit)
+	if err != nil {
+		return len(uploads), err
+	}
+	for i, file := range files {
+		if err := s.deleteFileObjects(ctx, &file); err != nil {
+			return len(uploads) + i, err
+		}
+		if err := s.repo.DeleteFile(file.ID); err != nil {
+			return len(uploads) + i, err
+		}
+	}
+	discarded := len(uploads) + len(files)
+
+	// Staged content is read by the completion of its upload and deleted; what is left once no
+	// pending file can own it was uploaded again afterwards
+	staged, err := s.store.List(ctx, stagingPrefix)
+	if err != nil {
+		return discarded, err
+	}
+	unowned := now.Add(-s.cfg.UploadTTL - s.cfg.SignedURLExpiry)
+	for _, object := range staged {
+		if discarded >= limit {
+			break
+		}
+		if !object.LastModified.Before(unowned) {
+			continue
+		}
+		if err := s.store.Delete(ctx, object.Key); err != nil {
+			return discarded, err
+		}
+		discarded++
+	}
+	return discarded, nil
+}
+
+// finishUpload assembles the chunks of a complete upload into a file. The file of an upload that
+// was already assembled is returned as it is. An upload whose content is rejected by validation is
+// discarded.
+func (s *FileService) finishUpload(ctx context.Context, upload *model.Upload) (*model.File, error) {
+	if upload.FileID != 0 {
+		return s.findUploadFile(upload)
+	}
+	chunks, err := s.store.List(ctx, chunkPrefix(upload.ID))
+	if err != nil {
+		return nil, err
+	}
+	chunks, err = orderChunks(chunks, upload.Length)
+	if err != nil {
+		return nil, err
+	}
+
+	content := &chunksReader{ctx: ctx, store: s.store, chunks: chunks}
+	defer content.Close()
+	head := make([]byte, sniffLength)
+	n, err := io.ReadFull(content, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	contentType, err := s.checkContent(upload.Name, head[:n], upload.Length)
+	if err != nil {
+		if discardErr := s.discardUpload(ctx, upload); discardErr != nil {
+			utils.LogError("Failed to discard rejected upload", discardErr, zap.String("upload_id", upload.ID.String()))
+		}
+		return nil, err
+	}
+
+	key := objectKey(contentType)
+	hash := sha256.New()
+	info, err := s.store.Put(ctx, key, io.TeeReader(io.MultiReader(bytes.NewReader(head[:n]), content), hash), contentType)
+	if err != nil {
+		return nil, err
+	}
+	if info.Size != upload.Length {
+		s.deleteObject(ctx, key)
+		return nil, fmt.Errorf("assembled upload %s has %d of %d bytes", upload.ID, info.Size, upload.Length)
+	}
+
+	record := &model.File{
+		OwnerID:     upload.OwnerID,
+		Name:        upload.Name,
+		Key:         key,
+		ContentType: contentType,
+		Size:        info.Size,
+		Checksum:    hex.EncodeToString(hash.Sum(nil)),
+		Status:      model.FileStatusReady,
+		ScanStatus:  s.newScanStatus(),
+	}
+	if err := s.processImage(ctx, record); err != nil {
+		s.deleteFileObjects(ctx, record)
+		var validation *ValidationError
+		if errors.As(err, &validation) {
+			if discardErr := s.discardUpload(ctx, upload); discardErr != nil {
+				utils.LogError("Failed to discard rejected upload", discardErr, zap.String("upload_id", upload.ID.String()))
+			}
+		}
+		return nil, err
+	}
+	if err := s.repo.CreateFile(record); err != nil {
+		s.deleteFileObjects(ctx, record)
+		return nil, err
+	}
+	linked, err := s.repo.SetUploadFile(upload.ID, record.ID)
+	if err != nil || !linked {
+		// Another request assembled the upload at the same time; its file is kept
+		s.deleteFileObjects(ctx, record)
+		s.repo.DeleteFile(record.ID)
+		if err != nil {
+			return nil, err
+		}
+		current, err := s.repo.FindUploadByID(upload.ID)
+		if err != nil {
+			return nil, err
+		}
+		upload.FileID = current.FileID
+		upload.FileURL = fileURL(current.FileID)
+		return s.findUploadFile(upload)
+	}
+
+	for _, chunk := range chunks {
+		s.deleteObject(ctx, chunk.Key)
+	}
+	s.queueScan(record)
+	upload.FileID = record.ID
+	setURLs(record)
+	upload.FileURL = record.URL
+	return record, nil
+}
+
+// findUploadFile loads the file assembled from an upload.
+func (s *FileService) findUploadFile(upload *model.Upload) (*model.File, error) {
+	file, err := s.repo.FindFileByID(upload.FileID)
+	if errors.Is(err, repository.ErrNotFound) {
+		return nil, ErrFileNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	setURLs(file)
+	return file, nil
+}
+
+// discardUpload deletes the chunks and the record of an upload.
+func (s *FileService) discardUpload(ctx context.Context, upload *model.Upload) error {
+	chunks, err := s.store.List(ctx, chunkPrefix(upload.ID))
+	if err != nil {
+		return err
+	}
+	for _, chunk := range chunks {
+		if err := s.store.Delete(ctx, chunk.Key); err != nil {
+			return err
+		}
+	}
+	return s.repo.DeleteUpload(upload.ID)
+}
+
+// deleteObject deletes an object that is no longer needed, logging failures.
+func (s *FileService) deleteObject(ctx context.Context, key string) {
+	if err := s.store.Delete(ctx, key); err != nil {
+		utils.LogError("Failed to delete object", err, zap.String("key", key))
+	}
+}
+
+// chunkPrefix returns the key prefix of the chunks of an upload.
+func chunkPrefix(uploadID uuid.UUID) string {
+	return uploadPrefix + uploadID.String() + "/"
+}
+
+// chunkKey names a chunk after its offset, padded so that keys sort by offset. A random suffix
+// keeps a chunk from replacing one stored at the same offset by a concurrent request.
+func chunkKey(uploadID uuid.UUID, offset int64) string {
+	return fmt.Sprintf("%s%020d-%s", chunkPrefix(uploadID), offset, uuid.New().String()[:8])
+}
+
+// orderChunks picks the chunks that make up an upload of the given length, in order. Chunks left
+// behind by requests that failed after storing them are skipped.
+func orderChunks(chunks []storage.ObjectInfo, length int64) ([]storage.ObjectInfo, error) {
+	var ordered []storage.ObjectInfo
+	var offset int64
+	for _, chunk := range chunks {
+		start, err := strconv.ParseInt(strings.SplitN(path.Base(chunk.Key), "-", 2)[0], 10, 64)
+		if err != nil || start != offset {
+			continue
+		}
+		ordered = append(ordered, chunk)
+		offset += chunk.Size
+	}
+	if offset != length {
+		return nil, fmt.Errorf("upload chunks cover %d of %d bytes", offset, length)
+	}
+	return ordered, nil
+}
+
+// newChecksumHash returns the hash of a checksum algorithm, or nil when it is not supported.
+func newChecksumHash(algorithm string) hash.Hash {
+	switch algorithm {
+	case "sha1":
+		return sha1.New()
+	case "sha256":
+		return sha256.New()
+	case "md5":
+		return md5.New()
+	default:
+		return nil
+	}
+}
+
+// partialReader ends a body at its first read error instead of failing, so that the bytes received
+// before a connection dropped can be kept. The error is kept in err.
+type partialReader struct {
+	r   io.Reader
+	err error
+}
+
+// Read reads from the body, reporting a read error as the end of the body.
+func (p *partialReader) Read(b []byte) (int, error) {
+	if p.err != nil {
+		return 0, io.EOF
+	}
+	n, err := p.r.Read(b)
+	if err != nil && err != io.EOF {
+		p.err = err
+		err = io.EOF
+	}
+	return n, err
+}
+
+// chunksReader reads the chunks of an upload one after another.
+type chunksReader struct {
+	ctx    context.Context
+	store  storage.BlobStore
+	chunks []storage.ObjectInfo
+	body   io.ReadCloser
+}
+
+// Read reads from the current chunk, opening the next one when it is exhausted.
+func (c *chunksReader) Read(b []byte) (int, error) {
+	for {
+		if c.body == nil {
+			if len(c.chunks) == 0 {
+				return 0, io.EOF
+			}
+			body, _, err := c.store.Get(c.ctx, c.chunks[0].Key)
+			if err != nil {
+				return 0, err
+			}
+			c.body = body
+			c.chunks = c.chunks[1:]
+		}
+		n, err := c.body.Read(b)
+		if err == io.EOF {
+			c.body.Close()
+			c.body = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// Close closes the chunk being read.
+func (c *chunksReader) Close() error {
+	if c.body == nil {
+		return nil
+	}
+	err := c.body.Close()
+	c.body = nil
+	return err
+}
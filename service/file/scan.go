@@ -0,0 +1,104 @@
+package file
+
+import (
+	"adwise-service/model"
+	"adwise-service/repository"
+	"adwise-service/scanner"
+	"context"
+	"errors"
+
+	"github.com/google/uuid"
+)
+
+// newScanStatus returns the scan status of a new file: quarantined until scanned when a scanner is
+// set, clean otherwise.
+func (s *FileService) newScanStatus() string {
+	if s.scanner == nil {
+		return model.ScanStatusClean
+	}
+	return model.ScanStatusQuarantined
+}
+
+// queueScan wakes the scan worker once a quarantined file is ready, so that it is scanned without
+// waiting for the next poll. The scan job itself is queued along with the file's record.
+func (s *FileService) queueScan(file *model.File) {
+	if file.ScanStatus != model.ScanStatusQuarantined {
+		return
+	}
+	select {
+	case s.scanQueued <- struct{}{}:
+	default:
+	}
+}
+
+// checkScanned rejects downloads of files that have not been found clean.
+func checkScanned(file *model.File) error {
+	switch file.ScanStatus {
+	case model.ScanStatusQuarantined:
+		return ErrFileQuarantined
+	case model.ScanStatusInfected:
+		return ErrFileInfected
+	case model.ScanStatusUnscannable:
+		return ErrFileUnscannable
+	}
+	return nil
+}
+
+// scanFile scans the content of a queued file and records the verdict. Jobs of files that were
+// deleted or already have a verdict are dropped.
+func (s *FileService) scanFile(ctx context.Context, job *model.ScanJob) error {
+	file, err := s.repo.FindFileByID(job.FileID)
+	if errors.Is(err, repository.ErrNotFound) {
+		return s.repo.DeleteScanJob(job.ID)
+	}
+	if err != nil {
+		return err
+	}
+	if file.ScanStatus != model.ScanStatusQuarantined {
+		return s.repo.DeleteScanJob(job.ID)
+	}
+
+	body, _, err := s.store.Get(ctx, file.Key)
+	if err != nil {
+		return err
+	}
+	result, err := s.scanner.Scan(ctx, body)
+	body.Close()
+	// Content too large for the scanner is never scanned, however often it is tried
+	tooLarge := errors.Is(err, scanner.ErrTooLarge)
+	if err != nil && !tooLarge {
+		return err
+	}
+
+	switch {
+	case tooLarge:
+		file.ScanStatus = model.ScanStatusUnscannable
+	case result.Infected:
+		file.ScanStatus = model.ScanStatusInfected
+		file.Signature = result.Signature
+	default:
+		file.ScanStatus = model.ScanStatusClean
+	}
+	scannedAt := s.clock.Now()
+	finished, err := s.repo.FinishFileScan(file.ID, file.ScanStatus, file.Signature, scannedAt)
+	if err != nil || !finished {
+		return err
+	}
+	file.ScannedAt = &scannedAt
+	s.notifyScanned(file)
+	return nil
+}
+
+// notifyScanned tells the uploader of a file the verdict of its scan.
+func (s *FileService) notifyScanned(file *model.File) {
+	if s.notifier == nil {
+		return
+	}
+	s.notifier.NotifyUsers([]uuid.UUID{file.OwnerID}, EventFileScanned, model.FileScanEvent{
+		FileID:     file.ID,
+		Name:       file.Name,
+		URL:        fileURL(file.ID),
+		ScanStatus: file.ScanStatus,
+		Signature:  file.Signature,
+	})
+}
@@ -0,0 +1,109 @@
+package file
+
+import (
+	"adwise-service/model"
+	"adwise-service/utils"
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// maxScanAttempts is how often a file's scan is tried before giving up; the file then stays
+	// quarantined.
+	maxScanAttempts = 5
+	// scanRetryDelay is how long a failed scan waits before its first retry; later retries wait
+	// proportionally longer.
+	scanRetryDelay = time.Minute
+	// scanClaimTimeout is how long a claimed scan may stay running before another worker assumes its
+	// instance stopped and scans the file again.
+	scanClaimTimeout = 10 * time.Minute
+)
+
+// ScanWorker works through the queue of files awaiting a malware scan.
+//
+// Scan jobs are persisted along with the files, so nothing is lost across restarts. The worker polls
+// every interval and is woken as soon as a file is queued by this instance.
+type ScanWorker struct {
+	service   *FileService
+	interval  time.Duration
+	batchSize int
+}
+
+// NewScanWorker creates a new ScanWorker that polls for queued files every interval.
+func NewScanWorker(service *FileService, interval time.Duration, batchSize int) *ScanWorker {
+	return &ScanWorker{
+		service:   service,
+		interval:  interval,
+		batchSize: batchSize,
+	}
+}
+
+// Run scans queued files until the context is cancelled.
+func (w *ScanWorker) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		w.RunDue(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-w.service.scanQueued:
+		}
+	}
+}
+
+// RunDue scans every file whose scan is due at the current time and returns how many were scanned.
+func (w *ScanWorker) RunDue(ctx context.Context) int {
+	if w.service.scanner == nil {
+		return 0
+	}
+	scanned := 0
+	for {
+		now := w.service.clock.Now()
+		claimed, err := w.service.repo.ClaimScanJobs(now, now.Add(-scanClaimTimeout), w.batchSize)
+		if err != nil {
+			utils.LogError("Failed to claim scan jobs", err)
+			return scanned
+		}
+
+		for i := range claimed {
+			if w.scan(ctx, &claimed[i]) {
+				scanned++
+			}
+		}
+
+		if len(claimed) < w.batchSize {
+			return scanned
+		}
+	}
+}
+
+// scan runs one claimed scan job. A failed scan is retried later, until it has been tried
+// maxScanAttempts times.
+func (w *ScanWorker) scan(ctx context.Context, job *model.ScanJob) bool {
+	err := w.service.scanFile(ctx, job)
+	if err == nil {
+		return true
+	}
+
+	now := w.service.clock.Now()
+	job.UpdatedAt = now
+	job.LastError = err.Error()
+	if job.Attempts >= maxScanAttempts {
+		job.Status = model.ScanJobFailed
+	} else {
+		job.Status = model.ScanJobPending
+		job.RunAt = now.Add(time.Duration(job.Attempts) * scanRetryDelay)
+	}
+	utils.LogWarn("Failed to scan file",
+		zap.Uint("file_id", job.FileID), zap.Uint("attempts", job.Attempts), zap.Error(err))
+	if err := w.service.repo.UpdateScanJob(job); err != nil {
+		utils.LogError("Failed to update scan job", err, zap.Uint("scan_job_id", job.ID))
+	}
+	return false
+}
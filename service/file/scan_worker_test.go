@@ -0,0 +1,275 @@
+package file
+
+import (
+	"adwise-service/model"
+	"adwise-service/scanner"
+	"adwise-service/storage"
+	"context"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func (r *fakeFileRepo) ClaimScanJobs(now, staleBefore time.Time, limit int) ([]model.ScanJob, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var claimed []model.ScanJob
+	for id := uint(1); id <= uint(len(r.jobs)) && len(claimed) < limit; id++ {
+		job, ok := r.jobs[id]
+		if !ok {
+			continue
+		}
+		due := job.Status == model.ScanJobPending && !job.RunAt.After(now)
+		stale := job.Status == model.ScanJobRunning && job.ClaimedAt.Before(staleBefore)
+		if !due && !stale {
+			continue
+		}
+		job.Status = model.ScanJobRunning
+		job.ClaimedAt = now
+		job.Attempts++
+		claimed = append(claimed, *job)
+	}
+	return claimed, nil
+}
+
+func (r *fakeFileRepo) UpdateScanJob(job *model.ScanJob) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stored := r.jobs[job.ID]
+	stored.Status = job.Status
+	stored.RunAt = job.RunAt
+	stored.LastError = job.LastError
+	return nil
+}
+
+func (r *fakeFileRepo) FinishFileScan(fileID uint, scanStatus, signature string, scannedAt time.Time) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, job := range r.jobs {
+		if job.FileID == fileID {
+			delete(r.jobs, id)
+		}
+	}
+	file := r.files[fileID]
+	if file.ScanStatus != model.ScanStatusQuarantined {
+		return false, nil
+	}
+	file.ScanStatus = scanStatus
+	file.Signature = signature
+	file.ScannedAt = &scannedAt
+	return true, nil
+}
+
+func (r *fakeFileRepo) DeleteScanJob(id uint) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.jobs, id)
+	return nil
+}
+
+// fakeNotifier records the scan verdicts pushed to uploaders.
+type fakeNotifier struct {
+	mu     sync.Mutex
+	events []model.FileScanEvent
+}
+
+func (n *fakeNotifier) NotifyUsers(userIDs []uuid.UUID, event string, payload interface{}) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.events = append(n.events, payload.(model.FileScanEvent))
+}
+
+// fakeClock is a utils.Clock that only moves when told to.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+// scanTest is a FileService with a FakeScanner and a ScanWorker working through its queue.
+type scanTest struct {
+	service  *FileService
+	worker   *ScanWorker
+	repo     *fakeFileRepo
+	scanner  *scanner.FakeScanner
+	notifier *fakeNotifier
+	clock    *fakeClock
+	ownerID  uuid.UUID
+}
+
+func newScanTest(t *testing.T) *scanTest {
+	t.Helper()
+	repo := newFakeFileRepo()
+	st := &scanTest{
+		service:  NewFileService(storage.NewMemoryStore(), repo, Config{}),
+		repo:     repo,
+		scanner:  scanner.NewFakeScanner(),
+		notifier: &fakeNotifier{},
+		clock:    &fakeClock{now: time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)},
+		ownerID:  uuid.New(),
+	}
+	st.service.SetScanner(st.scanner)
+	st.service.SetNotifier(st.notifier)
+	st.service.SetClock(st.clock)
+	st.worker = NewScanWorker(st.service, time.Minute, 10)
+	return st
+}
+
+// nopCloser makes a strings.Reader a multipart.File.
+type nopCloser struct {
+	*strings.Reader
+}
+
+func (nopCloser) Close() error { return nil }
+
+// upload stores a ready, quarantined file with its scan job queued, like a completed upload.
+func (st *scanTest) upload(t *testing.T, content string) *model.File {
+	t.Helper()
+	header := &multipart.FileHeader{Filename: "notes.txt", Size: int64(len(content))}
+	file, err := st.service.UploadFile(st.ownerID, nopCloser{strings.NewReader(content)}, header)
+	if err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+	st.repo.mu.Lock()
+	defer st.repo.mu.Unlock()
+	job := &model.ScanJob{ID: uint(len(st.repo.jobs) + 1), FileID: file.ID, Status: model.ScanJobPending}
+	st.repo.jobs[job.ID] = job
+	return file
+}
+
+func (st *scanTest) scanStatus(fileID uint) string {
+	file, _ := st.repo.FindFileByID(fileID)
+	return file.ScanStatus
+}
+
+func TestScanWorkerVerdicts(t *testing.T) {
+	tests := []struct {
+		name      string
+		content   string
+		status    string
+		signature string
+		download  error
+	}{
+		{"clean", "meeting notes\n", model.ScanStatusClean, "", nil},
+		{"infected", "notes " + `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`,
+			model.ScanStatusInfected, "Eicar-Test-Signature", ErrFileInfected},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := newScanTest(t)
+			file := st.upload(t, tt.content)
+			if _, _, _, err := st.service.OpenFile(context.Background(), st.ownerID, file.ID); !errors.Is(err, ErrFileQuarantined) {
+				t.Fatalf("opening the file before its scan: %v, want ErrFileQuarantined", err)
+			}
+
+			if scanned := st.worker.RunDue(context.Background()); scanned != 1 {
+				t.Fatalf("RunDue scanned %d files, want 1", scanned)
+			}
+			if status := st.scanStatus(file.ID); status != tt.status {
+				t.Fatalf("file is %s, want %s", status, tt.status)
+			}
+			if len(st.repo.jobs) != 0 {
+				t.Fatalf("%d scan jobs left after the verdict", len(st.repo.jobs))
+			}
+			want := model.FileScanEvent{FileID: file.ID, Name: file.Name, URL: file.URL, ScanStatus: tt.status, Signature: tt.signature}
+			if len(st.notifier.events) != 1 || st.notifier.events[0] != want {
+				t.Fatalf("uploader was told %+v, want %+v", st.notifier.events, want)
+			}
+			_, body, _, err := st.service.OpenFile(context.Background(), st.ownerID, file.ID)
+			if body != nil {
+				body.Close()
+			}
+			if !errors.Is(err, tt.download) {
+				t.Fatalf("opening the scanned file: %v, want %v", err, tt.download)
+			}
+		})
+	}
+}
+
+func TestScanWorkerRetriesFailedScans(t *testing.T) {
+	st := newScanTest(t)
+	file := st.upload(t, "meeting notes\n")
+	st.scanner.SetError(fmt.Errorf("%w: connection refused", scanner.ErrScanFailed))
+
+	for attempt := uint(1); attempt < maxScanAttempts; attempt++ {
+		if scanned := st.worker.RunDue(context.Background()); scanned != 0 {
+			t.Fatalf("attempt %d: RunDue scanned %d files while the scanner fails", attempt, scanned)
+		}
+		job := st.repo.jobs[1]
+		if job.Status != model.ScanJobPending || job.Attempts != attempt {
+			t.Fatalf("attempt %d: job is %s after %d attempts, want pending", attempt, job.Status, job.Attempts)
+		}
+		if want := st.clock.now.Add(time.Duration(attempt) * scanRetryDelay); !job.RunAt.Equal(want) {
+			t.Fatalf("attempt %d: retried at %s, want %s", attempt, job.RunAt, want)
+		}
+
+		// Nothing is retried before the delay is over
+		st.clock.now = job.RunAt.Add(-time.Second)
+		st.worker.RunDue(context.Background())
+		if attempts := st.repo.jobs[1].Attempts; attempts != attempt {
+			t.Fatalf("attempt %d: retried early", attempt)
+		}
+		st.clock.now = job.RunAt
+	}
+
+	st.scanner.SetError(nil)
+	if scanned := st.worker.RunDue(context.Background()); scanned != 1 {
+		t.Fatalf("RunDue scanned %d files once the scanner works, want 1", scanned)
+	}
+	if status := st.scanStatus(file.ID); status != model.ScanStatusClean {
+		t.Fatalf("file is %s, want clean", status)
+	}
+}
+
+func TestScanWorkerGivesUpAfterMaxAttempts(t *testing.T) {
+	st := newScanTest(t)
+	file := st.upload(t, "meeting notes\n")
+	st.scanner.SetError(fmt.Errorf("%w: connection refused", scanner.ErrScanFailed))
+
+	for i := 0; i < maxScanAttempts; i++ {
+		st.worker.RunDue(context.Background())
+		st.clock.now = st.clock.now.Add(time.Hour)
+	}
+	job := st.repo.jobs[1]
+	if job.Status != model.ScanJobFailed || job.Attempts != maxScanAttempts {
+		t.Fatalf("job is %s after %d attempts, want failed after %d", job.Status, job.Attempts, maxScanAttempts)
+	}
+	st.scanner.SetError(nil)
+	if scanned := st.worker.RunDue(context.Background()); scanned != 0 {
+		t.Fatalf("a failed job was scanned again")
+	}
+	if status := st.scanStatus(file.ID); status != model.ScanStatusQuarantined {
+		t.Fatalf("file is %s after the scan was given up, want quarantined", status)
+	}
+}
+
+func TestScanWorkerMarksContentTooLargeUnscannable(t *testing.T) {
+	st := newScanTest(t)
+	file := st.upload(t, "meeting notes\n")
+	st.scanner.SetError(fmt.Errorf("%w: clamd replied %q", scanner.ErrTooLarge, "INSTREAM size limit exceeded. ERROR"))
+
+	if scanned := st.worker.RunDue(context.Background()); scanned != 1 {
+		t.Fatalf("RunDue scanned %d files, want the verdict on the first attempt", scanned)
+	}
+	if status := st.scanStatus(file.ID); status != model.ScanStatusUnscannable {
+		t.Fatalf("file is %s, want unscannable", status)
+	}
+	if len(st.repo.jobs) != 0 {
+		t.Fatalf("the scan of content too large for the scanner is retried")
+	}
+	if len(st.notifier.events) != 1 || st.notifier.events[0].ScanStatus != model.ScanStatusUnscannable {
+		t.Fatalf("uploader was told %+v, want that the file is unscannable", st.notifier.events)
+	}
+	if _, _, _, err := st.service.OpenFile(context.Background(), st.ownerID, file.ID); !errors.Is(err, ErrFileUnscannable) {
+		t.Fatalf("opening the unscannable file: %v, want ErrFileUnscannable", err)
+	}
+	if ok, _ := st.service.CanAttach(st.ownerID, file.URL); ok {
+		t.Fatalf("an unscannable file can be attached")
+	}
+}
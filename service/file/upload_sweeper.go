@@ -0,0 +1,59 @@
+package file
+
+import (
+	"adwise-service/utils"
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// UploadSweeper periodically discards uploads that were abandoned before they completed: resumable
+// uploads past their expiry, with their chunks, and direct uploads that were never completed.
+type UploadSweeper struct {
+	service   *FileService
+	interval  time.Duration
+	batchSize int
+}
+
+// NewUploadSweeper creates a new UploadSweeper that sweeps every interval.
+func NewUploadSweeper(service *FileService, interval time.Duration, batchSize int) *UploadSweeper {
+	return &UploadSweeper{
+		service:   service,
+		interval:  interval,
+		batchSize: batchSize,
+	}
+}
+
+// Run sweeps for abandoned uploads until the context is cancelled.
+func (w *UploadSweeper) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		w.Sweep(w.service.clock.Now())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sweep discards every upload abandoned before now, one batch at a time.
+func (w *UploadSweeper) Sweep(now time.Time) {
+	for {
+		discarded, err := w.service.SweepUploads(now, w.batchSize)
+		if err != nil {
+			utils.LogError("Failed to discard abandoned uploads", err)
+			return
+		}
+		if discarded > 0 {
+			utils.LogInfo("Discarded abandoned uploads", zap.Int("count", discarded))
+		}
+		if discarded < w.batchSize {
+			return
+		}
+	}
+}
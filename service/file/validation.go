@@ -0,0 +1,232 @@
+package file
+
+import (
+	"adwise-service/model"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/google/uuid"
+)
+
+var (
+	// ErrInvalidUpload is returned when an upload lacks a name, type or size or has a malformed
+	// checksum.
+	ErrInvalidUpload = errors.New("invalid upload")
+	// ErrFileTooLarge is returned when a file exceeds the size limit of its type.
+	ErrFileTooLarge = errors.New("file exceeds the maximum upload size")
+	// ErrTypeNotAllowed is returned when a file's content type is not accepted.
+	ErrTypeNotAllowed = errors.New("file type is not allowed")
+	// ErrTypeMismatch is returned when a file's content does not match its extension.
+	ErrTypeMismatch = errors.New("file content does not match its extension")
+)
+
+// sniffLength is how many leading bytes of a file its content type is detected from.
+const sniffLength = 3072
+
+// maxNameLength is the longest file name kept, in bytes.
+const maxNameLength = 255
+
+// ValidationError is an upload rejected by validation. It describes the reason for clients and
+// wraps one of ErrInvalidUpload, ErrFileTooLarge, ErrTypeNotAllowed and ErrTypeMismatch.
+type ValidationError struct {
+	Detail model.UploadError
+	err    error
+}
+
+func (e *ValidationError) Error() string {
+	return e.Detail.Message
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.err
+}
+
+// newValidationError creates a ValidationError with a formatted message.
+func newValidationError(err error, code, format string, args ...interface{}) *ValidationError {
+	return &ValidationError{
+		Detail: model.UploadError{Code: code, Message: fmt.Sprintf(format, args...)},
+		err:    err,
+	}
+}
+
+// Uploads are checked twice. What the client declares, its name, type and size, is checked before
+// the content is accepted: a multipart upload's part headers, an upload intent or a tus creation.
+// Once the content is there, its type is detected from its leading bytes, and that type has to be
+// allowed, fit the size limit of its type and agree with the extension of the file name. Files are
+// stored and served with the detected type rather than the declared one.
+
+// validateUpload checks what a client declares about a file against the configured limits.
+func (s *FileService) validateUpload(request model.UploadIntentRequest) error {
+	if request.Name == "" || request.Size <= 0 {
+		return newValidationError(ErrInvalidUpload, model.UploadErrInvalid, "name and size are required")
+	}
+	if _, _, err := mime.ParseMediaType(request.ContentType); err != nil {
+		return newValidationError(ErrInvalidUpload, model.UploadErrInvalid, "content_type must be a media type")
+	}
+	if request.Checksum != "" {
+		if sum, err := hex.DecodeString(request.Checksum); err != nil || len(sum) != sha256.Size {
+			return newValidationError(ErrInvalidUpload, model.UploadErrInvalid, "checksum must be a hex-encoded SHA-256")
+		}
+	}
+	return s.checkType(request.Name, request.ContentType, request.Size)
+}
+
+// checkContent detects the type of a file's content from its leading bytes and checks it. It
+// returns the detected type.
+func (s *FileService) checkContent(name string, head []byte, size int64) (string, error) {
+	detected := mimetype.Detect(head)
+	if ext := strings.ToLower(filepath.Ext(name)); ext != "" && !matchesExtension(detected, ext) {
+		err := newValidationError(ErrTypeMismatch, model.UploadErrTypeMismatch,
+			"the content of the file is %s, which does not match its extension %s", detected.String(), ext)
+		err.Detail.DetectedType = detected.String()
+		return "", err
+	}
+	if err := s.checkType(name, detected.String(), size); err != nil {
+		var validation *ValidationError
+		if errors.As(err, &validation) {
+			validation.Detail.DetectedType = detected.String()
+		}
+		return "", err
+	}
+	return detected.String(), nil
+}
+
+// checkType checks a content type against the allowlist and a size against the type's limit.
+func (s *FileService) checkType(name, contentType string, size int64) error {
+	if !s.typeAllowed(contentType) {
+		return newValidationError(ErrTypeNotAllowed, model.UploadErrTypeNotAllowed, "files of type %s are not allowed", mediaType(contentType))
+	}
+	if limit := s.sizeLimit(contentType); limit > 0 && size > limit {
+		err := newValidationError(ErrFileTooLarge, model.UploadErrTooLarge, "%s is larger than the %d bytes allowed for %s files",
+			name, limit, mediaType(contentType))
+		err.Detail.MaxSize = limit
+		return err
+	}
+	return nil
+}
+
+// typeAllowed matches a content type against the allowed types. A type ending in /* allows every
+// subtype, and * allows any type.
+func (s *FileService) typeAllowed(contentType string) bool {
+	if len(s.cfg.AllowedTypes) == 0 {
+		return true
+	}
+	mediaType := mediaType(contentType)
+	for _, allowed := range s.cfg.AllowedTypes {
+		if prefix, ok := strings.CutSuffix(allowed, "*"); ok && strings.HasPrefix(mediaType, prefix) {
+			return true
+		}
+		if mediaType == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// sizeLimit returns the largest size accepted for a content type: the limit configured for the
+// type, else for its major type (image/*), else the general maximum.
+func (s *FileService) sizeLimit(contentType string) int64 {
+	mediaType := mediaType(contentType)
+	if limit, ok := s.cfg.TypeSizeLimits[mediaType]; ok {
+		return limit
+	}
+	major, _, _ := strings.Cut(mediaType, "/")
+	if limit, ok := s.cfg.TypeSizeLimits[major+"/*"]; ok {
+		return limit
+	}
+	return s.cfg.MaxUploadSize
+}
+
+// MaxUploadSize returns the largest file accepted of any type in bytes, or 0 without a limit.
+func (s *FileService) MaxUploadSize() int64 {
+	if s.cfg.MaxUploadSize <= 0 {
+		return 0
+	}
+	largest := s.cfg.MaxUploadSize
+	for _, limit := range s.cfg.TypeSizeLimits {
+		largest = max(largest, limit)
+	}
+	return largest
+}
+
+// matchesExtension reports whether a detected type agrees with a file extension. Extensions of
+// unknown types are not checked, and any text agrees with a text extension, since text formats can
+// rarely be told apart by their content.
+func matchesExtension(detected *mimetype.MIME, ext string) bool {
+	expected := mediaType(mime.TypeByExtension(ext))
+	if expected == "" {
+		return true
+	}
+	for m := detected; m != nil; m = m.Parent() {
+		if m.Is(expected) || m.Extension() == ext {
+			return true
+		}
+	}
+	return strings.HasPrefix(expected, "text/") && detected.Is("text/plain")
+}
+
+// mediaType strips the parameters from a content type.
+func mediaType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return mediaType
+}
+
+// sanitizeFileName reduces a client's file name to a safe base name: directories, control and
+// reserved characters, and leading dots are dropped, and long names are shortened keeping their
+// extension.
+func sanitizeFileName(name string) string {
+	name = strings.ReplaceAll(name, "\\", "/")
+	name = name[strings.LastIndexByte(name, '/')+1:]
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || strings.ContainsRune(`<>:"|?*`, r) || r == utf8.RuneError {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimLeft(strings.TrimSpace(name), ".")
+	name = strings.TrimRight(name, ". ")
+	if len(name) > maxNameLength {
+		ext := filepath.Ext(name)
+		if len(ext) > 16 {
+			ext = ""
+		}
+		base := name[:maxNameLength-len(ext)]
+		for !utf8.ValidString(base) {
+			base = base[:len(base)-1]
+		}
+		name = base + ext
+	}
+	if name == "" {
+		return "file"
+	}
+	return name
+}
+
+// objectKey generates a unique key for a file's object, with the extension of its content type so
+// that stores deriving types from keys serve it correctly.
+func objectKey(contentType string) string {
+	key := uuid.New().String()
+	if detected := mimetype.Lookup(mediaType(contentType)); detected != nil {
+		key += detected.Extension()
+	}
+	return key
+}
+
+// stagingPrefix is the key prefix of the objects direct uploads are written to until they complete.
+const stagingPrefix = "staging/"
+
+// stagingKey generates a unique key under stagingPrefix for the content of a direct upload.
+func stagingKey(contentType string) string {
+	return stagingPrefix + objectKey(contentType)
+}
@@ -0,0 +1,97 @@
+package message
+
+import (
+	"adwise-service/utils"
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// MediaRemover deletes the stored media of expired messages.
+type MediaRemover interface {
+	// DeleteExpiredMedia deletes the media behind a URL no remaining message refers to, unless it is
+	// still in use elsewhere.
+	DeleteExpiredMedia(mediaURL string) error
+}
+
+// ExpiryWorker periodically hard-deletes disappearing messages once they expire, together with media
+// that no remaining message refers to and that was sent only in them, and tells the conversation
+// members about the deletion.
+//
+// Batches are claimed with row locks that skip rows locked by other workers, so several instances
+// of the service can run the worker against the same database at once.
+type ExpiryWorker struct {
+	service   *MessageService
+	media     MediaRemover
+	interval  time.Duration
+	batchSize int
+}
+
+// NewExpiryWorker creates a new ExpiryWorker that sweeps every interval.
+func NewExpiryWorker(service *MessageService, media MediaRemover, interval time.Duration, batchSize int) *ExpiryWorker {
+	return &ExpiryWorker{
+		service:   service,
+		media:     media,
+		interval:  interval,
+		batchSize: batchSize,
+	}
+}
+
+// Run sweeps for expired messages until the context is cancelled.
+func (w *ExpiryWorker) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		w.Sweep(w.service.clock.Now())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sweep deletes every message that expired before now, one batch at a time.
+func (w *ExpiryWorker) Sweep(now time.Time) {
+	for {
+		deleted, orphanedMedia, err := w.service.repo.DeleteExpiredMessages(now, w.batchSize)
+		if err != nil {
+			utils.LogError("Failed to delete expired messages", err)
+			return
+		}
+		w.deleteMedia(orphanedMedia)
+
+		for i := range deleted {
+			message := &deleted[i]
+			w.service.notifyConversation(message, EventMessageDeleted, map[string]interface{}{
+				"message_id":      message.ID,
+				"conversation_id": message.ConversationID(),
+				"reason":          "expired",
+			})
+		}
+		if len(deleted) > 0 {
+			utils.LogInfo("Deleted expired messages", zap.Int("count", len(deleted)))
+		}
+
+		if len(deleted) < w.batchSize {
+			return
+		}
+	}
+}
+
+// deleteMedia removes the media no longer referenced once a batch of messages is deleted.
+// It runs after the deletion is committed, so a rolled back deletion never leaves messages pointing
+// at removed media; a failed removal only leaves an unreferenced object behind.
+func (w *ExpiryWorker) deleteMedia(orphanedMedia []string) {
+	if w.media == nil {
+		return
+	}
+	for _, fileURL := range orphanedMedia {
+		if err := w.media.DeleteExpiredMedia(fileURL); err != nil {
+			utils.LogError("Failed to delete expired media", err, zap.String("media_url", fileURL))
+		}
+	}
+}
@@ -3,25 +3,128 @@ package message
 import (
 	"adwise-service/model"
 	"adwise-service/repository"
+	"adwise-service/utils"
+	"errors"
 	"time"
 
 	"github.com/google/uuid"
+	"go.uber.org/zap"
 )
 
+var (
+	// ErrMessageNotFound is returned when a message does not exist.
+	ErrMessageNotFound = errors.New("message not found")
+	// ErrNotConversationMember is returned when a user acts on a conversation they do not belong to.
+	ErrNotConversationMember = errors.New("user is not a member of the conversation")
+	// ErrInvalidTarget is returned when a conversation target is neither a direct nor a group chat.
+	ErrInvalidTarget = errors.New("invalid conversation target")
+	// ErrForwardLimitReached is returned when a message may not be forwarded any further.
+	ErrForwardLimitReached = errors.New("message has reached the forward limit")
+	// ErrPinLimitReached is returned when a conversation already has the maximum number of pins.
+	ErrPinLimitReached = errors.New("conversation has reached the pin limit")
+	// ErrInvalidExpiry is returned when a message is given an expiry time that is not in the future.
+	ErrInvalidExpiry = errors.New("message expiry must be in the future")
+	// ErrAttachmentNotAllowed is returned when a message carries a file the sender may not access.
+	ErrAttachmentNotAllowed = errors.New("sender may not attach the file")
+)
+
+// Event types pushed to clients by the MessageService.
+const (
+	EventMessagePinned   = "message.pinned"
+	EventMessageUnpinned = "message.unpinned"
+	EventMessageDeleted  = "message.deleted"
+	// EventConversationUpdated is sent when the shared settings of a conversation change.
+	EventConversationUpdated = "conversation.updated"
+)
+
+// Config holds the tunable limits of the MessageService.
+type Config struct {
+	MaxForwardDepth   uint // Maximum number of forward hops from the original message; 0 disables the limit
+	MaxPinnedMessages int  // Maximum number of pinned messages per conversation
+}
+
+// Notifier pushes realtime events to connected users. The event name is used as the operation of
+// the WebSocket envelope carrying the payload.
+type Notifier interface {
+	NotifyUsers(userIDs []uuid.UUID, event string, payload interface{})
+	DeliverMessage(userIDs []uuid.UUID, message model.Message)
+}
+
+// AttachmentChecker checks that a sender may attach the file behind a media URL. Attaching a file
+// to a message gives the members of the conversation access to it.
+type AttachmentChecker interface {
+	CanAttach(userID uuid.UUID, mediaURL string) (bool, error)
+	// AttachedFile returns the stored file behind a media URL, or nil for other URLs.
+	AttachedFile(mediaURL string) (*model.File, error)
+	// MarkAttached records that a saved message of the sender attaches the file behind a media URL,
+	// telling whether the message disappears.
+	MarkAttached(senderID uuid.UUID, mediaURL string, disappearing bool) error
+}
+
+// previewThumbnailSize is the preferred size of the thumbnail given as the media thumbnail of a
+// message attaching an image.
+const previewThumbnailSize = 256
+
 // MessageService handles message storage and retrieval.
 type MessageService struct {
-	repo repository.MessageRepository
+	repo        repository.MessageRepository
+	groupRepo   repository.GroupRepository
+	prefRepo    repository.PreferenceRepository
+	notifier    Notifier
+	attachments AttachmentChecker
+	clock       utils.Clock
+	cfg         Config
 }
 
 // NewMessageService creates a new MessageService.
-func NewMessageService(repo repository.MessageRepository) *MessageService {
-	return &MessageService{repo: repo}
+func NewMessageService(
+	repo repository.MessageRepository,
+	groupRepo repository.GroupRepository,
+	prefRepo repository.PreferenceRepository,
+	cfg Config,
+) *MessageService {
+	return &MessageService{repo: repo, groupRepo: groupRepo, prefRepo: prefRepo, clock: utils.SystemClock{}, cfg: cfg}
+}
+
+// SetNotifier sets the notifier used to push events to connected users.
+func (s *MessageService) SetNotifier(notifier Notifier) {
+	s.notifier = notifier
+}
+
+// SetAttachmentChecker sets the checker authorizing the media URLs of sent messages.
+func (s *MessageService) SetAttachmentChecker(attachments AttachmentChecker) {
+	s.attachments = attachments
+}
+
+// SetClock replaces the clock the service reads the current time from.
+func (s *MessageService) SetClock(clock utils.Clock) {
+	s.clock = clock
+}
+
+// SendMessage saves a message from the sender and delivers it to every member of its conversation.
+func (s *MessageService) SendMessage(senderID uuid.UUID, message *model.Message) error {
+	if err := s.prepareMessage(senderID, message); err != nil {
+		return err
+	}
+	if err := s.SaveMessage(message); err != nil {
+		return err
+	}
+
+	s.deliver(message)
+	return nil
 }
 
 // SaveMessage saves a new message to the database.
 func (s *MessageService) SaveMessage(message *model.Message) error {
-	message.CreatedAt = time.Now()
-	return s.repo.CreateMessage(message)
+	message.CreatedAt = s.clock.Now()
+	if err := s.applyExpiry(message); err != nil {
+		return err
+	}
+	if err := s.repo.CreateMessage(message); err != nil {
+		return err
+	}
+	s.markAttachment(message)
+	return nil
 }
 
 // GetMessages retrieves messages for a user.
@@ -38,3 +141,412 @@ func (s *MessageService) GetMessageByID(messageID uint) (*model.Message, error)
 func (s *MessageService) DeleteMessage(messageID uint) error {
 	return s.repo.DeleteMessage(messageID)
 }
+
+// ForwardMessage copies a message, including its media references, into each target conversation
+// and delivers the copies. The copies record the original message as their provenance and the
+// original's forward count is incremented by the number of targets; either all copies are saved
+// or none is.
+func (s *MessageService) ForwardMessage(senderID uuid.UUID, messageID uint, targets []model.ConversationTarget) ([]model.Message, error) {
+	original, err := s.findAuthorizedMessage(senderID, messageID)
+	if err != nil {
+		return nil, err
+	}
+
+	depth := original.ForwardDepth + 1
+	if s.cfg.MaxForwardDepth > 0 && depth > s.cfg.MaxForwardDepth {
+		return nil, ErrForwardLimitReached
+	}
+
+	for _, target := range targets {
+		if !target.Valid() {
+			return nil, ErrInvalidTarget
+		}
+		if err := s.authorizeTarget(senderID, target); err != nil {
+			return nil, err
+		}
+	}
+
+	now := s.clock.Now()
+	forwarded := make([]model.Message, 0, len(targets))
+	for _, target := range targets {
+		copied := model.Message{
+			SenderID:        senderID,
+			ReceiverID:      target.ReceiverID,
+			GroupID:         target.GroupID,
+			Content:         original.Content,
+			Type:            original.Type,
+			Timestamp:       now,
+			Status:          "sent",
+			MediaThumbnail:  original.MediaThumbnail,
+			MediaURL:        original.MediaURL,
+			MediaType:       original.MediaType,
+			MediaSize:       original.MediaSize,
+			MediaDuration:   original.MediaDuration,
+			MediaWidth:      original.MediaWidth,
+			MediaHeight:     original.MediaHeight,
+			MediaBlurhash:   original.MediaBlurhash,
+			MediaThumbnails: original.MediaThumbnails,
+			LocationLat:     original.LocationLat,
+			LocationLng:     original.LocationLng,
+			Transcription:   original.Transcription,
+			Language:        original.Language,
+			IsForwarded:     true,
+			ForwardedFromID: original.ID,
+			ForwardDepth:    depth,
+			CreatedAt:       now,
+		}
+		if err := s.applyExpiry(&copied); err != nil {
+			return nil, err
+		}
+		forwarded = append(forwarded, copied)
+	}
+
+	if err := s.repo.CreateForwardedMessages(original.ID, forwarded); err != nil {
+		return nil, err
+	}
+
+	for i := range forwarded {
+		s.deliver(&forwarded[i])
+	}
+	return forwarded, nil
+}
+
+// StarMessage stars a message for a user.
+func (s *MessageService) StarMessage(userID uuid.UUID, messageID uint) error {
+	if _, err := s.findAuthorizedMessage(userID, messageID); err != nil {
+		return err
+	}
+	return s.repo.CreateMessageStar(&model.MessageStar{UserID: userID, MessageID: messageID, CreatedAt: s.clock.Now()})
+}
+
+// UnstarMessage removes a user's star from a message.
+func (s *MessageService) UnstarMessage(userID uuid.UUID, messageID uint) error {
+	return s.repo.DeleteMessageStar(userID, messageID)
+}
+
+// GetStarredMessages retrieves the messages a user has starred across all conversations.
+func (s *MessageService) GetStarredMessages(userID uuid.UUID, limit int) ([]model.Message, error) {
+	messages, err := s.repo.FindStarredMessages(userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	for i := range messages {
+		messages[i].IsStarred = true
+	}
+	return messages, nil
+}
+
+// PinMessage pins a message in its conversation and notifies the conversation's members. Pinning an
+// already pinned message notifies nobody.
+func (s *MessageService) PinMessage(userID uuid.UUID, messageID uint) (*model.MessagePin, error) {
+	message, err := s.findAuthorizedMessage(userID, messageID)
+	if err != nil {
+		return nil, err
+	}
+
+	pin := &model.MessagePin{
+		ConversationID: message.ConversationID(),
+		MessageID:      message.ID,
+		PinnedBy:       userID,
+		PinnedAt:       s.clock.Now(),
+	}
+	pinned, err := s.repo.CreateMessagePin(pin, s.cfg.MaxPinnedMessages)
+	if errors.Is(err, repository.ErrLimitReached) {
+		return nil, ErrPinLimitReached
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if pinned {
+		s.notifyConversation(message, EventMessagePinned, pin)
+	}
+	return pin, nil
+}
+
+// UnpinMessage unpins a message from its conversation and notifies the conversation's members.
+// Unpinning a message that is not pinned notifies nobody.
+func (s *MessageService) UnpinMessage(userID uuid.UUID, messageID uint) error {
+	message, err := s.findAuthorizedMessage(userID, messageID)
+	if err != nil {
+		return err
+	}
+
+	pin := &model.MessagePin{ConversationID: message.ConversationID(), MessageID: message.ID, PinnedBy: userID}
+	unpinned, err := s.repo.DeleteMessagePin(pin.ConversationID, pin.MessageID)
+	if err != nil {
+		return err
+	}
+
+	if unpinned {
+		s.notifyConversation(message, EventMessageUnpinned, pin)
+	}
+	return nil
+}
+
+// GetPinnedMessages retrieves the messages pinned in a conversation the user belongs to.
+func (s *MessageService) GetPinnedMessages(userID uuid.UUID, target model.ConversationTarget) ([]model.Message, error) {
+	if !target.Valid() {
+		return nil, ErrInvalidTarget
+	}
+	if err := s.authorizeTarget(userID, target); err != nil {
+		return nil, err
+	}
+
+	messages, err := s.repo.FindPinnedMessages(target.ConversationID(userID))
+	if err != nil {
+		return nil, err
+	}
+	for i := range messages {
+		messages[i].IsPinned = true
+	}
+	return messages, nil
+}
+
+// GetConversationSetting retrieves the settings of a conversation the user belongs to.
+func (s *MessageService) GetConversationSetting(userID uuid.UUID, target model.ConversationTarget) (*model.ConversationSetting, error) {
+	if !target.Valid() {
+		return nil, ErrInvalidTarget
+	}
+	if err := s.authorizeTarget(userID, target); err != nil {
+		return nil, err
+	}
+	return s.repo.FindConversationSetting(target.ConversationID(userID))
+}
+
+// SetDisappearingTimer sets the lifetime of new messages in a conversation and notifies its members.
+// A zero duration turns disappearing messages off. Messages sent before the change keep their expiry.
+func (s *MessageService) SetDisappearingTimer(userID uuid.UUID, target model.ConversationTarget, after time.Duration) (*model.ConversationSetting, error) {
+	setting, err := s.GetConversationSetting(userID, target)
+	if err != nil {
+		return nil, err
+	}
+
+	setting.DisappearAfterSeconds = uint(after / time.Second)
+	setting.UpdatedBy = userID
+	setting.UpdatedAt = s.clock.Now()
+	if err := s.repo.SaveConversationSetting(setting); err != nil {
+		return nil, err
+	}
+
+	members, err := s.getTargetMembers(userID, target)
+	if err != nil {
+		utils.LogError("Failed to resolve conversation members", err, zap.String("conversation_id", setting.ConversationID))
+		return setting, nil
+	}
+	s.notifyUsers(members, EventConversationUpdated, setting)
+	return setting, nil
+}
+
+// GetConversationMembers returns the user IDs taking part in the conversation of a message.
+func (s *MessageService) GetConversationMembers(message *model.Message) ([]uuid.UUID, error) {
+	if message.GroupID != 0 {
+		return s.groupRepo.FindGroupMemberIDs(message.GroupID)
+	}
+	if message.SenderID == message.ReceiverID {
+		return []uuid.UUID{message.SenderID}, nil
+	}
+	return []uuid.UUID{message.SenderID, message.ReceiverID}, nil
+}
+
+// GetTargetMembers returns the members of a conversation the user may post into.
+func (s *MessageService) GetTargetMembers(userID uuid.UUID, target model.ConversationTarget) ([]uuid.UUID, error) {
+	if !target.Valid() {
+		return nil, ErrInvalidTarget
+	}
+	if err := s.authorizeTarget(userID, target); err != nil {
+		return nil, err
+	}
+	return s.getTargetMembers(userID, target)
+}
+
+// prepareMessage checks that the sender may send a message and fills in what the sender does not
+// choose: its sender, timestamp, status and the description of its attachment.
+func (s *MessageService) prepareMessage(senderID uuid.UUID, message *model.Message) error {
+	message.SenderID = senderID
+	target := model.ConversationTarget{ReceiverID: message.ReceiverID, GroupID: message.GroupID}
+	if !target.Valid() {
+		return ErrInvalidTarget
+	}
+	if err := s.authorizeTarget(senderID, target); err != nil {
+		return err
+	}
+	if err := s.authorizeAttachment(senderID, message.MediaURL); err != nil {
+		return err
+	}
+	if err := s.describeAttachment(message); err != nil {
+		return err
+	}
+
+	if message.Timestamp.IsZero() {
+		message.Timestamp = s.clock.Now()
+	}
+	message.Status = "sent"
+	return nil
+}
+
+// findAuthorizedMessage loads a message and checks that the user belongs to its conversation.
+func (s *MessageService) findAuthorizedMessage(userID uuid.UUID, messageID uint) (*model.Message, error) {
+	message, err := s.repo.FindMessageByID(messageID)
+	if errors.Is(err, repository.ErrNotFound) {
+		return nil, ErrMessageNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := s.authorizeMessage(userID, message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// applyExpiry decides when a message disappears. An expiry set on the message itself overrides
+// the disappearing-message timer of its conversation.
+func (s *MessageService) applyExpiry(message *model.Message) error {
+	if message.ExpiresAt.IsZero() && !message.ExpiryTimestamp.IsZero() {
+		message.ExpiresAt = message.ExpiryTimestamp
+	}
+	if !message.ExpiresAt.IsZero() {
+		if !message.ExpiresAt.After(message.CreatedAt) {
+			return ErrInvalidExpiry
+		}
+		message.AutoDelete = true
+		message.ExpiryTimestamp = message.ExpiresAt
+		return nil
+	}
+
+	setting, err := s.repo.FindConversationSetting(message.ConversationID())
+	if err != nil {
+		return err
+	}
+	if setting.DisappearAfterSeconds > 0 {
+		message.ExpiresAt = message.CreatedAt.Add(time.Duration(setting.DisappearAfterSeconds) * time.Second)
+		message.ExpiryTimestamp = message.ExpiresAt
+		message.AutoDelete = true
+	}
+	return nil
+}
+
+// getTargetMembers returns the user IDs taking part in a conversation as seen by userID.
+func (s *MessageService) getTargetMembers(userID uuid.UUID, target model.ConversationTarget) ([]uuid.UUID, error) {
+	if target.IsGroup() {
+		return s.groupRepo.FindGroupMemberIDs(target.GroupID)
+	}
+	return s.GetConversationMembers(&model.Message{SenderID: userID, ReceiverID: target.ReceiverID})
+}
+
+// deliver pushes a saved message to every member of its conversation if a notifier is configured.
+func (s *MessageService) deliver(message *model.Message) {
+	if s.notifier == nil {
+		return
+	}
+	members, err := s.GetConversationMembers(message)
+	if err != nil {
+		utils.LogError("Failed to resolve conversation members", err, zap.Uint("message_id", message.ID))
+		return
+	}
+	s.notifier.DeliverMessage(members, *message)
+}
+
+// notifyConversation pushes an event to every member of a message's conversation.
+func (s *MessageService) notifyConversation(message *model.Message, event string, payload interface{}) {
+	if s.notifier == nil {
+		return
+	}
+	members, err := s.GetConversationMembers(message)
+	if err != nil {
+		utils.LogError("Failed to resolve conversation members", err, zap.Uint("message_id", message.ID))
+		return
+	}
+	s.notifyUsers(members, event, payload)
+}
+
+// notifyUsers pushes an event to the given users if a notifier is configured.
+func (s *MessageService) notifyUsers(userIDs []uuid.UUID, event string, payload interface{}) {
+	if s.notifier == nil {
+		return
+	}
+	s.notifier.NotifyUsers(userIDs, event, payload)
+}
+
+// authorizeMessage checks that a user belongs to the conversation of a message.
+func (s *MessageService) authorizeMessage(userID uuid.UUID, message *model.Message) error {
+	if message.GroupID != 0 {
+		return s.authorizeTarget(userID, model.ConversationTarget{GroupID: message.GroupID})
+	}
+	if message.SenderID != userID && message.ReceiverID != userID {
+		return ErrNotConversationMember
+	}
+	return nil
+}
+
+// authorizeAttachment checks that a user may attach the file behind a media URL.
+func (s *MessageService) authorizeAttachment(userID uuid.UUID, mediaURL string) error {
+	if mediaURL == "" || s.attachments == nil {
+		return nil
+	}
+	allowed, err := s.attachments.CanAttach(userID, mediaURL)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return ErrAttachmentNotAllowed
+	}
+	return nil
+}
+
+// markAttachment records the attachment of a saved message. A failure only keeps the file from
+// being deleted with the message, so it is logged rather than returned.
+func (s *MessageService) markAttachment(message *model.Message) {
+	if message.MediaURL == "" || s.attachments == nil {
+		return
+	}
+	if err := s.attachments.MarkAttached(message.SenderID, message.MediaURL, message.AutoDelete); err != nil {
+		utils.LogError("Failed to record message attachment", err, zap.String("media_url", message.MediaURL))
+	}
+}
+
+// describeAttachment fills in the media of a message attaching a stored file from the file: its
+// type and size unless given, and for images their dimensions, blurhash and thumbnails. The media
+// thumbnail becomes the smallest thumbnail of at least previewThumbnailSize, or the largest one.
+func (s *MessageService) describeAttachment(message *model.Message) error {
+	if message.MediaURL == "" || s.attachments == nil {
+		return nil
+	}
+	file, err := s.attachments.AttachedFile(message.MediaURL)
+	if err != nil || file == nil {
+		return err
+	}
+	if message.MediaType == "" {
+		message.MediaType = file.ContentType
+	}
+	if message.MediaSize == 0 {
+		message.MediaSize = file.Size
+	}
+	message.MediaWidth = file.Width
+	message.MediaHeight = file.Height
+	message.MediaBlurhash = file.Blurhash
+	message.MediaThumbnails = file.Thumbnails
+	for _, thumbnail := range file.Thumbnails {
+		message.MediaThumbnail = thumbnail.URL
+		if thumbnail.Size >= previewThumbnailSize {
+			break
+		}
+	}
+	return nil
+}
+
+// authorizeTarget checks that a user may post into a conversation.
+func (s *MessageService) authorizeTarget(userID uuid.UUID, target model.ConversationTarget) error {
+	if !target.IsGroup() {
+		return nil
+	}
+	isMember, err := s.groupRepo.IsGroupMember(target.GroupID, userID)
+	if err != nil {
+		return err
+	}
+	if !isMember {
+		return ErrNotConversationMember
+	}
+	return nil
+}
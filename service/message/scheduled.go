@@ -0,0 +1,175 @@
+package message
+
+import (
+	"adwise-service/model"
+	"adwise-service/repository"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	// ErrScheduledMessageNotFound is returned when a scheduled message does not exist or belongs to another user.
+	ErrScheduledMessageNotFound = errors.New("scheduled message not found")
+	// ErrScheduledMessageNotPending is returned when a scheduled message is edited after it was sent or cancelled.
+	ErrScheduledMessageNotPending = errors.New("scheduled message is no longer pending")
+	// ErrInvalidSendTime is returned when a send time can not be parsed or is not in the future.
+	ErrInvalidSendTime = errors.New("send time must be a future time")
+	// ErrInvalidTimeZone is returned for an unknown IANA time zone.
+	ErrInvalidTimeZone = errors.New("invalid time zone")
+)
+
+// localTimeLayouts are the accepted layouts for send times written without a UTC offset.
+var localTimeLayouts = []string{
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+}
+
+// ResolveSendAt turns a send time written by a user into an absolute time.
+//
+// A value with a UTC offset (RFC 3339) is used as is. A value without an offset is read as a wall
+// clock time in timeZone, or in the user's preferred time zone when timeZone is empty. The returned
+// zone name is the one the time was written in.
+func (s *MessageService) ResolveSendAt(userID uuid.UUID, value, timeZone string) (time.Time, string, error) {
+	if timeZone == "" {
+		preference, err := s.prefRepo.FindUserPreference(userID)
+		if err != nil {
+			return time.Time{}, "", err
+		}
+		timeZone = preference.TimeZone
+	}
+	if timeZone == "" {
+		timeZone = "UTC"
+	}
+	location, err := time.LoadLocation(timeZone)
+	if err != nil {
+		return time.Time{}, "", ErrInvalidTimeZone
+	}
+
+	if sendAt, err := time.Parse(time.RFC3339, value); err == nil {
+		return sendAt.UTC(), timeZone, nil
+	}
+	for _, layout := range localTimeLayouts {
+		if sendAt, err := time.ParseInLocation(layout, value, location); err == nil {
+			return sendAt.UTC(), timeZone, nil
+		}
+	}
+	return time.Time{}, "", ErrInvalidSendTime
+}
+
+// ScheduleMessage stores a message to be sent by the scheduler at its SendAt time.
+func (s *MessageService) ScheduleMessage(userID uuid.UUID, scheduled *model.ScheduledMessage) error {
+	scheduled.ID = 0
+	scheduled.SenderID = userID
+	if err := s.validateScheduled(userID, scheduled); err != nil {
+		return err
+	}
+
+	scheduled.Status = model.ScheduledStatusPending
+	scheduled.MessageID = 0
+	scheduled.Attempts = 0
+	scheduled.LastError = ""
+	return s.repo.CreateScheduledMessage(scheduled)
+}
+
+// GetScheduledMessages lists a user's scheduled messages, soonest first. Without statuses every
+// scheduled message is returned.
+func (s *MessageService) GetScheduledMessages(userID uuid.UUID, statuses ...string) ([]model.ScheduledMessage, error) {
+	return s.repo.FindScheduledMessagesBySender(userID, statuses)
+}
+
+// UpdateScheduledMessage replaces the content, target or send time of a pending scheduled message.
+func (s *MessageService) UpdateScheduledMessage(userID uuid.UUID, id uint, update *model.ScheduledMessage) (*model.ScheduledMessage, error) {
+	scheduled, err := s.findOwnScheduled(userID, id)
+	if err != nil {
+		return nil, err
+	}
+	if scheduled.Status != model.ScheduledStatusPending {
+		return nil, ErrScheduledMessageNotPending
+	}
+
+	update.ID = scheduled.ID
+	update.SenderID = userID
+	update.Status = model.ScheduledStatusPending
+	update.MessageID = 0
+	update.Attempts = 0
+	update.LastError = ""
+	update.CreatedAt = scheduled.CreatedAt
+	if err := s.validateScheduled(userID, update); err != nil {
+		return nil, err
+	}
+
+	updated, err := s.repo.UpdatePendingScheduledMessage(update)
+	if err != nil {
+		return nil, err
+	}
+	if !updated {
+		return nil, ErrScheduledMessageNotPending
+	}
+	return update, nil
+}
+
+// CancelScheduledMessage cancels a pending scheduled message.
+func (s *MessageService) CancelScheduledMessage(userID uuid.UUID, id uint) error {
+	scheduled, err := s.findOwnScheduled(userID, id)
+	if err != nil {
+		return err
+	}
+	if scheduled.Status != model.ScheduledStatusPending {
+		return ErrScheduledMessageNotPending
+	}
+
+	scheduled.Status = model.ScheduledStatusCancelled
+	updated, err := s.repo.UpdatePendingScheduledMessage(scheduled)
+	if err != nil {
+		return err
+	}
+	if !updated {
+		return ErrScheduledMessageNotPending
+	}
+	return nil
+}
+
+// findOwnScheduled loads a scheduled message owned by the user.
+func (s *MessageService) findOwnScheduled(userID uuid.UUID, id uint) (*model.ScheduledMessage, error) {
+	scheduled, err := s.repo.FindScheduledMessageByID(id)
+	if errors.Is(err, repository.ErrNotFound) {
+		return nil, ErrScheduledMessageNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if scheduled.SenderID != userID {
+		return nil, ErrScheduledMessageNotFound
+	}
+	return scheduled, nil
+}
+
+// validateScheduled checks the target and send time of a scheduled message.
+func (s *MessageService) validateScheduled(userID uuid.UUID, scheduled *model.ScheduledMessage) error {
+	if scheduled.IsReminder {
+		scheduled.ReceiverID = userID
+		scheduled.GroupID = 0
+	}
+	target := model.ConversationTarget{ReceiverID: scheduled.ReceiverID, GroupID: scheduled.GroupID}
+	if !target.Valid() {
+		return ErrInvalidTarget
+	}
+	if err := s.authorizeTarget(userID, target); err != nil {
+		return err
+	}
+	if err := s.authorizeAttachment(userID, scheduled.MediaURL); err != nil {
+		return err
+	}
+	if !scheduled.SendAt.After(s.clock.Now()) {
+		return ErrInvalidSendTime
+	}
+	scheduled.SendAt = scheduled.SendAt.UTC()
+	if scheduled.TimeZone == "" {
+		scheduled.TimeZone = "UTC"
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package message
+
+import (
+	"adwise-service/model"
+	"adwise-service/utils"
+	"context"
+	"errors"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// maxScheduledAttempts is how often the scheduler tries to send a scheduled message before giving up.
+	maxScheduledAttempts = 5
+	// scheduledRetryDelay is how long a failed send waits before its first retry; every later retry
+	// waits twice as long as the one before.
+	scheduledRetryDelay = 30 * time.Second
+	// scheduledClaimTimeout is how long a claimed message may stay in the sending state before another
+	// scheduler assumes its instance stopped and sends it again.
+	scheduledClaimTimeout = 5 * time.Minute
+)
+
+// Scheduler sends scheduled messages through the normal send path once they are due.
+//
+// Scheduled messages are persisted, so nothing is lost across restarts: anything that became due
+// while no scheduler was running is sent on the next poll. The scheduler reads the time from the
+// MessageService clock, which makes it testable with a fake clock by calling RunDue directly.
+type Scheduler struct {
+	service   *MessageService
+	interval  time.Duration
+	batchSize int
+}
+
+// NewScheduler creates a new Scheduler that polls for due messages every interval.
+func NewScheduler(service *MessageService, interval time.Duration, batchSize int) *Scheduler {
+	return &Scheduler{
+		service:   service,
+		interval:  interval,
+		batchSize: batchSize,
+	}
+}
+
+// Run sends due messages until the context is cancelled.
+func (sch *Scheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(sch.interval)
+	defer ticker.Stop()
+
+	for {
+		sch.RunDue()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunDue sends every scheduled message that is due at the current time and returns how many were sent.
+func (sch *Scheduler) RunDue() int {
+	sent := 0
+	for {
+		now := sch.service.clock.Now()
+		claimed, err := sch.service.repo.ClaimDueScheduledMessages(now, now.Add(-scheduledClaimTimeout), sch.batchSize)
+		if err != nil {
+			utils.LogError("Failed to claim scheduled messages", err)
+			return sent
+		}
+
+		for i := range claimed {
+			if sch.send(&claimed[i]) {
+				sent++
+			}
+		}
+
+		if len(claimed) < sch.batchSize {
+			return sent
+		}
+	}
+}
+
+// send delivers one claimed scheduled message and records the outcome. The message is saved
+// together with the sent state, so a scheduled message is sent at most once; a failed attempt is
+// retried after a delay that doubles with every attempt.
+func (sch *Scheduler) send(scheduled *model.ScheduledMessage) bool {
+	message := &model.Message{
+		ReceiverID:     scheduled.ReceiverID,
+		GroupID:        scheduled.GroupID,
+		Content:        scheduled.Content,
+		Type:           scheduled.Type,
+		MediaURL:       scheduled.MediaURL,
+		MediaType:      scheduled.MediaType,
+		MediaSize:      scheduled.MediaSize,
+		MediaThumbnail: scheduled.MediaThumbnail,
+	}
+
+	now := sch.service.clock.Now()
+	scheduled.UpdatedAt = now
+	err := sch.service.prepareMessage(scheduled.SenderID, message)
+	if err == nil {
+		message.CreatedAt = now
+		err = sch.service.applyExpiry(message)
+	}
+	if err == nil {
+		var sent bool
+		sent, err = sch.service.repo.SendScheduledMessage(scheduled, message)
+		if err == nil {
+			if !sent {
+				utils.LogWarn("Scheduled message was claimed again before it was sent",
+					zap.Uint("scheduled_message_id", scheduled.ID))
+				return false
+			}
+			sch.service.deliver(message)
+			return true
+		}
+	}
+
+	scheduled.LastError = err.Error()
+	switch {
+	case errors.Is(err, ErrNotConversationMember), errors.Is(err, ErrInvalidTarget),
+		errors.Is(err, ErrAttachmentNotAllowed), scheduled.Attempts >= maxScheduledAttempts:
+		scheduled.Status = model.ScheduledStatusFailed
+	default:
+		scheduled.Status = model.ScheduledStatusPending
+		scheduled.RetryAt = now.Add(scheduledRetryDelay << (scheduled.Attempts - 1))
+	}
+
+	utils.LogWarn("Failed to send scheduled message",
+		zap.Uint("scheduled_message_id", scheduled.ID), zap.Uint("attempts", scheduled.Attempts), zap.Error(err))
+	if err := sch.service.repo.UpdateScheduledMessageStatus(scheduled); err != nil {
+		utils.LogError("Failed to update scheduled message", err, zap.Uint("scheduled_message_id", scheduled.ID))
+	}
+	return false
+}
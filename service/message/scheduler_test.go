@@ -0,0 +1,257 @@
+package message
+
+import (
+	"adwise-service/model"
+	"adwise-service/repository"
+	"adwise-service/utils"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+func init() {
+	utils.Logger = zap.NewNop()
+}
+
+// fakeClock is a utils.Clock that only moves when told to.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// fakeMessageRepo keeps scheduled and sent messages in memory. Methods the scheduler does not use
+// are left to the embedded nil interface and panic when called.
+type fakeMessageRepo struct {
+	repository.MessageRepository
+
+	scheduled map[uint]*model.ScheduledMessage
+	messages  []model.Message
+	sendErr   error // Returned by SendScheduledMessage while set
+	claimLost bool  // Makes SendScheduledMessage report that the claim was lost
+}
+
+func newFakeMessageRepo() *fakeMessageRepo {
+	return &fakeMessageRepo{scheduled: make(map[uint]*model.ScheduledMessage)}
+}
+
+func (r *fakeMessageRepo) add(scheduled model.ScheduledMessage) {
+	scheduled.ID = uint(len(r.scheduled) + 1)
+	scheduled.Status = model.ScheduledStatusPending
+	r.scheduled[scheduled.ID] = &scheduled
+}
+
+func (r *fakeMessageRepo) FindConversationSetting(conversationID string) (*model.ConversationSetting, error) {
+	return &model.ConversationSetting{ConversationID: conversationID}, nil
+}
+
+func (r *fakeMessageRepo) ClaimDueScheduledMessages(now, staleBefore time.Time, limit int) ([]model.ScheduledMessage, error) {
+	var claimed []model.ScheduledMessage
+	for id := uint(1); id <= uint(len(r.scheduled)) && len(claimed) < limit; id++ {
+		scheduled := r.scheduled[id]
+		due := scheduled.Status == model.ScheduledStatusPending && !scheduled.RetryAt.After(now)
+		stale := scheduled.Status == model.ScheduledStatusSending && scheduled.ClaimedAt.Before(staleBefore)
+		if scheduled.SendAt.After(now) || (!due && !stale) {
+			continue
+		}
+		scheduled.Status = model.ScheduledStatusSending
+		scheduled.ClaimedAt = now
+		scheduled.Attempts++
+		claimed = append(claimed, *scheduled)
+	}
+	return claimed, nil
+}
+
+func (r *fakeMessageRepo) SendScheduledMessage(scheduled *model.ScheduledMessage, message *model.Message) (bool, error) {
+	if r.sendErr != nil {
+		return false, r.sendErr
+	}
+	if r.claimLost {
+		return false, nil
+	}
+	message.ID = uint(len(r.messages) + 1)
+	r.messages = append(r.messages, *message)
+	stored := r.scheduled[scheduled.ID]
+	stored.Status = model.ScheduledStatusSent
+	stored.MessageID = message.ID
+	stored.LastError = ""
+	return true, nil
+}
+
+func (r *fakeMessageRepo) UpdateScheduledMessageStatus(scheduled *model.ScheduledMessage) error {
+	stored := r.scheduled[scheduled.ID]
+	stored.Status = scheduled.Status
+	stored.Attempts = scheduled.Attempts
+	stored.LastError = scheduled.LastError
+	stored.RetryAt = scheduled.RetryAt
+	return nil
+}
+
+// fakeGroupRepo holds the members of groups.
+type fakeGroupRepo struct {
+	repository.GroupRepository
+	members map[uint][]uuid.UUID
+}
+
+func (r *fakeGroupRepo) FindGroupMemberIDs(groupID uint) ([]uuid.UUID, error) {
+	return r.members[groupID], nil
+}
+
+func (r *fakeGroupRepo) IsGroupMember(groupID uint, userID uuid.UUID) (bool, error) {
+	for _, member := range r.members[groupID] {
+		if member == userID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// fakeNotifier records the messages delivered to users.
+type fakeNotifier struct {
+	delivered []model.Message
+}
+
+func (n *fakeNotifier) NotifyUsers(userIDs []uuid.UUID, event string, payload interface{}) {}
+
+func (n *fakeNotifier) DeliverMessage(userIDs []uuid.UUID, message model.Message) {
+	n.delivered = append(n.delivered, message)
+}
+
+func newTestScheduler(t *testing.T) (*Scheduler, *fakeMessageRepo, *fakeNotifier, *fakeClock) {
+	t.Helper()
+	repo := newFakeMessageRepo()
+	service := NewMessageService(repo, &fakeGroupRepo{members: map[uint][]uuid.UUID{}}, nil, Config{})
+	clock := &fakeClock{now: time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)}
+	service.SetClock(clock)
+	notifier := &fakeNotifier{}
+	service.SetNotifier(notifier)
+	return NewScheduler(service, time.Minute, 10), repo, notifier, clock
+}
+
+func TestSchedulerSendsDueMessages(t *testing.T) {
+	scheduler, repo, notifier, clock := newTestScheduler(t)
+	sender, receiver := uuid.New(), uuid.New()
+	repo.add(model.ScheduledMessage{SenderID: sender, ReceiverID: receiver, Content: "now", SendAt: clock.Now()})
+	repo.add(model.ScheduledMessage{SenderID: sender, ReceiverID: receiver, Content: "later", SendAt: clock.Now().Add(time.Hour)})
+
+	if sent := scheduler.RunDue(); sent != 1 {
+		t.Fatalf("RunDue sent %d messages, want 1", sent)
+	}
+	if len(notifier.delivered) != 1 || notifier.delivered[0].Content != "now" {
+		t.Fatalf("delivered %+v, want the due message only", notifier.delivered)
+	}
+	if got := repo.scheduled[1]; got.Status != model.ScheduledStatusSent || got.MessageID != 1 {
+		t.Fatalf("due message is %s with message %d, want sent with message 1", got.Status, got.MessageID)
+	}
+	if delivered := notifier.delivered[0]; delivered.SenderID != sender || !delivered.Timestamp.Equal(clock.Now()) {
+		t.Fatalf("delivered message from %s at %s, want from %s at %s", delivered.SenderID, delivered.Timestamp, sender, clock.Now())
+	}
+
+	clock.Advance(59 * time.Minute)
+	if sent := scheduler.RunDue(); sent != 0 {
+		t.Fatalf("RunDue sent %d messages before the second was due", sent)
+	}
+	clock.Advance(time.Minute)
+	if sent := scheduler.RunDue(); sent != 1 {
+		t.Fatalf("RunDue sent %d messages once the second was due, want 1", sent)
+	}
+	if sent := scheduler.RunDue(); sent != 0 || len(repo.messages) != 2 {
+		t.Fatalf("RunDue sent %d more messages, %d in total; want none more and 2 in total", sent, len(repo.messages))
+	}
+}
+
+func TestSchedulerRetriesWithBackoff(t *testing.T) {
+	scheduler, repo, notifier, clock := newTestScheduler(t)
+	repo.add(model.ScheduledMessage{SenderID: uuid.New(), ReceiverID: uuid.New(), Content: "hi", SendAt: clock.Now()})
+	repo.sendErr = errors.New("connection reset")
+
+	start := clock.Now()
+	for attempt, delay := range []time.Duration{30 * time.Second, time.Minute, 2 * time.Minute} {
+		if sent := scheduler.RunDue(); sent != 0 {
+			t.Fatalf("attempt %d: RunDue sent %d messages while sending fails", attempt+1, sent)
+		}
+		scheduled := repo.scheduled[1]
+		if scheduled.Status != model.ScheduledStatusPending || scheduled.Attempts != uint(attempt+1) {
+			t.Fatalf("attempt %d: message is %s after %d attempts, want pending", attempt+1, scheduled.Status, scheduled.Attempts)
+		}
+		if want := clock.Now().Add(delay); !scheduled.RetryAt.Equal(want) {
+			t.Fatalf("attempt %d: retry at %s, want %s", attempt+1, scheduled.RetryAt.Sub(start), want.Sub(start))
+		}
+
+		// Nothing is retried before the delay is over
+		clock.Advance(delay - time.Second)
+		scheduler.RunDue()
+		if attempts := repo.scheduled[1].Attempts; attempts != uint(attempt+1) {
+			t.Fatalf("attempt %d: retried early, after %d attempts", attempt+1, attempts)
+		}
+		clock.Advance(time.Second)
+	}
+
+	repo.sendErr = nil
+	if sent := scheduler.RunDue(); sent != 1 || len(notifier.delivered) != 1 {
+		t.Fatalf("RunDue sent %d messages and delivered %d once sending works, want 1", sent, len(notifier.delivered))
+	}
+	if scheduled := repo.scheduled[1]; scheduled.Status != model.ScheduledStatusSent || scheduled.LastError != "" {
+		t.Fatalf("message is %s with error %q, want sent without error", scheduled.Status, scheduled.LastError)
+	}
+}
+
+func TestSchedulerGivesUpAfterMaxAttempts(t *testing.T) {
+	scheduler, repo, notifier, clock := newTestScheduler(t)
+	repo.add(model.ScheduledMessage{SenderID: uuid.New(), ReceiverID: uuid.New(), Content: "hi", SendAt: clock.Now()})
+	repo.sendErr = errors.New("connection reset")
+
+	for i := 0; i < maxScheduledAttempts; i++ {
+		scheduler.RunDue()
+		clock.Advance(time.Hour)
+	}
+	scheduled := repo.scheduled[1]
+	if scheduled.Status != model.ScheduledStatusFailed || scheduled.Attempts != maxScheduledAttempts {
+		t.Fatalf("message is %s after %d attempts, want failed after %d", scheduled.Status, scheduled.Attempts, maxScheduledAttempts)
+	}
+	if scheduled.LastError != "connection reset" {
+		t.Fatalf("last error is %q, want the send error", scheduled.LastError)
+	}
+
+	repo.sendErr = nil
+	if sent := scheduler.RunDue(); sent != 0 || len(notifier.delivered) != 0 {
+		t.Fatalf("failed message was sent again")
+	}
+}
+
+func TestSchedulerFailsUnauthorizedMessages(t *testing.T) {
+	scheduler, repo, notifier, clock := newTestScheduler(t)
+	repo.add(model.ScheduledMessage{SenderID: uuid.New(), GroupID: 7, Content: "hi", SendAt: clock.Now()})
+
+	if sent := scheduler.RunDue(); sent != 0 || len(notifier.delivered) != 0 {
+		t.Fatalf("message to a group the sender left was sent")
+	}
+	if scheduled := repo.scheduled[1]; scheduled.Status != model.ScheduledStatusFailed || scheduled.Attempts != 1 {
+		t.Fatalf("message is %s after %d attempts, want failed after the first", scheduled.Status, scheduled.Attempts)
+	}
+}
+
+func TestSchedulerSkipsMessagesClaimedAgain(t *testing.T) {
+	scheduler, repo, notifier, clock := newTestScheduler(t)
+	repo.add(model.ScheduledMessage{SenderID: uuid.New(), ReceiverID: uuid.New(), Content: "hi", SendAt: clock.Now()})
+	repo.claimLost = true
+
+	if sent := scheduler.RunDue(); sent != 0 || len(notifier.delivered) != 0 {
+		t.Fatalf("message whose claim was lost was delivered")
+	}
+}
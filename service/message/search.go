@@ -0,0 +1,98 @@
+package message
+
+import (
+	"adwise-service/model"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+var (
+	// ErrEmptySearchQuery is returned when a search has no query text.
+	ErrEmptySearchQuery = errors.New("search query is required")
+	// ErrInvalidCursor is returned when a pagination cursor can not be decoded.
+	ErrInvalidCursor = errors.New("invalid search cursor")
+)
+
+// SearchMessages runs a full-text search over the content and transcriptions of the messages in
+// conversations the user belongs to. The query is parsed in filter.Language, defaulting to the
+// user's language preference. Results are ordered newest first and paginated with an opaque cursor.
+func (s *MessageService) SearchMessages(userID uuid.UUID, filter model.MessageSearchFilter, cursor string) (*model.MessageSearchPage, error) {
+	filter.Query = strings.TrimSpace(filter.Query)
+	if filter.Query == "" {
+		return nil, ErrEmptySearchQuery
+	}
+	if filter.Conversation != nil {
+		if !filter.Conversation.Valid() {
+			return nil, ErrInvalidTarget
+		}
+		if err := s.authorizeTarget(userID, *filter.Conversation); err != nil {
+			return nil, err
+		}
+	}
+	if filter.Limit <= 0 {
+		filter.Limit = defaultSearchLimit
+	}
+	if filter.Limit > maxSearchLimit {
+		filter.Limit = maxSearchLimit
+	}
+	if filter.Language == "" {
+		preference, err := s.prefRepo.FindUserPreference(userID)
+		if err != nil {
+			return nil, err
+		}
+		filter.Language = preference.LanguagePreference
+	}
+	if cursor != "" {
+		before, err := decodeSearchCursor(cursor)
+		if err != nil {
+			return nil, err
+		}
+		filter.Before = before
+	}
+
+	// Fetch one extra result to find out whether there is a next page.
+	limit := filter.Limit
+	filter.Limit++
+	results, err := s.repo.SearchMessages(userID, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &model.MessageSearchPage{Results: results}
+	if len(results) > limit {
+		page.Results = results[:limit]
+		last := page.Results[limit-1].Message
+		page.NextCursor = encodeSearchCursor(model.MessageSearchCursor{CreatedAt: last.CreatedAt, ID: last.ID})
+	}
+	return page, nil
+}
+
+// encodeSearchCursor encodes the position of the last result on a page.
+func encodeSearchCursor(cursor model.MessageSearchCursor) string {
+	raw := fmt.Sprintf("%d:%d", cursor.CreatedAt.UnixNano(), cursor.ID)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// decodeSearchCursor decodes a cursor produced by encodeSearchCursor.
+func decodeSearchCursor(cursor string) (*model.MessageSearchCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var nanos int64
+	var id uint
+	if _, err := fmt.Sscanf(string(raw), "%d:%d", &nanos, &id); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return &model.MessageSearchCursor{CreatedAt: time.Unix(0, nanos), ID: id}, nil
+}
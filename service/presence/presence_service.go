@@ -0,0 +1,357 @@
+package presence
+
+import (
+	"adwise-service/model"
+	"adwise-service/repository"
+	"adwise-service/utils"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrInvalidStatus is returned when a device reports a status other than online or away.
+	ErrInvalidStatus = errors.New("status must be online or away")
+	// ErrNotGroupMember is returned when subscribing to the members of a group the user is not in.
+	ErrNotGroupMember = errors.New("user is not a member of the group")
+)
+
+// Notifier pushes presence events to connected users.
+type Notifier interface {
+	NotifyUsers(userIDs []uuid.UUID, event string, payload interface{})
+}
+
+// Config holds the tunables of the PresenceService.
+type Config struct {
+	OfflineGrace time.Duration // Time a user must stay disconnected before being reported offline
+}
+
+// userState is the presence of a user with at least one connection, or whose last connection
+// closed less than the offline grace ago.
+type userState struct {
+	devices      map[string]string // Status of each connection, keyed by connection ID
+	status       string            // Status last published to subscribers
+	hideLastSeen bool              // Privacy preference, loaded when the user connects
+	offline      *pendingOffline   // Reports the user offline once the grace has passed
+}
+
+// pendingOffline is a scheduled offline report. Its identity tells a firing timer whether it was
+// superseded by a reconnect.
+type pendingOffline struct {
+	timer *time.Timer
+}
+
+// PresenceService tracks which users are online from the lifecycle of their connections and the
+// idle/away state reported by each device, and pushes changes to subscribed users.
+//
+// A user is online while any device is active, away while every connected device is idle, and
+// offline once the last connection has been closed for the offline grace. The grace debounces
+// flapping connections: a client that drops and reconnects within it causes no presence events.
+type PresenceService struct {
+	repo      repository.PresenceRepository
+	groupRepo repository.GroupRepository
+	prefRepo  repository.PreferenceRepository
+	notifier  Notifier
+	clock     utils.Clock
+	cfg       Config
+
+	mu            sync.Mutex
+	users         map[uuid.UUID]*userState
+	subscribers   map[uuid.UUID]map[uuid.UUID]struct{} // Subscribers of each user
+	subscriptions map[uuid.UUID]map[uuid.UUID]struct{} // Users each subscriber follows
+}
+
+// NewPresenceService creates a new PresenceService.
+func NewPresenceService(
+	repo repository.PresenceRepository,
+	groupRepo repository.GroupRepository,
+	prefRepo repository.PreferenceRepository,
+	cfg Config,
+) *PresenceService {
+	return &PresenceService{
+		repo:          repo,
+		groupRepo:     groupRepo,
+		prefRepo:      prefRepo,
+		clock:         utils.SystemClock{},
+		cfg:           cfg,
+		users:         make(map[uuid.UUID]*userState),
+		subscribers:   make(map[uuid.UUID]map[uuid.UUID]struct{}),
+		subscriptions: make(map[uuid.UUID]map[uuid.UUID]struct{}),
+	}
+}
+
+// SetNotifier sets the notifier used to push presence changes to subscribers.
+func (s *PresenceService) SetNotifier(notifier Notifier) {
+	s.notifier = notifier
+}
+
+// SetClock replaces the clock the service reads the current time from.
+func (s *PresenceService) SetClock(clock utils.Clock) {
+	s.clock = clock
+}
+
+// Connected records a new connection of a user. The device starts out online.
+func (s *PresenceService) Connected(userID uuid.UUID, connectionID string) {
+	hideLastSeen := false
+	if preference, err := s.prefRepo.FindUserPreference(userID); err != nil {
+		utils.LogError("Failed to load presence preference", err, zap.String("user_id", userID.String()))
+	} else {
+		hideLastSeen = preference.HideLastSeen
+	}
+	s.saveLastSeen(userID)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state, ok := s.users[userID]
+	if !ok {
+		state = &userState{devices: make(map[string]string), status: model.PresenceOffline}
+		s.users[userID] = state
+	}
+	state.hideLastSeen = hideLastSeen
+	if state.offline != nil {
+		state.offline.timer.Stop()
+		state.offline = nil
+	}
+	state.devices[connectionID] = model.PresenceOnline
+	s.publishLocked(userID, state)
+}
+
+// Disconnected records that a connection of a user closed. When it was the user's last connection
+// the user is reported offline after the offline grace, unless they reconnect in the meantime.
+func (s *PresenceService) Disconnected(userID uuid.UUID, connectionID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state, ok := s.users[userID]
+	if !ok {
+		return
+	}
+	delete(state.devices, connectionID)
+	if len(state.devices) > 0 {
+		s.publishLocked(userID, state)
+		return
+	}
+	if state.offline != nil {
+		return
+	}
+
+	pending := &pendingOffline{}
+	pending.timer = time.AfterFunc(s.cfg.OfflineGrace, func() {
+		s.goOffline(userID, pending)
+	})
+	state.offline = pending
+}
+
+// goOffline reports a user offline once the offline grace has passed without a new connection.
+func (s *PresenceService) goOffline(userID uuid.UUID, pending *pendingOffline) {
+	s.saveLastSeen(userID)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state, ok := s.users[userID]
+	if !ok || state.offline != pending || len(state.devices) > 0 {
+		return
+	}
+	delete(s.users, userID)
+	for target := range s.subscriptions[userID] {
+		s.removeSubscriberLocked(userID, target)
+	}
+	delete(s.subscriptions, userID)
+
+	if state.status != model.PresenceOffline {
+		state.status = model.PresenceOffline
+		s.notifyLocked(userID, s.presenceLocked(userID, state, s.clock.Now()))
+	}
+}
+
+// SetStatus records the idle/away state reported by one of a user's devices.
+func (s *PresenceService) SetStatus(userID uuid.UUID, connectionID, status string) error {
+	if status != model.PresenceOnline && status != model.PresenceAway {
+		return ErrInvalidStatus
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state, ok := s.users[userID]
+	if !ok {
+		return nil
+	}
+	if _, ok := state.devices[connectionID]; !ok {
+		return nil
+	}
+	state.devices[connectionID] = status
+	s.publishLocked(userID, state)
+	return nil
+}
+
+// Subscribe subscribes a user to the presence of their contacts or the members of one of their
+// groups and returns the current presence of those users. Requested users that are not contacts
+// of the subscriber are left out.
+func (s *PresenceService) Subscribe(subscriberID uuid.UUID, request model.PresenceSubscribePayload) ([]model.PresencePayload, error) {
+	targets, err := s.resolveTargets(subscriberID, request)
+	if err != nil {
+		return nil, err
+	}
+	if len(targets) == 0 {
+		return []model.PresencePayload{}, nil
+	}
+
+	lastSeen, err := s.repo.FindLastSeen(targets)
+	if err != nil {
+		return nil, err
+	}
+	hidden, err := s.repo.FindHiddenLastSeen(targets)
+	if err != nil {
+		return nil, err
+	}
+	hiddenSet := make(map[uuid.UUID]bool, len(hidden))
+	for _, userID := range hidden {
+		hiddenSet[userID] = true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	following, ok := s.subscriptions[subscriberID]
+	if !ok {
+		following = make(map[uuid.UUID]struct{})
+		s.subscriptions[subscriberID] = following
+	}
+
+	presences := make([]model.PresencePayload, 0, len(targets))
+	for _, target := range targets {
+		following[target] = struct{}{}
+		subscribers, ok := s.subscribers[target]
+		if !ok {
+			subscribers = make(map[uuid.UUID]struct{})
+			s.subscribers[target] = subscribers
+		}
+		subscribers[subscriberID] = struct{}{}
+
+		if state, ok := s.users[target]; ok && state.status != model.PresenceOffline {
+			presences = append(presences, s.presenceLocked(target, state, time.Time{}))
+			continue
+		}
+		presence := model.PresencePayload{UserID: target, Status: model.PresenceOffline}
+		if seen, ok := lastSeen[target]; ok && !hiddenSet[target] {
+			presence.LastSeen = &seen
+		}
+		presences = append(presences, presence)
+	}
+	return presences, nil
+}
+
+// Unsubscribe stops pushing the presence of the requested users to a subscriber.
+func (s *PresenceService) Unsubscribe(subscriberID uuid.UUID, request model.PresenceSubscribePayload) {
+	targets := request.UserIDs
+	if request.GroupID != 0 {
+		members, err := s.groupRepo.FindGroupMemberIDs(request.GroupID)
+		if err != nil {
+			utils.LogError("Failed to resolve group members", err, zap.Uint("group_id", request.GroupID))
+		}
+		targets = append(targets, members...)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, target := range targets {
+		s.removeSubscriberLocked(subscriberID, target)
+		delete(s.subscriptions[subscriberID], target)
+	}
+	if len(s.subscriptions[subscriberID]) == 0 {
+		delete(s.subscriptions, subscriberID)
+	}
+}
+
+// resolveTargets returns the users a subscription request may follow.
+func (s *PresenceService) resolveTargets(subscriberID uuid.UUID, request model.PresenceSubscribePayload) ([]uuid.UUID, error) {
+	var targets []uuid.UUID
+	if request.GroupID != 0 {
+		isMember, err := s.groupRepo.IsGroupMember(request.GroupID, subscriberID)
+		if err != nil {
+			return nil, err
+		}
+		if !isMember {
+			return nil, ErrNotGroupMember
+		}
+		members, err := s.groupRepo.FindGroupMemberIDs(request.GroupID)
+		if err != nil {
+			return nil, err
+		}
+		for _, member := range members {
+			if member != subscriberID {
+				targets = append(targets, member)
+			}
+		}
+	}
+
+	if len(request.UserIDs) > 0 {
+		contacts, err := s.repo.FilterContacts(subscriberID, request.UserIDs)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, contacts...)
+	}
+	return targets, nil
+}
+
+// removeSubscriberLocked removes a subscriber from the subscribers of a user.
+func (s *PresenceService) removeSubscriberLocked(subscriberID, target uuid.UUID) {
+	subscribers := s.subscribers[target]
+	delete(subscribers, subscriberID)
+	if len(subscribers) == 0 {
+		delete(s.subscribers, target)
+	}
+}
+
+// publishLocked pushes a user's status to their subscribers if it changed.
+func (s *PresenceService) publishLocked(userID uuid.UUID, state *userState) {
+	status := model.PresenceAway
+	for _, deviceStatus := range state.devices {
+		if deviceStatus == model.PresenceOnline {
+			status = model.PresenceOnline
+			break
+		}
+	}
+	if len(state.devices) == 0 || status == state.status {
+		return
+	}
+	state.status = status
+	s.notifyLocked(userID, s.presenceLocked(userID, state, time.Time{}))
+}
+
+// presenceLocked builds the presence event of a user. lastSeen is only reported for offline users
+// that do not hide it.
+func (s *PresenceService) presenceLocked(userID uuid.UUID, state *userState, lastSeen time.Time) model.PresencePayload {
+	presence := model.PresencePayload{UserID: userID, Status: state.status}
+	if state.status == model.PresenceOffline && !state.hideLastSeen && !lastSeen.IsZero() {
+		presence.LastSeen = &lastSeen
+	}
+	return presence
+}
+
+// notifyLocked pushes a presence event to the subscribers of a user.
+func (s *PresenceService) notifyLocked(userID uuid.UUID, presence model.PresencePayload) {
+	if s.notifier == nil || len(s.subscribers[userID]) == 0 {
+		return
+	}
+	subscribers := make([]uuid.UUID, 0, len(s.subscribers[userID]))
+	for subscriberID := range s.subscribers[userID] {
+		subscribers = append(subscribers, subscriberID)
+	}
+	s.notifier.NotifyUsers(subscribers, model.OpPresence, presence)
+}
+
+// saveLastSeen persists the current time as the last time a user was seen online.
+func (s *PresenceService) saveLastSeen(userID uuid.UUID) {
+	if err := s.repo.UpdateLastSeen(userID, s.clock.Now()); err != nil {
+		utils.LogError("Failed to update last seen", err, zap.String("user_id", userID.String()))
+	}
+}
@@ -0,0 +1,187 @@
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// ErrSlowConsumer is returned when a client's outbound queue is full. The client is disconnected.
+var ErrSlowConsumer = errors.New("client outbound queue is full")
+
+// errClientClosed is returned when sending to a client that is already disconnected.
+var errClientClosed = errors.New("client is closed")
+
+// Config holds the connection limits of the WebSocketService.
+type Config struct {
+	WriteWait       time.Duration // Time allowed to write a frame to the peer
+	PongWait        time.Duration // Time allowed to read the next pong from the peer
+	PingPeriod      time.Duration // Interval between pings; must be less than PongWait
+	MaxMessageSize  int64         // Maximum size in bytes of an inbound message
+	SendQueueSize   int           // Number of outbound messages buffered per connection before it is evicted
+	AllowedOrigins  []string      // Origins allowed to open a connection; "*" allows any, none allows only same-origin requests
+	ReplayLogSize   int           // Number of recent events kept per user for replay on reconnect
+	ReplayRetention time.Duration // Time a disconnected user's replay log is kept
+	TypingTimeout   time.Duration // Time after which a typing indicator without a stop is stopped by the server
+	TypingThrottle  time.Duration // Minimum interval between typing starts forwarded per sender and conversation
+	RouteTTL        time.Duration // Time a node's entries in the route registry stay valid without a refresh
+	StreamKeepAlive time.Duration // Interval between keep-alive comments on an event stream
+	LongPollWait    time.Duration // Longest time a long-poll request waits for an event
+}
+
+// DefaultConfig returns the default connection limits.
+func DefaultConfig() Config {
+	return Config{
+		WriteWait:       10 * time.Second,
+		PongWait:        60 * time.Second,
+		PingPeriod:      54 * time.Second,
+		MaxMessageSize:  64 * 1024,
+		SendQueueSize:   256,
+		ReplayLogSize:   200,
+		ReplayRetention: 5 * time.Minute,
+		TypingTimeout:   6 * time.Second,
+		TypingThrottle:  3 * time.Second,
+		RouteTTL:        30 * time.Second,
+		StreamKeepAlive: 15 * time.Second,
+		LongPollWait:    25 * time.Second,
+	}
+}
+
+// Client is a single WebSocket connection of a user. A user has one Client per open device or tab.
+// Clients of the HTTP transports in stream.go have no WebSocket connection and drain their outbound
+// queue into the HTTP response instead.
+//
+// All writes to the connection happen on the client's own writer goroutine, which drains a bounded
+// outbound queue. Any goroutine may enqueue messages; a client whose queue fills up is too slow to
+// keep up and is disconnected instead of blocking the sender.
+type Client struct {
+	ID       string          // Connection ID, unique for every connection
+	UserID   uuid.UUID       // Authenticated user owning the connection
+	DeviceID string          // Device identifier supplied by the client, or the connection ID if none was given
+	Version  int             // Protocol version negotiated at connect
+	conn     *websocket.Conn // nil for clients of the HTTP transports
+	cfg      Config
+	send     chan []byte   // Outbound queue drained by writePump
+	done     chan struct{} // Closed when the client is being disconnected
+
+	closeOnce   sync.Once
+	closeCode   int
+	closeReason string
+}
+
+// newClient creates a Client for a freshly upgraded connection.
+func newClient(conn *websocket.Conn, userID uuid.UUID, deviceID string, version int, cfg Config) *Client {
+	id := uuid.New().String()
+	if deviceID == "" {
+		deviceID = id
+	}
+	return &Client{
+		ID:       id,
+		UserID:   userID,
+		DeviceID: deviceID,
+		Version:  version,
+		conn:     conn,
+		cfg:      cfg,
+		send:     make(chan []byte, cfg.SendQueueSize),
+		done:     make(chan struct{}),
+	}
+}
+
+// writeJSON queues a JSON value for sending. It never blocks: if the outbound queue is full the
+// client is disconnected as a slow consumer and ErrSlowConsumer is returned.
+func (c *Client) writeJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-c.done:
+		return errClientClosed
+	default:
+	}
+
+	select {
+	case c.send <- data:
+		return nil
+	default:
+		c.close(websocket.CloseTryAgainLater, "slow consumer")
+		return ErrSlowConsumer
+	}
+}
+
+// reply queues an envelope for the client in its negotiated protocol version.
+func (c *Client) reply(op, id string, payload interface{}) {
+	if err := c.writeJSON(newEnvelope(c.Version, op, id, payload)); err != nil {
+		log.Println("WebSocket write error:", err)
+	}
+}
+
+// replyError queues the error reply to the request with the given ID.
+func (c *Client) replyError(id string, err error) {
+	var protoErr *protocolError
+	if !errors.As(err, &protoErr) {
+		log.Println("WebSocket request failed:", err)
+	}
+	if err := c.writeJSON(errorEnvelope(c.Version, id, err)); err != nil {
+		log.Println("WebSocket write error:", err)
+	}
+}
+
+// close disconnects the client with a close code and reason. Only the first call has an effect.
+func (c *Client) close(code int, reason string) {
+	c.closeOnce.Do(func() {
+		c.closeCode = code
+		c.closeReason = reason
+		close(c.done)
+	})
+}
+
+// writePump writes queued messages and periodic pings to the connection. It is the only goroutine
+// that writes to the connection, and it closes the connection when it returns.
+func (c *Client) writePump() {
+	ticker := time.NewTicker(c.cfg.PingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case data := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(c.cfg.WriteWait))
+			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				log.Println("WebSocket write error:", err)
+				c.close(websocket.CloseAbnormalClosure, "")
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(c.cfg.WriteWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				c.close(websocket.CloseAbnormalClosure, "")
+				return
+			}
+		case <-c.done:
+			if c.closeCode != websocket.CloseAbnormalClosure {
+				message := websocket.FormatCloseMessage(c.closeCode, c.closeReason)
+				c.conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(c.cfg.WriteWait))
+			}
+			return
+		}
+	}
+}
+
+// prepareRead applies the inbound size limit and the heartbeat read deadline to the connection.
+// Every pong from the peer extends the deadline, so a peer that stops answering pings is dropped.
+func (c *Client) prepareRead() {
+	c.conn.SetReadLimit(c.cfg.MaxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(c.cfg.PongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(c.cfg.PongWait))
+	})
+}
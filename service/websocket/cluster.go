@@ -0,0 +1,307 @@
+package websocket
+
+import (
+	"adwise-service/broker"
+	"adwise-service/repository"
+	"adwise-service/utils"
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// routedEvent is an event published on a user's broker channel for the nodes holding the user's
+// sessions.
+type routedEvent struct {
+	Origin    string          `json:"origin"` // Node that published the event; it has delivered it locally already
+	Op        string          `json:"op"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+	Transient bool            `json:"transient,omitempty"`
+}
+
+// routeNotice announces on broker.RoutesChannel that a node gained or lost the session of a user.
+// A notice without a user announces that the node left the cluster.
+type routeNotice struct {
+	NodeID string    `json:"node_id"`
+	UserID uuid.UUID `json:"user_id,omitempty"`
+	Joined bool      `json:"joined,omitempty"`
+}
+
+// cluster connects a WebSocketService to the other service instances.
+//
+// Every node subscribes to the broker channel of each user it holds a session of, records the
+// session in the route registry and announces it to the other nodes. An event for a user is
+// delivered to the local connections and, when another node holds a session of the user, published
+// on the user's channel.
+//
+// Each node keeps the routes of the other nodes in memory, so routing an event needs no database
+// query. The table is loaded from the registry when the node joins and kept current by the notices
+// of the other nodes; since the broker may drop notices, and a crashed node sends none, it is
+// reloaded from the registry with every heartbeat as well.
+type cluster struct {
+	nodeID string
+	broker broker.Broker
+	routes repository.WebSocketRouteRepository
+
+	mu            sync.Mutex
+	subscriptions map[uuid.UUID]func() // Unsubscribe functions of the user channels, per user with a local session
+
+	tableMu sync.Mutex
+	remote  map[uuid.UUID]map[string]bool // Nodes other than this one holding a session, per user
+	loading bool                          // Set while the table is reloaded
+	missed  []routeNotice                 // Notices received during a reload, applied once it is done
+}
+
+// JoinCluster makes the service deliver events to users connected to other instances through a
+// broker, using a route registry shared by all instances to find them. nodeID must be unique per
+// instance. Without a cluster only local connections receive events.
+func (s *WebSocketService) JoinCluster(nodeID string, b broker.Broker, routes repository.WebSocketRouteRepository) {
+	c := &cluster{
+		nodeID:        nodeID,
+		broker:        b,
+		routes:        routes,
+		subscriptions: make(map[uuid.UUID]func()),
+		remote:        make(map[uuid.UUID]map[string]bool),
+	}
+	s.cluster = c
+
+	// Subscribing before the table is loaded makes sure no notice falls between the two
+	if _, err := b.Subscribe(broker.RoutesChannel, c.receiveNotice); err != nil {
+		utils.LogError("Failed to subscribe to route notices", err, zap.String("node_id", nodeID))
+	}
+	c.reload()
+}
+
+// RunRegistry keeps the routes of this node alive until the context is cancelled, then removes them.
+func (s *WebSocketService) RunRegistry(ctx context.Context) {
+	if s.cluster == nil {
+		return
+	}
+	ticker := time.NewTicker(s.cfg.RouteTTL / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if err := s.cluster.routes.UnregisterNode(s.cluster.nodeID); err != nil {
+				utils.LogError("Failed to unregister WebSocket node", err, zap.String("node_id", s.cluster.nodeID))
+			}
+			s.cluster.announce(routeNotice{NodeID: s.cluster.nodeID})
+			return
+		case <-ticker.C:
+			now := time.Now()
+			if err := s.cluster.routes.RefreshNode(s.cluster.nodeID, now, now.Add(s.cfg.RouteTTL)); err != nil {
+				utils.LogError("Failed to refresh WebSocket routes", err, zap.String("node_id", s.cluster.nodeID))
+			}
+			s.cluster.reload()
+		}
+	}
+}
+
+// joinUser subscribes to a user's channel and registers the route to this node when the user opens
+// their first session here.
+func (s *WebSocketService) joinUser(userID uuid.UUID) {
+	c := s.cluster
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.subscriptions[userID]; ok {
+		return
+	}
+	unsubscribe, err := c.broker.Subscribe(broker.UserChannel(userID), func(payload []byte) {
+		s.receiveRouted(userID, payload)
+	})
+	if err != nil {
+		utils.LogError("Failed to subscribe to user channel", err, zap.String("user_id", userID.String()))
+		return
+	}
+	c.subscriptions[userID] = unsubscribe
+
+	if err := c.routes.RegisterUserNode(c.nodeID, userID, time.Now().Add(s.cfg.RouteTTL)); err != nil {
+		utils.LogError("Failed to register WebSocket route", err, zap.String("user_id", userID.String()))
+	}
+	c.announce(routeNotice{NodeID: c.nodeID, UserID: userID, Joined: true})
+}
+
+// leaveUser undoes joinUser once the user's session on this node is gone. A session created again
+// in the meantime keeps the subscription.
+func (s *WebSocketService) leaveUser(userID uuid.UUID) {
+	c := s.cluster
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	unsubscribe, ok := c.subscriptions[userID]
+	if !ok || s.session(userID, false) != nil {
+		return
+	}
+	unsubscribe()
+	delete(c.subscriptions, userID)
+
+	if err := c.routes.UnregisterUserNode(c.nodeID, userID); err != nil {
+		utils.LogError("Failed to unregister WebSocket route", err, zap.String("user_id", userID.String()))
+	}
+	c.announce(routeNotice{NodeID: c.nodeID, UserID: userID})
+}
+
+// route publishes an event for the users among userIDs that hold a session on another node. It
+// reports whether there was at least one such user.
+func (s *WebSocketService) route(userIDs []uuid.UUID, op string, data json.RawMessage, transient bool) bool {
+	c := s.cluster
+	if c == nil || len(userIDs) == 0 {
+		return false
+	}
+
+	remote := c.remoteUsers(userIDs)
+	if len(remote) == 0 {
+		return false
+	}
+
+	event, err := json.Marshal(routedEvent{Origin: c.nodeID, Op: op, Payload: data, Transient: transient})
+	if err != nil {
+		utils.LogError("Failed to encode routed event", err)
+		return false
+	}
+	published := false
+	for _, userID := range remote {
+		if err := c.broker.Publish(context.Background(), broker.UserChannel(userID), event); err != nil {
+			utils.LogError("Failed to publish routed event", err, zap.String("user_id", userID.String()))
+			continue
+		}
+		published = true
+	}
+	return published
+}
+
+// IsReachable reports whether a user has an open connection to this or any other node.
+func (s *WebSocketService) IsReachable(userID uuid.UUID) bool {
+	if s.IsConnected(userID) {
+		return true
+	}
+	return s.cluster != nil && len(s.cluster.remoteUsers([]uuid.UUID{userID})) > 0
+}
+
+// remoteUsers returns the users among userIDs with a session on another node.
+func (c *cluster) remoteUsers(userIDs []uuid.UUID) []uuid.UUID {
+	c.tableMu.Lock()
+	defer c.tableMu.Unlock()
+
+	var remote []uuid.UUID
+	for _, userID := range userIDs {
+		if len(c.remote[userID]) > 0 {
+			remote = append(remote, userID)
+		}
+	}
+	return remote
+}
+
+// announce tells the other nodes about a change of this node's routes.
+func (c *cluster) announce(notice routeNotice) {
+	payload, err := json.Marshal(notice)
+	if err != nil {
+		utils.LogError("Failed to encode route notice", err)
+		return
+	}
+	if err := c.broker.Publish(context.Background(), broker.RoutesChannel, payload); err != nil {
+		utils.LogError("Failed to publish route notice", err, zap.String("node_id", c.nodeID))
+	}
+}
+
+// receiveNotice applies a route notice of another node to the route table.
+func (c *cluster) receiveNotice(payload []byte) {
+	var notice routeNotice
+	if err := json.Unmarshal(payload, &notice); err != nil {
+		utils.LogError("Invalid route notice", err)
+		return
+	}
+	if notice.NodeID == c.nodeID {
+		return
+	}
+
+	c.tableMu.Lock()
+	defer c.tableMu.Unlock()
+	c.apply(c.remote, notice)
+	if c.loading {
+		c.missed = append(c.missed, notice)
+	}
+}
+
+// apply records a route notice in a route table.
+func (c *cluster) apply(table map[uuid.UUID]map[string]bool, notice routeNotice) {
+	if notice.UserID == uuid.Nil {
+		for userID, nodes := range table {
+			delete(nodes, notice.NodeID)
+			if len(nodes) == 0 {
+				delete(table, userID)
+			}
+		}
+		return
+	}
+
+	nodes := table[notice.UserID]
+	switch {
+	case notice.Joined && nodes == nil:
+		table[notice.UserID] = map[string]bool{notice.NodeID: true}
+	case notice.Joined:
+		nodes[notice.NodeID] = true
+	case nodes != nil:
+		delete(nodes, notice.NodeID)
+		if len(nodes) == 0 {
+			delete(table, notice.UserID)
+		}
+	}
+}
+
+// reload replaces the route table with the live routes of the other nodes in the registry. Notices
+// received while the registry is read are applied again afterwards, since the registry may not
+// reflect them yet.
+func (c *cluster) reload() {
+	c.tableMu.Lock()
+	if c.loading {
+		c.tableMu.Unlock()
+		return
+	}
+	c.loading = true
+	c.missed = nil
+	c.tableMu.Unlock()
+
+	routes, err := c.routes.FindRoutesOfOtherNodes(c.nodeID, time.Now())
+
+	c.tableMu.Lock()
+	defer c.tableMu.Unlock()
+	c.loading = false
+	if err != nil {
+		utils.LogError("Failed to load WebSocket routes", err, zap.String("node_id", c.nodeID))
+		return
+	}
+	table := make(map[uuid.UUID]map[string]bool)
+	for _, route := range routes {
+		c.apply(table, routeNotice{NodeID: route.NodeID, UserID: route.UserID, Joined: true})
+	}
+	for _, notice := range c.missed {
+		c.apply(table, notice)
+	}
+	c.missed = nil
+	c.remote = table
+}
+
+// receiveRouted delivers an event published by another node to the local connections of a user.
+func (s *WebSocketService) receiveRouted(userID uuid.UUID, payload []byte) {
+	var event routedEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		utils.LogError("Invalid routed event", err)
+		return
+	}
+	if event.Origin == s.cluster.nodeID {
+		return
+	}
+	s.deliverLocal(userID, event.Op, event.Payload, event.Transient)
+}
@@ -0,0 +1,208 @@
+package websocket
+
+import (
+	"adwise-service/broker"
+	"adwise-service/model"
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// fakeRouteRepo is a route registry shared by the nodes of a test, standing in for the database
+// table shared by service instances.
+type fakeRouteRepo struct {
+	mu     sync.Mutex
+	routes map[model.WebSocketRoute]time.Time // Expiry per node and user; the key's ExpiresAt is unset
+	loads  int                                // Number of times a node read the registry
+	onLoad func()                             // Called while a node reads the registry
+}
+
+func newFakeRouteRepo() *fakeRouteRepo {
+	return &fakeRouteRepo{routes: make(map[model.WebSocketRoute]time.Time)}
+}
+
+func (r *fakeRouteRepo) RegisterUserNode(nodeID string, userID uuid.UUID, expiresAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.routes[model.WebSocketRoute{NodeID: nodeID, UserID: userID}] = expiresAt
+	return nil
+}
+
+func (r *fakeRouteRepo) UnregisterUserNode(nodeID string, userID uuid.UUID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.routes, model.WebSocketRoute{NodeID: nodeID, UserID: userID})
+	return nil
+}
+
+func (r *fakeRouteRepo) RefreshNode(nodeID string, now, expiresAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for route, expiry := range r.routes {
+		switch {
+		case route.NodeID == nodeID:
+			r.routes[route] = expiresAt
+		case expiry.Before(now):
+			delete(r.routes, route)
+		}
+	}
+	return nil
+}
+
+func (r *fakeRouteRepo) UnregisterNode(nodeID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for route := range r.routes {
+		if route.NodeID == nodeID {
+			delete(r.routes, route)
+		}
+	}
+	return nil
+}
+
+func (r *fakeRouteRepo) FindRoutesOfOtherNodes(nodeID string, now time.Time) ([]model.WebSocketRoute, error) {
+	if r.onLoad != nil {
+		r.onLoad()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.loads++
+	var routes []model.WebSocketRoute
+	for route, expiry := range r.routes {
+		if route.NodeID != nodeID && expiry.After(now) {
+			routes = append(routes, model.WebSocketRoute{NodeID: route.NodeID, UserID: route.UserID, ExpiresAt: expiry})
+		}
+	}
+	return routes, nil
+}
+
+func (r *fakeRouteRepo) loadCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.loads
+}
+
+// readEvent reads the next frame of a connection and checks that it is the given event.
+func readEvent(t *testing.T, conn *websocket.Conn, op string, seq uint64, want testEvent) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var envelope model.Envelope
+	if err := conn.ReadJSON(&envelope); err != nil {
+		t.Fatalf("read %s: %v", op, err)
+	}
+	var event testEvent
+	json.Unmarshal(envelope.Payload, &event)
+	if envelope.Op != op || envelope.Seq != seq || event != want {
+		t.Fatalf("got %s %d %+v, want %s %d %+v", envelope.Op, envelope.Seq, event, op, seq, want)
+	}
+}
+
+func TestTwoNodesShareOneBroker(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ReplayRetention = 20 * time.Millisecond
+	cfg.RouteTTL = 300 * time.Millisecond
+	bus := broker.NewInProcessBroker()
+	routes := newFakeRouteRepo()
+
+	node1 := NewWebSocketService(cfg)
+	node1.JoinCluster("node-1", bus, routes)
+	node2 := NewWebSocketService(cfg)
+	node2.JoinCluster("node-2", bus, routes)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go node2.RunRegistry(ctx)
+	server1, server2 := newTestServer(t, node1), newTestServer(t, node2)
+
+	alice, bob := uuid.New(), uuid.New()
+	aliceConn, aliceHello := dial(t, server1, alice, "phone")
+	bobConn, bobHello := dial(t, server2, bob, "phone")
+	waitFor(t, time.Second, "the nodes to learn each other's routes", func() bool {
+		return node1.IsReachable(bob) && node2.IsReachable(alice)
+	})
+	if node1.IsConnected(bob) {
+		t.Fatalf("node 1 has a local connection of a user connected to node 2")
+	}
+
+	// Routing an event needs no registry lookup
+	loads := routes.loadCount()
+	node1.NotifyUsers([]uuid.UUID{alice, bob}, "test.event", testEvent{N: 1})
+	readEvent(t, aliceConn, "test.event", aliceHello.Seq+1, testEvent{N: 1})
+	readEvent(t, bobConn, "test.event", bobHello.Seq+1, testEvent{N: 1})
+
+	// Transient events are routed too, without a sequence number
+	node1.sendEvent([]uuid.UUID{bob}, "test.typing", testEvent{N: 2}, true)
+	readEvent(t, bobConn, "test.typing", 0, testEvent{N: 2})
+
+	if !node2.SendToUser(alice, "test.event", testEvent{N: 3}) {
+		t.Fatalf("SendToUser reported a user on the other node as unreachable")
+	}
+	readEvent(t, aliceConn, "test.event", aliceHello.Seq+2, testEvent{N: 3})
+	if n := routes.loadCount(); n != loads {
+		t.Fatalf("sending read the route registry %d times", n-loads)
+	}
+
+	// A user connected to both nodes gets an event on each
+	bobLaptop, bobLaptopHello := dial(t, server1, bob, "laptop")
+	node2.NotifyUsers([]uuid.UUID{bob}, "test.event", testEvent{N: 4})
+	readEvent(t, bobConn, "test.event", bobHello.Seq+2, testEvent{N: 4})
+	readEvent(t, bobLaptop, "test.event", bobLaptopHello.Seq+1, testEvent{N: 4})
+
+	// A node joining later loads the routes already in the registry
+	node3 := NewWebSocketService(cfg)
+	node3.JoinCluster("node-3", bus, routes)
+	if !node3.IsReachable(alice) || !node3.IsReachable(bob) {
+		t.Fatalf("a node joining later does not know the routes in the registry")
+	}
+
+	// Once a user's session on a node is gone the other nodes stop routing to it
+	bobConn.Close()
+	waitFor(t, 2*time.Second, "the route of the closed session to be dropped", func() bool {
+		node3.cluster.tableMu.Lock()
+		defer node3.cluster.tableMu.Unlock()
+		return len(node3.cluster.remote[bob]) == 1
+	})
+	bobLaptop.Close()
+	waitFor(t, 2*time.Second, "every node to drop the user's routes", func() bool {
+		return !node1.IsReachable(bob) && !node2.IsReachable(bob) && !node3.IsReachable(bob)
+	})
+	if node2.SendToUser(bob, "test.event", testEvent{N: 5}) {
+		t.Fatalf("SendToUser reported a user without connections as reachable")
+	}
+
+	// A node leaving the cluster takes its routes along
+	bobConn, _ = dial(t, server2, bob, "phone")
+	waitFor(t, time.Second, "node 1 to learn the new route", func() bool { return node1.IsReachable(bob) })
+	cancel()
+	waitFor(t, 2*time.Second, "node 1 to drop the routes of the node that left", func() bool {
+		return !node1.IsReachable(bob) && !node3.IsReachable(bob)
+	})
+}
+
+func TestRouteTableReloadKeepsNoticesReceivedMeanwhile(t *testing.T) {
+	routes := newFakeRouteRepo()
+	c := &cluster{nodeID: "node-1", routes: routes, remote: make(map[uuid.UUID]map[string]bool)}
+	alice, bob := uuid.New(), uuid.New()
+	routes.RegisterUserNode("node-2", alice, time.Now().Add(time.Minute))
+
+	// While the registry is read, bob connects to node 3 and alice leaves node 2, neither of which
+	// the read sees
+	routes.onLoad = func() {
+		joined, _ := json.Marshal(routeNotice{NodeID: "node-3", UserID: bob, Joined: true})
+		left, _ := json.Marshal(routeNotice{NodeID: "node-2", UserID: alice})
+		c.receiveNotice(joined)
+		c.receiveNotice(left)
+	}
+	c.reload()
+
+	if len(c.remoteUsers([]uuid.UUID{bob})) != 1 {
+		t.Fatalf("a route announced during the reload was lost")
+	}
+	if len(c.remoteUsers([]uuid.UUID{alice})) != 0 {
+		t.Fatalf("a route removed during the reload came back")
+	}
+}
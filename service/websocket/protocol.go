@@ -0,0 +1,432 @@
+package websocket
+
+import (
+	"adwise-service/model"
+	callservice "adwise-service/service/call"
+	"adwise-service/service/message"
+	presenceservice "adwise-service/service/presence"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// ProtocolVersion is the newest protocol version spoken by the server.
+const ProtocolVersion = 1
+
+// versionSubprotocolPrefix prefixes the subprotocols used to negotiate the protocol version, for
+// example "adwise.v1".
+const versionSubprotocolPrefix = "adwise.v"
+
+// supportedVersions are the protocol versions the server accepts at connect.
+var supportedVersions = map[int]bool{1: true}
+
+// ErrUnsupportedVersion is returned when a client asks for a protocol version the server does not speak.
+var ErrUnsupportedVersion = errors.New("unsupported protocol version")
+
+//go:embed protocol.schema.json
+var protocolSchema []byte
+
+// ProtocolSchema returns the JSON Schema describing the envelopes and payloads of the protocol.
+func ProtocolSchema() []byte {
+	return protocolSchema
+}
+
+// NegotiateVersion picks the protocol version of an upgrade request. The client either offers
+// "adwise.v<N>" subprotocols, in which case the newest supported one is chosen and must be echoed
+// back as the accepted subprotocol, or passes a "v" query parameter. Without either the current
+// version is used.
+func NegotiateVersion(r *http.Request) (int, string, error) {
+	best := 0
+	offered := false
+	for _, protocol := range requestedSubprotocols(r) {
+		if !strings.HasPrefix(protocol, versionSubprotocolPrefix) {
+			continue
+		}
+		offered = true
+		version, err := strconv.Atoi(strings.TrimPrefix(protocol, versionSubprotocolPrefix))
+		if err == nil && supportedVersions[version] && version > best {
+			best = version
+		}
+	}
+	if offered {
+		if best == 0 {
+			return 0, "", ErrUnsupportedVersion
+		}
+		return best, versionSubprotocolPrefix + strconv.Itoa(best), nil
+	}
+
+	if value := r.URL.Query().Get("v"); value != "" {
+		version, err := strconv.Atoi(value)
+		if err != nil || !supportedVersions[version] {
+			return 0, "", ErrUnsupportedVersion
+		}
+		return version, "", nil
+	}
+	return ProtocolVersion, "", nil
+}
+
+// IsVersionSubprotocol reports whether a subprotocol is used for version negotiation.
+func IsVersionSubprotocol(protocol string) bool {
+	return strings.HasPrefix(protocol, versionSubprotocolPrefix)
+}
+
+// requestedSubprotocols returns the subprotocols offered by an upgrade request.
+func requestedSubprotocols(r *http.Request) []string {
+	var offered []string
+	for _, header := range r.Header.Values("Sec-Websocket-Protocol") {
+		for _, protocol := range strings.Split(header, ",") {
+			if protocol = strings.TrimSpace(protocol); protocol != "" {
+				offered = append(offered, protocol)
+			}
+		}
+	}
+	return offered
+}
+
+// MessageSender sends chat messages on behalf of connected users and resolves the members of
+// their conversations.
+type MessageSender interface {
+	SendMessage(senderID uuid.UUID, message *model.Message) error
+	GetTargetMembers(userID uuid.UUID, target model.ConversationTarget) ([]uuid.UUID, error)
+}
+
+// PresenceTracker follows the lifecycle of connections to track which users are online.
+type PresenceTracker interface {
+	Connected(userID uuid.UUID, connectionID string)
+	Disconnected(userID uuid.UUID, connectionID string)
+	SetStatus(userID uuid.UUID, connectionID, status string) error
+	Subscribe(subscriberID uuid.UUID, request model.PresenceSubscribePayload) ([]model.PresencePayload, error)
+	Unsubscribe(subscriberID uuid.UUID, request model.PresenceSubscribePayload)
+}
+
+// CallSignaller runs the signalling of calls between connected users and follows their connections
+// to end the calls of users that are gone.
+type CallSignaller interface {
+	Offer(callerID uuid.UUID, signal model.CallSignalPayload) (*model.Call, error)
+	Answer(userID uuid.UUID, signal model.CallSignalPayload) (*model.Call, error)
+	Candidate(userID uuid.UUID, signal model.CallSignalPayload) error
+	Reject(userID uuid.UUID, signal model.CallSignalPayload) (*model.Call, error)
+	End(userID uuid.UUID, signal model.CallSignalPayload) (*model.Call, error)
+	JoinGroupCall(userID uuid.UUID, request model.GroupCallPayload) (*model.GroupCall, error)
+	LeaveGroupCall(userID uuid.UUID, request model.GroupCallPayload) (*model.GroupCall, error)
+	RelayGroupSignal(userID uuid.UUID, signal model.CallSignalPayload) error
+	SetGroupCallMedia(userID uuid.UUID, request model.GroupCallPayload) (*model.GroupCall, error)
+	MuteParticipant(hostID uuid.UUID, request model.GroupCallPayload) (*model.GroupCall, error)
+	RemoveParticipant(hostID uuid.UUID, request model.GroupCallPayload) (*model.GroupCall, error)
+	Connected(userID uuid.UUID)
+	Disconnected(userID uuid.UUID)
+}
+
+// protocolError is a request failure reported to the client in an error envelope.
+type protocolError struct {
+	code    string
+	message string
+}
+
+func (e *protocolError) Error() string {
+	return e.message
+}
+
+// newProtocolError creates a protocolError with a formatted message.
+func newProtocolError(code, format string, args ...interface{}) *protocolError {
+	return &protocolError{code: code, message: fmt.Sprintf(format, args...)}
+}
+
+// opHandler handles an inbound operation and returns the payload of the ack reply.
+type opHandler func(client *Client, payload json.RawMessage) (interface{}, error)
+
+// handlers returns the inbound operations of the protocol.
+func (s *WebSocketService) handlers() map[string]opHandler {
+	return map[string]opHandler{
+		model.OpMessageSend:         s.handleMessageSend,
+		model.OpTyping:              s.handleTyping,
+		model.OpPresence:            s.handlePresence,
+		model.OpPresenceSubscribe:   s.handlePresenceSubscribe,
+		model.OpPresenceUnsubscribe: s.handlePresenceUnsubscribe,
+		model.OpCallOffer:           s.handleCallSignal(model.OpCallOffer),
+		model.OpCallAnswer:          s.handleCallSignal(model.OpCallAnswer),
+		model.OpCallICE:             s.handleCallSignal(model.OpCallICE),
+		model.OpCallReject:          s.handleCallSignal(model.OpCallReject),
+		model.OpCallEnd:             s.handleCallSignal(model.OpCallEnd),
+		model.OpGroupCallJoin:       s.handleGroupCall(model.OpGroupCallJoin),
+		model.OpGroupCallLeave:      s.handleGroupCall(model.OpGroupCallLeave),
+		model.OpGroupCallSignal:     s.handleGroupCallSignal,
+		model.OpGroupCallMedia:      s.handleGroupCall(model.OpGroupCallMedia),
+		model.OpGroupCallMute:       s.handleGroupCall(model.OpGroupCallMute),
+		model.OpGroupCallRemove:     s.handleGroupCall(model.OpGroupCallRemove),
+	}
+}
+
+// dispatch decodes an inbound frame, runs its operation and replies with an ack or error envelope
+// carrying the request ID of the frame.
+func (s *WebSocketService) dispatch(client *Client, data []byte) {
+	var envelope model.Envelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		client.replyError("", newProtocolError(model.ErrCodeBadRequest, "invalid envelope: %v", err))
+		return
+	}
+	if envelope.V != client.Version {
+		client.replyError(envelope.ID, newProtocolError(model.ErrCodeBadRequest,
+			"envelope version %d does not match the negotiated version %d", envelope.V, client.Version))
+		return
+	}
+
+	handler, ok := s.ops[envelope.Op]
+	if !ok {
+		client.replyError(envelope.ID, newProtocolError(model.ErrCodeUnknownOp, "unknown operation %q", envelope.Op))
+		return
+	}
+
+	result, err := handler(client, envelope.Payload)
+	if err != nil {
+		client.replyError(envelope.ID, err)
+		return
+	}
+	if envelope.ID != "" {
+		client.reply(model.OpAck, envelope.ID, result)
+	}
+}
+
+// decodePayload unmarshals the payload of an inbound operation.
+func decodePayload(payload json.RawMessage, v interface{}) error {
+	if len(payload) == 0 {
+		return newProtocolError(model.ErrCodeBadRequest, "missing payload")
+	}
+	if err := json.Unmarshal(payload, v); err != nil {
+		return newProtocolError(model.ErrCodeBadRequest, "invalid payload: %v", err)
+	}
+	return nil
+}
+
+// handleMessageSend stores a chat message and delivers it to the members of its conversation.
+func (s *WebSocketService) handleMessageSend(client *Client, payload json.RawMessage) (interface{}, error) {
+	if s.sender == nil {
+		return nil, newProtocolError(model.ErrCodeInternal, "sending messages is not available")
+	}
+
+	var msg model.Message
+	if err := decodePayload(payload, &msg); err != nil {
+		return nil, err
+	}
+	msg.ID = 0
+	if err := s.sender.SendMessage(client.UserID, &msg); err != nil {
+		return nil, messageError(err)
+	}
+
+	// A sent message ends the sender's typing indicator in the conversation
+	s.stopTyping(client.UserID, msg.ConversationID())
+	return model.AckPayload{MessageID: msg.ID, Status: msg.Status}, nil
+}
+
+// resolveMembers returns the members of a conversation the user may post into.
+func (s *WebSocketService) resolveMembers(userID uuid.UUID, target model.ConversationTarget) ([]uuid.UUID, error) {
+	if s.sender == nil {
+		return nil, newProtocolError(model.ErrCodeInternal, "conversations are not available")
+	}
+	members, err := s.sender.GetTargetMembers(userID, target)
+	if err != nil {
+		return nil, messageError(err)
+	}
+	return members, nil
+}
+
+// messageError maps message service errors onto protocol errors.
+func messageError(err error) error {
+	switch {
+	case errors.Is(err, message.ErrInvalidTarget), errors.Is(err, message.ErrInvalidExpiry):
+		return newProtocolError(model.ErrCodeBadRequest, "%v", err)
+	case errors.Is(err, message.ErrNotConversationMember), errors.Is(err, message.ErrAttachmentNotAllowed):
+		return newProtocolError(model.ErrCodeForbidden, "%v", err)
+	default:
+		return err
+	}
+}
+
+// handlePresence records the idle/away state of the sending device.
+func (s *WebSocketService) handlePresence(client *Client, payload json.RawMessage) (interface{}, error) {
+	if s.presence == nil {
+		return nil, newProtocolError(model.ErrCodeUnknownOp, "presence is not available")
+	}
+	var presence model.PresencePayload
+	if err := decodePayload(payload, &presence); err != nil {
+		return nil, err
+	}
+	if err := s.presence.SetStatus(client.UserID, client.ID, presence.Status); err != nil {
+		if errors.Is(err, presenceservice.ErrInvalidStatus) {
+			return nil, newProtocolError(model.ErrCodeBadRequest, "%v", err)
+		}
+		return nil, err
+	}
+	return model.AckPayload{Status: presence.Status}, nil
+}
+
+// handlePresenceSubscribe subscribes the user to the presence of contacts or group members and
+// replies with their current presence.
+func (s *WebSocketService) handlePresenceSubscribe(client *Client, payload json.RawMessage) (interface{}, error) {
+	if s.presence == nil {
+		return nil, newProtocolError(model.ErrCodeUnknownOp, "presence is not available")
+	}
+	var request model.PresenceSubscribePayload
+	if err := decodePayload(payload, &request); err != nil {
+		return nil, err
+	}
+	presences, err := s.presence.Subscribe(client.UserID, request)
+	if err != nil {
+		if errors.Is(err, presenceservice.ErrNotGroupMember) {
+			return nil, newProtocolError(model.ErrCodeForbidden, "%v", err)
+		}
+		return nil, err
+	}
+	return model.PresenceListPayload{Presences: presences}, nil
+}
+
+// handlePresenceUnsubscribe stops pushing the presence of users to the user.
+func (s *WebSocketService) handlePresenceUnsubscribe(client *Client, payload json.RawMessage) (interface{}, error) {
+	if s.presence == nil {
+		return nil, newProtocolError(model.ErrCodeUnknownOp, "presence is not available")
+	}
+	var request model.PresenceSubscribePayload
+	if err := decodePayload(payload, &request); err != nil {
+		return nil, err
+	}
+	s.presence.Unsubscribe(client.UserID, request)
+	return model.AckPayload{Status: "unsubscribed"}, nil
+}
+
+// handleCallSignal returns the handler of a call signalling operation. Calls are acked with their
+// current state; ICE candidates are acked once relayed.
+func (s *WebSocketService) handleCallSignal(op string) opHandler {
+	return func(client *Client, payload json.RawMessage) (interface{}, error) {
+		if s.calls == nil {
+			return nil, newProtocolError(model.ErrCodeUnavailable, "calls are not available")
+		}
+		var signal model.CallSignalPayload
+		if err := decodePayload(payload, &signal); err != nil {
+			return nil, err
+		}
+
+		var call *model.Call
+		var err error
+		switch op {
+		case model.OpCallOffer:
+			call, err = s.calls.Offer(client.UserID, signal)
+		case model.OpCallAnswer:
+			call, err = s.calls.Answer(client.UserID, signal)
+		case model.OpCallICE:
+			if err := s.calls.Candidate(client.UserID, signal); err != nil {
+				return nil, callError(err)
+			}
+			return model.AckPayload{Status: "sent"}, nil
+		case model.OpCallReject:
+			call, err = s.calls.Reject(client.UserID, signal)
+		default:
+			call, err = s.calls.End(client.UserID, signal)
+		}
+		if err != nil {
+			return nil, callError(err)
+		}
+		return call, nil
+	}
+}
+
+// handleGroupCall returns the handler of a group call operation. Operations are acked with the call
+// and its roster.
+func (s *WebSocketService) handleGroupCall(op string) opHandler {
+	return func(client *Client, payload json.RawMessage) (interface{}, error) {
+		if s.calls == nil {
+			return nil, newProtocolError(model.ErrCodeUnavailable, "calls are not available")
+		}
+		var request model.GroupCallPayload
+		if err := decodePayload(payload, &request); err != nil {
+			return nil, err
+		}
+
+		var call *model.GroupCall
+		var err error
+		switch op {
+		case model.OpGroupCallJoin:
+			call, err = s.calls.JoinGroupCall(client.UserID, request)
+		case model.OpGroupCallLeave:
+			call, err = s.calls.LeaveGroupCall(client.UserID, request)
+		case model.OpGroupCallMedia:
+			call, err = s.calls.SetGroupCallMedia(client.UserID, request)
+		case model.OpGroupCallMute:
+			call, err = s.calls.MuteParticipant(client.UserID, request)
+		default:
+			call, err = s.calls.RemoveParticipant(client.UserID, request)
+		}
+		if err != nil {
+			return nil, callError(err)
+		}
+		return call, nil
+	}
+}
+
+// handleGroupCallSignal relays a signal between two participants of a group call.
+func (s *WebSocketService) handleGroupCallSignal(client *Client, payload json.RawMessage) (interface{}, error) {
+	if s.calls == nil {
+		return nil, newProtocolError(model.ErrCodeUnavailable, "calls are not available")
+	}
+	var signal model.CallSignalPayload
+	if err := decodePayload(payload, &signal); err != nil {
+		return nil, err
+	}
+	if err := s.calls.RelayGroupSignal(client.UserID, signal); err != nil {
+		return nil, callError(err)
+	}
+	return model.AckPayload{Status: "sent"}, nil
+}
+
+// callError maps CallService errors onto protocol errors.
+func callError(err error) error {
+	switch {
+	case errors.Is(err, callservice.ErrInvalidSignal), errors.Is(err, callservice.ErrInvalidCallee),
+		errors.Is(err, callservice.ErrInvalidCallState), errors.Is(err, callservice.ErrAlreadyInCall):
+		return newProtocolError(model.ErrCodeBadRequest, "%v", err)
+	case errors.Is(err, callservice.ErrNotCallParticipant), errors.Is(err, callservice.ErrNotCallee),
+		errors.Is(err, callservice.ErrNotGroupMember), errors.Is(err, callservice.ErrNotHost):
+		return newProtocolError(model.ErrCodeForbidden, "%v", err)
+	case errors.Is(err, callservice.ErrCallFull):
+		return newProtocolError(model.ErrCodeUnavailable, "%v", err)
+	case errors.Is(err, callservice.ErrCallNotFound):
+		return newProtocolError(model.ErrCodeNotFound, "%v", err)
+	default:
+		return err
+	}
+}
+
+// newEnvelope wraps a payload in an envelope. A payload that can not be encoded is replaced by an
+// internal error, so callers always get a frame they can send.
+func newEnvelope(version int, op, id string, payload interface{}) model.Envelope {
+	envelope := model.Envelope{V: version, Op: op, ID: id}
+	if payload == nil {
+		return envelope
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return errorEnvelope(version, id, err)
+	}
+	envelope.Payload = data
+	return envelope
+}
+
+// errorEnvelope builds the error reply to a request. Errors other than protocol errors are reported
+// as internal errors without exposing their message.
+func errorEnvelope(version int, id string, err error) model.Envelope {
+	var protoErr *protocolError
+	if !errors.As(err, &protoErr) {
+		protoErr = &protocolError{code: model.ErrCodeInternal, message: "internal server error"}
+	}
+	return model.Envelope{
+		V:     version,
+		Op:    model.OpError,
+		ID:    id,
+		Error: &model.EnvelopeError{Code: protoErr.code, Message: protoErr.message},
+	}
+}
@@ -0,0 +1,180 @@
+package websocket
+
+import (
+	"adwise-service/model"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Reasons sent with OpResync.
+const (
+	resyncReasonUnknownStream = "unknown_stream" // The client's sequence numbers come from another server stream
+	resyncReasonGapTooOld     = "gap_too_old"    // Events the client missed are no longer in the replay log
+)
+
+// loggedEvent is an event in a user's replay log. The payload is kept encoded so that it can be
+// wrapped in an envelope of whichever protocol version a reconnecting client negotiated.
+type loggedEvent struct {
+	seq     uint64
+	op      string
+	payload json.RawMessage
+}
+
+// session holds the event sequence and replay log of a user. It outlives the user's connections
+// for the replay retention so that a client reconnecting after a network drop can catch up.
+//
+// Sequence numbers are assigned and events are written to the user's connections while holding
+// the session lock, so every connection sees the events in sequence order and a connection that
+// registers while replaying can neither miss an event nor see one twice.
+type session struct {
+	mu     sync.Mutex
+	seq    uint64        // Sequence number of the last event
+	log    []loggedEvent // Ring buffer of the most recent events, oldest at head
+	head   int
+	expiry *time.Timer // Removes the session once the user has been offline for the retention
+	closed bool        // Set once the session was removed; a connection must then use a new session
+}
+
+// ResumeState is what a reconnecting client tells the server about the events it has seen.
+type ResumeState struct {
+	StreamID string // Stream the client's sequence numbers belong to, from the hello of a previous connection
+	LastSeq  uint64 // Sequence number of the last event the client processed
+}
+
+// append records an event and returns its sequence number. The oldest event is dropped once the
+// log holds size events.
+func (ss *session) append(op string, payload json.RawMessage, size int) uint64 {
+	ss.seq++
+	event := loggedEvent{seq: ss.seq, op: op, payload: payload}
+	if size <= 0 {
+		return ss.seq
+	}
+	if len(ss.log) < size {
+		ss.log = append(ss.log, event)
+	} else {
+		ss.log[ss.head] = event
+		ss.head = (ss.head + 1) % len(ss.log)
+	}
+	return ss.seq
+}
+
+// since returns the logged events after seq in order. ok is false when some of those events are no
+// longer in the log.
+func (ss *session) since(seq uint64) (events []loggedEvent, ok bool) {
+	if seq >= ss.seq {
+		return nil, seq == ss.seq
+	}
+	if len(ss.log) == 0 || ss.log[ss.head].seq > seq+1 {
+		return nil, false
+	}
+	for i := 0; i < len(ss.log); i++ {
+		event := ss.log[(ss.head+i)%len(ss.log)]
+		if event.seq > seq {
+			events = append(events, event)
+		}
+	}
+	return events, true
+}
+
+// session returns the session of a user, creating it if create is set. It returns nil for a user
+// without a session when create is not set.
+func (s *WebSocketService) session(userID uuid.UUID, create bool) *session {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+
+	ss, ok := s.sessions[userID]
+	if !ok && create {
+		ss = &session{}
+		s.sessions[userID] = ss
+	}
+	return ss
+}
+
+// attach registers a connection and brings it up to date. The hello is sent first, followed by the
+// events the client missed since its resume state or, when those are no longer available, a resync
+// telling the client to reload its state over REST.
+func (s *WebSocketService) attach(client *Client, resume *ResumeState) {
+	ss := s.session(client.UserID, true)
+	ss.mu.Lock()
+	for ss.closed {
+		ss.mu.Unlock()
+		ss = s.session(client.UserID, true)
+		ss.mu.Lock()
+	}
+	defer ss.mu.Unlock()
+
+	if ss.expiry != nil {
+		ss.expiry.Stop()
+		ss.expiry = nil
+	}
+	s.register(client)
+
+	client.reply(model.OpHello, "", model.HelloPayload{
+		Version:      client.Version,
+		ConnectionID: client.ID,
+		DeviceID:     client.DeviceID,
+		UserID:       client.UserID,
+		PingInterval: int(s.cfg.PingPeriod / time.Second),
+		StreamID:     s.streamID,
+		Seq:          ss.seq,
+	})
+	if resume == nil {
+		return
+	}
+
+	if resume.StreamID != s.streamID {
+		client.reply(model.OpResync, "", model.ResyncPayload{Reason: resyncReasonUnknownStream, Seq: ss.seq})
+		return
+	}
+	events, ok := ss.since(resume.LastSeq)
+	// A replay that would overflow the outbound queue evicts the client, so it resyncs instead
+	if !ok || len(events) >= cap(client.send) {
+		client.reply(model.OpResync, "", model.ResyncPayload{Reason: resyncReasonGapTooOld, Seq: ss.seq})
+		return
+	}
+	for _, event := range events {
+		client.writeJSON(model.Envelope{V: client.Version, Op: event.op, Seq: event.seq, Payload: event.payload})
+	}
+}
+
+// detach unregisters a connection. When it was the user's last connection the session is kept for
+// the replay retention and then dropped.
+func (s *WebSocketService) detach(client *Client) {
+	ss := s.session(client.UserID, false)
+	if ss == nil {
+		s.unregister(client)
+		return
+	}
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	s.unregister(client)
+	if s.IsConnected(client.UserID) || ss.expiry != nil {
+		return
+	}
+	ss.expiry = time.AfterFunc(s.cfg.ReplayRetention, func() {
+		if s.expire(client.UserID, ss) {
+			s.leaveUser(client.UserID)
+		}
+	})
+}
+
+// expire drops a session whose retention passed, unless the user reconnected in the meantime. It
+// reports whether the session was dropped.
+func (s *WebSocketService) expire(userID uuid.UUID, ss *session) bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if s.IsConnected(userID) {
+		return false
+	}
+	ss.closed = true
+	s.sessionsMu.Lock()
+	if s.sessions[userID] == ss {
+		delete(s.sessions, userID)
+	}
+	s.sessionsMu.Unlock()
+	return true
+}
@@ -0,0 +1,220 @@
+package websocket
+
+import (
+	"adwise-service/model"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// ErrInvalidEventID is returned when a Last-Event-ID was not issued by EventID.
+var ErrInvalidEventID = errors.New("invalid event ID")
+
+// Clients behind proxies that block WebSocket upgrades receive the same server events over plain
+// HTTP, either as a Server-Sent Events stream or by long-polling. Both transports register a
+// Client without a WebSocket connection and drain its outbound queue into the response, so they
+// share the sessions, replay log and routing of WebSocket connections. They only carry server
+// events; the client sends through the REST API.
+//
+// Every event with a sequence number is identified by EventID. A client resumes with the ID of the
+// last event it processed, which EventSource sends as the Last-Event-ID header on its own.
+
+// EventID identifies an event of a stream for resuming with Last-Event-ID.
+func EventID(streamID string, seq uint64) string {
+	return streamID + ":" + strconv.FormatUint(seq, 10)
+}
+
+// ParseEventID reads the resume state from an ID issued by EventID.
+func ParseEventID(id string) (*ResumeState, error) {
+	i := strings.LastIndexByte(id, ':')
+	if i <= 0 {
+		return nil, ErrInvalidEventID
+	}
+	seq, err := strconv.ParseUint(id[i+1:], 10, 64)
+	if err != nil {
+		return nil, ErrInvalidEventID
+	}
+	return &ResumeState{StreamID: id[:i], LastSeq: seq}, nil
+}
+
+// streamClose is the data of the close event ending an event stream. It carries the close code and
+// reason a WebSocket connection would have been closed with.
+type streamClose struct {
+	Code   int    `json:"code"`
+	Reason string `json:"reason"`
+}
+
+// HandleEventStream sends a user's server events as a Server-Sent Events stream until the client
+// goes away. Each event's data is an envelope, and events the client resumes from carry an EventID.
+// The stream starts with the hello and the events missed since resume, like a WebSocket connection.
+// It ends with a "close" event when the token expires, a newer connection of the device replaces
+// it or the client falls too far behind.
+func (s *WebSocketService) HandleEventStream(w http.ResponseWriter, r *http.Request, userID uuid.UUID, deviceID string, version int, expiresAt time.Time, resume *ResumeState) {
+	controller := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no") // Keeps nginx from buffering the stream
+	w.WriteHeader(http.StatusOK)
+	if err := controller.Flush(); err != nil {
+		log.Println("Event stream flush error:", err)
+		return
+	}
+
+	client := newClient(nil, userID, deviceID, version, s.cfg)
+	s.connect(client, resume)
+	defer func() {
+		s.disconnect(client)
+		client.close(websocket.CloseNormalClosure, "")
+	}()
+
+	var expired <-chan time.Time
+	if !expiresAt.IsZero() {
+		expiry := time.NewTimer(time.Until(expiresAt))
+		defer expiry.Stop()
+		expired = expiry.C
+	}
+	keepAlive := time.NewTicker(s.cfg.StreamKeepAlive)
+	defer keepAlive.Stop()
+
+	write := func(frame string) bool {
+		controller.SetWriteDeadline(time.Now().Add(s.cfg.WriteWait))
+		if _, err := io.WriteString(w, frame); err != nil {
+			return false
+		}
+		return controller.Flush() == nil
+	}
+	closeEvent := func(code int, reason string) string {
+		data, _ := json.Marshal(streamClose{Code: code, Reason: reason})
+		return fmt.Sprintf("event: close\ndata: %s\n\n", data)
+	}
+
+	for {
+		select {
+		case data := <-client.send:
+			if !write(s.streamFrame(data)) {
+				return
+			}
+		case <-keepAlive.C:
+			if !write(": keep-alive\n\n") {
+				return
+			}
+		case <-expired:
+			write(closeEvent(CloseTokenExpired, "token expired"))
+			return
+		case <-client.done:
+			write(closeEvent(client.closeCode, client.closeReason))
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// PollEvents waits up to wait, capped by the configured long-poll wait, for server events of a
+// user and returns those that arrived. It returns as soon as there is an event, after collecting
+// the events queued with it. Each poll is a connection of its own: the client passes the
+// LastEventID of the previous batch as resume state and is sent what it missed in between.
+func (s *WebSocketService) PollEvents(ctx context.Context, userID uuid.UUID, deviceID string, version int, resume *ResumeState, wait time.Duration) model.EventBatch {
+	if wait <= 0 || wait > s.cfg.LongPollWait {
+		wait = s.cfg.LongPollWait
+	}
+	client := newClient(nil, userID, deviceID, version, s.cfg)
+	s.connect(client, resume)
+	defer func() {
+		s.disconnect(client)
+		client.close(websocket.CloseNormalClosure, "")
+	}()
+
+	batch := model.EventBatch{Events: []json.RawMessage{}}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		select {
+		case data := <-client.send:
+			if s.collect(&batch, data) {
+				return s.drain(client, batch)
+			}
+		case <-client.done:
+			// A newer poll of the same device replaced this one
+			return s.drain(client, batch)
+		case <-timer.C:
+			return batch
+		case <-ctx.Done():
+			return batch
+		}
+	}
+}
+
+// drain adds the events still queued for a client to a batch.
+func (s *WebSocketService) drain(client *Client, batch model.EventBatch) model.EventBatch {
+	for {
+		select {
+		case data := <-client.send:
+			s.collect(&batch, data)
+		default:
+			return batch
+		}
+	}
+}
+
+// collect adds a queued envelope to a batch and advances its LastEventID. The hello only sets the
+// LastEventID and is not added. It reports whether an event was added.
+func (s *WebSocketService) collect(batch *model.EventBatch, data []byte) bool {
+	var envelope model.Envelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		log.Println("Event batch decode error:", err)
+		return false
+	}
+	if id := s.eventID(envelope); id != "" {
+		batch.LastEventID = id
+	}
+	if envelope.Op == model.OpHello {
+		return false
+	}
+	batch.Events = append(batch.Events, data)
+	return true
+}
+
+// streamFrame formats a queued envelope as a Server-Sent Event.
+func (s *WebSocketService) streamFrame(data []byte) string {
+	var envelope model.Envelope
+	if err := json.Unmarshal(data, &envelope); err == nil {
+		if id := s.eventID(envelope); id != "" {
+			return fmt.Sprintf("id: %s\ndata: %s\n\n", id, data)
+		}
+	}
+	return fmt.Sprintf("data: %s\n\n", data)
+}
+
+// eventID returns the ID a client resumes from after an envelope, or "" when the envelope does not
+// move the client's position in the stream. The hello and a resync move it to the sequence number
+// they carry, so a client that saw no other event still resumes from where it connected.
+func (s *WebSocketService) eventID(envelope model.Envelope) string {
+	switch envelope.Op {
+	case model.OpHello:
+		var hello model.HelloPayload
+		if err := json.Unmarshal(envelope.Payload, &hello); err == nil {
+			return EventID(hello.StreamID, hello.Seq)
+		}
+	case model.OpResync:
+		var resync model.ResyncPayload
+		if err := json.Unmarshal(envelope.Payload, &resync); err == nil {
+			return EventID(s.streamID, resync.Seq)
+		}
+	default:
+		if envelope.Seq > 0 {
+			return EventID(s.streamID, envelope.Seq)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,186 @@
+package websocket
+
+import (
+	"adwise-service/model"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Typing states.
+const (
+	typingStart = "start"
+	typingStop  = "stop"
+)
+
+// typingKey identifies a user typing in a conversation.
+type typingKey struct {
+	conversationID string
+	userID         uuid.UUID
+}
+
+// typingIndicator is a user currently shown as typing in a conversation.
+type typingIndicator struct {
+	payload  model.TypingPayload // Event sent to the other members
+	members  []uuid.UUID         // Members resolved when the indicator started
+	lastSent time.Time           // Time the last start event was sent to the members
+	expiry   *time.Timer         // Sends the stop event when no stop arrives in time
+}
+
+// typingTracker keeps the typing indicators of all conversations.
+//
+// A start is forwarded to the other members of the conversation at most once per throttle interval
+// per sender; starts in between only extend the indicator. An indicator for which no stop arrives
+// within the typing timeout is stopped by the server.
+type typingTracker struct {
+	mu         sync.Mutex
+	indicators map[typingKey]*typingIndicator
+}
+
+// handleTyping starts or stops the typing indicator of the sender in a direct or group conversation
+// and forwards it to the conversation's other members.
+func (s *WebSocketService) handleTyping(client *Client, payload json.RawMessage) (interface{}, error) {
+	var typing model.TypingPayload
+	if err := decodePayload(payload, &typing); err != nil {
+		return nil, err
+	}
+	if !typing.Valid() {
+		return nil, newProtocolError(model.ErrCodeBadRequest, "exactly one of receiver_id and group_id is required")
+	}
+
+	switch typing.State {
+	case typingStart:
+		if err := s.startTyping(client.UserID, typing.ConversationTarget); err != nil {
+			return nil, err
+		}
+	case typingStop:
+		s.stopTyping(client.UserID, typing.ConversationTarget.ConversationID(client.UserID))
+	default:
+		return nil, newProtocolError(model.ErrCodeBadRequest, "state must be start or stop")
+	}
+	return model.AckPayload{Status: typing.State}, nil
+}
+
+// startTyping shows the user as typing in a conversation until they stop or the typing timeout
+// passes.
+func (s *WebSocketService) startTyping(userID uuid.UUID, target model.ConversationTarget) error {
+	key := typingKey{conversationID: target.ConversationID(userID), userID: userID}
+	now := time.Now()
+
+	s.typing.mu.Lock()
+	indicator, ok := s.typing.indicators[key]
+	if ok {
+		indicator.expiry.Reset(s.cfg.TypingTimeout)
+		throttled := now.Sub(indicator.lastSent) < s.cfg.TypingThrottle
+		if !throttled {
+			indicator.lastSent = now
+		}
+		s.typing.mu.Unlock()
+		if !throttled {
+			s.sendTyping(indicator.members, indicator.payload)
+		}
+		return nil
+	}
+	s.typing.mu.Unlock()
+
+	members, err := s.resolveMembers(userID, target)
+	if err != nil {
+		return err
+	}
+
+	indicator = &typingIndicator{
+		payload: model.TypingPayload{
+			ConversationTarget: target,
+			ConversationID:     key.conversationID,
+			UserID:             userID,
+			State:              typingStart,
+		},
+		lastSent: now,
+	}
+	for _, member := range members {
+		if member != userID {
+			indicator.members = append(indicator.members, member)
+		}
+	}
+
+	s.typing.mu.Lock()
+	if _, ok := s.typing.indicators[key]; ok {
+		// A concurrent start from another device of the user won the race
+		s.typing.mu.Unlock()
+		return nil
+	}
+	indicator.expiry = time.AfterFunc(s.cfg.TypingTimeout, func() {
+		s.expireTyping(key, indicator)
+	})
+	s.typing.indicators[key] = indicator
+	s.typing.mu.Unlock()
+
+	s.sendTyping(indicator.members, indicator.payload)
+	return nil
+}
+
+// stopTyping removes the typing indicator of a user in a conversation, if any, and tells the other
+// members.
+func (s *WebSocketService) stopTyping(userID uuid.UUID, conversationID string) {
+	key := typingKey{conversationID: conversationID, userID: userID}
+
+	s.typing.mu.Lock()
+	indicator, ok := s.typing.indicators[key]
+	if ok {
+		indicator.expiry.Stop()
+		delete(s.typing.indicators, key)
+	}
+	s.typing.mu.Unlock()
+
+	if ok {
+		s.sendTypingStop(indicator)
+	}
+}
+
+// stopAllTyping removes every typing indicator of a user, for example when their last connection
+// closes.
+func (s *WebSocketService) stopAllTyping(userID uuid.UUID) {
+	var stopped []*typingIndicator
+
+	s.typing.mu.Lock()
+	for key, indicator := range s.typing.indicators {
+		if key.userID == userID {
+			indicator.expiry.Stop()
+			delete(s.typing.indicators, key)
+			stopped = append(stopped, indicator)
+		}
+	}
+	s.typing.mu.Unlock()
+
+	for _, indicator := range stopped {
+		s.sendTypingStop(indicator)
+	}
+}
+
+// expireTyping stops an indicator for which no stop arrived within the typing timeout.
+func (s *WebSocketService) expireTyping(key typingKey, indicator *typingIndicator) {
+	s.typing.mu.Lock()
+	if s.typing.indicators[key] != indicator {
+		s.typing.mu.Unlock()
+		return
+	}
+	delete(s.typing.indicators, key)
+	s.typing.mu.Unlock()
+
+	s.sendTypingStop(indicator)
+}
+
+// sendTypingStop tells the members that the user of an indicator stopped typing.
+func (s *WebSocketService) sendTypingStop(indicator *typingIndicator) {
+	payload := indicator.payload
+	payload.State = typingStop
+	s.sendTyping(indicator.members, payload)
+}
+
+// sendTyping sends a typing event to members. Typing events are transient: they get no sequence
+// number and are not replayed to reconnecting clients.
+func (s *WebSocketService) sendTyping(members []uuid.UUID, payload model.TypingPayload) {
+	s.sendEvent(members, model.OpTyping, payload, true)
+}
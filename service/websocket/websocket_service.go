@@ -10,37 +10,71 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 )
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true // Allow all connections (customize for production)
-	},
-}
+// CloseTokenExpired is the close code sent when the token that authenticated a connection expires.
+// The client should obtain a fresh token and reconnect.
+const CloseTokenExpired = 4001
 
 // WebSocketService manages WebSocket connections and messaging.
 type WebSocketService struct {
-	clients map[uuid.UUID]*websocket.Conn // Map user IDs to WebSocket connections
-	mu      sync.Mutex
-	key     []byte // Encryption key for end-to-end encryption
+	clients  map[uuid.UUID]map[string]*Client // Map user IDs to their connections, keyed by connection ID
+	mu       sync.Mutex
+	key      []byte // Encryption key for end-to-end encryption
+	cfg      Config
+	ops      map[string]opHandler // Inbound operations of the protocol
+	sender   MessageSender        // Sends chat messages on behalf of connected users
+	presence PresenceTracker      // Tracks which users are online
+	calls    CallSignaller        // Runs the signalling of calls
+
+	sessions   map[uuid.UUID]*session // Event sequence and replay log per user
+	sessionsMu sync.Mutex
+	streamID   string // Identifies this server's event sequences; a restart starts a new stream
+
+	typing  typingTracker
+	cluster *cluster // Routes events to users connected to other nodes; nil on a single node
 }
 
 // NewWebSocketService creates a new WebSocketService.
-func NewWebSocketService() *WebSocketService {
+func NewWebSocketService(cfg Config) *WebSocketService {
 	// Generate a random encryption key (for demonstration purposes)
 	key := make([]byte, 32)
 	if _, err := rand.Read(key); err != nil {
 		log.Fatalf("Failed to generate encryption key: %v", err)
 	}
 
-	return &WebSocketService{
-		clients: make(map[uuid.UUID]*websocket.Conn),
-		key:     key,
+	s := &WebSocketService{
+		clients:  make(map[uuid.UUID]map[string]*Client),
+		key:      key,
+		cfg:      cfg,
+		sessions: make(map[uuid.UUID]*session),
+		streamID: uuid.New().String(),
+		typing:   typingTracker{indicators: make(map[typingKey]*typingIndicator)},
 	}
+	s.ops = s.handlers()
+	return s
+}
+
+// SetMessageSender sets the service that stores and delivers messages sent over a connection.
+func (s *WebSocketService) SetMessageSender(sender MessageSender) {
+	s.sender = sender
+}
+
+// SetPresenceTracker sets the tracker informed about connections opening and closing.
+func (s *WebSocketService) SetPresenceTracker(presence PresenceTracker) {
+	s.presence = presence
+}
+
+// SetCallSignaller sets the service running the signalling of calls.
+func (s *WebSocketService) SetCallSignaller(calls CallSignaller) {
+	s.calls = calls
 }
 
 // encrypt encrypts a message using AES-256.
@@ -82,150 +116,226 @@ func (s *WebSocketService) decrypt(ciphertext []byte) ([]byte, error) {
 	return ciphertext, nil
 }
 
-// HandleConnection handles a new WebSocket connection.
-func (s *WebSocketService) HandleConnection(conn *websocket.Conn, userID uuid.UUID) {
-	s.mu.Lock()
-	s.clients[userID] = conn
-	s.mu.Unlock()
+// Upgrade upgrades an authenticated HTTP request to a WebSocket connection, checking the request's
+// origin against the configured allowlist. On failure an HTTP error has already been written.
+func (s *WebSocketService) Upgrade(w http.ResponseWriter, r *http.Request, responseHeader http.Header) (*websocket.Conn, error) {
+	upgrader := websocket.Upgrader{CheckOrigin: s.CheckOrigin}
+	return upgrader.Upgrade(w, r, responseHeader)
+}
+
+// CheckOrigin reports whether the request's origin is on the allowlist. Without an allowlist only
+// same-origin requests, and clients that send no Origin header, are accepted.
+func (s *WebSocketService) CheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if len(s.cfg.AllowedOrigins) == 0 {
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	}
+	for _, allowed := range s.cfg.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// HandleConnection handles a new WebSocket connection of a user's device.
+// A user may be connected from several devices at once; each connection is tracked separately.
+// The calling goroutine reads from the connection while a dedicated goroutine writes to it.
+// If expiresAt is set, the connection is closed with CloseTokenExpired once the user's token expires.
+// Every frame is an envelope of the given protocol version, which was negotiated at connect.
+// A client reconnecting with a resume state is sent the events it missed, see attach.
+func (s *WebSocketService) HandleConnection(conn *websocket.Conn, userID uuid.UUID, deviceID string, version int, expiresAt time.Time, resume *ResumeState) {
+	client := newClient(conn, userID, deviceID, version, s.cfg)
+	s.connect(client, resume)
+
+	if !expiresAt.IsZero() {
+		expiry := time.AfterFunc(time.Until(expiresAt), func() {
+			client.close(CloseTokenExpired, "token expired")
+		})
+		defer expiry.Stop()
+	}
+
+	writerDone := make(chan struct{})
+	go func() {
+		client.writePump()
+		close(writerDone)
+	}()
 
 	defer func() {
-		s.mu.Lock()
-		delete(s.clients, userID)
-		s.mu.Unlock()
-		conn.Close()
+		s.disconnect(client)
+		client.close(websocket.CloseNormalClosure, "")
+		<-writerDone
 	}()
 
+	client.prepareRead()
 	for {
-		_, message, err := conn.ReadMessage()
+		_, data, err := conn.ReadMessage()
 		if err != nil {
-			log.Println("WebSocket read error:", err)
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Println("WebSocket read error:", err)
+			}
 			break
 		}
+		s.dispatch(client, data)
+	}
+}
 
-		// Decrypt the message
-		// decryptedMessage, err := s.decrypt(message)
-		// if err != nil {
-		// 	log.Println("WebSocket decryption error:", err)
-		// 	continue
-		// }
-		// log.Printf("Decrypted message: %s\n", decryptedMessage)
-
-		log.Printf("Decrypted message: %s\n", message)
-
-		// Unmarshal the message
-		var msg model.Message
-		if err := json.Unmarshal(message, &msg); err != nil {
-			log.Println("WebSocket unmarshal error:", err)
-			continue
-		}
+// connect attaches a new connection of any transport to its user's session and tells the trackers
+// following the user's connections.
+func (s *WebSocketService) connect(client *Client, resume *ResumeState) {
+	s.attach(client, resume)
+	s.joinUser(client.UserID)
+	if s.calls != nil {
+		s.calls.Connected(client.UserID)
+	}
+	if s.presence != nil {
+		s.presence.Connected(client.UserID, client.ID)
+	}
+}
 
-		// Handle different message types
-		switch msg.Type {
-		case "message":
-			s.HandleMessage(userID, msg)
-		case "call":
-			s.handleCall(userID, msg)
-		case "ice-candidate":
-			s.handleICECandidate(userID, msg)
-		// case "typing":
-		// 	s.handleTyping(msg)
-		// case "ack":
-		// 	s.handleAcknowledgment(msg)
-		default:
-			log.Println("Unknown message type:", msg.Type)
+// disconnect detaches a closed connection. Once the user has no connection left their typing
+// indicators stop and their calls are told.
+func (s *WebSocketService) disconnect(client *Client) {
+	s.detach(client)
+	if !s.IsConnected(client.UserID) {
+		s.stopAllTyping(client.UserID)
+		if s.calls != nil {
+			s.calls.Disconnected(client.UserID)
 		}
-
-		// Broadcast the message to all clients
-		// s.broadcast(msg)
+	}
+	if s.presence != nil {
+		s.presence.Disconnected(client.UserID, client.ID)
 	}
 }
 
-// handleMessage handles a one-to-one message.
-func (s *WebSocketService) HandleMessage(senderID uuid.UUID, msg model.Message) {
-	// Set the message status to "sent"
-	msg.Status = "sent"
+// register adds a connection to the user's set of connections. A new connection from a device that
+// is still connected replaces the old connection of that device.
+func (s *WebSocketService) register(client *Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	// Send the message to the recipient
-	recipientConn, ok := s.clients[msg.ReceiverID]
+	conns, ok := s.clients[client.UserID]
 	if !ok {
-		log.Println("Recipient not connected")
-		return
+		conns = make(map[string]*Client)
+		s.clients[client.UserID] = conns
 	}
-
-	// Marshal the message
-	// messageBytes, err := json.Marshal(msg)
-	// if err != nil {
-	// 	log.Println("WebSocket marshal error:", err)
-	// 	return
-	// }
-	// JSON Implementation
-	if err := recipientConn.WriteJSON(msg); err != nil {
-		log.Println("WebSocket write error:", err)
+	for id, existing := range conns {
+		if existing.DeviceID == client.DeviceID {
+			delete(conns, id)
+			existing.close(websocket.CloseNormalClosure, "replaced by a newer connection")
+		}
 	}
+	conns[client.ID] = client
+}
 
-	// Encrypt the message
-	// encryptedMessage, err := s.encrypt(messageBytes)
-	// if err != nil {
-	// 	log.Println("WebSocket encryption error:", err)
-	// 	return
-	// }
-	// if err := recipientConn.WriteMessage(websocket.TextMessage, encryptedMessage); err != nil {
-	// 	log.Println("WebSocket write error:", err)
-	// }
-
-	// Send an acknowledgment back to the sender
-	ack := model.WebSocketMessage{
-		Type:       "ack",
-		SenderID:   msg.ReceiverID,
-		ReceiverID: msg.SenderID,
-		ID:         msg.ID,
-		Status:     "sent",
-		Content:    "Message sent successfully",
-	}
-	senderConn, ok := s.clients[senderID]
+// unregister removes a connection. Other connections of the same user are left untouched.
+func (s *WebSocketService) unregister(client *Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	conns, ok := s.clients[client.UserID]
 	if !ok {
-		log.Println("Sender not connected")
 		return
 	}
+	delete(conns, client.ID)
+	if len(conns) == 0 {
+		delete(s.clients, client.UserID)
+	}
+}
 
-	if err := senderConn.WriteJSON(ack); err != nil {
-		log.Println("WebSocket write error:", err)
+// connections returns a snapshot of a user's open connections.
+func (s *WebSocketService) connections(userID uuid.UUID) []*Client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	conns := make([]*Client, 0, len(s.clients[userID]))
+	for _, client := range s.clients[userID] {
+		conns = append(conns, client)
 	}
+	return conns
 }
 
-// handleCall handles a WebRTC call setup.
-func (s *WebSocketService) handleCall(senderID uuid.UUID, msg model.Message) {
-	// Forward the call offer to the recipient
-	recipientConn, ok := s.clients[msg.ReceiverID]
-	if !ok {
-		log.Println("Recipient not connected")
-		return
+// sendEnvelope sends an event to every connection of a user, on this or any other node, in the
+// protocol version negotiated by each connection. The event gets the user's next sequence number
+// and is kept in the replay log. It reports whether the user had at least one connection to send to.
+func (s *WebSocketService) sendEnvelope(userID uuid.UUID, op string, payload interface{}) bool {
+	return s.sendEvent([]uuid.UUID{userID}, op, payload, false)
+}
+
+// sendEvent delivers an event to the local connections of each user in userIDs and routes it to
+// the nodes holding their other sessions. It reports whether any connection was sent to locally or
+// the event was routed to another node.
+func (s *WebSocketService) sendEvent(userIDs []uuid.UUID, op string, payload interface{}, transient bool) bool {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		log.Println("WebSocket marshal error:", err)
+		return false
 	}
 
-	if err := recipientConn.WriteJSON(msg); err != nil {
-		log.Println("WebSocket write error:", err)
+	sent := false
+	for _, userID := range userIDs {
+		if s.deliverLocal(userID, op, data, transient) {
+			sent = true
+		}
 	}
+	if s.route(userIDs, op, data, transient) {
+		sent = true
+	}
+	return sent
 }
 
-// handleICECandidate handles WebRTC ICE candidates.
-func (s *WebSocketService) handleICECandidate(senderID uuid.UUID, msg model.Message) {
-	// Forward the ICE candidate to the recipient
-	recipientConn, ok := s.clients[msg.ReceiverID]
-	if !ok {
-		log.Println("Recipient not connected")
-		return
+// deliverLocal writes an encoded event to the connections of a user on this node. Events that are
+// not transient are only delivered to users with a session, and are numbered and logged in it.
+func (s *WebSocketService) deliverLocal(userID uuid.UUID, op string, data json.RawMessage, transient bool) bool {
+	var seq uint64
+	if !transient {
+		ss := s.session(userID, false)
+		if ss == nil {
+			return false
+		}
+		ss.mu.Lock()
+		defer ss.mu.Unlock()
+		seq = ss.append(op, data, s.cfg.ReplayLogSize)
 	}
 
-	if err := recipientConn.WriteJSON(msg); err != nil {
-		log.Println("WebSocket write error:", err)
+	sent := false
+	for _, client := range s.connections(userID) {
+		if err := client.writeJSON(model.Envelope{V: client.Version, Op: op, Seq: seq, Payload: data}); err != nil {
+			log.Println("WebSocket write error:", err)
+			continue
+		}
+		sent = true
 	}
+	return sent
 }
 
-// // handleTyping handles a typing indicator.
-// func (s *WebSocketService) handleTyping(msg model.Message) {
-// 	// Broadcast the typing indicator to the recipient
-// 	s.broadcast(msg)
-// }
+// IsConnected reports whether a user has at least one open connection.
+func (s *WebSocketService) IsConnected(userID uuid.UUID) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.clients[userID]) > 0
+}
+
+// SendToUser pushes an event to every connection of a user and reports whether the user had a
+// connection, on this or another node.
+func (s *WebSocketService) SendToUser(userID uuid.UUID, event string, payload interface{}) bool {
+	return s.sendEnvelope(userID, event, payload)
+}
+
+// NotifyUsers pushes an event to every connection of each user in userIDs. The event name is the
+// operation of the envelope.
+func (s *WebSocketService) NotifyUsers(userIDs []uuid.UUID, event string, payload interface{}) {
+	s.sendEvent(userIDs, event, payload, false)
+}
+
+// DeliverMessage pushes a chat message to every connection of each user in userIDs.
+func (s *WebSocketService) DeliverMessage(userIDs []uuid.UUID, msg model.Message) {
+	s.sendEvent(userIDs, model.OpMessage, msg, false)
+}
 
 // // handleAcknowledgment handles a message acknowledgment.
 // func (s *WebSocketService) handleAcknowledgment(msg model.Message) {
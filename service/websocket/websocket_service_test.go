@@ -0,0 +1,345 @@
+package websocket
+
+import (
+	"adwise-service/model"
+	"adwise-service/utils"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+func init() {
+	utils.Logger = zap.NewNop()
+}
+
+// testEvent is the payload of the events sent in the tests.
+type testEvent struct {
+	Sender int    `json:"sender"`
+	N      int    `json:"n"`
+	Data   string `json:"data,omitempty"`
+}
+
+// newTestServer serves WebSocket connections of the service, authenticating the user given in the
+// "user" query parameter.
+func newTestServer(t *testing.T, s *WebSocketService) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, err := uuid.Parse(r.URL.Query().Get("user"))
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		conn, err := s.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		s.HandleConnection(conn, userID, r.URL.Query().Get("device"), ProtocolVersion, time.Time{}, nil)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// dial connects a device of a user and reads the hello.
+func dial(t *testing.T, server *httptest.Server, userID uuid.UUID, deviceID string) (*websocket.Conn, model.HelloPayload) {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/?user=" + userID.String() + "&device=" + deviceID
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	var envelope model.Envelope
+	if err := conn.ReadJSON(&envelope); err != nil {
+		t.Fatalf("read hello: %v", err)
+	}
+	var hello model.HelloPayload
+	if envelope.Op != model.OpHello || json.Unmarshal(envelope.Payload, &hello) != nil {
+		t.Fatalf("first frame is %s, want a hello", envelope.Op)
+	}
+	return conn, hello
+}
+
+// waitFor polls a condition until it holds or the timeout passes.
+func waitFor(t *testing.T, timeout time.Duration, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// readEvents reads n events from a connection and checks that their sequence numbers follow each
+// other from after, and that the events of each sender arrive in the order they were sent. It
+// returns the events in the order received.
+func readEvents(conn *websocket.Conn, after uint64, n int) ([]testEvent, error) {
+	events := make([]testEvent, 0, n)
+	next := make(map[int]int)
+	for len(events) < n {
+		conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		var envelope model.Envelope
+		if err := conn.ReadJSON(&envelope); err != nil {
+			return events, err
+		}
+		if envelope.Seq != after+uint64(len(events))+1 {
+			return events, fmt.Errorf("sequence number %d after %d events", envelope.Seq, len(events))
+		}
+		var event testEvent
+		if err := json.Unmarshal(envelope.Payload, &event); err != nil {
+			return events, err
+		}
+		if event.N != next[event.Sender] {
+			return events, fmt.Errorf("event %d of sender %d before event %d", event.N, event.Sender, next[event.Sender])
+		}
+		next[event.Sender]++
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+func TestConcurrentSendersKeepOrder(t *testing.T) {
+	const senders, perSender = 16, 100
+	cfg := DefaultConfig()
+	cfg.SendQueueSize = senders * perSender
+	s := NewWebSocketService(cfg)
+	server := newTestServer(t, s)
+
+	userID, otherID := uuid.New(), uuid.New()
+	phone, hello := dial(t, server, userID, "phone")
+	laptop, _ := dial(t, server, userID, "laptop")
+	other, otherHello := dial(t, server, otherID, "phone")
+
+	var wg sync.WaitGroup
+	for sender := 0; sender < senders; sender++ {
+		wg.Add(1)
+		go func(sender int) {
+			defer wg.Done()
+			for n := 0; n < perSender; n++ {
+				event := testEvent{Sender: sender, N: n}
+				// Mix the entry points that end up writing to the connections
+				switch n % 3 {
+				case 0:
+					s.NotifyUsers([]uuid.UUID{userID, otherID}, "test.event", event)
+				case 1:
+					s.sendEnvelope(userID, "test.event", event)
+					s.sendEnvelope(otherID, "test.event", event)
+				default:
+					s.SendToUser(otherID, "test.event", event)
+					s.SendToUser(userID, "test.event", event)
+				}
+			}
+		}(sender)
+	}
+
+	results := make([][]testEvent, 3)
+	errs := make([]error, 3)
+	var readers sync.WaitGroup
+	for i, conn := range []*websocket.Conn{phone, laptop, other} {
+		after := hello.Seq
+		if conn == other {
+			after = otherHello.Seq
+		}
+		readers.Add(1)
+		go func(i int, conn *websocket.Conn, after uint64) {
+			defer readers.Done()
+			results[i], errs[i] = readEvents(conn, after, senders*perSender)
+		}(i, conn, after)
+	}
+	wg.Wait()
+	readers.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("connection %d after %d events: %v", i, len(results[i]), err)
+		}
+	}
+	// Both devices of a user see the events in the same order
+	for i := range results[0] {
+		if results[0][i] != results[1][i] {
+			t.Fatalf("devices differ at event %d: %+v and %+v", i, results[0][i], results[1][i])
+		}
+	}
+}
+
+func TestSlowClientIsEvicted(t *testing.T) {
+	const queueSize, window = 32, 16
+	cfg := DefaultConfig()
+	cfg.SendQueueSize = queueSize
+	cfg.WriteWait = 200 * time.Millisecond
+	s := NewWebSocketService(cfg)
+	server := newTestServer(t, s)
+
+	userID := uuid.New()
+	fast, hello := dial(t, server, userID, "fast")
+	slow, _ := dial(t, server, userID, "slow") // Never read until evicted
+	if n := len(s.connections(userID)); n != 2 {
+		t.Fatalf("user has %d connections, want 2", n)
+	}
+
+	// The senders stay at most window events ahead of the fast reader, so only the slow
+	// connection can fill its queue
+	inFlight := make(chan struct{}, window)
+	stop := make(chan struct{})
+	var total, received atomic.Int64
+	data := strings.Repeat("x", 256<<10)
+
+	var wg sync.WaitGroup
+	for sender := 0; sender < 4; sender++ {
+		wg.Add(1)
+		go func(sender int) {
+			defer wg.Done()
+			for n := 0; ; n++ {
+				select {
+				case inFlight <- struct{}{}:
+				case <-stop:
+					return
+				}
+				s.NotifyUsers([]uuid.UUID{userID}, "test.event", testEvent{Sender: sender, N: n, Data: data})
+				total.Add(1)
+			}
+		}(sender)
+	}
+
+	readErr := make(chan error, 1)
+	go func() {
+		next := make(map[int]int)
+		for seq := hello.Seq + 1; ; seq++ {
+			fast.SetReadDeadline(time.Now().Add(10 * time.Second))
+			var envelope model.Envelope
+			if err := fast.ReadJSON(&envelope); err != nil {
+				readErr <- err
+				return
+			}
+			var event testEvent
+			json.Unmarshal(envelope.Payload, &event)
+			if envelope.Seq != seq || event.N != next[event.Sender] {
+				readErr <- fmt.Errorf("event %d of sender %d with sequence number %d, want sequence number %d",
+					event.N, event.Sender, envelope.Seq, seq)
+				return
+			}
+			next[event.Sender]++
+			received.Add(1)
+			<-inFlight
+		}
+	}()
+
+	waitFor(t, 30*time.Second, "the slow connection to be evicted", func() bool {
+		select {
+		case err := <-readErr:
+			t.Fatalf("fast connection: %v", err)
+		default:
+		}
+		return len(s.connections(userID)) == 1
+	})
+	close(stop)
+	wg.Wait()
+
+	if conns := s.connections(userID); len(conns) != 1 || conns[0].DeviceID != "fast" {
+		t.Fatalf("the fast connection was evicted")
+	}
+
+	// The slow connection ends after the frames that made it out before the eviction
+	slow.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for {
+		if _, _, err := slow.ReadMessage(); err != nil {
+			if netErr, ok := err.(interface{ Timeout() bool }); ok && netErr.Timeout() {
+				t.Fatalf("the slow connection was not closed")
+			}
+			break
+		}
+	}
+
+	// The fast connection keeps up to the last event sent
+	waitFor(t, 10*time.Second, "the fast connection to catch up", func() bool {
+		select {
+		case err := <-readErr:
+			t.Fatalf("fast connection: %v", err)
+		default:
+		}
+		return received.Load() == total.Load()
+	})
+}
+
+func TestConnectionsComeAndGoWhileSending(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ReplayRetention = 50 * time.Millisecond
+	s := NewWebSocketService(cfg)
+	server := newTestServer(t, s)
+
+	userIDs := []uuid.UUID{uuid.New(), uuid.New(), uuid.New()}
+	stop := make(chan struct{})
+	var senders sync.WaitGroup
+	for sender := 0; sender < 8; sender++ {
+		senders.Add(1)
+		go func(sender int) {
+			defer senders.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				s.NotifyUsers(userIDs, "test.event", testEvent{Sender: sender, N: n})
+			}
+		}(sender)
+	}
+
+	var clients sync.WaitGroup
+	for i := 0; i < 12; i++ {
+		clients.Add(1)
+		go func(i int) {
+			defer clients.Done()
+			userID := userIDs[i%len(userIDs)]
+			url := "ws" + strings.TrimPrefix(server.URL, "http") + "/?user=" + userID.String() + "&device=d" + strconv.Itoa(i%4)
+			for round := 0; round < 20; round++ {
+				conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+				if err != nil {
+					t.Errorf("dial: %v", err)
+					return
+				}
+				// Read a few frames, then drop the connection, sometimes without a close frame
+				for frames := 0; frames < round%5; frames++ {
+					conn.SetReadDeadline(time.Now().Add(time.Second))
+					if _, _, err := conn.ReadMessage(); err != nil {
+						break
+					}
+				}
+				if round%2 == 0 {
+					conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+						time.Now().Add(time.Second))
+				}
+				conn.Close()
+			}
+		}(i)
+	}
+	clients.Wait()
+	close(stop)
+	senders.Wait()
+
+	for _, userID := range userIDs {
+		waitFor(t, 10*time.Second, "every connection to be closed", func() bool {
+			return !s.IsConnected(userID)
+		})
+	}
+
+	// A connection opened afterwards still receives events
+	conn, hello := dial(t, server, userIDs[0], "late")
+	s.NotifyUsers(userIDs[:1], "test.event", testEvent{})
+	if _, err := readEvents(conn, hello.Seq, 1); err != nil {
+		t.Fatalf("late connection: %v", err)
+	}
+}
@@ -0,0 +1,344 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tempPrefix marks files being written by a LocalStore; they are renamed into place once complete.
+const tempPrefix = ".upload-"
+
+// SignedPath is the path below which the API serves a LocalStore's signed URLs.
+const SignedPath = "/api/storage/"
+
+// LocalStore is a BlobStore keeping objects as files below a root directory. Content types are not
+// stored; they are derived from the key's extension.
+//
+// The store emulates the signed URLs of S3 once SetSigning gives it a key: a URL carries its
+// method's constraints and expiry, authenticated with an HMAC, and the store serves it as an
+// http.Handler mounted at SignedPath.
+type LocalStore struct {
+	root    string
+	secret  []byte
+	baseURL string
+}
+
+// NewLocalStore creates a LocalStore rooted at dir, creating the directory if needed.
+func NewLocalStore(dir string) (*LocalStore, error) {
+	if dir == "" {
+		return nil, errors.New("local storage directory is required")
+	}
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(root, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create storage directory: %w", err)
+	}
+	return &LocalStore{root: root}, nil
+}
+
+// Put writes an object to a temporary file and renames it into place, so readers never see a
+// partial object.
+func (s *LocalStore) Put(ctx context.Context, key string, body io.Reader, contentType string) (ObjectInfo, error) {
+	name, err := s.path(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0o750); err != nil {
+		return ObjectInfo{}, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(name), tempPrefix+"*")
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, body); err != nil {
+		tmp.Close()
+		return ObjectInfo{}, err
+	}
+	if err := tmp.Close(); err != nil {
+		return ObjectInfo{}, err
+	}
+	if err := os.Rename(tmp.Name(), name); err != nil {
+		return ObjectInfo{}, err
+	}
+	return s.Stat(ctx, key)
+}
+
+// Get opens an object for reading.
+func (s *LocalStore) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	name, err := s.path(key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, ObjectInfo{}, notFound(err)
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, ObjectInfo{}, err
+	}
+	if stat.IsDir() {
+		f.Close()
+		return nil, ObjectInfo{}, ErrNotFound
+	}
+	return f, fileInfo(key, stat), nil
+}
+
+// GetRange opens part of an object for reading.
+func (s *LocalStore) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	body, _, err := s.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	f := body.(*os.File)
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if length < 0 {
+		return f, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(f, length), f}, nil
+}
+
+// Stat describes an object.
+func (s *LocalStore) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	name, err := s.path(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	stat, err := os.Stat(name)
+	if err != nil {
+		return ObjectInfo{}, notFound(err)
+	}
+	if stat.IsDir() {
+		return ObjectInfo{}, ErrNotFound
+	}
+	return fileInfo(key, stat), nil
+}
+
+// Delete removes an object.
+func (s *LocalStore) Delete(ctx context.Context, key string) error {
+	name, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// List describes the objects whose keys start with prefix.
+func (s *LocalStore) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var infos []ObjectInfo
+	err := filepath.WalkDir(s.root, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), tempPrefix) {
+			return nil
+		}
+		rel, err := filepath.Rel(s.root, name)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		stat, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		infos = append(infos, fileInfo(key, stat))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Key < infos[j].Key })
+	return infos, nil
+}
+
+// SetSigning enables signed URLs, signed with secret and pointing at the API served at baseURL.
+func (s *LocalStore) SetSigning(secret []byte, baseURL string) {
+	s.secret = secret
+	s.baseURL = strings.TrimSuffix(baseURL, "/")
+}
+
+// SignedURL returns a URL of the store's handler that allows method on an object until expiry.
+func (s *LocalStore) SignedURL(ctx context.Context, key, method string, expiry time.Duration, opts SignOptions) (string, error) {
+	if err := checkMethod(method); err != nil {
+		return "", err
+	}
+	if s.secret == nil {
+		return "", ErrNotSupported
+	}
+	if _, err := s.path(key); err != nil {
+		return "", err
+	}
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(time.Now().Add(expiry).Unix(), 10))
+	if opts.ContentType != "" {
+		query.Set("content_type", opts.ContentType)
+	}
+	if opts.ContentLength > 0 {
+		query.Set("content_length", strconv.FormatInt(opts.ContentLength, 10))
+	}
+	if opts.ContentDisposition != "" {
+		query.Set("disposition", opts.ContentDisposition)
+	}
+	query.Set("signature", s.sign(method, key, query))
+	return s.baseURL + SignedPath + (&url.URL{Path: key}).EscapedPath() + "?" + query.Encode(), nil
+}
+
+// ServeHTTP serves the requests of signed URLs: GET and HEAD read an object, PUT writes one.
+func (s *LocalStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, SignedPath)
+	query := r.URL.Query()
+	method := r.Method
+	if method == http.MethodHead {
+		method = http.MethodGet
+	}
+	if method != http.MethodGet && method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.verify(method, key, query) {
+		http.Error(w, "Invalid or expired signature", http.StatusForbidden)
+		return
+	}
+
+	if method == http.MethodPut {
+		s.servePut(w, r, key, query)
+		return
+	}
+	body, info, err := s.Get(r.Context(), key)
+	if errors.Is(err, ErrNotFound) || errors.Is(err, ErrInvalidKey) {
+		http.Error(w, "Object not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to read object", http.StatusInternalServerError)
+		return
+	}
+	defer body.Close()
+
+	contentType := query.Get("content_type")
+	if contentType == "" {
+		contentType = info.ContentType
+	}
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	if disposition := query.Get("disposition"); disposition != "" {
+		w.Header().Set("Content-Disposition", disposition)
+	}
+	w.Header().Set("ETag", info.ETag)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, "", info.LastModified, body.(io.ReadSeeker))
+}
+
+// servePut stores the body of a signed PUT after checking it against the URL's constraints.
+func (s *LocalStore) servePut(w http.ResponseWriter, r *http.Request, key string, query url.Values) {
+	if contentType := query.Get("content_type"); contentType != "" && r.Header.Get("Content-Type") != contentType {
+		http.Error(w, "Content-Type does not match the signature", http.StatusForbidden)
+		return
+	}
+	if length := query.Get("content_length"); length != "" {
+		if strconv.FormatInt(r.ContentLength, 10) != length {
+			http.Error(w, "Content-Length does not match the signature", http.StatusForbidden)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, r.ContentLength)
+	}
+	info, err := s.Put(r.Context(), key, r.Body, r.Header.Get("Content-Type"))
+	if errors.Is(err, ErrInvalidKey) {
+		http.Error(w, "Invalid object key", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to store object", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("ETag", info.ETag)
+	w.WriteHeader(http.StatusOK)
+}
+
+// verify checks the signature and expiry of a signed URL's query.
+func (s *LocalStore) verify(method, key string, query url.Values) bool {
+	if s.secret == nil {
+		return false
+	}
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	return hmac.Equal([]byte(query.Get("signature")), []byte(s.sign(method, key, query)))
+}
+
+// sign authenticates the method, key and constraints of a signed URL.
+func (s *LocalStore) sign(method, key string, query url.Values) string {
+	mac := hmac.New(sha256.New, s.secret)
+	for _, part := range []string{method, key, query.Get("expires"), query.Get("content_type"),
+		query.Get("content_length"), query.Get("disposition")} {
+		mac.Write([]byte(part))
+		mac.Write([]byte{0})
+	}
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// path maps a key to a file below the root. Keys that are empty, absolute or climb out of the root
+// are rejected.
+func (s *LocalStore) path(key string) (string, error) {
+	if key == "" || strings.HasPrefix(key, "/") || path.Clean(key) != key || strings.HasPrefix(key, "../") ||
+		key == ".." || strings.HasPrefix(path.Base(key), tempPrefix) {
+		return "", ErrInvalidKey
+	}
+	return filepath.Join(s.root, filepath.FromSlash(key)), nil
+}
+
+// fileInfo describes the file holding an object. The entity tag is derived from the modification
+// time and size, which change whenever the object is replaced.
+func fileInfo(key string, stat fs.FileInfo) ObjectInfo {
+	return ObjectInfo{
+		Key:          key,
+		Size:         stat.Size(),
+		ContentType:  mime.TypeByExtension(path.Ext(key)),
+		ETag:         fmt.Sprintf(`"%x-%x"`, stat.ModTime().UnixNano(), stat.Size()),
+		LastModified: stat.ModTime().UTC(),
+	}
+}
+
+// notFound maps a missing file onto ErrNotFound.
+func notFound(err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrNotFound
+	}
+	return err
+}
@@ -0,0 +1,121 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore is a BlobStore that keeps objects in memory. It is meant for tests and local
+// development; objects are lost when the process exits.
+type MemoryStore struct {
+	mu      sync.RWMutex
+	objects map[string]memoryObject
+}
+
+// memoryObject is an object held by a MemoryStore.
+type memoryObject struct {
+	info ObjectInfo
+	data []byte
+}
+
+// NewMemoryStore creates an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{objects: make(map[string]memoryObject)}
+}
+
+// Put stores an object.
+func (s *MemoryStore) Put(ctx context.Context, key string, body io.Reader, contentType string) (ObjectInfo, error) {
+	if key == "" {
+		return ObjectInfo{}, ErrInvalidKey
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	sum := md5.Sum(data)
+	info := ObjectInfo{
+		Key:          key,
+		Size:         int64(len(data)),
+		ContentType:  contentType,
+		ETag:         `"` + hex.EncodeToString(sum[:]) + `"`,
+		LastModified: time.Now().UTC(),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[key] = memoryObject{info: info, data: data}
+	return info, nil
+}
+
+// Get opens an object for reading.
+func (s *MemoryStore) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	object, ok := s.objects[key]
+	if !ok {
+		return nil, ObjectInfo{}, ErrNotFound
+	}
+	return io.NopCloser(bytes.NewReader(object.data)), object.info, nil
+}
+
+// GetRange opens part of an object for reading.
+func (s *MemoryStore) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	object, ok := s.objects[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	size := int64(len(object.data))
+	offset = min(max(offset, 0), size)
+	end := size
+	if length >= 0 && offset+length < size {
+		end = offset + length
+	}
+	return io.NopCloser(bytes.NewReader(object.data[offset:end])), nil
+}
+
+// Stat describes an object.
+func (s *MemoryStore) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	object, ok := s.objects[key]
+	if !ok {
+		return ObjectInfo{}, ErrNotFound
+	}
+	return object.info, nil
+}
+
+// Delete removes an object.
+func (s *MemoryStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.objects, key)
+	return nil
+}
+
+// List describes the objects whose keys start with prefix.
+func (s *MemoryStore) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var infos []ObjectInfo
+	for key, object := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			infos = append(infos, object.info)
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Key < infos[j].Key })
+	return infos, nil
+}
+
+// SignedURL is not supported: objects in memory can not be reached by URL.
+func (s *MemoryStore) SignedURL(ctx context.Context, key, method string, expiry time.Duration, opts SignOptions) (string, error) {
+	return "", ErrNotSupported
+}
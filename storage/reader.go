@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// errNegativeOffset is returned when seeking before the start of an object.
+var errNegativeOffset = errors.New("seek to a negative offset")
+
+// Reader reads an object through ranged reads of its store. Seeking is free: the next Read opens
+// the object at the new offset, so serving a range of a large object does not fetch what comes
+// before it. It suits http.ServeContent.
+type Reader struct {
+	ctx    context.Context
+	store  BlobStore
+	info   ObjectInfo
+	offset int64
+	body   io.ReadCloser // Open at offset; nil until the next Read
+}
+
+// NewReader creates a Reader for the object described by info.
+func NewReader(ctx context.Context, store BlobStore, info ObjectInfo) *Reader {
+	return &Reader{ctx: ctx, store: store, info: info}
+}
+
+// Read reads from the current offset.
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.offset >= r.info.Size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		body, err := r.store.GetRange(r.ctx, r.info.Key, r.offset, -1)
+		if err != nil {
+			return 0, err
+		}
+		r.body = body
+	}
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	if err == io.EOF && r.offset < r.info.Size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// Seek sets the offset of the next Read.
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.info.Size
+	}
+	if offset < 0 {
+		return 0, errNegativeOffset
+	}
+	if offset != r.offset {
+		r.closeBody()
+		r.offset = offset
+	}
+	return offset, nil
+}
+
+// Close releases the open read of the object, if any.
+func (r *Reader) Close() error {
+	return r.closeBody()
+}
+
+// closeBody closes the current read so that the next Read starts a new one.
+func (r *Reader) closeBody() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
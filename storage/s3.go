@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// S3Store is a BlobStore backed by an S3 bucket or an S3-compatible service.
+type S3Store struct {
+	bucket   string
+	client   *s3.S3
+	uploader *s3manager.Uploader
+}
+
+// NewS3Store creates an S3Store for the configured bucket. One session is shared by all requests.
+func NewS3Store(cfg Config) (*S3Store, error) {
+	if cfg.S3Bucket == "" {
+		return nil, errors.New("S3 bucket is required")
+	}
+	awsConfig := &aws.Config{Region: aws.String(cfg.S3Region)}
+	if cfg.S3Endpoint != "" {
+		// S3-compatible services are usually addressed by path rather than by bucket subdomain
+		awsConfig.Endpoint = aws.String(cfg.S3Endpoint)
+		awsConfig.S3ForcePathStyle = aws.Bool(true)
+	}
+	if cfg.S3AccessKeyID != "" {
+		awsConfig.Credentials = credentials.NewStaticCredentials(cfg.S3AccessKeyID, cfg.S3SecretAccessKey, "")
+	}
+	sess, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	client := s3.New(sess)
+	return &S3Store{
+		bucket:   cfg.S3Bucket,
+		client:   client,
+		uploader: s3manager.NewUploaderWithClient(client),
+	}, nil
+}
+
+// Put uploads an object, in parts when it is large.
+func (s *S3Store) Put(ctx context.Context, key string, body io.Reader, contentType string) (ObjectInfo, error) {
+	if key == "" {
+		return ObjectInfo{}, ErrInvalidKey
+	}
+	input := &s3manager.UploadInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		Body:   body,
+	}
+	if contentType != "" {
+		input.ContentType = aws.String(contentType)
+	}
+	if _, err := s.uploader.UploadWithContext(ctx, input); err != nil {
+		return ObjectInfo{}, err
+	}
+	return s.Stat(ctx, key)
+}
+
+// Get opens an object for reading.
+func (s *S3Store) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	output, err := s.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, ObjectInfo{}, s3Error(err)
+	}
+	return output.Body, ObjectInfo{
+		Key:          key,
+		Size:         aws.Int64Value(output.ContentLength),
+		ContentType:  aws.StringValue(output.ContentType),
+		ETag:         aws.StringValue(output.ETag),
+		LastModified: aws.TimeValue(output.LastModified),
+	}, nil
+}
+
+// GetRange opens part of an object for reading with a ranged GET.
+func (s *S3Store) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	byteRange := fmt.Sprintf("bytes=%d-", offset)
+	if length >= 0 {
+		byteRange += strconv.FormatInt(offset+length-1, 10)
+	}
+	output, err := s.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		Range:  aws.String(byteRange),
+	})
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	return output.Body, nil
+}
+
+// Stat describes an object.
+func (s *S3Store) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	output, err := s.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return ObjectInfo{}, s3Error(err)
+	}
+	return ObjectInfo{
+		Key:          key,
+		Size:         aws.Int64Value(output.ContentLength),
+		ContentType:  aws.StringValue(output.ContentType),
+		ETag:         aws.StringValue(output.ETag),
+		LastModified: aws.TimeValue(output.LastModified),
+	}, nil
+}
+
+// Delete removes an object.
+func (s *S3Store) Delete(ctx context.Context, key string) error {
+	_, err := s.client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	return s3Error(err)
+}
+
+// List describes the objects whose keys start with prefix. Listings do not carry content types.
+func (s *S3Store) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var infos []ObjectInfo
+	err := s.client.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			infos = append(infos, ObjectInfo{
+				Key:          aws.StringValue(object.Key),
+				Size:         aws.Int64Value(object.Size),
+				ETag:         aws.StringValue(object.ETag),
+				LastModified: aws.TimeValue(object.LastModified),
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	return infos, nil
+}
+
+// SignedURL presigns a GET or PUT request for an object. The constraints of opts become signed
+// headers of a PUT, so S3 rejects uploads that do not match them, or response overrides of a GET.
+func (s *S3Store) SignedURL(ctx context.Context, key, method string, expiry time.Duration, opts SignOptions) (string, error) {
+	if err := checkMethod(method); err != nil {
+		return "", err
+	}
+	var req *request.Request
+	if method == http.MethodPut {
+		input := &s3.PutObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(key)}
+		if opts.ContentType != "" {
+			input.ContentType = aws.String(opts.ContentType)
+		}
+		if opts.ContentLength > 0 {
+			input.ContentLength = aws.Int64(opts.ContentLength)
+		}
+		req, _ = s.client.PutObjectRequest(input)
+	} else {
+		input := &s3.GetObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(key)}
+		if opts.ContentType != "" {
+			input.ResponseContentType = aws.String(opts.ContentType)
+		}
+		if opts.ContentDisposition != "" {
+			input.ResponseContentDisposition = aws.String(opts.ContentDisposition)
+		}
+		req, _ = s.client.GetObjectRequest(input)
+	}
+	req.SetContext(ctx)
+	return req.Presign(expiry)
+}
+
+// s3Error maps the errors of missing objects onto ErrNotFound. A missing bucket is a configuration
+// error and is passed on.
+func s3Error(err error) error {
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) && awsErr.Code() == s3.ErrCodeNoSuchBucket {
+		return err
+	}
+	var failure awserr.RequestFailure
+	if errors.As(err, &failure) && failure.StatusCode() == http.StatusNotFound {
+		return ErrNotFound
+	}
+	return err
+}
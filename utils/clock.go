@@ -0,0 +1,16 @@
+package utils
+
+import "time"
+
+// Clock tells the current time. It is injected where code has to be tested against a controlled time.
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock is the Clock backed by the system time.
+type SystemClock struct{}
+
+// Now returns the current system time.
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}